@@ -84,7 +84,38 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 		r.Route("/downloads", func(r *router) {
 			r.With(authRequired).Get("/", api.DownloadList)
-			r.Get("/{download_id}", api.DownloadURL)
+			r.Route("/{download_id}", func(r *router) {
+				r.Get("/", api.DownloadURL)
+				r.Get("/stream", api.DownloadStream)
+				r.With(adminRequired).Post("/revoke", api.DownloadRevoke)
+				r.With(adminRequired).Post("/reinstate", api.DownloadReinstate)
+			})
+			r.Get("/files/*", api.DownloadFile)
+		})
+
+		r.Route("/subscriptions", func(r *router) {
+			r.Use(authRequired)
+
+			r.Get("/", api.SubscriptionList)
+			r.Route("/{subscription_id}", func(r *router) {
+				r.Get("/", api.SubscriptionView)
+				r.Post("/cancel", api.SubscriptionCancel)
+				r.Post("/pause", api.SubscriptionPause)
+				r.Post("/resume", api.SubscriptionResume)
+			})
+		})
+
+		r.Get("/gift_cards/{code}", api.GiftCardView)
+
+		r.Route("/licenses", func(r *router) {
+			r.Post("/verify", api.LicenseVerify)
+			r.Get("/public_key", api.LicensePublicKey)
+			r.Route("/pools/{pool}", func(r *router) {
+				r.Use(adminRequired)
+
+				r.Get("/", api.LicensePoolView)
+				r.Post("/keys", api.LicensePoolImport)
+			})
 		})
 
 		r.Route("/vatnumbers", func(r *router) {
@@ -95,21 +126,22 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Use(adminRequired)
 
 			r.Get("/", api.PaymentList)
+			r.Get("/fake", api.FakePaymentsView)
+			r.Delete("/fake", api.FakePaymentsReset)
 			r.Route("/{payment_id}", func(r *router) {
 				r.Get("/", api.PaymentView)
 				r.With(addGetBody).Post("/refund", api.PaymentRefund)
+				r.Post("/confirm", api.PaymentConfirm)
 			})
 		})
 
-		r.Route("/paypal", func(r *router) {
-			r.With(addGetBody).Post("/", api.PreauthorizePayment)
-		})
-
 		r.Route("/reports", func(r *router) {
 			r.Use(adminRequired)
 
 			r.Get("/sales", api.SalesReport)
 			r.Get("/products", api.ProductsReport)
+			r.Post("/", api.ReportCreate)
+			r.Get("/{report_id}", api.ReportView)
 		})
 
 		r.Route("/coupons", func(r *router) {
@@ -119,6 +151,42 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 		r.With(adminRequired).Get("/settings", api.ViewSettings)
 
+		r.With(adminRequired).Get("/audit", api.AuditLogList)
+
+		r.Route("/webhooks", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Get("/", api.WebhookSubscriptionList)
+			r.Post("/", api.WebhookSubscriptionCreate)
+			r.Get("/events", api.WebhookEventList)
+			r.Route("/deliveries", func(r *router) {
+				r.Get("/", api.HookList)
+				r.Route("/{hook_id}", func(r *router) {
+					r.Get("/", api.HookView)
+					r.Post("/replay", api.HookReplay)
+					r.Post("/cancel", api.HookCancel)
+				})
+			})
+			r.Route("/{subscription_id}", func(r *router) {
+				r.Get("/", api.WebhookSubscriptionView)
+				r.Put("/", api.WebhookSubscriptionUpdate)
+				r.Delete("/", api.WebhookSubscriptionDelete)
+			})
+		})
+
+		r.Route("/emails", func(r *router) {
+			r.Use(adminRequired)
+
+			r.Get("/", api.EmailList)
+			r.Get("/types", api.EmailTypes)
+			r.Get("/preview", api.EmailPreview)
+			r.Post("/preview/send", api.EmailPreviewSend)
+			r.Route("/{email_id}", func(r *router) {
+				r.Get("/", api.EmailView)
+				r.Post("/resend", api.EmailResend)
+			})
+		})
+
 		r.With(authRequired).Post("/claim", api.ClaimOrders)
 	})
 
@@ -163,11 +231,15 @@ func (a *API) orderRoutes(r *router) {
 		r.Route("/payments", func(r *router) {
 			r.With(authRequired).Get("/", a.PaymentListForOrder)
 			r.With(addGetBody).Post("/", a.PaymentCreate)
+			r.With(addGetBody).Post("/preauthorize", a.PaymentPreauthorize)
 		})
 
 		r.Get("/downloads", a.DownloadList)
+		r.Get("/licenses", a.LicenseList)
 		r.Get("/receipt", a.ReceiptView)
 		r.Post("/receipt", a.ResendOrderReceipt)
+		r.Get("/invoice.pdf", a.InvoiceView)
+		r.Get("/refunds/{transaction_id}/credit_note.pdf", a.CreditNoteView)
 	})
 }
 
@@ -184,6 +256,16 @@ func (a *API) userRoutes(r *router) {
 
 		r.Get("/payments", a.PaymentListForUser)
 		r.Get("/orders", a.OrderList)
+		r.Get("/subscriptions", a.SubscriptionList)
+
+		r.Get("/store_credit", a.StoreCreditList)
+		r.With(adminRequired).Post("/store_credit", a.StoreCreditGrant)
+
+		r.Route("/payment_methods", func(r *router) {
+			r.Get("/", a.PaymentMethodList)
+			r.With(addGetBody).Post("/", a.PaymentMethodCreate)
+			r.Delete("/{method_id}", a.PaymentMethodDelete)
+		})
 
 		r.Route("/addresses", func(r *router) {
 			r.Get("/", a.AddressList)
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const operatorActorID = "operator"
+
+// auditSnapshot captures the state of a model before it is changed in place.
+func auditSnapshot(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(data)
+}
+
+// audit appends an entry for an administrative action to the audit log of the
+// instance. It must be called within the transaction that applies the change,
+// so the change is rolled back if it can't be audited.
+func (a *API) audit(tx *gorm.DB, r *http.Request, instanceID, action, modelType, modelID string, before, after interface{}) *HTTPError {
+	ctx := r.Context()
+
+	entry, err := models.NewAuditLog(instanceID, action, modelType, modelID, before, after)
+	if err != nil {
+		return internalServerError("Error creating audit log entry").WithInternalError(err)
+	}
+
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		if err := entry.SetActorClaims(claims); err != nil {
+			return internalServerError("Error creating audit log entry").WithInternalError(err)
+		}
+	} else if token, _ := extractBearerToken(r); token != "" && token == a.config.OperatorToken {
+		entry.ActorID = operatorActorID
+	}
+
+	entry.IP = r.RemoteAddr
+	entry.RequestID = gcontext.GetRequestID(ctx)
+	entry.Route = r.Method + " " + r.URL.Path
+
+	if err := models.AppendAuditLog(tx, entry, []byte(a.config.Audit.Key)); err != nil {
+		return internalServerError("Error writing audit log").WithInternalError(err)
+	}
+	return nil
+}
+
+// AuditLogList lists the audit log entries of the instance, newest first. It
+// is only available to admins.
+func (a *API) AuditLogList(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.db.Where("instance_id = ?", instanceID)
+	query, err := parseAuditLogQueryParams(query, r.URL.Query())
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.AuditLog{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	entries := []models.AuditLog{}
+	if result := query.Order("sequence desc").Offset(offset).Limit(limit).Find(&entries); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	log.WithField("entry_count", len(entries)).Debugf("Successfully retrieved %d audit log entries", len(entries))
+	return sendJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+var testAuditKey = []byte("audit-key")
+
+func TestAuditLog(t *testing.T) {
+	t.Run("OrderUpdate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{Email: "mrfreeze@dc.com"}, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/audit?model_type=order", nil, token)
+		entries := []models.AuditLog{}
+		extractPayload(t, http.StatusOK, recorder, &entries)
+		require.Len(t, entries, 1)
+
+		entry := entries[0]
+		assert.Equal(t, "order.update", entry.Action)
+		assert.Equal(t, test.Data.firstOrder.ID, entry.ModelID)
+		assert.Equal(t, "admin-yo", entry.ActorID)
+		assert.Equal(t, "admin@wayneindustries.com", entry.ActorEmail)
+		assert.EqualValues(t, 1, entry.Sequence)
+		assert.Empty(t, entry.PrevHash)
+
+		before := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(entry.Before, &before))
+		after := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(entry.After, &after))
+		assert.Equal(t, test.Data.firstOrder.Email, before["email"])
+		assert.Equal(t, "mrfreeze@dc.com", after["email"])
+		assert.NotContains(t, after, "currency")
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/audit", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		test := NewRouteTest(t)
+		for i := 0; i < 3; i++ {
+			entry, err := models.NewAuditLog("", "order.update", "order", "first-order", nil, map[string]int{"count": i})
+			require.NoError(t, err)
+			require.NoError(t, models.AppendAuditLog(test.DB, entry, testAuditKey))
+		}
+
+		verification, err := models.VerifyAuditLog(test.DB, "", testAuditKey)
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, verification.Entries)
+
+		require.NoError(t, test.DB.Model(&models.AuditLog{}).Where("sequence = ?", 2).Update("raw_after", `{"count":42}`).Error)
+		_, err = models.VerifyAuditLog(test.DB, "", testAuditKey)
+		require.Error(t, err)
+		chainErr, ok := err.(models.AuditChainError)
+		require.True(t, ok)
+		assert.EqualValues(t, 2, chainErr.Sequence)
+	})
+
+	t.Run("VerifyTruncated", func(t *testing.T) {
+		test := NewRouteTest(t)
+		for i := 0; i < 3; i++ {
+			entry, err := models.NewAuditLog("", "order.update", "order", "first-order", nil, map[string]int{"count": i})
+			require.NoError(t, err)
+			require.NoError(t, models.AppendAuditLog(test.DB, entry, testAuditKey))
+		}
+
+		require.NoError(t, test.DB.Where("sequence > ?", 1).Delete(&models.AuditLog{}).Error)
+		_, err := models.VerifyAuditLog(test.DB, "", testAuditKey)
+		require.Error(t, err)
+		chainErr, ok := err.(models.AuditChainError)
+		require.True(t, ok)
+		assert.EqualValues(t, 2, chainErr.Sequence)
+	})
+
+	t.Run("ChainWithoutHead", func(t *testing.T) {
+		test := NewRouteTest(t)
+		appendEntry := func() error {
+			entry, err := models.NewAuditLog("", "order.update", "order", "first-order", nil, map[string]string{"email": "mrfreeze@dc.com"})
+			require.NoError(t, err)
+			return models.AppendAuditLog(test.DB, entry, testAuditKey)
+		}
+		for i := 0; i < 3; i++ {
+			require.NoError(t, appendEntry())
+		}
+
+		require.NoError(t, test.DB.Delete(&models.AuditLogHead{}).Error)
+		require.NoError(t, test.DB.Where("sequence > ?", 1).Delete(&models.AuditLog{}).Error)
+		_, err := models.VerifyAuditLog(test.DB, "", testAuditKey)
+		require.Error(t, err)
+		chainErr, ok := err.(models.AuditChainError)
+		require.True(t, ok)
+		assert.EqualValues(t, 2, chainErr.Sequence)
+
+		// the chain isn't continued from its truncated end
+		assert.Error(t, appendEntry())
+	})
+
+	t.Run("OtherKey", func(t *testing.T) {
+		test := NewRouteTest(t)
+		entry, err := models.NewAuditLog("", "order.update", "order", "first-order", nil, map[string]int{"count": 1})
+		require.NoError(t, err)
+		require.NoError(t, models.AppendAuditLog(test.DB, entry, testAuditKey))
+
+		_, err = models.VerifyAuditLog(test.DB, "", []byte("another-key"))
+		require.Error(t, err)
+		chainErr, ok := err.(models.AuditChainError)
+		require.True(t, ok)
+		assert.EqualValues(t, 1, chainErr.Sequence)
+	})
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+// giftCardBalance is what anyone with the code of a gift card sees of it.
+type giftCardBalance struct {
+	Code     string `json:"code"`
+	Currency string `json:"currency"`
+	Balance  uint64 `json:"balance"`
+}
+
+type storeCreditParams struct {
+	// Amount is added to the store credit, or taken from it if negative.
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+	Note     string `json:"note"`
+}
+
+// GiftCardView shows the balance of a gift card. Admins also see its ledger.
+func (a *API) GiftCardView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	card, err := models.GetGiftCard(a.db, gcontext.GetInstanceID(ctx), chi.URLParam(r, "code"))
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	if card == nil {
+		return notFoundError("Gift card not found")
+	}
+
+	if !gcontext.IsAdmin(ctx) {
+		return sendJSON(w, http.StatusOK, &giftCardBalance{Code: card.Code, Currency: card.Currency, Balance: card.Balance})
+	}
+	if result := a.db.Where("account_id = ?", card.ID).Order("created_at").Find(&card.Entries); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, card)
+}
+
+// StoreCreditList lists the store credit of a user in every currency, with
+// its ledger.
+func (a *API) StoreCreditList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	credits := []models.BalanceAccount{}
+	query := a.db.Preload("Entries", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at")
+	})
+	query = query.Where("instance_id = ? AND kind = ? AND user_id = ?", gcontext.GetInstanceID(ctx), models.StoreCreditAccount, userID)
+	if result := query.Order("currency").Find(&credits); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, credits)
+}
+
+// StoreCreditGrant changes the store credit of a user. It is only available
+// to admins.
+func (a *API) StoreCreditGrant(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &storeCreditParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Amount == 0 || params.Currency == "" {
+		return badRequestError("Granting store credit requires an 'amount' and a 'currency'")
+	}
+
+	instanceID := gcontext.GetInstanceID(ctx)
+	tx := a.db.Begin()
+	credit, err := models.StoreCredit(tx, instanceID, userID, params.Currency)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error loading store credit").WithInternalError(err)
+	}
+	before := auditSnapshot(credit)
+
+	entry := &models.BalanceEntry{Type: models.BalanceGranted, Note: params.Note}
+	if params.Amount > 0 {
+		_, err = models.CreditBalance(tx, credit, uint64(params.Amount), entry)
+	} else {
+		_, err = models.DebitBalance(tx, credit, uint64(-params.Amount), entry)
+	}
+	if err == models.ErrInsufficientBalance {
+		tx.Rollback()
+		return badRequestError("The store credit of the user is only %d", credit.Balance)
+	} else if err != nil {
+		tx.Rollback()
+		return internalServerError("Error granting store credit").WithInternalError(err)
+	}
+
+	if httpErr := a.audit(tx, r, instanceID, "store_credit.grant", "balance_account", credit.ID, before, credit); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error granting store credit").WithInternalError(rsp.Error)
+	}
+	credit.Entries = []models.BalanceEntry{*entry}
+	return sendJSON(w, http.StatusOK, credit)
+}
+
+// redeemBalances pays as much of an order as the gift card and store credit
+// of a payment cover, and returns their transactions and the amount left to
+// charge. The balances are debited in the database transaction, so they are
+// given back if charging the rest fails.
+func (a *API) redeemBalances(tx *gorm.DB, order *models.Order, params *PaymentParams) ([]*models.Transaction, uint64, *HTTPError) {
+	accounts := []*models.BalanceAccount{}
+	if params.GiftCardCode != "" {
+		card, err := models.GetGiftCard(tx, order.InstanceID, params.GiftCardCode)
+		if err != nil {
+			return nil, 0, internalServerError("Error during database query").WithInternalError(err)
+		}
+		if card == nil {
+			return nil, 0, badRequestError("This gift card doesn't exist").WithErrorCode("gift_card_invalid")
+		}
+		accounts = append(accounts, card)
+	}
+	if params.UseStoreCredit {
+		if order.UserID == "" {
+			return nil, 0, badRequestError("Only logged in customers can pay with store credit")
+		}
+		credit, err := models.StoreCredit(tx, order.InstanceID, order.UserID, order.Currency)
+		if err != nil {
+			return nil, 0, internalServerError("Error loading store credit").WithInternalError(err)
+		}
+		accounts = append(accounts, credit)
+	}
+
+	remaining := order.Total
+	tenders := []*models.Transaction{}
+	for _, account := range accounts {
+		if account.Currency != order.Currency {
+			return nil, 0, badRequestError("Currencies doesn't match - %v vs %v", order.Currency, account.Currency)
+		}
+		amount := account.Balance
+		if amount > remaining {
+			amount = remaining
+		}
+		if amount == 0 {
+			continue
+		}
+
+		tr := models.NewTransaction(order)
+		tr.Amount = amount
+		tr.BalanceAccountID = account.ID
+		tr.Status = models.PaidState
+		entry, err := models.DebitBalance(tx, account, amount, &models.BalanceEntry{
+			Type:          models.BalanceRedeemed,
+			OrderID:       order.ID,
+			TransactionID: tr.ID,
+		})
+		if err == models.ErrInsufficientBalance {
+			return nil, 0, badRequestError("The balance was used for another order, please try again")
+		} else if err != nil {
+			return nil, 0, internalServerError("Error redeeming balance").WithInternalError(err)
+		}
+		tr.ProcessorID = entry.ID
+		if result := tx.Create(tr); result.Error != nil {
+			return nil, 0, internalServerError("Error creating transaction").WithInternalError(result.Error)
+		}
+
+		tenders = append(tenders, tr)
+		remaining -= amount
+	}
+	return tenders, remaining, nil
+}
+
+// balanceRefunder refunds a payment by crediting a balance account in the
+// database transaction of the refund.
+func balanceRefunder(tx *gorm.DB, account *models.BalanceAccount, refund *models.Transaction) payments.Refunder {
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		entry, err := models.CreditBalance(tx, account, amount, &models.BalanceEntry{
+			Type:          models.BalanceRefunded,
+			OrderID:       refund.OrderID,
+			TransactionID: refund.ID,
+		})
+		if err != nil {
+			return "", err
+		}
+		return entry.ID, nil
+	}
+}
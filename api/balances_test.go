@@ -0,0 +1,250 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newGiftCard(test *RouteTest, balance uint64) *models.BalanceAccount {
+	code, err := models.NewGiftCardCode()
+	require.NoError(test.T, err)
+	card := &models.BalanceAccount{ID: "card-" + code, Kind: models.GiftCardAccount, Code: code, Currency: "USD"}
+	require.NoError(test.T, test.DB.Create(card).Error)
+	_, err = models.CreditBalance(test.DB, card, balance, &models.BalanceEntry{Type: models.BalanceGranted})
+	require.NoError(test.T, err)
+	return card
+}
+
+func balanceOf(test *RouteTest, accountID string) uint64 {
+	account := &models.BalanceAccount{}
+	require.NoError(test.T, test.DB.First(account, "id = ?", accountID).Error)
+	return account.Balance
+}
+
+func orderTransactions(test *RouteTest) []models.Transaction {
+	trs := []models.Transaction{}
+	require.NoError(test.T, test.DB.Where("order_id = ? AND status = ?", "unpaid-order", models.PaidState).Order("amount").Find(&trs).Error)
+	return trs
+}
+
+func TestGiftCardPurchase(t *testing.T) {
+	test := NewRouteTest(t)
+	provider := &memProvider{name: payments.StripeProvider}
+	require.NoError(t, test.DB.Model(test.Data.unpaidLineItem).Update("type", models.GiftCardType).Error)
+
+	recorder := payUnpaidOrder(test, provider)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	recorder = test.TestEndpoint(http.MethodGet, "/orders/unpaid-order", nil, test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusOK, recorder, order)
+	require.Len(t, order.GiftCards, 2)
+	assert.NotEqual(t, order.GiftCards[0].Code, order.GiftCards[1].Code)
+	assert.EqualValues(t, 12, order.GiftCards[0].Balance)
+
+	code := strings.ToLower(strings.Replace(order.GiftCards[0].Code, "-", "", -1))
+	recorder = test.TestEndpoint(http.MethodGet, "/gift_cards/"+code, nil, nil)
+	balance := &giftCardBalance{}
+	extractPayload(t, http.StatusOK, recorder, balance)
+	assert.Equal(t, order.GiftCards[0].Code, balance.Code)
+	assert.EqualValues(t, 12, balance.Balance)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/gift_cards/"+code, nil, testAdminToken("magical-unicorn", ""))
+	card := &models.BalanceAccount{}
+	extractPayload(t, http.StatusOK, recorder, card)
+	require.Len(t, card.Entries, 1)
+	assert.Equal(t, models.BalanceIssued, card.Entries[0].Type)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/gift_cards/AAAA-BBBB", nil, nil)
+	validateError(t, http.StatusNotFound, recorder)
+
+	tr := &models.Transaction{}
+	require.NoError(t, test.DB.Where("order_id = ? AND processor_id = ?", "unpaid-order", "charge-1").First(tr).Error)
+	refundURL := "/payments/" + tr.ID + "/refund"
+
+	t.Run("RefundRedeemed", func(t *testing.T) {
+		_, err := models.DebitBalance(test.DB, &order.GiftCards[1], 1, &models.BalanceEntry{Type: models.BalanceRedeemed})
+		require.NoError(t, err)
+		defer models.CreditBalance(test.DB, &order.GiftCards[1], 1, &models.BalanceEntry{Type: models.BalanceRefunded})
+
+		body := jsonBody(t, map[string]interface{}{"amount": 24, "currency": "USD"})
+		recorder := providerRequest(test, provider, http.MethodPost, refundURL, body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Empty(t, provider.refundCalls)
+		assert.EqualValues(t, 12, balanceOf(test, order.GiftCards[0].ID))
+	})
+
+	t.Run("PartialRefund", func(t *testing.T) {
+		_, err := models.DebitBalance(test.DB, &order.GiftCards[1], 1, &models.BalanceEntry{Type: models.BalanceRedeemed})
+		require.NoError(t, err)
+		defer models.CreditBalance(test.DB, &order.GiftCards[1], 1, &models.BalanceEntry{Type: models.BalanceRefunded})
+
+		body := jsonBody(t, map[string]interface{}{"amount": 5, "currency": "USD"})
+		recorder := providerRequest(test, provider, http.MethodPost, refundURL, body, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.EqualValues(t, 12, balanceOf(test, order.GiftCards[0].ID))
+		assert.EqualValues(t, 11, balanceOf(test, order.GiftCards[1].ID))
+	})
+
+	t.Run("Refund", func(t *testing.T) {
+		body := jsonBody(t, map[string]interface{}{"amount": 19, "currency": "USD"})
+		recorder := providerRequest(test, provider, http.MethodPost, refundURL, body, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		for _, card := range order.GiftCards {
+			assert.EqualValues(t, 0, balanceOf(test, card.ID))
+		}
+	})
+}
+
+func TestPaymentSplitTender(t *testing.T) {
+	test := NewRouteTest(t)
+	provider := &memProvider{name: payments.StripeProvider}
+	card := newGiftCard(test, 10)
+
+	recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "123456", "gift_card_code": card.Code})
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, []uint64{14}, provider.amounts)
+	assert.EqualValues(t, 0, balanceOf(test, card.ID))
+
+	trs := orderTransactions(test)
+	require.Len(t, trs, 2)
+	assert.EqualValues(t, 10, trs[0].Amount)
+	assert.Equal(t, card.ID, trs[0].BalanceAccountID)
+	assert.EqualValues(t, 14, trs[1].Amount)
+	assert.Equal(t, "charge-1", trs[1].ProcessorID)
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+	assert.Equal(t, payments.StripeProvider, order.PaymentProcessor)
+
+	t.Run("RefundToGiftCard", func(t *testing.T) {
+		body := jsonBody(t, map[string]interface{}{"amount": 4, "currency": "USD"})
+		recorder := providerRequest(test, provider, http.MethodPost, "/payments/"+trs[0].ID+"/refund", body, testAdminToken("magical-unicorn", ""))
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, refund)
+		assert.Equal(t, card.ID, refund.BalanceAccountID)
+		assert.EqualValues(t, 4, balanceOf(test, card.ID))
+		assert.Empty(t, provider.refundCalls)
+	})
+
+	t.Run("RefundAsStoreCredit", func(t *testing.T) {
+		body := jsonBody(t, map[string]interface{}{"amount": 14, "currency": "USD", "store_credit": true})
+		recorder := providerRequest(test, provider, http.MethodPost, "/payments/"+trs[1].ID+"/refund", body, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Empty(t, provider.refundCalls)
+
+		credit, err := models.StoreCredit(test.DB, "", test.Data.testUser.ID, "USD")
+		require.NoError(t, err)
+		assert.EqualValues(t, 14, credit.Balance)
+	})
+
+	t.Run("RefundedTwice", func(t *testing.T) {
+		body := jsonBody(t, map[string]interface{}{"amount": 14, "currency": "USD", "store_credit": true})
+		recorder := providerRequest(test, provider, http.MethodPost, "/payments/"+trs[1].ID+"/refund", body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder, "wasn't refunded yet")
+
+		credit, err := models.StoreCredit(test.DB, "", test.Data.testUser.ID, "USD")
+		require.NoError(t, err)
+		assert.EqualValues(t, 14, credit.Balance)
+	})
+}
+
+func TestPaymentWithBalanceOnly(t *testing.T) {
+	test := NewRouteTest(t)
+	provider := &memProvider{name: payments.StripeProvider}
+	card := newGiftCard(test, 30)
+
+	recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"gift_card_code": card.Code})
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, 0, provider.charges)
+	assert.EqualValues(t, 6, balanceOf(test, card.ID))
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+	assert.Equal(t, models.BalanceProcessor, order.PaymentProcessor)
+	assert.NotZero(t, order.InvoiceNumber)
+}
+
+func TestPaymentBalanceErrors(t *testing.T) {
+	t.Run("NotCovered", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		card := newGiftCard(test, 10)
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"provider": "", "gift_card_code": card.Code})
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.EqualValues(t, 10, balanceOf(test, card.ID))
+	})
+
+	t.Run("ChargeFailed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		provider.fail = true
+		card := newGiftCard(test, 10)
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "123456", "gift_card_code": card.Code})
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.EqualValues(t, 10, balanceOf(test, card.ID))
+		assert.Empty(t, orderTransactions(test))
+	})
+
+	t.Run("UnknownCode", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "123456", "gift_card_code": "AAAA-BBBB-CCCC-DDDD"})
+		assert.Contains(t, recorder.Body.String(), "gift_card_invalid")
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Equal(t, 0, provider.charges)
+	})
+}
+
+func TestStoreCredit(t *testing.T) {
+	test := NewRouteTest(t)
+	provider := &memProvider{name: payments.StripeProvider}
+	url := "/users/" + test.Data.testUser.ID + "/store_credit"
+	grant := func(amount int64) *models.BalanceAccount {
+		body := jsonBody(t, &storeCreditParams{Amount: amount, Currency: "USD", Note: "Sorry for the delay"})
+		recorder := test.TestEndpoint(http.MethodPost, url, body, testAdminToken("magical-unicorn", ""))
+		credit := &models.BalanceAccount{}
+		extractPayload(t, http.StatusOK, recorder, credit)
+		return credit
+	}
+
+	assert.EqualValues(t, 20, grant(20).Balance)
+	assert.EqualValues(t, 15, grant(-5).Balance)
+
+	recorder := test.TestEndpoint(http.MethodPost, url, jsonBody(t, &storeCreditParams{Amount: -50, Currency: "USD"}), testAdminToken("magical-unicorn", ""))
+	validateError(t, http.StatusBadRequest, recorder)
+	recorder = test.TestEndpoint(http.MethodPost, url, jsonBody(t, &storeCreditParams{Amount: 50, Currency: "USD"}), test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	recorder = payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "123456", "use_store_credit": true})
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Equal(t, []uint64{9}, provider.amounts)
+
+	recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+	credits := []models.BalanceAccount{}
+	extractPayload(t, http.StatusOK, recorder, &credits)
+	require.Len(t, credits, 1)
+	assert.EqualValues(t, 0, credits[0].Balance)
+	require.Len(t, credits[0].Entries, 3)
+	assert.EqualValues(t, -15, credits[0].Entries[2].Amount)
+	assert.Equal(t, models.BalanceRedeemed, credits[0].Entries[2].Type)
+	assert.Equal(t, "unpaid-order", credits[0].Entries[2].OrderID)
+
+	// the store credit of the user in another instance is kept apart
+	other, err := models.StoreCredit(test.DB, "other-instance", test.Data.testUser.ID, "USD")
+	require.NoError(t, err)
+	assert.NotEqual(t, credits[0].ID, other.ID)
+	assert.Equal(t, "other-instance", other.InstanceID)
+	recorder = test.TestEndpoint(http.MethodGet, url, nil, test.Data.testUserToken)
+	credits = []models.BalanceAccount{}
+	extractPayload(t, http.StatusOK, recorder, &credits)
+	require.Len(t, credits, 1)
+	assert.NotEqual(t, other.ID, credits[0].ID)
+}
@@ -1,18 +1,22 @@
 package api
 
 import (
+	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/assetstores"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 )
 
 const maxIPsPerDay = 50
 
-// DownloadURL returns a signed URL to download a purchased asset.
+// DownloadURL returns a signed URL to download a purchased asset. With the
+// download proxy, the URL points at DownloadStream instead of the asset store.
 func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	downloadID := chi.URLParam(r, "download_id")
@@ -41,7 +45,49 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if order.PaymentState != models.PaidState {
-		return unauthorizedError("This download has not been paid yet")
+		return unauthorizedError("This download has not been paid yet").WithErrorCode("download_not_paid")
+	}
+
+	ip := clientIP(r)
+	if httpErr := a.checkDownloadAccess(download, order, ip); httpErr != nil {
+		return httpErr
+	}
+
+	if config := gcontext.GetConfig(ctx); config.Downloads.Proxy.Enabled {
+		proxied, err := proxyURL(config, download)
+		if err != nil {
+			return internalServerError("Error signing download").WithInternalError(err)
+		}
+		download.URL = proxied
+	} else if err := download.SignURL(assets); err != nil {
+		return internalServerError("Error signing download").WithInternalError(err)
+	}
+
+	tx := a.db.Begin()
+	if httpErr := recordDownload(tx, download, ip); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"download"})
+	bestEffort(tx, getLogEntry(r), "Failed to process webhook", func() error {
+		return a.triggerWebhooks(ctx, tx, models.WebhookDownloadIssued, order.UserID, download)
+	})
+	// the URL is only handed out once the download counts against its limits
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error recording download").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, download)
+}
+
+// checkDownloadAccess enforces the limits of a download, and the number of
+// IPs the downloads of an order can be accessed from within a day.
+func (a *API) checkDownloadAccess(download *models.Download, order *models.Order, ip string) *HTTPError {
+	if httpErr := checkDownloadState(download); httpErr != nil {
+		return httpErr
+	}
+	if download.MaxDownloads > 0 && download.DownloadCount >= download.MaxDownloads {
+		return forbiddenError("This download has reached its maximum number of downloads").WithErrorCode("download_limit_reached")
 	}
 
 	rows, err := a.db.Model(&models.Event{}).
@@ -51,6 +97,7 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return internalServerError("Error signing download").WithInternalError(err)
 	}
+	defer rows.Close()
 	var count uint64
 	for rows.Next() {
 		err = rows.Scan(&count)
@@ -59,18 +106,159 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 		}
 	}
 	if count > maxIPsPerDay {
-		return unauthorizedError("This download has been accessed from too many IPs within the last day")
+		return unauthorizedError("This download has been accessed from too many IPs within the last day").WithErrorCode("download_ip_rate_limited")
 	}
+	return nil
+}
 
-	if err := download.SignURL(assets); err != nil {
-		return internalServerError("Error signing download").WithInternalError(err)
+// checkDownloadState checks that a download is neither revoked nor expired.
+func checkDownloadState(download *models.Download) *HTTPError {
+	if download.RevokedAt != nil {
+		return forbiddenError("This download has been revoked").WithErrorCode("download_revoked")
+	}
+	if download.Expired(time.Now()) {
+		return forbiddenError("This download has expired").WithErrorCode("download_expired")
 	}
+	return nil
+}
 
-	tx := a.db.Begin()
-	tx.Model(download).Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
-	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"download"})
-	tx.Commit()
+// recordDownload counts a download and the IP it came from. The count is
+// only incremented below the maximum, and the IPs are only counted once the
+// increment locked the download, so concurrent downloads can't exceed either
+// limit.
+func recordDownload(tx *gorm.DB, download *models.Download, ip string) *HTTPError {
+	result := tx.Model(download).
+		Where("max_downloads = 0 OR download_count < max_downloads").
+		Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
+	if result.Error != nil {
+		return internalServerError("Error counting download").WithInternalError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return forbiddenError("This download has reached its maximum number of downloads").WithErrorCode("download_limit_reached")
+	}
+	if download.MaxIPs > 0 {
+		count, known, err := models.DownloadIPs(tx, download.ID, ip)
+		if err != nil {
+			return internalServerError("Error checking download IPs").WithInternalError(err)
+		}
+		if !known && count >= download.MaxIPs {
+			return forbiddenError("This download has been accessed from too many IPs").WithErrorCode("download_ip_limit_reached")
+		}
+	}
+	if result := tx.Create(&models.DownloadAccess{DownloadID: download.ID, IP: ip}); result.Error != nil {
+		return internalServerError("Error counting download").WithInternalError(result.Error)
+	}
+	return nil
+}
+
+// clientIP is the IP of a request without the port.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// DownloadFile serves a file of an asset store that keeps its files on the
+// local disk. The URL must be one signed by DownloadURL that hasn't expired.
+func (a *API) DownloadFile(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	filePath := chi.URLParam(r, "*")
+	logEntrySetField(r, "file", filePath)
 
+	store, ok := gcontext.GetAssetStore(ctx).(assetstores.FileServer)
+	if !ok {
+		return notFoundError("Downloads are not served from here")
+	}
+
+	file, err := store.OpenFile(filePath, r.URL.Query())
+	switch {
+	case err == assetstores.ErrInvalidSignature || err == assetstores.ErrExpiredURL:
+		return unauthorizedError("%v", err)
+	case os.IsNotExist(err):
+		return notFoundError("File not found")
+	case err != nil:
+		return internalServerError("Error opening file").WithInternalError(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return internalServerError("Error opening file").WithInternalError(err)
+	}
+	setAttachment(w, info.Name())
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return nil
+}
+
+// loadInstanceDownload loads a download of an order of the instance.
+func (a *API) loadInstanceDownload(r *http.Request) (*models.Download, *HTTPError) {
+	downloadID := chi.URLParam(r, "download_id")
+	logEntrySetField(r, "download_id", downloadID)
+
+	download := &models.Download{}
+	if result := a.db.Where("id = ?", downloadID).First(download); result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Download not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	order := &models.Order{}
+	result := a.db.Where("id = ? AND instance_id = ?", download.OrderID, gcontext.GetInstanceID(r.Context())).First(order)
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Download not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return download, nil
+}
+
+// DownloadRevoke revokes a download, so it can't be downloaded until it is
+// reinstated.
+func (a *API) DownloadRevoke(w http.ResponseWriter, r *http.Request) error {
+	download, httpErr := a.loadInstanceDownload(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if download.RevokedAt != nil {
+		return badRequestError("Download is already revoked")
+	}
+
+	before := auditSnapshot(download)
+	download.Revoke(models.RevokedByAdmin)
+	return a.saveDownload(w, r, "download.revoke", before, download)
+}
+
+// DownloadReinstate gives access to a revoked download again.
+func (a *API) DownloadReinstate(w http.ResponseWriter, r *http.Request) error {
+	download, httpErr := a.loadInstanceDownload(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if download.RevokedAt == nil {
+		return badRequestError("Download is not revoked")
+	}
+
+	before := auditSnapshot(download)
+	download.Reinstate()
+	return a.saveDownload(w, r, "download.reinstate", before, download)
+}
+
+func (a *API) saveDownload(w http.ResponseWriter, r *http.Request, action string, before interface{}, download *models.Download) error {
+	tx := a.db.Begin()
+	if result := tx.Save(download); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving download").WithInternalError(result.Error)
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(r.Context()), action, "download", download.ID, before, download); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving download").WithInternalError(rsp.Error)
+	}
 	return sendJSON(w, http.StatusOK, download)
 }
 
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/assetstores"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pkg/errors"
+)
+
+// proxyHeaders are the headers of the asset store that the download proxy
+// passes on.
+var proxyHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "Content-Type", "ETag", "Last-Modified"}
+
+// proxyURL is the signed URL the download proxy streams a download from.
+func proxyURL(config *conf.Configuration, download *models.Download) (string, error) {
+	proxy := config.Downloads.Proxy
+	if proxy.URL == "" || proxy.Secret == "" {
+		return "", errors.New("No URL and secret configured for the download proxy")
+	}
+
+	query := assetstores.SignPath([]byte(proxy.Secret), download.ID, time.Now().Add(assetstores.URLLifetime(config)))
+	return strings.TrimRight(proxy.URL, "/") + "/downloads/" + url.PathEscape(download.ID) + "/stream?" + query.Encode(), nil
+}
+
+// DownloadStream streams the file of a download from the asset store. It
+// supports range requests, so interrupted downloads can be resumed, and
+// counts the bytes it serves.
+func (a *API) DownloadStream(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	downloadID := chi.URLParam(r, "download_id")
+	logEntrySetField(r, "download_id", downloadID)
+	proxy := gcontext.GetConfig(ctx).Downloads.Proxy
+
+	// without a secret, any signature made with an empty key would verify
+	if !proxy.Enabled || proxy.Secret == "" {
+		return notFoundError("Downloads are not streamed from here")
+	}
+	if err := assetstores.VerifyPath([]byte(proxy.Secret), downloadID, r.URL.Query(), time.Now()); err != nil {
+		return unauthorizedError("%v", err).WithErrorCode("download_invalid_signature")
+	}
+	transform, err := assetstores.GetTransform(proxy.Transform)
+	if err != nil {
+		return internalServerError("Error loading download transform").WithInternalError(err)
+	}
+
+	download := &models.Download{}
+	if result := a.db.Where("id = ?", downloadID).First(download); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Download not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	order := &models.Order{}
+	if result := a.db.Where("id = ? AND instance_id = ?", download.OrderID, gcontext.GetInstanceID(ctx)).First(order); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Download not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	// the limits on the number of downloads and IPs were checked when the
+	// link was handed out, but it mustn't work after a refund or expiry
+	if order.PaymentState != models.PaidState {
+		return unauthorizedError("This download has not been paid yet").WithErrorCode("download_not_paid")
+	}
+	if httpErr := checkDownloadState(download); httpErr != nil {
+		return httpErr
+	}
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	httpErr := a.streamDownload(counter, r, download, order, transform)
+	if counter.bytes > 0 {
+		if err := recordStream(a.db, download, clientIP(r), r.Header.Get("Range"), counter.bytes); err != nil {
+			getLogEntry(r).WithError(err).Error("Error counting streamed download")
+		}
+	}
+	if httpErr != nil {
+		return httpErr
+	}
+	return nil
+}
+
+func (a *API) streamDownload(w http.ResponseWriter, r *http.Request, download *models.Download, order *models.Order, transform assetstores.Transform) *HTTPError {
+	store := gcontext.GetAssetStore(r.Context())
+	name := downloadFilename(download)
+
+	if transform != nil {
+		return a.streamTransformed(w, r, store, download, order, transform, name)
+	}
+
+	opener, ok := store.(assetstores.Opener)
+	if !ok {
+		signedURL, err := store.SignURL(download.URL)
+		if err != nil {
+			return internalServerError("Error signing download").WithInternalError(err)
+		}
+		return a.proxyDownload(w, r, signedURL, name)
+	}
+
+	file, err := opener.Open(download.URL)
+	if os.IsNotExist(err) {
+		return notFoundError("File not found")
+	} else if err != nil {
+		return internalServerError("Error opening file").WithInternalError(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return internalServerError("Error opening file").WithInternalError(err)
+	}
+
+	setAttachment(w, name)
+	http.ServeContent(w, r, name, info.ModTime(), file)
+	return nil
+}
+
+// streamTransformed streams the transformed file of a download. Transforms
+// need the whole file in memory, so the transformed file is cached on disk
+// for the range requests that follow, until the file in the asset store
+// changes.
+func (a *API) streamTransformed(w http.ResponseWriter, r *http.Request, store assetstores.Store, download *models.Download, order *models.Order, transform assetstores.Transform, name string) *HTTPError {
+	proxy := gcontext.GetConfig(r.Context()).Downloads.Proxy
+	cachePath := transformCachePath(proxy.CacheDir, download.ID, proxy.Transform)
+
+	var since time.Time
+	cached, err := os.Open(cachePath)
+	if err == nil {
+		defer cached.Close()
+		if info, err := cached.Stat(); err == nil {
+			since = info.ModTime()
+		}
+	}
+
+	data, modified, httpErr := a.loadDownload(store, download, since)
+	if httpErr != nil {
+		return httpErr
+	}
+	if data == nil {
+		// unchanged since it was cached
+		setAttachment(w, name)
+		http.ServeContent(w, r, name, since, cached)
+		return nil
+	}
+
+	data, err = transform(data, &assetstores.TransformInfo{
+		DownloadID: download.ID,
+		OrderID:    order.ID,
+		Email:      order.Email,
+		Format:     download.Format,
+		Filename:   name,
+	})
+	if err != nil {
+		return internalServerError("Error transforming file").WithInternalError(err)
+	}
+	if err := writeTransformCache(cachePath, data, modified); err != nil {
+		getLogEntry(r).WithError(err).Error("Error caching transformed download")
+	}
+
+	setAttachment(w, name)
+	http.ServeContent(w, r, name, modified, bytes.NewReader(data))
+	return nil
+}
+
+// loadDownload reads the whole file of a download from the asset store, with
+// the time it was last modified. It returns no data if the file wasn't
+// modified since a time.
+func (a *API) loadDownload(store assetstores.Store, download *models.Download, since time.Time) ([]byte, time.Time, *HTTPError) {
+	if opener, ok := store.(assetstores.Opener); ok {
+		file, err := opener.Open(download.URL)
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, notFoundError("File not found")
+		} else if err != nil {
+			return nil, time.Time{}, internalServerError("Error opening file").WithInternalError(err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return nil, time.Time{}, internalServerError("Error opening file").WithInternalError(err)
+		}
+		if !since.IsZero() && !info.ModTime().Truncate(time.Second).After(since) {
+			return nil, since, nil
+		}
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, time.Time{}, internalServerError("Error loading file").WithInternalError(err)
+		}
+		return data, info.ModTime().Truncate(time.Second), nil
+	}
+
+	signedURL, err := store.SignURL(download.URL)
+	if err != nil {
+		return nil, time.Time{}, internalServerError("Error signing download").WithInternalError(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, signedURL, nil)
+	if err != nil {
+		return nil, time.Time{}, internalServerError("Error loading file").WithInternalError(err)
+	}
+	if !since.IsZero() {
+		req.Header.Set("If-Modified-Since", since.UTC().Format(http.TimeFormat))
+	}
+	rsp, err := a.httpClient.Do(req)
+	if err != nil {
+		return nil, time.Time{}, internalServerError("Error loading file").WithInternalError(err)
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, since, nil
+	case http.StatusNotFound:
+		return nil, time.Time{}, notFoundError("File not found")
+	default:
+		return nil, time.Time{}, internalServerError("Error loading file").WithInternalError(fmt.Errorf("Asset store responded with status %d", rsp.StatusCode))
+	}
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, time.Time{}, internalServerError("Error loading file").WithInternalError(err)
+	}
+	modified, _ := http.ParseTime(rsp.Header.Get("Last-Modified"))
+	return data, modified, nil
+}
+
+// transformCachePath is the file a transformed download is cached in.
+func transformCachePath(dir, downloadID, transform string) string {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "gocommerce-downloads")
+	}
+	sum := sha256.Sum256([]byte(transform + "/" + downloadID))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// writeTransformCache caches a transformed download, with the modification
+// time of the file in the asset store. It writes to a temporary file first,
+// so concurrent requests never see a partial file.
+func writeTransformCache(path string, data []byte, modified time.Time) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !modified.IsZero() {
+		err = os.Chtimes(tmp.Name(), modified, modified)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// proxyDownload passes a request on to the asset store, with the headers
+// that make range requests work.
+func (a *API) proxyDownload(w http.ResponseWriter, r *http.Request, signedURL, name string) *HTTPError {
+	req, err := http.NewRequest(http.MethodGet, signedURL, nil)
+	if err != nil {
+		return internalServerError("Error loading file").WithInternalError(err)
+	}
+	for _, header := range []string{"Range", "If-Range"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	rsp, err := a.httpClient.Do(req)
+	if err != nil {
+		return internalServerError("Error loading file").WithInternalError(err)
+	}
+	defer rsp.Body.Close()
+
+	switch rsp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+	case http.StatusNotFound:
+		return notFoundError("File not found")
+	default:
+		return internalServerError("Error loading file").WithInternalError(fmt.Errorf("Asset store responded with status %d", rsp.StatusCode))
+	}
+
+	for _, header := range proxyHeaders {
+		if value := rsp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	setAttachment(w, name)
+	w.WriteHeader(rsp.StatusCode)
+	if _, err := io.Copy(w, rsp.Body); err != nil {
+		getLogEntry(r).WithError(err).Info("Download stream interrupted")
+	}
+	return nil
+}
+
+func setAttachment(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+}
+
+// downloadFilename is the name of the file of a download.
+func downloadFilename(download *models.Download) string {
+	if u, err := url.Parse(download.URL); err == nil && path.Base(u.Path) != "." && path.Base(u.Path) != "/" {
+		return path.Base(u.Path)
+	}
+	return download.ID
+}
+
+// recordStream counts the bytes of a range the download proxy served.
+func recordStream(db *gorm.DB, download *models.Download, ip, byteRange string, bytes uint64) error {
+	tx := db.Begin()
+	result := tx.Model(download).Updates(map[string]interface{}{"bytes_served": gorm.Expr("bytes_served + ?", bytes)})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	access := &models.DownloadAccess{DownloadID: download.ID, IP: ip, Range: byteRange, Bytes: bytes}
+	if result := tx.Create(access); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	return tx.Commit().Error
+}
+
+// countingResponseWriter counts the bytes of the body of successful responses.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  uint64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	if w.status == http.StatusOK || w.status == http.StatusPartialContent {
+		w.bytes += uint64(n)
+	}
+	return n, err
+}
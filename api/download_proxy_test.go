@@ -0,0 +1,218 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netlify/gocommerce/assetstores"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBlueprints = "blueprints of the batwing"
+
+// streamRange requests a range of a download from the proxy.
+func streamRange(test *RouteTest, path, byteRange string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, baseURL+path, nil)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	ctx, err := WithInstanceConfig(context.Background(), new(conf.GlobalConfiguration).SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func proxyTest(t *testing.T, downloadURL string) *RouteTest {
+	test := NewRouteTest(t)
+	test.Config.Downloads.Proxy.Enabled = true
+	test.Config.Downloads.Proxy.URL = baseURL
+	test.Config.Downloads.Proxy.Secret = "proxysecret"
+	require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", downloadURL).Error)
+	return test
+}
+
+// proxiedPath hands out a download URL and returns its path.
+func proxiedPath(t *testing.T, test *RouteTest) string {
+	recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+	download := &models.Download{}
+	extractPayload(t, http.StatusOK, recorder, download)
+	require.True(t, strings.HasPrefix(download.URL, baseURL+"/downloads/first-download/stream?"), download.URL)
+	return strings.TrimPrefix(download.URL, baseURL)
+}
+
+func TestDownloadProxyLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocommerce-downloads")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "batwing.pdf"), []byte(testBlueprints), 0644))
+
+	test := proxyTest(t, "/batwing.pdf")
+	test.Config.Downloads.Provider = "local"
+	test.Config.Downloads.Local.Dir = dir
+	test.Config.Downloads.Local.URL = baseURL
+	test.Config.Downloads.Local.Secret = "localsecret"
+	path := proxiedPath(t, test)
+
+	t.Run("Full", func(t *testing.T) {
+		recorder := streamRange(test, path, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, testBlueprints, recorder.Body.String())
+		assert.Equal(t, "bytes", recorder.Header().Get("Accept-Ranges"))
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "batwing.pdf")
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		recorder := streamRange(test, path, "bytes=0-9")
+		assert.Equal(t, http.StatusPartialContent, recorder.Code)
+		assert.Equal(t, "blueprints", recorder.Body.String())
+
+		recorder = streamRange(test, path, "bytes=10-")
+		assert.Equal(t, http.StatusPartialContent, recorder.Code)
+		assert.Equal(t, " of the batwing", recorder.Body.String())
+		assert.Equal(t, "bytes 10-24/25", recorder.Header().Get("Content-Range"))
+	})
+
+	t.Run("Counted", func(t *testing.T) {
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.EqualValues(t, 2*len(testBlueprints), download.BytesServed)
+		assert.EqualValues(t, 1, download.DownloadCount)
+
+		accesses := []models.DownloadAccess{}
+		require.NoError(t, test.DB.Where("download_id = ? AND bytes > 0", "first-download").Order("id").Find(&accesses).Error)
+		require.Len(t, accesses, 3)
+		assert.Equal(t, "", accesses[0].Range)
+		assert.Equal(t, "bytes=0-9", accesses[1].Range)
+		assert.EqualValues(t, 10, accesses[1].Bytes)
+		assert.EqualValues(t, 15, accesses[2].Bytes)
+	})
+
+	t.Run("TransformCached", func(t *testing.T) {
+		transforms := 0
+		assetstores.RegisterTransform("test-count", func(file []byte, info *assetstores.TransformInfo) ([]byte, error) {
+			transforms++
+			return append(file, '!'), nil
+		})
+		test.Config.Downloads.Proxy.Transform = "test-count"
+		test.Config.Downloads.Proxy.CacheDir = filepath.Join(dir, "cache")
+		defer func() { test.Config.Downloads.Proxy.Transform = "" }()
+
+		recorder := streamRange(test, path, "bytes=0-9")
+		assert.Equal(t, "blueprints", recorder.Body.String())
+		recorder = streamRange(test, path, "bytes=25-")
+		assert.Equal(t, "!", recorder.Body.String())
+		assert.Equal(t, 1, transforms)
+
+		// a changed file is transformed again
+		later := time.Now().Add(time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(dir, "batwing.pdf"), later, later))
+		recorder = streamRange(test, path, "bytes=25-")
+		assert.Equal(t, "!", recorder.Body.String())
+		assert.Equal(t, 2, transforms)
+	})
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		recorder := streamRange(test, strings.Replace(path, "signature=", "signature=0", 1), "")
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = streamRange(test, "/downloads/other-download/stream?"+strings.SplitN(path, "?", 2)[1], "")
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("Revoked", func(t *testing.T) {
+		require.NoError(t, models.RevokeOrderDownloads(test.DB, "first-order", models.RevokedByRefund))
+		defer test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Updates(map[string]interface{}{"revoked_at": nil, "revoke_reason": ""})
+		recorder := streamRange(test, path, "")
+		validateError(t, http.StatusForbidden, recorder)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test.Config.Downloads.Proxy.Enabled = false
+		defer func() { test.Config.Downloads.Proxy.Enabled = true }()
+		recorder := streamRange(test, path, "")
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("NoSecret", func(t *testing.T) {
+		test.Config.Downloads.Proxy.Secret = ""
+		defer func() { test.Config.Downloads.Proxy.Secret = "proxysecret" }()
+		query := assetstores.SignPath([]byte(""), "first-download", time.Now().Add(time.Hour))
+		recorder := streamRange(test, "/downloads/first-download/stream?"+query.Encode(), "")
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("OtherInstance", func(t *testing.T) {
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", "first-order").Update("instance_id", "other-instance").Error)
+		defer test.DB.Model(&models.Order{}).Where("id = ?", "first-order").Update("instance_id", "")
+		recorder := streamRange(test, path, "")
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestDownloadProxyRemote(t *testing.T) {
+	var ranges []string
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/batwing.pdf" {
+			http.NotFound(w, r)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "batwing.pdf", time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), strings.NewReader(testBlueprints))
+	}))
+	defer store.Close()
+
+	test := proxyTest(t, store.URL+"/files/batwing.pdf")
+	path := proxiedPath(t, test)
+
+	recorder := streamRange(test, path, "bytes=11-13")
+	assert.Equal(t, http.StatusPartialContent, recorder.Code)
+	assert.Equal(t, "of ", recorder.Body.String())
+	assert.Equal(t, "bytes 11-13/25", recorder.Header().Get("Content-Range"))
+	assert.Equal(t, []string{"bytes=11-13"}, ranges)
+
+	t.Run("Transform", func(t *testing.T) {
+		transforms := 0
+		assetstores.RegisterTransform("test-upper", func(file []byte, info *assetstores.TransformInfo) ([]byte, error) {
+			assert.Equal(t, "first-order", info.OrderID)
+			assert.Equal(t, "batwing.pdf", info.Filename)
+			transforms++
+			return bytes.ToUpper(file), nil
+		})
+		cacheDir, err := ioutil.TempDir("", "transform-cache")
+		require.NoError(t, err)
+		defer os.RemoveAll(cacheDir)
+		test.Config.Downloads.Proxy.Transform = "test-upper"
+		test.Config.Downloads.Proxy.CacheDir = cacheDir
+		defer func() { test.Config.Downloads.Proxy.Transform = "" }()
+
+		recorder := streamRange(test, path, "bytes=0-9")
+		assert.Equal(t, http.StatusPartialContent, recorder.Code)
+		assert.Equal(t, "BLUEPRINTS", recorder.Body.String())
+		// the whole file is needed to transform it
+		assert.Equal(t, "", ranges[len(ranges)-1])
+
+		// resuming is served from the cache while the file is unchanged
+		recorder = streamRange(test, path, "bytes=11-13")
+		assert.Equal(t, http.StatusPartialContent, recorder.Code)
+		assert.Equal(t, "OF ", recorder.Body.String())
+		assert.Equal(t, 1, transforms)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", store.URL+"/files/missing.pdf").Error)
+		recorder := streamRange(test, path, "")
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -1,11 +1,19 @@
 package api
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/netlify/gocommerce/models"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDownloadList(t *testing.T) {
@@ -19,3 +27,144 @@ func TestDownloadList(t *testing.T) {
 		assert.Len(t, downloads, 1)
 	})
 }
+
+func TestDownloadLocalFile(t *testing.T) {
+	test := NewRouteTest(t)
+	dir, err := ioutil.TempDir("", "gocommerce-downloads")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "batwing.pdf"), []byte("blueprints"), 0644))
+
+	test.Config.Downloads.Provider = "local"
+	test.Config.Downloads.Local.Dir = dir
+	test.Config.Downloads.Local.URL = baseURL
+	test.Config.Downloads.Local.Secret = "downloadsecret"
+	require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", "/batwing.pdf").Error)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+	download := &models.Download{}
+	extractPayload(t, http.StatusOK, recorder, download)
+	require.True(t, strings.HasPrefix(download.URL, baseURL+"/downloads/files/batwing.pdf?"))
+	signedPath := strings.TrimPrefix(download.URL, baseURL)
+
+	t.Run("Signed", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, signedPath, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "blueprints", recorder.Body.String())
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "batwing.pdf")
+	})
+
+	t.Run("InvalidSignature", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/files/batwing.pdf?expires=9999999999&signature=nope", nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NotLocal", func(t *testing.T) {
+		test.Config.Downloads.Provider = ""
+		defer func() { test.Config.Downloads.Provider = "local" }()
+		recorder := test.TestEndpoint(http.MethodGet, signedPath, nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestDownloadPolicies(t *testing.T) {
+	download := func(test *RouteTest) *httptest.ResponseRecorder {
+		return test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+	}
+	update := func(test *RouteTest, fields map[string]interface{}) {
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Updates(fields).Error)
+	}
+	validateErrorCode := func(t *testing.T, code int, errorCode string, recorder *httptest.ResponseRecorder) {
+		require.Equal(t, code, recorder.Code, "code mismatch: %v", recorder.Body)
+		rsp := &HTTPError{}
+		require.NoError(t, json.NewDecoder(recorder.Body).Decode(rsp))
+		assert.Equal(t, errorCode, rsp.ErrorCode)
+	}
+
+	t.Run("MaxDownloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		update(test, map[string]interface{}{"max_downloads": 2})
+		assert.Equal(t, http.StatusOK, download(test).Code)
+		assert.Equal(t, http.StatusOK, download(test).Code)
+		validateErrorCode(t, http.StatusForbidden, "download_limit_reached", download(test))
+
+		stored := &models.Download{}
+		require.NoError(t, test.DB.First(stored, "id = ?", "first-download").Error)
+		assert.EqualValues(t, 2, stored.DownloadCount)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		update(test, map[string]interface{}{"expires_at": time.Now().Add(time.Hour)})
+		assert.Equal(t, http.StatusOK, download(test).Code)
+
+		update(test, map[string]interface{}{"expires_at": time.Now().Add(-time.Hour)})
+		validateErrorCode(t, http.StatusForbidden, "download_expired", download(test))
+	})
+
+	t.Run("MaxIPs", func(t *testing.T) {
+		test := NewRouteTest(t)
+		update(test, map[string]interface{}{"max_ips": 2})
+		assert.Equal(t, http.StatusOK, download(test).Code)
+		// the same IP can keep downloading
+		assert.Equal(t, http.StatusOK, download(test).Code)
+
+		// so can the IPs that got in before the limit was reached
+		require.NoError(t, test.DB.Create(&models.DownloadAccess{DownloadID: "first-download", IP: "203.0.113.7"}).Error)
+		assert.Equal(t, http.StatusOK, download(test).Code)
+
+		test = NewRouteTest(t)
+		update(test, map[string]interface{}{"max_ips": 2})
+		for _, ip := range []string{"203.0.113.7", "203.0.113.8"} {
+			require.NoError(t, test.DB.Create(&models.DownloadAccess{DownloadID: "first-download", IP: ip}).Error)
+		}
+		validateErrorCode(t, http.StatusForbidden, "download_ip_limit_reached", download(test))
+
+		// the rejected download isn't counted
+		stored := &models.Download{}
+		require.NoError(t, test.DB.First(stored, "id = ?", "first-download").Error)
+		assert.EqualValues(t, 0, stored.DownloadCount)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		test := NewRouteTest(t)
+		adminToken := testAdminToken("magical-unicorn", "")
+
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/first-download/revoke", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/downloads/first-download/revoke", nil, adminToken)
+		revoked := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, revoked)
+		assert.NotNil(t, revoked.RevokedAt)
+		assert.Equal(t, models.RevokedByAdmin, revoked.RevokeReason)
+		validateErrorCode(t, http.StatusForbidden, "download_revoked", download(test))
+
+		recorder = test.TestEndpoint(http.MethodPost, "/downloads/first-download/revoke", nil, adminToken)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/downloads/first-download/reinstate", nil, adminToken)
+		reinstated := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, reinstated)
+		assert.Nil(t, reinstated.RevokedAt)
+		assert.Equal(t, http.StatusOK, download(test).Code)
+
+		var entries int
+		require.NoError(t, test.DB.Model(&models.AuditLog{}).Where("model_id = ?", "first-download").Count(&entries).Error)
+		assert.Equal(t, 2, entries)
+	})
+
+	t.Run("ExpiryStartsWithPayment", func(t *testing.T) {
+		d := &models.Download{}
+		paidAt := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		d.StartExpiry(paidAt)
+		assert.Nil(t, d.ExpiresAt)
+
+		d.ExpiresAfter = 3600
+		d.StartExpiry(paidAt)
+		require.NotNil(t, d.ExpiresAt)
+		assert.Equal(t, paidAt.Add(time.Hour), *d.ExpiresAt)
+		assert.False(t, d.Expired(paidAt.Add(time.Hour)))
+		assert.True(t, d.Expired(paidAt.Add(time.Hour+time.Second)))
+	})
+}
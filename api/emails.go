@@ -0,0 +1,271 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+// emailPreviewParams selects the email to preview. Without an order, the email
+// is rendered for a made up order.
+type emailPreviewParams struct {
+	Type     string `json:"type"`
+	OrderID  string `json:"order_id"`
+	Template string `json:"template"`
+	Locale   string `json:"locale"`
+	To       string `json:"to"`
+}
+
+func (a *API) loadEmail(r *http.Request) (*models.Email, *HTTPError) {
+	emailID := chi.URLParam(r, "email_id")
+	logEntrySetField(r, "email_id", emailID)
+
+	email := &models.Email{}
+	result := a.db.Where("id = ? AND instance_id = ?", emailID, gcontext.GetInstanceID(r.Context())).First(email)
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Email not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return email, nil
+}
+
+// EmailList lists the emails in the outbox of the instance, newest first.
+// It supports filtering by type, status, order_id and date.
+func (a *API) EmailList(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.db.Where("instance_id = ?", instanceID)
+	query, err := parseEmailQueryParams(query, r.URL.Query())
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Email{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	emails := []*models.Email{}
+	if result := query.Order("id desc").Offset(offset).Limit(limit).Find(&emails); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	log.WithField("email_count", len(emails)).Debugf("Successfully retrieved %d emails", len(emails))
+	return sendJSON(w, http.StatusOK, emails)
+}
+
+// EmailView returns an email from the outbox.
+func (a *API) EmailView(w http.ResponseWriter, r *http.Request) error {
+	email, httpErr := a.loadEmail(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, email)
+}
+
+// EmailResend queues an email to be sent again. Pending emails are sent right
+// away instead of waiting for their next retry.
+func (a *API) EmailResend(w http.ResponseWriter, r *http.Request) error {
+	email, httpErr := a.loadEmail(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.db.Begin()
+	if err := models.ResendEmail(tx, email); err != nil {
+		tx.Rollback()
+		return internalServerError("Error queuing email").WithInternalError(err)
+	}
+	if httpErr := a.audit(tx, r, email.InstanceID, "email.resend", "email", strconv.FormatUint(email.ID, 10), nil, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error queuing email").WithInternalError(rsp.Error)
+	}
+
+	email, httpErr = a.loadEmail(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, email)
+}
+
+// EmailTypes lists the email types that can be previewed.
+func (a *API) EmailTypes(w http.ResponseWriter, r *http.Request) error {
+	return sendJSON(w, http.StatusOK, models.EmailTypes)
+}
+
+// EmailPreview renders an email without sending it. It takes the type, and
+// optionally an order_id, a template URL and a locale in the query.
+func (a *API) EmailPreview(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	params := &emailPreviewParams{
+		Type:     query.Get("type"),
+		OrderID:  query.Get("order_id"),
+		Template: query.Get("template"),
+		Locale:   query.Get("locale"),
+	}
+
+	msg, httpErr := a.renderPreview(r, params)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, msg)
+}
+
+// EmailPreviewSend renders an email like EmailPreview and sends it to the
+// given address right away, bypassing the outbox.
+func (a *API) EmailPreviewSend(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &emailPreviewParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.To == "" {
+		return badRequestError("A test email needs an address to send it to")
+	}
+
+	msg, httpErr := a.renderPreview(r, params)
+	if httpErr != nil {
+		return httpErr
+	}
+	msg.To = params.To
+	if err := gcontext.GetMailer(ctx).Send(msg); err != nil {
+		return internalServerError("Error sending test email: %v", err).WithInternalError(err)
+	}
+
+	tx := a.db.Begin()
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "email.test_send", "email", params.Type, nil, params); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving audit log").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, msg)
+}
+
+func (a *API) renderPreview(r *http.Request, params *emailPreviewParams) (*mailer.Message, *HTTPError) {
+	if !isEmailType(params.Type) {
+		return nil, badRequestError("Unknown email type '%s'", params.Type)
+	}
+	if params.Locale != "" && !mailer.ValidLocale(params.Locale) {
+		return nil, badRequestError("Invalid locale '%s'", params.Locale)
+	}
+
+	var order *models.Order
+	if params.OrderID == "" {
+		order = previewOrder(gcontext.GetInstanceID(r.Context()))
+	} else {
+		order = &models.Order{}
+		result := orderQuery(a.db).First(order, "id = ? AND instance_id = ?", params.OrderID, gcontext.GetInstanceID(r.Context()))
+		if result.Error != nil {
+			if result.RecordNotFound() {
+				return nil, notFoundError("Order not found")
+			}
+			return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+		}
+	}
+	if params.Locale != "" {
+		order.Locale = params.Locale
+	}
+
+	msg, err := gcontext.GetMailer(r.Context()).Render(params.Type, order, previewTransaction(order, params.Type), params.Template)
+	if err != nil {
+		if _, ok := err.(*mailer.TemplateError); ok {
+			return nil, badRequestError("%v", err)
+		}
+		return nil, internalServerError("Error rendering email").WithInternalError(err)
+	}
+	return msg, nil
+}
+
+func isEmailType(emailType string) bool {
+	for _, t := range models.EmailTypes {
+		if t == emailType {
+			return true
+		}
+	}
+	return false
+}
+
+// previewTransaction picks the latest transaction of the order that fits the
+// email type, or makes one up.
+func previewTransaction(order *models.Order, emailType string) *models.Transaction {
+	txType := models.ChargeTransactionType
+	if emailType == models.RefundIssuedEmail {
+		txType = models.RefundTransactionType
+	}
+
+	var transaction *models.Transaction
+	for _, tr := range order.Transactions {
+		if tr.Type == txType && (transaction == nil || tr.CreatedAt.After(transaction.CreatedAt)) {
+			transaction = tr
+		}
+	}
+	if transaction == nil {
+		transaction = models.NewTransaction(order)
+		transaction.Type = txType
+		transaction.Status = models.PaidState
+		transaction.CreatedAt = time.Now()
+		if emailType == models.PaymentFailedEmail {
+			transaction.Status = models.FailedState
+			transaction.FailureCode = "card_declined"
+			transaction.FailureDescription = "Your card was declined."
+		}
+	}
+	transaction.Order = order
+	return transaction
+}
+
+// previewOrder is a made up order for previewing emails in shops that don't
+// have a fitting order yet. It is never saved.
+func previewOrder(instanceID string) *models.Order {
+	now := time.Now()
+	order := &models.Order{
+		InstanceID:       instanceID,
+		ID:               "preview-order",
+		InvoiceNumber:    1001,
+		Email:            "customer@example.com",
+		Currency:         "USD",
+		Taxes:            200,
+		Shipping:         500,
+		SubTotal:         2998,
+		Total:            3698,
+		PaymentState:     models.PaidState,
+		FulfillmentState: models.PendingState,
+		State:            models.PaidState,
+		Carrier:          "UPS",
+		TrackingNumber:   "1Z999AA10123456784",
+		TrackingURL:      "https://www.ups.com/track?tracknum=1Z999AA10123456784",
+		CreatedAt:        now,
+		UpdatedAt:        now,
+		LineItems: []*models.LineItem{
+			{ID: 1, Title: "Sample T-Shirt", Sku: "sample-shirt", Type: "apparel", Path: "/products/sample-shirt/", Price: 1999, Quantity: 1},
+			{ID: 2, Title: "Sample E-Book", Sku: "sample-ebook", Type: "ebook", Path: "/products/sample-ebook/", Price: 999, Quantity: 1},
+		},
+		Downloads: []models.Download{
+			{ID: "preview-download", LineItemID: 2, Title: "Sample E-Book", Sku: "sample-ebook", Format: "pdf", URL: "/downloads/sample-ebook.pdf"},
+		},
+	}
+	address := models.AddressRequest{
+		Name:     "Jane Doe",
+		Address1: "1 Main Street",
+		City:     "Springfield",
+		Country:  "USA",
+		Zip:      "12345",
+	}
+	order.ShippingAddress = models.Address{AddressRequest: address}
+	order.BillingAddress = models.Address{AddressRequest: address}
+	return order
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+func createTestEmail(test *RouteTest, status string) *models.Email {
+	email := models.NewTransactionEmail(models.OrderConfirmationEmail, test.Data.firstTransaction)
+	require.NoError(test.T, models.EnqueueEmail(test.DB, email))
+	if status != models.EmailPending {
+		require.NoError(test.T, test.DB.Model(email).Update("status", status).Error)
+		email.Status = status
+	}
+	return email
+}
+
+func TestEmailOutbox(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("ResendReceipt", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"email": "alfred@wayneindustries.com"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/receipt", body, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		emails := []models.Email{}
+		require.NoError(t, test.DB.Find(&emails).Error)
+		require.Len(t, emails, 1)
+		assert.Equal(t, models.OrderConfirmationEmail, emails[0].Type)
+		assert.Equal(t, "first-trans", emails[0].TransactionID)
+		assert.Equal(t, "alfred@wayneindustries.com", emails[0].To)
+		assert.Equal(t, models.EmailPending, emails[0].Status)
+		require.NotNil(t, emails[0].JobID)
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.Where("id = ?", *emails[0].JobID).First(job).Error)
+		assert.Equal(t, models.EmailJobType, job.Type)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestEmail(test, models.EmailSent)
+		failed := createTestEmail(test, models.EmailFailed)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/emails", nil, token)
+		emails := []models.Email{}
+		extractPayload(t, http.StatusOK, recorder, &emails)
+		assert.Len(t, emails, 2)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/emails?status=failed", nil, token)
+		emails = []models.Email{}
+		extractPayload(t, http.StatusOK, recorder, &emails)
+		require.Len(t, emails, 1)
+		assert.Equal(t, failed.ID, emails[0].ID)
+	})
+
+	t.Run("Resend", func(t *testing.T) {
+		test := NewRouteTest(t)
+		failed := createTestEmail(test, models.EmailFailed)
+
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/emails/%d/resend", failed.ID), nil, token)
+		email := models.Email{}
+		extractPayload(t, http.StatusOK, recorder, &email)
+		assert.Equal(t, models.EmailPending, email.Status)
+
+		jobs := []models.Job{}
+		require.NoError(t, test.DB.Where("type = ?", models.EmailJobType).Find(&jobs).Error)
+		assert.Len(t, jobs, 2)
+
+		entries := []models.AuditLog{}
+		require.NoError(t, test.DB.Where("action = ?", "email.resend").Find(&entries).Error)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/emails/1234/resend", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/emails", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func queuedEmails(test *RouteTest, emailType string) []models.Email {
+	emails := []models.Email{}
+	require.NoError(test.T, test.DB.Where("type = ?", emailType).Find(&emails).Error)
+	return emails
+}
+
+func TestTransactionalEmails(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("OrderShipped", func(t *testing.T) {
+		test := NewRouteTest(t)
+		params := &orderRequestParams{
+			FulfillmentState: models.ShippedState,
+			Carrier:          "UPS",
+			TrackingNumber:   "1Z999",
+			TrackingURL:      "https://example.com/track/1Z999",
+		}
+		recorder := runOrderUpdate(test, test.Data.firstOrder, params, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, "1Z999", order.TrackingNumber)
+		assert.Equal(t, "https://example.com/track/1Z999", order.TrackingURL)
+
+		emails := queuedEmails(test, models.OrderShippedEmail)
+		require.Len(t, emails, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, emails[0].OrderID)
+
+		// shipping twice doesn't send another email
+		recorder = runOrderUpdate(test, test.Data.firstOrder, params, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, queuedEmails(test, models.OrderShippedEmail), 1)
+	})
+
+	t.Run("OrderCancelled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := runOrderUpdate(test, test.Data.unpaidOrder, &orderRequestParams{State: models.CancelledState}, token)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Equal(t, models.CancelledState, order.State)
+		assert.Len(t, queuedEmails(test, models.OrderCancelledEmail), 1)
+	})
+
+	t.Run("CancelShippedOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.unpaidOrder.FulfillmentState = models.ShippedState
+		require.NoError(t, test.DB.Save(test.Data.unpaidOrder).Error)
+
+		recorder := runOrderUpdate(test, test.Data.unpaidOrder, &orderRequestParams{State: models.CancelledState}, token)
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Len(t, queuedEmails(test, models.OrderCancelledEmail), 0)
+	})
+
+	t.Run("CancelPaidOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{State: models.CancelledState}, token)
+		assert.Contains(t, recorder.Body.String(), "refund")
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Len(t, queuedEmails(test, models.OrderCancelledEmail), 0)
+	})
+
+	t.Run("BadState", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{State: "lost"}, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("AbandonedCart", func(t *testing.T) {
+		server := startTestSite()
+		defer server.Close()
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Mailer.AbandonedCartDelay = 24
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+
+		emails := queuedEmails(test, models.AbandonedCartEmail)
+		require.Len(t, emails, 1)
+		assert.Equal(t, order.ID, emails[0].OrderID)
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.Where("id = ?", *emails[0].JobID).First(job).Error)
+		assert.True(t, job.RunAfter.After(time.Now().Add(23*time.Hour)))
+	})
+}
+
+func TestEmailPreview(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Types", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/emails/types", nil, token)
+		types := []string{}
+		extractPayload(t, http.StatusOK, recorder, &types)
+		assert.Equal(t, models.EmailTypes, types)
+	})
+
+	t.Run("Fixture", func(t *testing.T) {
+		test := NewRouteTest(t)
+		for _, emailType := range models.EmailTypes {
+			recorder := test.TestEndpoint(http.MethodGet, "/emails/preview?type="+emailType, nil, token)
+			msg := &mailer.Message{}
+			extractPayload(t, http.StatusOK, recorder, msg)
+			assert.NotEmpty(t, msg.Subject, emailType)
+			assert.NotEmpty(t, msg.HTML, emailType)
+			assert.NotEmpty(t, msg.Text, emailType)
+		}
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/emails/preview?type=order_confirmation&order_id=" + test.Data.firstOrder.ID
+		recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
+		msg := &mailer.Message{}
+		extractPayload(t, http.StatusOK, recorder, msg)
+		assert.Equal(t, test.Data.firstOrder.Email, msg.To)
+		assert.Contains(t, msg.Text, test.Data.firstOrder.LineItems[0].Title)
+	})
+
+	t.Run("UnknownOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/emails/preview?type=order_confirmation&order_id=nope", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("UnknownType", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/emails/preview?type=birthday", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("TemplateError", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/mail/broken.html" {
+				fmt.Fprint(w, "{{ .Order.Nope }")
+				return
+			}
+			http.NotFound(w, r)
+		}))
+		defer server.Close()
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodGet, "/emails/preview?type=order_shipped&template=/mail/broken.html", nil, token)
+		validateError(t, http.StatusBadRequest, recorder, "/mail/broken.html")
+	})
+
+	t.Run("SendTest", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SMTP.Transport = mailer.CaptureTransport
+		mailer.Captured.Reset()
+		defer mailer.Captured.Reset()
+
+		body := strings.NewReader(`{"type": "order_shipped", "locale": "de", "to": "alfred@wayneindustries.com"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/emails/preview/send", body, token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		messages := mailer.Captured.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "alfred@wayneindustries.com", messages[0].To)
+
+		entries := []models.AuditLog{}
+		require.NoError(t, test.DB.Where("action = ?", "email.test_send").Find(&entries).Error)
+		assert.Len(t, entries, 1)
+		assert.Len(t, queuedEmails(test, models.OrderShippedEmail), 0)
+	})
+
+	t.Run("SendTestWithoutAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"type": "order_shipped"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/emails/preview/send", body, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/emails/preview?type=order_shipped", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -26,6 +26,10 @@ func unauthorizedError(fmtString string, args ...interface{}) *HTTPError {
 	return httpError(http.StatusUnauthorized, fmtString, args...)
 }
 
+func forbiddenError(fmtString string, args ...interface{}) *HTTPError {
+	return httpError(http.StatusForbidden, fmtString, args...)
+}
+
 // HTTPError is an error with a message and an HTTP status code.
 type HTTPError struct {
 	Code            int    `json:"code"`
@@ -33,6 +37,9 @@ type HTTPError struct {
 	InternalError   error  `json:"-"`
 	InternalMessage string `json:"-"`
 	ErrorID         string `json:"error_id,omitempty"`
+	// ErrorCode tells clients which of several errors with the same status
+	// occurred, like "download_expired".
+	ErrorCode string `json:"error_code,omitempty"`
 }
 
 func (e *HTTPError) Error() string {
@@ -56,6 +63,12 @@ func (e *HTTPError) WithInternalError(err error) *HTTPError {
 	return e
 }
 
+// WithErrorCode adds a machine readable error code to the error
+func (e *HTTPError) WithErrorCode(code string) *HTTPError {
+	e.ErrorCode = code
+	return e
+}
+
 // WithInternalMessage adds internal message information to the error
 func (e *HTTPError) WithInternalMessage(fmtString string, args ...interface{}) *HTTPError {
 	e.InternalMessage = fmt.Sprintf(fmtString, args)
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments/fake"
+)
+
+// FakePaymentsView shows the charges, refunds and preauthorizations of the
+// fake payment provider of the instance, so tests can check what was sent to it. It is only
+// available to admins of instances with the fake provider enabled.
+func (a *API) FakePaymentsView(w http.ResponseWriter, r *http.Request) error {
+	if gcontext.GetPaymentProviders(r.Context())[fake.ProviderName] == nil {
+		return notFoundError("The fake payment provider is not enabled")
+	}
+	return sendJSON(w, http.StatusOK, fake.CurrentState(gcontext.GetInstanceID(r.Context())))
+}
+
+// FakePaymentsReset clears the state of the fake payment provider of the
+// instance.
+func (a *API) FakePaymentsReset(w http.ResponseWriter, r *http.Request) error {
+	if gcontext.GetPaymentProviders(r.Context())[fake.ProviderName] == nil {
+		return notFoundError("The fake payment provider is not enabled")
+	}
+	fake.Reset(gcontext.GetInstanceID(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useFakeProvider configures the fake payment provider, with a clean state.
+func useFakeProvider(test *RouteTest) {
+	test.Config.Payment.Providers = conf.PaymentProviders{
+		fake.ProviderName: json.RawMessage(`{"enabled": true, "slow_response_ms": 50}`),
+	}
+	fake.Reset("")
+}
+
+func payWithFakeToken(test *RouteTest, token string) *models.Transaction {
+	recorder := payUnpaidOrderWith(test, nil, map[string]interface{}{"provider": fake.ProviderName, "fake_token": token})
+	if recorder.Code != http.StatusOK {
+		validateError(test.T, http.StatusInternalServerError, recorder)
+		return nil
+	}
+	tr := &models.Transaction{}
+	extractPayload(test.T, http.StatusOK, recorder, tr)
+	return tr
+}
+
+func refundFake(test *RouteTest, tr *models.Transaction, amount uint64) string {
+	body := jsonBody(test.T, map[string]interface{}{"amount": amount, "currency": "USD"})
+	recorder := test.TestEndpoint(http.MethodPost, "/payments/"+tr.ID+"/refund", body, testAdminToken("magical-unicorn", ""))
+	refund := &models.Transaction{}
+	extractPayload(test.T, http.StatusOK, recorder, refund)
+	return refund.Status
+}
+
+func fakeState(test *RouteTest) *fake.State {
+	recorder := test.TestEndpoint(http.MethodGet, "/payments/fake", nil, testAdminToken("magical-unicorn", ""))
+	state := &fake.State{}
+	extractPayload(test.T, http.StatusOK, recorder, state)
+	return state
+}
+
+func TestFakePayments(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		tr := payWithFakeToken(test, fake.TokenSuccess)
+		require.NotNil(t, tr)
+		assert.Equal(t, "fake_ch_1", tr.ProcessorID)
+		assert.Equal(t, models.PaidState, tr.Status)
+
+		assert.Equal(t, models.PaidState, refundFake(test, tr, 10))
+		state := fakeState(test)
+		require.Len(t, state.Charges, 1)
+		assert.EqualValues(t, 24, state.Charges[0].Amount)
+		assert.EqualValues(t, 10, state.Charges[0].Refunded)
+		require.Len(t, state.Refunds, 1)
+		assert.Equal(t, fake.StatusSucceeded, state.Refunds[0].Status)
+	})
+
+	t.Run("Decline", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		assert.Nil(t, payWithFakeToken(test, fake.TokenDecline))
+		state := fakeState(test)
+		require.Len(t, state.Charges, 1)
+		assert.Equal(t, fake.StatusDeclined, state.Charges[0].Status)
+		assert.Equal(t, 1, countEmails(test, models.PaymentFailedEmail))
+	})
+
+	t.Run("NetworkError", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		assert.Nil(t, payWithFakeToken(test, fake.TokenNetworkError))
+		assert.Equal(t, fake.StatusNetworkError, fakeState(test).Charges[0].Status)
+	})
+
+	t.Run("Slow", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		start := time.Now()
+		require.NotNil(t, payWithFakeToken(test, fake.TokenSlow))
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	})
+
+	t.Run("PartialRefundFailure", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		tr := payWithFakeToken(test, fake.TokenPartialRefundFailure)
+		require.NotNil(t, tr)
+		assert.Equal(t, models.FailedState, refundFake(test, tr, 10))
+		assert.Equal(t, models.PaidState, refundFake(test, tr, 24))
+
+		state := fakeState(test)
+		require.Len(t, state.Refunds, 2)
+		assert.Equal(t, fake.StatusFailed, state.Refunds[0].Status)
+		assert.Equal(t, fake.StatusSucceeded, state.Refunds[1].Status)
+	})
+
+	t.Run("UnknownToken", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		recorder := payUnpaidOrderWith(test, nil, map[string]interface{}{"provider": fake.ProviderName, "fake_token": "tok_other"})
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Empty(t, fakeState(test).Charges)
+	})
+}
+
+func TestFakePaymentsState(t *testing.T) {
+	t.Run("Reset", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		require.NotNil(t, payWithFakeToken(test, fake.TokenSuccess))
+		recorder := test.TestEndpoint(http.MethodDelete, "/payments/fake", nil, testAdminToken("magical-unicorn", ""))
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Empty(t, fakeState(test).Charges)
+	})
+
+	t.Run("Instances", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		fake.Reset("other-instance")
+		require.NotNil(t, payWithFakeToken(test, fake.TokenSuccess))
+
+		provider, err := fake.NewPaymentProvider(fake.Config{Enabled: true})
+		require.NoError(t, err)
+		r, err := http.NewRequest(http.MethodPost, "/orders/other-order/payments", strings.NewReader(`{"fake_token": "tok_success"}`))
+		require.NoError(t, err)
+		charge, err := provider.NewCharger(gcontext.WithInstanceID(context.Background(), "other-instance"), r)
+		require.NoError(t, err)
+		id, err := charge(10, "USD")
+		require.NoError(t, err)
+		assert.Equal(t, "fake_ch_1", id)
+
+		assert.Len(t, fakeState(test).Charges, 1)
+		assert.Len(t, fake.CurrentState("other-instance").Charges, 1)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		useFakeProvider(test)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/fake", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/fake", nil, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("NoFlag", func(t *testing.T) {
+		config := &conf.Configuration{}
+		config.Payment.Providers = conf.PaymentProviders{fake.ProviderName: json.RawMessage(`{}`)}
+		_, err := createPaymentProviders(config)
+		assert.Error(t, err)
+	})
+}
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
@@ -18,3 +21,12 @@ func sendJSON(w http.ResponseWriter, status int, obj interface{}) error {
 	_, err = w.Write(b)
 	return err
 }
+
+// bestEffort runs a write that the change of a transaction doesn't depend on,
+// like queuing an email about it. When the write fails, only it is rolled
+// back and its error logged, so the change is still committed.
+func bestEffort(tx *gorm.DB, log logrus.FieldLogger, message string, write func() error) {
+	if err := models.Savepoint(tx, write); err != nil {
+		log.WithError(err).Error(message)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// HookDelivery is a webhook delivery with the request that was sent.
+type HookDelivery struct {
+	*models.Hook
+	Status  string            `json:"status"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"request_headers"`
+}
+
+func newHookDelivery(hook *models.Hook) *HookDelivery {
+	headers := map[string]string{
+		"Content-Type":                "application/json",
+		"X-Commerce-Event":            hook.Type,
+		"X-Commerce-Event-Id":         hook.EventID,
+		"X-Commerce-Delivery-Attempt": strconv.Itoa(hook.Tries),
+	}
+	if hook.Secret != "" {
+		headers["X-Commerce-Signature"] = "<signed JWT>"
+		headers["X-Commerce-Signature-256"] = "<sha256 HMAC of timestamp and body>"
+	}
+	return &HookDelivery{
+		Hook:    hook,
+		Status:  hook.Status(),
+		Method:  http.MethodPost,
+		Headers: headers,
+	}
+}
+
+func (a *API) loadHook(r *http.Request) (*models.Hook, *HTTPError) {
+	hookID := chi.URLParam(r, "hook_id")
+	logEntrySetField(r, "hook_id", hookID)
+
+	hook := &models.Hook{}
+	result := a.db.Where("id = ? AND instance_id = ?", hookID, gcontext.GetInstanceID(r.Context())).First(hook)
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Webhook delivery not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return hook, nil
+}
+
+// HookList lists the webhook deliveries of the instance, newest first.
+// It supports filtering by type, status, subscription_id, user_id and date.
+func (a *API) HookList(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	query := a.db.Where("instance_id = ?", instanceID)
+	query, err := parseHookQueryParams(query, r.URL.Query())
+	if err != nil {
+		return badRequestError("Bad parameters in query: %v", err)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Hook{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	hooks := []*models.Hook{}
+	if result := query.Order("id desc").Offset(offset).Limit(limit).Find(&hooks); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	deliveries := make([]*HookDelivery, len(hooks))
+	for i, hook := range hooks {
+		deliveries[i] = newHookDelivery(hook)
+	}
+
+	log.WithField("hook_count", len(hooks)).Debugf("Successfully retrieved %d webhook deliveries", len(hooks))
+	return sendJSON(w, http.StatusOK, deliveries)
+}
+
+// HookView returns the full request and response of a webhook delivery.
+func (a *API) HookView(w http.ResponseWriter, r *http.Request) error {
+	hook, httpErr := a.loadHook(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, newHookDelivery(hook))
+}
+
+// HookReplay sends the request of a webhook delivery again right away. The
+// replay is recorded as a new delivery, which is retried if it fails.
+func (a *API) HookReplay(w http.ResponseWriter, r *http.Request) error {
+	log := getLogEntry(r)
+	hook, httpErr := a.loadHook(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !hook.Done {
+		return badRequestError("Webhook delivery is still pending")
+	}
+
+	replay := hook.Replay()
+	tx := a.db.Begin()
+	if result := tx.Create(replay); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error creating webhook delivery").WithInternalError(result.Error)
+	}
+	if httpErr := a.audit(tx, r, hook.InstanceID, "webhook.replay", "hook", strconv.FormatUint(replay.ID, 10), nil, map[string]uint64{"replay_of": hook.ID}); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error creating webhook delivery").WithInternalError(rsp.Error)
+	}
+
+	replay.Deliver(r.Context(), a.db, a.httpClient, log)
+	if !replay.Done {
+		// leave the retries to the workers
+		if err := models.EnqueueHook(a.db, replay); err != nil {
+			return internalServerError("Error scheduling webhook delivery retry").WithInternalError(err)
+		}
+	}
+	return sendJSON(w, http.StatusOK, newHookDelivery(replay))
+}
+
+// HookCancel stops the pending retries of a webhook delivery.
+func (a *API) HookCancel(w http.ResponseWriter, r *http.Request) error {
+	hook, httpErr := a.loadHook(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.db.Begin()
+	canceled, err := models.CancelHook(tx, hook, "Canceled by admin")
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error canceling webhook delivery").WithInternalError(err)
+	}
+	if !canceled {
+		tx.Rollback()
+		return badRequestError("Webhook delivery is not pending")
+	}
+	if httpErr := a.audit(tx, r, hook.InstanceID, "webhook.cancel", "hook", strconv.FormatUint(hook.ID, 10), nil, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error canceling webhook delivery").WithInternalError(rsp.Error)
+	}
+
+	hook, httpErr = a.loadHook(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, newHookDelivery(hook))
+}
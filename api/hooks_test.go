@@ -0,0 +1,152 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createTestHook(test *RouteTest, hookURL string, done, failed bool) *models.Hook {
+	hook, err := models.NewHook(models.WebhookOrderCreated, "", hookURL, "", "", map[string]string{"id": "first-order"})
+	require.NoError(test.T, err)
+	hook.Done = done
+	hook.Failed = failed
+	if done {
+		now := time.Now()
+		hook.CompletedAt = &now
+		hook.Tries = 1
+	}
+	require.NoError(test.T, test.DB.Create(hook).Error)
+	return hook
+}
+
+func TestHookDeliveries(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("List", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestHook(test, "https://example.com/hook", true, false)
+		failed := createTestHook(test, "https://example.com/hook", true, true)
+		createTestHook(test, "https://example.com/hook", false, false)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/webhooks/deliveries", nil, token)
+		deliveries := []HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &deliveries)
+		assert.Len(t, deliveries, 3)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/webhooks/deliveries?status=failed", nil, token)
+		deliveries = []HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &deliveries)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, failed.ID, deliveries[0].ID)
+		assert.Equal(t, models.HookFailed, deliveries[0].Status)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/webhooks/deliveries?status=bogus", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("View", func(t *testing.T) {
+		test := NewRouteTest(t)
+		hook := createTestHook(test, "https://example.com/hook", true, false)
+
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/webhooks/deliveries/%d", hook.ID), nil, token)
+		delivery := HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &delivery)
+		assert.Equal(t, hook.Payload, delivery.Payload)
+		assert.Equal(t, http.MethodPost, delivery.Method)
+		assert.Equal(t, models.WebhookOrderCreated, delivery.Headers["X-Commerce-Event"])
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		test := NewRouteTest(t)
+		received := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received++
+			w.Write([]byte("thanks"))
+		}))
+		defer server.Close()
+		hook := createTestHook(test, server.URL, true, true)
+
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/webhooks/deliveries/%d/replay", hook.ID), nil, token)
+		delivery := HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &delivery)
+		assert.Equal(t, 1, received)
+		assert.NotEqual(t, hook.ID, delivery.ID)
+		assert.Equal(t, models.HookSucceeded, delivery.Status)
+		assert.Equal(t, "thanks", delivery.ResponseBody)
+	})
+
+	t.Run("Signature", func(t *testing.T) {
+		test := NewRouteTest(t)
+		var headers http.Header
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			headers = r.Header
+			body, _ = ioutil.ReadAll(r.Body)
+		}))
+		defer server.Close()
+		hook := createTestHook(test, server.URL, true, false)
+		require.NoError(t, test.DB.Model(hook).Update("secret", "shh").Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/webhooks/deliveries/%d/replay", hook.ID), nil, token)
+		delivery := HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &delivery)
+
+		assert.Equal(t, hook.EventID, headers.Get("X-Commerce-Event-Id"))
+		assert.Equal(t, "1", headers.Get("X-Commerce-Delivery-Attempt"))
+		assert.NotEmpty(t, headers.Get("X-Commerce-Signature"))
+		timestamp, err := strconv.ParseInt(headers.Get("X-Commerce-Timestamp"), 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, "sha256="+models.SignHookPayload("shh", timestamp, body), headers.Get("X-Commerce-Signature-256"))
+		assert.NotEqual(t, "sha256="+models.SignHookPayload("shh", timestamp, []byte(`{"id":"other-order"}`)), headers.Get("X-Commerce-Signature-256"))
+	})
+
+	t.Run("RetryBackoff", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+		hook := createTestHook(test, server.URL, true, true)
+		hook.WebhookRetryPolicy = models.WebhookRetryPolicy{MaxRetries: 2, RetryBaseDelay: 60, RetryMaxDelay: 60}
+		require.NoError(t, test.DB.Save(hook).Error)
+
+		started := time.Now()
+		recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/webhooks/deliveries/%d/replay", hook.ID), nil, token)
+		delivery := HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &delivery)
+		assert.Equal(t, models.HookPending, delivery.Status)
+		require.NotNil(t, delivery.RunAfter)
+		assert.WithinDuration(t, started.Add(45*time.Second), *delivery.RunAfter, 16*time.Second)
+		assert.Equal(t, 2, delivery.MaxRetries)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		test := NewRouteTest(t)
+		hook := createTestHook(test, "https://example.com/hook", false, false)
+
+		url := fmt.Sprintf("/webhooks/deliveries/%d/cancel", hook.ID)
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, token)
+		delivery := HookDelivery{}
+		extractPayload(t, http.StatusOK, recorder, &delivery)
+		assert.Equal(t, models.HookFailed, delivery.Status)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/webhooks/deliveries", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -66,9 +66,18 @@ func (a *API) CreateInstance(w http.ResponseWriter, r *http.Request) error {
 		UUID:       params.UUID,
 		BaseConfig: params.BaseConfig,
 	}
-	if err = models.CreateInstance(a.db, &i); err != nil {
+	tx := a.db.Begin()
+	if err = models.CreateInstance(tx, &i); err != nil {
+		tx.Rollback()
 		return internalServerError("Database error creating instance").WithInternalError(err)
 	}
+	if httpErr := a.audit(tx, r, i.ID, "instance.create", "instance", i.ID, nil, i); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Database error creating instance").WithInternalError(rsp.Error)
+	}
 
 	resp := InstanceResponse{
 		Instance: i,
@@ -91,21 +100,40 @@ func (a *API) UpdateInstance(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Error decoding params: %v", err)
 	}
 
+	before := auditSnapshot(i)
 	if params.BaseConfig != nil {
 		i.BaseConfig = params.BaseConfig
 	}
 
-	if err := models.UpdateInstance(a.db, i); err != nil {
+	tx := a.db.Begin()
+	if err := models.UpdateInstance(tx, i); err != nil {
+		tx.Rollback()
 		return internalServerError("Database error updating instance").WithInternalError(err)
 	}
+	if httpErr := a.audit(tx, r, i.ID, "instance.update", "instance", i.ID, before, i); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Database error updating instance").WithInternalError(rsp.Error)
+	}
 	return sendJSON(w, http.StatusOK, i)
 }
 
 func (a *API) DeleteInstance(w http.ResponseWriter, r *http.Request) error {
 	i := gcontext.GetInstance(r.Context())
-	if err := models.DeleteInstance(a.db, i); err != nil {
+	tx := a.db.Begin()
+	if err := models.DeleteInstance(tx, i); err != nil {
+		tx.Rollback()
 		return internalServerError("Database error deleting instance").WithInternalError(err)
 	}
+	if httpErr := a.audit(tx, r, i.ID, "instance.delete", "instance", i.ID, i, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Database error deleting instance").WithInternalError(rsp.Error)
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 	return nil
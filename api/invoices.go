@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/invoices"
+	"github.com/netlify/gocommerce/models"
+)
+
+// invoiceNumbering returns how the instance numbers a sequence. Credit notes
+// are numbered like invoices with a "CN-" prefix, unless they have a format
+// of their own.
+func invoiceNumbering(config *conf.Configuration, sequence string) models.InvoiceNumbering {
+	format := config.Invoices.NumberFormat
+	if sequence == models.CreditNoteSequence {
+		if config.Invoices.CreditNoteFormat != "" {
+			format = config.Invoices.CreditNoteFormat
+		} else if format != "" {
+			format = "CN-" + format
+		} else {
+			format = "CN-{number}"
+		}
+	}
+	return models.InvoiceNumbering{
+		Sequence: sequence,
+		Format:   format,
+		Reset:    config.Invoices.NumberReset,
+	}
+}
+
+func (a *API) loadInvoiceOrder(r *http.Request) (*models.Order, *HTTPError) {
+	ctx := r.Context()
+	id := gcontext.GetOrderID(ctx)
+	logEntrySetField(r, "order_id", id)
+
+	order := &models.Order{}
+	if result := orderQuery(a.db).First(order, "id = ?", id); result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if !hasOrderAccess(ctx, order) {
+		return nil, unauthorizedError("Order History Requires Authentication")
+	}
+	return order, nil
+}
+
+// InvoiceView renders the invoice of a paid order as PDF.
+func (a *API) InvoiceView(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadInvoiceOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if order.InvoiceNumber == 0 {
+		return notFoundError("Invoice not found")
+	}
+
+	invoice, err := invoices.NewInvoice(order, gcontext.GetConfig(r.Context()))
+	if err != nil {
+		return internalServerError("Error creating invoice").WithInternalError(err)
+	}
+	return sendInvoice(w, r, invoice)
+}
+
+// CreditNoteView renders the credit note of a refund as PDF.
+func (a *API) CreditNoteView(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.loadInvoiceOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	transactionID := chi.URLParam(r, "transaction_id")
+	logEntrySetField(r, "transaction_id", transactionID)
+	var refund *models.Transaction
+	for _, tr := range order.Transactions {
+		if tr.ID == transactionID && tr.Type == models.RefundTransactionType && tr.InvoiceNumber != 0 {
+			refund = tr
+		}
+	}
+	if refund == nil || order.InvoiceNumber == 0 {
+		return notFoundError("Credit note not found")
+	}
+
+	note, err := invoices.NewCreditNote(order, refund, gcontext.GetConfig(r.Context()))
+	if err != nil {
+		return internalServerError("Error creating credit note").WithInternalError(err)
+	}
+	return sendInvoice(w, r, note)
+}
+
+func sendInvoice(w http.ResponseWriter, r *http.Request, invoice *invoices.Invoice) error {
+	tmpl, err := invoices.LoadTemplate(gcontext.GetConfig(r.Context()))
+	if err != nil {
+		return internalServerError("Error loading invoice template").WithInternalError(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := invoices.Render(buf, invoice, tmpl); err != nil {
+		return internalServerError("Error rendering invoice").WithInternalError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `inline; filename="`+invoice.Filename()+`"`)
+	w.WriteHeader(http.StatusOK)
+	_, err = buf.WriteTo(w)
+	return err
+}
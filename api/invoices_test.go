@@ -0,0 +1,131 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestInvoices(t *testing.T) {
+	t.Run("Invoice", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("invoice_number", 1001).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/invoice.pdf", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Equal(t, "application/pdf", recorder.Header().Get("Content-Type"))
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "invoice-1001.pdf")
+		assert.True(t, strings.HasPrefix(recorder.Body.String(), "%PDF-"))
+		assert.Contains(t, recorder.Body.String(), "(Invoice 1001)")
+	})
+
+	t.Run("NoInvoice", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/invoice.pdf", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("invoice_number", 1001).Error)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/invoice.pdf", nil, testToken("stranger", "stranger@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("CreditNote", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Update("invoice_number", 1001).Error)
+		refund := models.NewTransaction(test.Data.firstOrder)
+		refund.Type = models.RefundTransactionType
+		refund.Status = models.PaidState
+		refund.Amount = 50
+		refund.InvoiceNumber = 1002
+		require.NoError(t, test.DB.Create(refund).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/refunds/"+refund.ID+"/credit_note.pdf", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "credit-note-1002.pdf")
+		assert.Contains(t, recorder.Body.String(), "(Credit note 1002)")
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/first-order/refunds/first-trans/credit_note.pdf", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestInvoiceNumbers(t *testing.T) {
+	at := time.Date(2017, time.March, 5, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Format", func(t *testing.T) {
+		numbering := models.InvoiceNumbering{Format: "INV-{year}-{month}-{number:6}", Reset: models.ResetMonthly}
+		require.NoError(t, numbering.Validate())
+		assert.Equal(t, "INV-2017-03-000123", numbering.FormatNumber(123, at))
+		assert.Equal(t, "INV-2017-03-1234567", numbering.FormatNumber(1234567, at))
+		assert.Equal(t, "42", models.InvoiceNumbering{}.FormatNumber(42, at))
+
+		for _, invalid := range []models.InvoiceNumbering{
+			{Format: "INV-{year}"},
+			{Format: "INV-{number}-{day}"},
+			{Format: "INV-{number}", Reset: models.ResetYearly},
+			{Format: "INV-{year}-{number}", Reset: models.ResetMonthly},
+			{Format: "INV-{year}-{number}", Reset: "weekly"},
+		} {
+			assert.Error(t, invalid.Validate(), invalid.Format)
+		}
+	})
+
+	t.Run("Sequences", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Invoices.NumberFormat = "INV-{year}-{number:6}"
+		test.Config.Invoices.NumberReset = models.ResetYearly
+		invoices := invoiceNumbering(test.Config, models.InvoiceSequence)
+		creditNotes := invoiceNumbering(test.Config, models.CreditNoteSequence)
+
+		next := func(numbering models.InvoiceNumbering, at time.Time) string {
+			_, formatted, err := models.NextInvoiceNumber(test.DB, "", numbering, at)
+			require.NoError(t, err)
+			return formatted
+		}
+		assert.Equal(t, "INV-2017-000001", next(invoices, at))
+		assert.Equal(t, "INV-2017-000002", next(invoices, at))
+		assert.Equal(t, "CN-INV-2017-000001", next(creditNotes, at))
+		assert.Equal(t, "INV-2018-000001", next(invoices, at.AddDate(1, 0, 0)))
+		assert.Equal(t, "INV-2017-000003", next(invoices, at))
+
+		// a rolled back transaction gives its number back
+		tx := test.DB.Begin()
+		_, formatted, err := models.NextInvoiceNumber(tx, "", invoices, at)
+		require.NoError(t, err)
+		assert.Equal(t, "INV-2017-000004", formatted)
+		require.NoError(t, tx.Rollback().Error)
+		assert.Equal(t, "INV-2017-000004", next(invoices, at))
+	})
+
+	t.Run("LegacyCounter", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Create(&models.InvoiceNumber{InstanceID: "global-instance", Number: 41}).Error)
+
+		number, formatted, err := models.NextInvoiceNumber(test.DB, "", invoiceNumbering(test.Config, models.InvoiceSequence), at)
+		require.NoError(t, err)
+		assert.Equal(t, int64(42), number)
+		assert.Equal(t, "42", formatted)
+	})
+
+	t.Run("FormattedInvoice", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).Updates(map[string]interface{}{
+			"invoice_number":           7,
+			"formatted_invoice_number": "INV/2017/000007",
+		}).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/first-order/invoice.pdf", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "invoice-INV-2017-000007.pdf")
+		assert.Contains(t, recorder.Body.String(), "(Invoice INV/2017/000007)")
+	})
+}
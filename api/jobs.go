@@ -0,0 +1,22 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/jobs"
+	"github.com/netlify/gocommerce/models"
+)
+
+// RegisterJobs adds the handlers of the jobs that run through the API to a
+// worker.
+func RegisterJobs(w *jobs.Worker, globalConfig *conf.GlobalConfiguration, db *gorm.DB) {
+	a := &API{
+		config:     globalConfig,
+		db:         db,
+		httpClient: &http.Client{},
+	}
+	w.Register(models.SubscriptionRenewalJobType, a.renewSubscription(w))
+	w.Register(models.ReportJobType, a.generateReport)
+}
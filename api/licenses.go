@@ -0,0 +1,214 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// License states reported by the verification endpoint.
+const (
+	licenseActive  = "active"
+	licenseRevoked = "revoked"
+	licenseUnknown = "unknown"
+)
+
+type licenseVerifyParams struct {
+	Key string `json:"key"`
+}
+
+// licenseVerification is the result of verifying a license key. It leaves
+// out the order and buyer of the license, since anyone can verify keys.
+type licenseVerification struct {
+	Valid     bool       `json:"valid"`
+	Status    string     `json:"status"`
+	Sku       string     `json:"sku,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	IssuedAt  *time.Time `json:"issued_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+type licensePoolStock struct {
+	Pool      string `json:"pool"`
+	Available int64  `json:"available"`
+	Issued    int64  `json:"issued"`
+	Imported  int64  `json:"imported,omitempty"`
+}
+
+// LicenseList lists the license keys of a paid order.
+func (a *API) LicenseList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	orderID := gcontext.GetOrderID(ctx)
+
+	order := &models.Order{}
+	if result := a.db.Where("id = ?", orderID).First(order); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("License order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if !hasOrderAccess(ctx, order) {
+		return unauthorizedError("You don't have permission to access this order")
+	}
+	if order.PaymentState != models.PaidState {
+		return unauthorizedError("This order has not been completed yet")
+	}
+
+	licenses := []models.License{}
+	if result := a.db.Where("order_id = ?", order.ID).Order("created_at").Find(&licenses); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, licenses)
+}
+
+// LicenseVerify checks if a license key was issued and isn't revoked. Signed
+// keys must also have a valid signature.
+func (a *API) LicenseVerify(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	params := &licenseVerifyParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	key := strings.TrimSpace(params.Key)
+	if key == "" {
+		return badRequestError("A license key is required")
+	}
+
+	license := &models.License{}
+	result := a.db.Where("instance_id = ? AND license_key = ?", gcontext.GetInstanceID(ctx), key).First(license)
+	if result.RecordNotFound() {
+		return sendJSON(w, http.StatusOK, &licenseVerification{Status: licenseUnknown})
+	} else if result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	if license.Source == models.LicenseSignedSource {
+		signingKey, err := models.ParseSigningKey(gcontext.GetConfig(ctx).Licenses.SigningKey)
+		if err != nil {
+			return internalServerError("Error verifying license key").WithInternalError(err)
+		}
+		signed, err := models.VerifyLicenseKey(key, signingKey.Public().(ed25519.PublicKey))
+		if err != nil || signed.ID != license.ID {
+			return sendJSON(w, http.StatusOK, &licenseVerification{Status: licenseUnknown})
+		}
+	}
+
+	verification := &licenseVerification{
+		Valid:     license.RevokedAt == nil,
+		Status:    licenseActive,
+		Sku:       license.Sku,
+		Title:     license.Title,
+		IssuedAt:  &license.CreatedAt,
+		RevokedAt: license.RevokedAt,
+	}
+	if license.RevokedAt != nil {
+		verification.Status = licenseRevoked
+	}
+	return sendJSON(w, http.StatusOK, verification)
+}
+
+// LicensePublicKey returns the public key signed license keys can be
+// verified with offline.
+func (a *API) LicensePublicKey(w http.ResponseWriter, r *http.Request) error {
+	signingKey, err := models.ParseSigningKey(gcontext.GetConfig(r.Context()).Licenses.SigningKey)
+	if err != nil {
+		return notFoundError("No license signing key configured")
+	}
+	return sendJSON(w, http.StatusOK, map[string]string{
+		"algorithm":  "ed25519",
+		"public_key": base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)),
+	})
+}
+
+// LicensePoolView shows how many keys of a pool are left.
+func (a *API) LicensePoolView(w http.ResponseWriter, r *http.Request) error {
+	stock, httpErr := a.licensePoolStock(r, chi.URLParam(r, "pool"))
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, stock)
+}
+
+// LicensePoolImport imports keys into a pool from a CSV file with a key in
+// the first column of every row. Keys already in the pool are skipped.
+func (a *API) LicensePoolImport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	instanceID := gcontext.GetInstanceID(ctx)
+	pool := chi.URLParam(r, "pool")
+	logEntrySetField(r, "license_pool", pool)
+
+	reader := csv.NewReader(r.Body)
+	reader.FieldsPerRecord = -1
+	keys := []string{}
+	seen := map[string]bool{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return badRequestError("Could not read CSV: %v", err)
+		}
+		key := strings.TrimSpace(record[0])
+		if key == "" || seen[key] || (len(keys) == 0 && strings.EqualFold(key, "key")) {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return badRequestError("No license keys to import")
+	}
+
+	tx := a.db.Begin()
+	var imported int64
+	for _, key := range keys {
+		var count int64
+		if result := tx.Model(&models.LicensePoolKey{}).Where("instance_id = ? AND pool = ? AND license_key = ?", instanceID, pool, key).Count(&count); result.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error during database query").WithInternalError(result.Error)
+		}
+		if count > 0 {
+			continue
+		}
+		if result := tx.Create(&models.LicensePoolKey{InstanceID: instanceID, Pool: pool, Key: key}); result.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error importing license keys").WithInternalError(result.Error)
+		}
+		imported++
+	}
+	if httpErr := a.audit(tx, r, instanceID, "license_pool.import", "license_pool", pool, nil, map[string]int64{"imported": imported}); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error importing license keys").WithInternalError(rsp.Error)
+	}
+
+	stock, httpErr := a.licensePoolStock(r, pool)
+	if httpErr != nil {
+		return httpErr
+	}
+	stock.Imported = imported
+	return sendJSON(w, http.StatusCreated, stock)
+}
+
+func (a *API) licensePoolStock(r *http.Request, pool string) (*licensePoolStock, *HTTPError) {
+	query := a.db.Model(&models.LicensePoolKey{}).Where("instance_id = ? AND pool = ?", gcontext.GetInstanceID(r.Context()), pool)
+	stock := &licensePoolStock{Pool: pool}
+	if result := query.Where("license_id = ''").Count(&stock.Available); result.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if result := query.Where("license_id <> ''").Count(&stock.Issued); result.Error != nil {
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return stock, nil
+}
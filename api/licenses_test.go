@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// licenseTest sells the product of the unpaid order with license keys from
+// the given source.
+func licenseTest(t *testing.T, source string) (*RouteTest, *memProvider) {
+	test := NewRouteTest(t)
+	test.Config.Payment.Stripe.Enabled = true
+	test.Config.Payment.Stripe.SecretKey = "secret"
+	require.NoError(t, test.DB.Model(&models.LineItem{}).Where("order_id = ?", "unpaid-order").Updates(map[string]interface{}{
+		"license_source": source,
+		"license_pool":   "i-can-fly",
+	}).Error)
+	return test, &memProvider{name: payments.StripeProvider}
+}
+
+func importLicenseKeys(test *RouteTest, csv string) *licensePoolStock {
+	recorder := test.TestEndpoint(http.MethodPost, "/licenses/pools/i-can-fly/keys", strings.NewReader(csv), testAdminToken("magical-unicorn", ""))
+	stock := &licensePoolStock{}
+	extractPayload(test.T, http.StatusCreated, recorder, stock)
+	return stock
+}
+
+func verifyLicense(test *RouteTest, key string) *licenseVerification {
+	body, err := json.Marshal(&licenseVerifyParams{Key: key})
+	require.NoError(test.T, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/licenses/verify", bytes.NewBuffer(body), nil)
+	verification := &licenseVerification{}
+	extractPayload(test.T, http.StatusOK, recorder, verification)
+	return verification
+}
+
+func orderLicenses(test *RouteTest) []models.License {
+	recorder := test.TestEndpoint(http.MethodGet, "/orders/unpaid-order/licenses", nil, test.Data.testUserToken)
+	licenses := []models.License{}
+	extractPayload(test.T, http.StatusOK, recorder, &licenses)
+	return licenses
+}
+
+func TestLicensesFromPool(t *testing.T) {
+	test, provider := licenseTest(t, models.LicensePoolSource)
+
+	stock := importLicenseKeys(test, "key,note\nAAAA-1111,first\nBBBB-2222\nAAAA-1111\n\nCCCC-3333\n")
+	assert.EqualValues(t, 3, stock.Imported)
+	assert.EqualValues(t, 3, stock.Available)
+	assert.EqualValues(t, 1, importLicenseKeys(test, "CCCC-3333\nDDDD-4444\n").Imported)
+
+	recorder := payUnpaidOrder(test, provider)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	licenses := orderLicenses(test)
+	require.Len(t, licenses, 2)
+	assert.Equal(t, "AAAA-1111", licenses[0].Key)
+	assert.Equal(t, "BBBB-2222", licenses[1].Key)
+	assert.Equal(t, "789-i-drive-at-night-012", licenses[0].Sku)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/licenses/pools/i-can-fly", nil, testAdminToken("magical-unicorn", ""))
+	extractPayload(t, http.StatusOK, recorder, stock)
+	assert.EqualValues(t, 2, stock.Available)
+	assert.EqualValues(t, 2, stock.Issued)
+
+	verification := verifyLicense(test, "AAAA-1111")
+	assert.True(t, verification.Valid)
+	assert.Equal(t, licenseActive, verification.Status)
+	assert.Equal(t, "789-i-drive-at-night-012", verification.Sku)
+	assert.False(t, verifyLicense(test, "CCCC-3333").Valid)
+	assert.Equal(t, licenseUnknown, verifyLicense(test, "CCCC-3333").Status)
+
+	t.Run("Refund", func(t *testing.T) {
+		tr := &models.Transaction{}
+		require.NoError(t, test.DB.Where("order_id = ? AND processor_id = ?", "unpaid-order", "charge-1").First(tr).Error)
+		body := jsonBody(t, map[string]interface{}{"amount": 1, "currency": "USD", "stripe_token": "123", "revoke": true})
+		recorder := providerRequest(test, provider, http.MethodPost, "/payments/"+tr.ID+"/refund", body, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		verification := verifyLicense(test, "AAAA-1111")
+		assert.False(t, verification.Valid)
+		assert.Equal(t, licenseRevoked, verification.Status)
+		assert.NotNil(t, verification.RevokedAt)
+	})
+}
+
+func TestLicensesSoldOut(t *testing.T) {
+	test, provider := licenseTest(t, models.LicensePoolSource)
+	importLicenseKeys(test, "AAAA-1111\n")
+
+	recorder := payUnpaidOrder(test, provider)
+	assert.Contains(t, recorder.Body.String(), "license_keys_sold_out")
+	validateError(t, http.StatusBadRequest, recorder)
+	assert.Equal(t, 0, provider.charges)
+
+	key := &models.LicensePoolKey{}
+	require.NoError(t, test.DB.Where("license_key = ?", "AAAA-1111").First(key).Error)
+	assert.Empty(t, key.LicenseID)
+}
+
+func TestLicensesChargeFailed(t *testing.T) {
+	test, provider := licenseTest(t, models.LicensePoolSource)
+	importLicenseKeys(test, "AAAA-1111\nBBBB-2222\n")
+	provider.fail = true
+
+	recorder := payUnpaidOrder(test, provider)
+	validateError(t, http.StatusInternalServerError, recorder)
+	assert.Equal(t, 1, provider.charges)
+
+	var issued int64
+	require.NoError(t, test.DB.Model(&models.LicensePoolKey{}).Where("license_id <> ''").Count(&issued).Error)
+	assert.EqualValues(t, 0, issued)
+	require.NoError(t, test.DB.Model(&models.License{}).Count(&issued).Error)
+	assert.EqualValues(t, 0, issued)
+}
+
+func TestLicensesSigned(t *testing.T) {
+	test, provider := licenseTest(t, models.LicenseSignedSource)
+
+	t.Run("NoSigningKey", func(t *testing.T) {
+		recorder := payUnpaidOrder(test, provider)
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.Equal(t, 0, provider.charges)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/licenses/public_key", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	test.Config.Licenses.SigningKey = base64.StdEncoding.EncodeToString(seed)
+
+	recorder := payUnpaidOrder(test, provider)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	licenses := orderLicenses(test)
+	require.Len(t, licenses, 2)
+	assert.NotEqual(t, licenses[0].Key, licenses[1].Key)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/licenses/public_key", nil, nil)
+	publicKey := map[string]string{}
+	extractPayload(t, http.StatusOK, recorder, &publicKey)
+	key, err := base64.StdEncoding.DecodeString(publicKey["public_key"])
+	require.NoError(t, err)
+
+	signed, err := models.VerifyLicenseKey(licenses[0].Key, ed25519.PublicKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, licenses[0].ID, signed.ID)
+	assert.Equal(t, "unpaid-order", signed.OrderID)
+	assert.Equal(t, "789-i-drive-at-night-012", signed.Sku)
+
+	assert.True(t, verifyLicense(test, licenses[0].Key).Valid)
+	tampered := strings.Replace(licenses[0].Key, ".", "x.", 1)
+	_, err = models.VerifyLicenseKey(tampered, ed25519.PublicKey(key))
+	assert.Error(t, err)
+	assert.Equal(t, licenseUnknown, verifyLicense(test, tampered).Status)
+}
+
+func TestLicensesAccess(t *testing.T) {
+	test := NewRouteTest(t)
+
+	recorder := test.TestEndpoint(http.MethodGet, "/orders/unpaid-order/licenses", nil, nil)
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/licenses/pools/i-can-fly", nil, test.Data.testUserToken)
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	assert.Empty(t, orderLicenses(test))
+}
@@ -126,9 +126,6 @@ func WithInstanceConfig(ctx context.Context, smtp conf.SMTPConfiguration, config
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating payment providers")
 	}
-	if len(provs) == 0 {
-		return nil, errors.Wrap(err, "No payment providers enabled")
-	}
 	ctx = gcontext.WithPaymentProviders(ctx, provs)
 
 	return ctx, nil
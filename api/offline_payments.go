@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+type paymentConfirmParams struct {
+	// Reference identifies the payment, like the reference of a bank
+	// transfer.
+	Reference string `json:"reference"`
+}
+
+// createOfflinePayment records a pending payment with the instructions to pay
+// an order outside of gocommerce, or returns the one the order already
+// awaits. The order stays unpaid until an admin confirms the payment.
+func (a *API) createOfflinePayment(w http.ResponseWriter, r *http.Request, tx *gorm.DB, order *models.Order, providerName string, offline payments.OfflineProvider) error {
+	// an order awaits a single payment, so asking again returns the same
+	// instructions
+	existing := &models.Transaction{}
+	result := tx.Where("order_id = ? AND type = ? AND status = ?", order.ID, models.ChargeTransactionType, models.PendingState).First(existing)
+	if result.Error == nil {
+		tx.Rollback()
+		if order.PaymentProcessor != providerName {
+			return badRequestError("This order already awaits a payment with '%s'", order.PaymentProcessor)
+		}
+		return sendJSON(w, http.StatusOK, existing)
+	} else if !result.RecordNotFound() {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	instructions, err := offline.Instructions(order.Total, order.Currency, order.ID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error creating payment instructions").WithInternalError(err)
+	}
+
+	tr := models.NewTransaction(order)
+	tr.Status = models.PendingState
+	tr.Instructions = instructions
+	if result := tx.Create(tr); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error creating transaction").WithInternalError(result.Error)
+	}
+	order.PaymentProcessor = providerName
+	if result := tx.Save(order); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order").WithInternalError(result.Error)
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error creating transaction").WithInternalError(rsp.Error)
+	}
+
+	getLogEntry(r).Infof("Awaiting %s payment %s", providerName, tr.ID)
+	return sendJSON(w, http.StatusOK, tr)
+}
+
+// PaymentConfirm marks a pending manual payment as paid, with a reference
+// like the one of the bank transfer. The order is then numbered and
+// completed like any other paid order. It is only available to admins.
+func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	params := &paymentConfirmParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.Reference == "" {
+		return badRequestError("Confirming a payment requires a 'reference'")
+	}
+
+	tx := a.db.Begin()
+	tr := &models.Transaction{}
+	if result := tx.First(tr, "id = ?", chi.URLParam(r, "payment_id")); result.Error != nil {
+		tx.Rollback()
+		if result.RecordNotFound() {
+			return notFoundError("Transaction not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if tr.Type != models.ChargeTransactionType || tr.Status != models.PendingState {
+		tx.Rollback()
+		return badRequestError("Only pending payments can be confirmed")
+	}
+
+	order := &models.Order{}
+	if result := tx.Preload("LineItems").Preload("BillingAddress").First(order, "id = ?", tr.OrderID); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if order.PaymentState == models.PaidState {
+		tx.Rollback()
+		return badRequestError("This order has already been paid")
+	}
+	if _, ok := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor].(payments.OfflineProvider); !ok {
+		tx.Rollback()
+		return badRequestError("Only payments made outside of gocommerce can be confirmed")
+	}
+
+	invoiceNumber, formattedNumber, httpErr := a.prepareOrderPayment(ctx, tx, order)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	before := auditSnapshot(tr)
+	tr.ProcessorID = params.Reference
+	tr.Status = models.PaidState
+	tx.Save(tr)
+	order.PaymentState = models.PaidState
+	order.InvoiceNumber = invoiceNumber
+	order.FormattedInvoiceNumber = formattedNumber
+	tx.Save(order)
+	a.orderPaid(ctx, tx, order, tr, log)
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "payment.confirm", "transaction", tr.ID, before, tr); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error confirming payment").WithInternalError(rsp.Error)
+	}
+
+	log.Infof("Confirmed payment %s with reference %s", tr.ID, tr.ProcessorID)
+	return sendJSON(w, http.StatusOK, tr)
+}
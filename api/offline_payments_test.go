@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const manualInstructions = "Transfer {{ .Amount }} {{ .Currency }} to DE89 3704 0044 0532 0130 00 with reference {{ .Reference }}"
+
+// payManually pays for the unpaid order with a bank transfer, which leaves
+// the payment pending.
+func payManually(test *RouteTest) *models.Transaction {
+	test.Config.Payment.Manual.Enabled = true
+	test.Config.Payment.Manual.Instructions = manualInstructions
+	tr := &models.Transaction{}
+	extractPayload(test.T, http.StatusOK, payUnpaidOrderWith(test, nil, map[string]interface{}{"provider": payments.ManualProvider}), tr)
+	return tr
+}
+
+func confirmPayment(test *RouteTest, id, reference string) *models.Transaction {
+	body := jsonBody(test.T, &paymentConfirmParams{Reference: reference})
+	recorder := test.TestEndpoint(http.MethodPost, "/payments/"+id+"/confirm", body, testAdminToken("magical-unicorn", ""))
+	tr := &models.Transaction{}
+	extractPayload(test.T, http.StatusOK, recorder, tr)
+	return tr
+}
+
+func TestManualPayment(t *testing.T) {
+	test := NewRouteTest(t)
+	tr := payManually(test)
+	assert.Equal(t, models.PendingState, tr.Status)
+	assert.Equal(t, "Transfer 0.24 USD to DE89 3704 0044 0532 0130 00 with reference unpaid-order", tr.Instructions)
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+	assert.Equal(t, models.PendingState, order.PaymentState)
+	assert.Equal(t, payments.ManualProvider, order.PaymentProcessor)
+	assert.Zero(t, order.InvoiceNumber)
+	assert.Equal(t, 0, countEmails(test, models.OrderConfirmationEmail))
+
+	// paying again returns the payment the order already awaits
+	again := payManually(test)
+	assert.Equal(t, tr.ID, again.ID)
+	var pending int
+	require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ? AND status = ?", "unpaid-order", models.PendingState).Count(&pending).Error)
+	assert.Equal(t, 1, pending)
+
+	tr = confirmPayment(test, tr.ID, "TRANSFER-123")
+	assert.Equal(t, models.PaidState, tr.Status)
+	assert.Equal(t, "TRANSFER-123", tr.ProcessorID)
+
+	require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+	assert.NotZero(t, order.InvoiceNumber)
+	assert.Equal(t, 1, countEmails(test, models.OrderConfirmationEmail))
+	assert.Equal(t, 1, countEmails(test, models.OrderReceivedEmail))
+
+	body := jsonBody(t, &paymentConfirmParams{Reference: "TRANSFER-123"})
+	recorder := test.TestEndpoint(http.MethodPost, "/payments/"+tr.ID+"/confirm", body, testAdminToken("magical-unicorn", ""))
+	validateError(t, http.StatusBadRequest, recorder)
+}
+
+func TestManualPaymentConfirmErrors(t *testing.T) {
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		tr := payManually(test)
+		body := jsonBody(t, &paymentConfirmParams{Reference: "TRANSFER-123"})
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+tr.ID+"/confirm", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NoReference", func(t *testing.T) {
+		test := NewRouteTest(t)
+		tr := payManually(test)
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+tr.ID+"/confirm", jsonBody(t, &paymentConfirmParams{}), testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("ProviderPayment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := jsonBody(t, &paymentConfirmParams{Reference: "TRANSFER-123"})
+		recorder := test.TestEndpoint(http.MethodPost, "/payments/"+test.Data.firstTransaction.ID+"/confirm", body, testAdminToken("magical-unicorn", ""))
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("WithBalance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Manual.Enabled = true
+		recorder := payUnpaidOrderWith(test, nil, map[string]interface{}{"provider": payments.ManualProvider, "use_store_credit": true})
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestWithInstanceConfigWithoutProviders(t *testing.T) {
+	config := &conf.Configuration{}
+	ctx, err := WithInstanceConfig(context.Background(), conf.SMTPConfiguration{}, config, "")
+	require.NoError(t, err)
+	assert.Empty(t, gcontext.GetPaymentProviders(ctx))
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/go-chi/chi"
@@ -14,6 +16,7 @@ import (
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/mailer"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
@@ -49,6 +52,8 @@ type orderRequestParams struct {
 
 	VATNumber string `json:"vatnumber"`
 
+	Locale string `json:"locale"`
+
 	MetaData map[string]interface{} `json:"meta"`
 
 	LineItems []*orderLineItem `json:"line_items"`
@@ -57,6 +62,12 @@ type orderRequestParams struct {
 
 	FulfillmentState string `json:"fulfillment_state"`
 
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number"`
+	TrackingURL    string `json:"tracking_url"`
+
+	State string `json:"state"`
+
 	CouponCode string `json:"coupon"`
 }
 
@@ -189,7 +200,6 @@ func (a *API) ReceiptView(w http.ResponseWriter, r *http.Request) error {
 func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	id := gcontext.GetOrderID(ctx)
-	log := getLogEntry(r)
 
 	params := &receiptParams{}
 	jsonDecoder := json.NewDecoder(r.Body)
@@ -210,19 +220,20 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 		return unauthorizedError("Order History Requires Authentication")
 	}
 
-	if params.Email != "" {
-		order.Email = params.Email
-	}
-
-	mailer := gcontext.GetMailer(ctx)
+	tx := a.db.Begin()
 	for _, transaction := range order.Transactions {
 		if transaction.Type == models.ChargeTransactionType {
-			transaction.Order = order
-			if mailErr := mailer.OrderConfirmationMail(transaction); mailErr != nil {
-				log.WithError(mailErr).Errorf("Error sending order confirmation mail")
+			email := models.NewTransactionEmail(models.OrderConfirmationEmail, transaction)
+			email.To = params.Email
+			if err := models.EnqueueEmail(tx, email); err != nil {
+				tx.Rollback()
+				return internalServerError("Error queuing order confirmation mail").WithInternalError(err)
 			}
 		}
 	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error queuing order confirmation mail").WithInternalError(rsp.Error)
+	}
 
 	return sendJSON(w, http.StatusOK, map[string]string{})
 }
@@ -305,7 +316,6 @@ func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
 // OrderCreate endpoint
 func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
-	config := gcontext.GetConfig(ctx)
 	instanceID := gcontext.GetInstanceID(ctx)
 
 	params := &orderRequestParams{Currency: "USD"}
@@ -318,6 +328,16 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	claims := gcontext.GetClaims(ctx)
 	order := models.NewOrder(instanceID, params.SessionID, params.Email, params.Currency)
 
+	if params.Locale == "" {
+		params.Locale = acceptedLocale(r)
+	}
+	if params.Locale != "" {
+		if !mailer.ValidLocale(params.Locale) {
+			return badRequestError("Invalid locale: %s", params.Locale)
+		}
+		order.Locale = params.Locale
+	}
+
 	if params.CouponCode != "" {
 		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
 		if err != nil {
@@ -400,19 +420,41 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	tx.Create(order)
 	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
-	if config.Webhooks.Order != "" {
-		hook, err := models.NewHook("order", config.SiteURL, config.Webhooks.Order, order.UserID, config.Webhooks.Secret, order)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
+	bestEffort(tx, log, "Failed to process webhook", func() error {
+		return a.triggerWebhooks(ctx, tx, models.WebhookOrderCreated, order.UserID, order)
+	})
+	if delay := gcontext.GetConfig(ctx).Mailer.AbandonedCartDelay; delay > 0 && order.Email != "" && order.Total > 0 {
+		at := time.Now().Add(time.Duration(delay) * time.Hour)
+		bestEffort(tx, log, "Error queuing abandoned cart email", func() error {
+			return models.EnqueueEmailAt(tx, models.NewOrderEmail(models.AbandonedCartEmail, order), at)
+		})
+	}
+	if expireAfter := gcontext.GetConfig(ctx).Orders.ExpireAfter; expireAfter > 0 && order.Total > 0 {
+		if err := models.ScheduleOrderExpiry(tx, order, time.Now().Add(time.Duration(expireAfter)*time.Hour)); err != nil {
+			tx.Rollback()
+			return internalServerError("Error scheduling order expiry").WithInternalError(err)
 		}
-		tx.Save(hook)
 	}
-	tx.Commit()
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error creating order").WithInternalError(rsp.Error)
+	}
 
 	log.Infof("Successfully created order %s", order.ID)
 	return sendJSON(w, http.StatusCreated, order)
 }
 
+// acceptedLocale returns the preferred language of the Accept-Language header,
+// or an empty string if it has none we can use.
+func acceptedLocale(r *http.Request) string {
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag = strings.TrimSpace(strings.Split(tag, ";")[0])
+		if mailer.ValidLocale(tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
 // OrderUpdate will allow an ADMIN only to update the details of a record
 // it is also important to note that it will not let modification of an order if the
 // order is no longer pending.
@@ -424,8 +466,9 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	orderID := gcontext.GetOrderID(ctx)
 	log := getLogEntry(r)
 	claims := gcontext.GetClaims(ctx)
-	config := gcontext.GetConfig(ctx)
 	changes := []string{}
+	shipped := false
+	cancelled := false
 
 	orderParams := new(orderRequestParams)
 	err := json.NewDecoder(r.Body).Decode(orderParams)
@@ -444,6 +487,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
 	}
 
+	before := auditSnapshot(existingOrder)
 	alreadyPaid := existingOrder.PaymentState == models.PaidState
 
 	//
@@ -534,10 +578,42 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			tx.Rollback()
 			return badRequestError("Bad fulfillment state: " + orderParams.FulfillmentState)
 		}
+		shipped = orderParams.FulfillmentState == models.ShippedState && existingOrder.FulfillmentState != models.ShippedState
 		existingOrder.FulfillmentState = orderParams.FulfillmentState
 		changes = append(changes, "fulfillment_state")
 	}
 
+	if orderParams.Carrier != "" {
+		existingOrder.Carrier = orderParams.Carrier
+		changes = append(changes, "carrier")
+	}
+	if orderParams.TrackingNumber != "" {
+		existingOrder.TrackingNumber = orderParams.TrackingNumber
+		changes = append(changes, "tracking_number")
+	}
+	if orderParams.TrackingURL != "" {
+		existingOrder.TrackingURL = orderParams.TrackingURL
+		changes = append(changes, "tracking_url")
+	}
+
+	if orderParams.State != "" && orderParams.State != existingOrder.State {
+		if orderParams.State != models.CancelledState {
+			tx.Rollback()
+			return badRequestError("Bad order state: " + orderParams.State)
+		}
+		if existingOrder.FulfillmentState == models.ShippedState {
+			tx.Rollback()
+			return badRequestError("Can't cancel an order that has been shipped")
+		}
+		if existingOrder.PaymentState == models.PaidState {
+			tx.Rollback()
+			return badRequestError("Can't cancel an order that has been paid, refund its payment instead")
+		}
+		cancelled = true
+		existingOrder.State = orderParams.State
+		changes = append(changes, "state")
+	}
+
 	//
 	// handle the line items
 	//
@@ -566,13 +642,26 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	models.LogEvent(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, changes)
-	if config.Webhooks.Update != "" {
-		// TODO should this be claims.Subject or existingOrder.UserID ?
-		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, claims.Subject, config.Webhooks.Secret, existingOrder)
-		if err != nil {
-			log.WithError(err).Error("Failed to process web hook")
-		}
-		tx.Save(hook)
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "order.update", "order", existingOrder.ID, before, existingOrder); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	// TODO should this be claims.Subject or existingOrder.UserID ?
+	bestEffort(tx, log, "Failed to process web hook", func() error {
+		return a.triggerWebhooks(ctx, tx, models.WebhookOrderUpdated, claims.Subject, existingOrder)
+	})
+	if shipped {
+		bestEffort(tx, log, "Failed to process web hook", func() error {
+			return a.triggerWebhooks(ctx, tx, models.WebhookShipmentCreated, existingOrder.UserID, existingOrder)
+		})
+		bestEffort(tx, log, "Error queuing order shipped email", func() error {
+			return models.EnqueueEmail(tx, models.NewOrderEmail(models.OrderShippedEmail, existingOrder))
+		})
+	}
+	if cancelled {
+		bestEffort(tx, log, "Error queuing order cancelled email", func() error {
+			return models.EnqueueEmail(tx, models.NewOrderEmail(models.OrderCancelledEmail, existingOrder))
+		})
 	}
 	if rsp := tx.Commit(); rsp.Error != nil {
 		tx.Rollback()
@@ -658,13 +747,6 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 		return internalServerError("Error processing line item").WithInternalError(sharedErr.err)
 	}
 
-	for _, item := range order.LineItems {
-		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
-		if err := tx.Save(&item).Error; err != nil {
-			return internalServerError("Error creating line item").WithInternalError(err)
-		}
-	}
-
 	for _, download := range order.Downloads {
 		if err := tx.Create(&download).Error; err != nil {
 			return internalServerError("Error creating download item").WithInternalError(err)
@@ -676,7 +758,14 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 		return internalServerError(err.Error()).WithInternalError(err)
 	}
 
+	// line items are saved after calculating the total, which sets their
+	// net prices and taxes
 	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx))
+	for _, item := range order.LineItems {
+		if err := tx.Save(&item).Error; err != nil {
+			return internalServerError("Error creating line item").WithInternalError(err)
+		}
+	}
 	return nil
 }
 
@@ -784,6 +873,8 @@ func orderQuery(db *gorm.DB) *gorm.DB {
 	return db.
 		Preload("LineItems").
 		Preload("Downloads").
+		Preload("Licenses").
+		Preload("GiftCards").
 		Preload("ShippingAddress").
 		Preload("BillingAddress").
 		Preload("Transactions")
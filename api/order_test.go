@@ -16,6 +16,7 @@ import (
 
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
 	"github.com/stretchr/testify/require"
 )
 
@@ -129,6 +130,42 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, total, order.Total, fmt.Sprintf("Total should be 1105, was %v", order.Total))
 		assert.Equal(t, taxes, order.Taxes, fmt.Sprintf("Total should be 106, was %v", order.Total))
 	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Orders.ExpireAfter = 48
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User",
+				"address1": "610 22nd Street",
+				"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+
+		job := &models.Job{}
+		require.NoError(t, test.DB.Where("type = ?", models.OrderExpiryJobType).First(job).Error)
+		payload := models.OrderExpiryJob{}
+		require.NoError(t, job.DecodePayload(&payload))
+		assert.Equal(t, order.ID, payload.OrderID)
+		assert.True(t, job.RunAfter.After(time.Now().Add(47*time.Hour)))
+	})
+}
+
+func TestOrderExpired(t *testing.T) {
+	test := NewRouteTest(t)
+	expired, err := models.ExpireOrder(test.DB, test.Data.unpaidOrder.ID)
+	require.NoError(t, err)
+	require.True(t, expired)
+
+	recorder := payUnpaidOrder(test, &memProvider{name: payments.StripeProvider})
+	assert.Contains(t, recorder.Body.String(), "cancelled")
+	validateError(t, http.StatusBadRequest, recorder)
 }
 
 // ------------------------------------------------------------------------------------------------
@@ -143,7 +180,7 @@ func TestOrdersList(t *testing.T) {
 
 		orders := []models.Order{}
 		extractPayload(t, http.StatusOK, recorder, &orders)
-		assert.Len(t, orders, 2)
+		assert.Len(t, orders, 3)
 		validateAllOrders(t, orders, test.Data)
 	})
 	t.Run("AsStranger", func(t *testing.T) {
@@ -169,7 +206,7 @@ func TestOrdersList(t *testing.T) {
 
 			orders := []models.Order{}
 			extractPayload(t, http.StatusOK, recorder, &orders)
-			assert.Len(t, orders, 2)
+			assert.Len(t, orders, 3)
 		})
 		t.Run("EmailFilterAsTheUserEmptyResponse", func(t *testing.T) {
 			test := NewRouteTest(t)
@@ -236,7 +273,7 @@ func TestUserOrdersList(t *testing.T) {
 
 		orders := []models.Order{}
 		extractPayload(t, http.StatusOK, recorder, &orders)
-		assert.Len(t, orders, 2)
+		assert.Len(t, orders, 3)
 		validateAllOrders(t, orders, test.Data)
 	})
 	t.Run("NotWithAdminRights", func(t *testing.T) {
@@ -672,6 +709,10 @@ func validateAllOrders(t *testing.T, actual []models.Order, expected *TestData)
 			validateOrder(t, expected.secondOrder, &o)
 			validateAddress(t, expected.secondOrder.BillingAddress, o.BillingAddress)
 			validateAddress(t, expected.secondOrder.ShippingAddress, o.ShippingAddress)
+		case expected.unpaidOrder.ID:
+			validateOrder(t, expected.unpaidOrder, &o)
+			validateAddress(t, expected.unpaidOrder.BillingAddress, o.BillingAddress)
+			validateAddress(t, expected.unpaidOrder.ShippingAddress, o.ShippingAddress)
 		default:
 			assert.Fail(t, fmt.Sprintf("unexpected order: %+v\n", o))
 		}
@@ -68,6 +68,50 @@ func parseUserQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	return parseTimeQueryParams(query, params)
 }
 
+func parseAuditLogQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	query = addFilters(query, query.NewScope(models.AuditLog{}).QuotedTableName(), params, []string{
+		"actor_id",
+		"request_id",
+		"action",
+		"model_type",
+		"model_id",
+	})
+
+	return parseTimeQueryParams(query, params)
+}
+
+func parseHookQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	query = addFilters(query, query.NewScope(models.Hook{}).QuotedTableName(), params, []string{
+		"type",
+		"subscription_id",
+		"user_id",
+	})
+
+	if status := params.Get("status"); status != "" {
+		switch status {
+		case models.HookPending:
+			query = query.Where("done = ?", false)
+		case models.HookSucceeded:
+			query = query.Where("done = ? AND failed = ?", true, false)
+		case models.HookFailed:
+			query = query.Where("done = ? AND failed = ?", true, true)
+		default:
+			return nil, fmt.Errorf("bad value for 'status' parameter: %s", status)
+		}
+	}
+
+	return parseTimeQueryParams(query, params)
+}
+
+func parseEmailQueryParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+	query = addFilters(query, query.NewScope(models.Email{}).QuotedTableName(), params, []string{
+		"type",
+		"status",
+		"order_id",
+	})
+	return parseTimeQueryParams(query, params)
+}
+
 func sortField(value string) string {
 	return sortFields[value]
 }
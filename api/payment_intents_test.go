@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stripeIntents stands in for the PaymentIntents API of Stripe.
+type stripeIntents struct {
+	amount    string
+	currency  string
+	status    string
+	confirmed int
+	// noCharge leaves out the charge of the intent
+	noCharge bool
+}
+
+func (si *stripeIntents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, _, _ := r.BasicAuth(); user != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error": {"type": "invalid_request_error", "message": "Invalid API Key provided"}}`)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents":
+		si.amount = r.FormValue("amount")
+		si.currency = r.FormValue("currency")
+		si.status = "requires_payment_method"
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/payment_intents/pi_1/confirm":
+		si.confirmed++
+		si.status = "succeeded"
+	case r.Method == http.MethodGet && r.URL.Path == "/v1/payment_intents/pi_1":
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error": {"type": "invalid_request_error", "message": "No such payment_intent"}}`)
+		return
+	}
+	charge := "ch_1"
+	if si.noCharge {
+		charge = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id": "pi_1", "amount": %s, "currency": "%s", "status": "%s", "client_secret": "pi_1_secret_2", "latest_charge": "%s"}`, si.amount, si.currency, si.status, charge)
+}
+
+// preauthorizeWithIntent preauthorizes the unpaid order with a PaymentIntent
+// of the stand-in server, which the caller closes.
+func preauthorizeWithIntent(test *RouteTest) (*stripeIntents, *httptest.Server) {
+	intents := &stripeIntents{}
+	server := httptest.NewServer(intents)
+	test.Config.Payment.Providers = conf.PaymentProviders{
+		payments.StripeProvider: json.RawMessage(`{"secret_key": "secret", "api_url": "` + server.URL + `/v1"}`),
+	}
+
+	body := jsonBody(test.T, map[string]interface{}{"provider": payments.StripeProvider})
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, baseURL+"/orders/unpaid-order/payments/preauthorize", body)
+	req.Header.Set("Content-Type", "application/json")
+	require.NoError(test.T, signHTTPRequest(req, test.Data.testUserToken, test.Config.JWT.Secret))
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler.ServeHTTP(recorder, req)
+	result := &payments.PreauthorizationResult{}
+	extractPayload(test.T, http.StatusOK, recorder, result)
+	assert.Equal(test.T, "pi_1", result.ID)
+	assert.Equal(test.T, "pi_1_secret_2", result.ClientSecret)
+	assert.Equal(test.T, "24", intents.amount)
+	assert.Equal(test.T, "usd", intents.currency)
+	return intents, server
+}
+
+func payWithIntent(test *RouteTest, intentID string) *httptest.ResponseRecorder {
+	return payUnpaidOrderWith(test, nil, map[string]interface{}{"stripe_payment_intent_id": intentID})
+}
+
+func TestPaymentIntents(t *testing.T) {
+	t.Run("Succeeded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "succeeded"
+
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, payWithIntent(test, "pi_1"), tr)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.Equal(t, "ch_1", tr.ProcessorID)
+		assert.Equal(t, 0, intents.confirmed)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		assert.Equal(t, payments.StripeProvider, order.PaymentProcessor)
+
+		// a confirmed intent can't pay twice
+		require.NoError(t, test.DB.Model(order).Update("payment_state", models.PendingState).Error)
+		validateError(t, http.StatusInternalServerError, payWithIntent(test, "pi_1"))
+	})
+
+	t.Run("WithoutCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "succeeded"
+		intents.noCharge = true
+
+		recorder := payWithIntent(test, "pi_1")
+		assert.Contains(t, recorder.Body.String(), "has no charge")
+		validateError(t, http.StatusInternalServerError, recorder)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+
+	t.Run("RequiresConfirmation", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "requires_confirmation"
+
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, payWithIntent(test, "pi_1"), tr)
+		assert.Equal(t, "ch_1", tr.ProcessorID)
+		assert.Equal(t, 1, intents.confirmed)
+	})
+
+	t.Run("RequiresAction", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "requires_action"
+
+		recorder := payWithIntent(test, "pi_1")
+		assert.Contains(t, recorder.Body.String(), "authenticate")
+		validateError(t, http.StatusInternalServerError, recorder)
+
+		order := &models.Order{}
+		require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+		assert.Equal(t, models.PendingState, order.PaymentState)
+	})
+
+	t.Run("AmountMismatch", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "succeeded"
+		intents.amount = "1"
+		validateError(t, http.StatusInternalServerError, payWithIntent(test, "pi_1"))
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		test := NewRouteTest(t)
+		_, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		require.NoError(t, test.DB.Model(test.Data.unpaidOrder).Update("preauthorized_payment_id", "pi_2").Error)
+		recorder := payWithIntent(test, "pi_2")
+		assert.Contains(t, recorder.Body.String(), "No such payment_intent")
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+
+	t.Run("OtherOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "succeeded"
+		require.NoError(t, test.DB.Model(test.Data.unpaidOrder).Update("preauthorized_payment_id", "pi_2").Error)
+		validateError(t, http.StatusBadRequest, payWithIntent(test, "pi_1"))
+		assert.Equal(t, 0, intents.confirmed)
+	})
+
+	t.Run("WithBalance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		intents, server := preauthorizeWithIntent(test)
+		defer server.Close()
+		intents.status = "succeeded"
+		card := newGiftCard(test, 10)
+		recorder := payUnpaidOrderWith(test, nil, map[string]interface{}{"stripe_payment_intent_id": "pi_1", "gift_card_code": card.Code})
+		assert.Contains(t, recorder.Body.String(), "gift card or store credit")
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Equal(t, 0, intents.confirmed)
+		assert.EqualValues(t, 10, balanceOf(test, card.ID))
+	})
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+type paymentMethodParams struct {
+	ProviderType string `json:"provider"`
+}
+
+// PaymentMethodList lists the saved payment methods of a user.
+func (a *API) PaymentMethodList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	if gcontext.GetUser(ctx) == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	methods := []models.PaymentMethod{}
+	if result := a.db.Where("user_id = ?", userID).Order("created_at").Find(&methods); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, methods)
+}
+
+// PaymentMethodCreate saves a payment method of a user with a provider, like
+// the card of a stripe_token, so the user can pay with it later.
+func (a *API) PaymentMethodCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	params := &paymentMethodParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.ProviderType == "" {
+		return badRequestError("Saving a payment method requires specifying a 'provider'")
+	}
+	saver, err := savedMethodProvider(ctx, strings.ToLower(params.ProviderType))
+	if err != nil {
+		return badRequestError("%v", err)
+	}
+
+	tx := a.db.Begin()
+	method, httpErr := a.savePaymentMethod(ctx, tx, r, saver, strings.ToLower(params.ProviderType), user.ID, user.Email)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "payment_method.create", "payment_method", method.ID, nil, method); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving payment method").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, method)
+}
+
+// PaymentMethodDelete removes a saved payment method from the provider.
+// Subscriptions renewed with it must be paid for with another method.
+func (a *API) PaymentMethodDelete(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	userID := gcontext.GetUserID(ctx)
+	methodID := chi.URLParam(r, "method_id")
+	logEntrySetField(r, "payment_method_id", methodID)
+
+	method := &models.PaymentMethod{}
+	if result := a.db.Where("id = ? AND user_id = ?", methodID, userID).First(method); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Payment method not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	saver, err := savedMethodProvider(ctx, method.Provider)
+	if err != nil {
+		return internalServerError("Error removing payment method").WithInternalError(err)
+	}
+	if err := saver.RemoveMethod(ctx, method.CustomerID, method.ProviderMethodID); err != nil {
+		return internalServerError("Error removing payment method").WithInternalError(err)
+	}
+
+	tx := a.db.Begin()
+	if rsp := tx.Delete(method); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error removing payment method").WithInternalError(rsp.Error)
+	}
+	if rsp := tx.Model(&models.Subscription{}).Where("payment_method_id = ?", method.ID).Update("payment_method_id", ""); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error removing payment method").WithInternalError(rsp.Error)
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "payment_method.delete", "payment_method", method.ID, method, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error removing payment method").WithInternalError(rsp.Error)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func savedMethodProvider(ctx context.Context, name string) (payments.SavedMethodProvider, error) {
+	provider := gcontext.GetPaymentProviders(ctx)[name]
+	if provider == nil {
+		return nil, fmt.Errorf("Payment provider '%s' not configured", name)
+	}
+	saver, ok := provider.(payments.SavedMethodProvider)
+	if !ok {
+		return nil, fmt.Errorf("Payment provider '%s' can't save payment methods", name)
+	}
+	return saver, nil
+}
+
+// savePaymentMethod saves the payment method in the request with the
+// provider. All methods of a user with a provider belong to the same
+// customer of the provider.
+func (a *API) savePaymentMethod(ctx context.Context, tx *gorm.DB, r *http.Request, saver payments.SavedMethodProvider, provider, userID, email string) (*models.PaymentMethod, *HTTPError) {
+	existing := &models.PaymentMethod{}
+	if result := tx.Where("user_id = ? AND provider = ?", userID, provider).First(existing); result.Error != nil && !result.RecordNotFound() {
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	saved, err := saver.SaveMethod(ctx, r, existing.CustomerID, email)
+	if err != nil {
+		return nil, badRequestError("Error saving payment method: %v", err)
+	}
+	method := models.NewPaymentMethod(gcontext.GetInstanceID(ctx), userID, provider, saved)
+	if result := tx.Create(method); result.Error != nil {
+		return nil, internalServerError("Error saving payment method").WithInternalError(result.Error)
+	}
+	return method, nil
+}
+
+// discardPaymentMethod removes a payment method that was saved for a
+// payment that didn't go through from the provider again.
+func discardPaymentMethod(ctx context.Context, r *http.Request, method *models.PaymentMethod) {
+	saver, err := savedMethodProvider(ctx, method.Provider)
+	if err == nil {
+		err = saver.RemoveMethod(ctx, method.CustomerID, method.ProviderMethodID)
+	}
+	if err != nil {
+		getLogEntry(r).WithError(err).WithField("payment_method_id", method.ID).Error("Error removing payment method of a failed payment")
+	}
+}
+
+// orderPaymentMethod loads the saved payment method an order is paid with,
+// or saves the one in the request if the customer wants to keep it, and
+// returns a charger for it.
+func (a *API) orderPaymentMethod(ctx context.Context, tx *gorm.DB, r *http.Request, order *models.Order, provider string, params *PaymentParams) (*models.PaymentMethod, payments.Charger, *HTTPError) {
+	if order.UserID == "" {
+		return nil, nil, badRequestError("Only logged in customers can pay with saved payment methods")
+	}
+	saver, err := savedMethodProvider(ctx, provider)
+	if err != nil {
+		return nil, nil, badRequestError("%v", err)
+	}
+
+	var method *models.PaymentMethod
+	if params.PaymentMethodID != "" {
+		method = &models.PaymentMethod{}
+		if result := tx.Where("id = ? AND user_id = ? AND provider = ?", params.PaymentMethodID, order.UserID, provider).First(method); result.Error != nil {
+			if result.RecordNotFound() {
+				return nil, nil, notFoundError("Payment method not found")
+			}
+			return nil, nil, internalServerError("Error during database query").WithInternalError(result.Error)
+		}
+	} else {
+		var httpErr *HTTPError
+		method, httpErr = a.savePaymentMethod(ctx, tx, r, saver, provider, order.UserID, order.Email)
+		if httpErr != nil {
+			return nil, nil, httpErr
+		}
+	}
+
+	charge, err := saver.NewSavedMethodCharger(ctx, method.CustomerID, method.ProviderMethodID)
+	if err != nil {
+		if params.PaymentMethodID == "" {
+			discardPaymentMethod(ctx, r, method)
+		}
+		return nil, nil, badRequestError("Error creating payment provider: %v", err)
+	}
+	return method, charge, nil
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/netlify/gocommerce/payments/fake"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func jsonBody(t *testing.T, body interface{}) *bytes.Buffer {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	return bytes.NewBuffer(data)
+}
+
+func addPaymentMethod(test *RouteTest, provider payments.Provider, token string) *models.PaymentMethod {
+	url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+	body := jsonBody(test.T, map[string]string{"provider": payments.StripeProvider, "stripe_token": token})
+	recorder := providerRequest(test, provider, http.MethodPost, url, body, test.Data.testUserToken)
+	method := &models.PaymentMethod{}
+	extractPayload(test.T, http.StatusCreated, recorder, method)
+	return method
+}
+
+func listPaymentMethods(test *RouteTest) []models.PaymentMethod {
+	recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods", nil, test.Data.testUserToken)
+	methods := []models.PaymentMethod{}
+	extractPayload(test.T, http.StatusOK, recorder, &methods)
+	return methods
+}
+
+func TestPaymentMethods(t *testing.T) {
+	test := NewRouteTest(t)
+	provider := &memProvider{name: payments.StripeProvider}
+
+	first := addPaymentMethod(test, provider, "tok_1")
+	assert.Equal(t, test.Data.testUser.ID, first.UserID)
+	assert.Equal(t, payments.StripeProvider, first.Provider)
+	assert.Equal(t, "4242", first.Last4)
+	assert.EqualValues(t, 2030, first.ExpYear)
+	second := addPaymentMethod(test, provider, "tok_2")
+	assert.Equal(t, 1, provider.customers)
+
+	stored := &models.PaymentMethod{}
+	require.NoError(t, test.DB.First(stored, "id = ?", second.ID).Error)
+	assert.Equal(t, "cus_1", stored.CustomerID)
+	assert.Equal(t, "card_tok_2", stored.ProviderMethodID)
+
+	methods := listPaymentMethods(test)
+	require.Len(t, methods, 2)
+	assert.Equal(t, first.ID, methods[0].ID)
+
+	t.Run("OtherUser", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/payment_methods", nil, testToken("stranger", "stranger@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NoToken", func(t *testing.T) {
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods"
+		body := jsonBody(t, map[string]string{"provider": payments.StripeProvider})
+		recorder := providerRequest(test, provider, http.MethodPost, url, body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := &models.Subscription{ID: "subscription-1", UserID: test.Data.testUser.ID, PaymentMethodID: first.ID}
+		require.NoError(t, test.DB.Create(s).Error)
+
+		url := "/users/" + test.Data.testUser.ID + "/payment_methods/" + first.ID
+		recorder := providerRequest(test, provider, http.MethodDelete, url, nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusNoContent, recorder.Code, recorder.Body.String())
+		assert.Equal(t, []string{"card_tok_1"}, provider.removed)
+
+		methods := listPaymentMethods(test)
+		require.Len(t, methods, 1)
+		assert.Equal(t, second.ID, methods[0].ID)
+		require.NoError(t, test.DB.First(s, "id = ?", s.ID).Error)
+		assert.Empty(t, s.PaymentMethodID)
+
+		recorder = providerRequest(test, provider, http.MethodDelete, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestPaymentCreateWithSavedMethod(t *testing.T) {
+	t.Run("Save", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "tok_1", "save_payment_method": true})
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, []string{"card_tok_1"}, provider.charged)
+
+		methods := listPaymentMethods(test)
+		require.Len(t, methods, 1)
+		assert.Equal(t, methods[0].ID, tr.PaymentMethodID)
+	})
+
+	t.Run("SaveFailedCharge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		provider.fail = true
+
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "tok_1", "save_payment_method": true})
+		validateError(t, http.StatusInternalServerError, recorder)
+		assert.Equal(t, []string{"card_tok_1"}, provider.removed)
+		assert.Empty(t, listPaymentMethods(test))
+	})
+
+	t.Run("Saved", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		method := addPaymentMethod(test, provider, "tok_1")
+
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"payment_method_id": method.ID})
+		tr := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, method.ID, tr.PaymentMethodID)
+		assert.Equal(t, []string{"card_tok_1"}, provider.charged)
+	})
+
+	t.Run("OtherUsersMethod", func(t *testing.T) {
+		test := NewRouteTest(t)
+		provider := &memProvider{name: payments.StripeProvider}
+		method := &models.PaymentMethod{ID: "other-method", UserID: "stranger", Provider: payments.StripeProvider, ProviderMethodID: "card_other"}
+		require.NoError(t, test.DB.Create(method).Error)
+
+		recorder := payUnpaidOrderWith(test, provider, map[string]interface{}{"payment_method_id": method.ID})
+		validateError(t, http.StatusNotFound, recorder)
+		assert.Empty(t, provider.charged)
+	})
+
+	t.Run("NotSupported", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Payment.Providers = conf.PaymentProviders{fake.ProviderName: json.RawMessage(`{"enabled": true}`)}
+		fake.Reset("")
+
+		recorder := payUnpaidOrderWith(test, nil, map[string]interface{}{"provider": fake.ProviderName, "fake_token": fake.TokenSuccess, "save_payment_method": true})
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Empty(t, fake.CurrentState("").Charges)
+	})
+}
@@ -2,17 +2,20 @@ package api
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"mime"
@@ -22,6 +25,7 @@ import (
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
+	"github.com/netlify/gocommerce/payments/manual"
 	"github.com/netlify/gocommerce/payments/paypal"
 	"github.com/netlify/gocommerce/payments/stripe"
 )
@@ -32,6 +36,22 @@ type PaymentParams struct {
 	Currency     string `json:"currency"`
 	ProviderType string `json:"provider"`
 	Description  string `json:"description"`
+
+	// PaymentMethodID pays with a saved payment method of the user, and
+	// SavePaymentMethod saves the one of the payment for later.
+	PaymentMethodID   string `json:"payment_method_id"`
+	SavePaymentMethod bool   `json:"save_payment_method"`
+
+	// GiftCardCode and UseStoreCredit pay for as much of an order as their
+	// balance covers, and the provider charges the rest.
+	GiftCardCode   string `json:"gift_card_code"`
+	UseStoreCredit bool   `json:"use_store_credit"`
+
+	// StoreCredit refunds a payment as store credit of the customer.
+	StoreCredit bool `json:"store_credit"`
+	// Revoke revokes the downloads and licenses of an order on a partial
+	// refund. They're always revoked when the order is refunded in full.
+	Revoke bool `json:"revoke"`
 }
 
 // PaymentListForUser is the endpoint for listing transactions for a user.
@@ -84,25 +104,35 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	log := getLogEntry(r)
-	config := gcontext.GetConfig(ctx)
-	mailer := gcontext.GetMailer(ctx)
 
 	params := PaymentParams{Currency: "USD"}
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
 	}
-	if params.ProviderType == "" {
+	useBalance := params.GiftCardCode != "" || params.UseStoreCredit
+	if params.ProviderType == "" && !useBalance {
 		return badRequestError("Creating a payment requires specifying a 'provider'")
 	}
 
-	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+	var provider payments.Provider
+	if params.ProviderType != "" {
+		provider = gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
+		if provider == nil {
+			return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+		}
 	}
-	charge, err := provider.NewCharger(ctx, r)
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+	offline, isOffline := provider.(payments.OfflineProvider)
+	if isOffline && useBalance {
+		return badRequestError("Payments with '%s' can't be combined with a balance", params.ProviderType)
+	}
+	useSavedMethod := provider != nil && (params.PaymentMethodID != "" || params.SavePaymentMethod)
+	var charge payments.Charger
+	if provider != nil && !useSavedMethod && !isOffline {
+		charge, err = provider.NewCharger(ctx, r)
+		if err != nil {
+			return badRequestError("Error creating payment provider: %v", err)
+		}
 	}
 
 	orderID := gcontext.GetOrderID(ctx)
@@ -121,6 +151,10 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		tx.Rollback()
 		return badRequestError("This order has already been paid")
 	}
+	if order.State == models.CancelledState {
+		tx.Rollback()
+		return badRequestError("This order has been cancelled")
+	}
 
 	if order.Currency != params.Currency {
 		tx.Rollback()
@@ -152,53 +186,208 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("We failed to authorize the amount for this order: %v", err)
 	}
 
-	invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
-	if err != nil {
+	if preauthorized, ok := provider.(payments.PreauthorizedProvider); ok {
+		paymentID, err := preauthorized.PreauthorizedPaymentID(r)
+		if err != nil {
+			tx.Rollback()
+			return badRequestError("Error reading preauthorized payment: %v", err)
+		}
+		if paymentID != "" && paymentID != order.PreauthorizedPaymentID {
+			tx.Rollback()
+			return badRequestError("This payment wasn't preauthorized for this order")
+		}
+		// preauthorized payments are for the total of the order
+		if paymentID != "" && (params.GiftCardCode != "" || params.UseStoreCredit) {
+			tx.Rollback()
+			return badRequestError("Preauthorized payments can't be combined with a gift card or store credit")
+		}
+	}
+
+	if isOffline {
+		return a.createOfflinePayment(w, r, tx, order, provider.Name(), offline)
+	}
+
+	invoiceNumber, formattedNumber, httpErr := a.prepareOrderPayment(ctx, tx, order)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+
+	tenders, remaining, httpErr := a.redeemBalances(tx, order, &params)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if remaining > 0 && provider == nil {
 		tx.Rollback()
-		return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		return badRequestError("The balance doesn't cover this order, paying the rest requires specifying a 'provider'")
+	}
+
+	// methods are saved with the provider last, so only a failed charge
+	// can leave them behind
+	var method *models.PaymentMethod
+	if useSavedMethod {
+		method, charge, httpErr = a.orderPaymentMethod(ctx, tx, r, order, provider.Name(), &params)
+		if httpErr != nil {
+			tx.Rollback()
+			return httpErr
+		}
 	}
 
 	tr := models.NewTransaction(order)
-	processorID, err := charge(params.Amount, params.Currency)
+	tr.Amount = remaining
+	// nothing is charged for orders without a price, like the start of a trial
+	var processorID string
+	if remaining > 0 {
+		processorID, err = charge(remaining, params.Currency)
+		if err == nil {
+			err = ensurePaymentUnused(tx, processorID)
+		}
+	}
 	tr.ProcessorID = processorID
 
 	if err != nil {
+		// give the invoice number, license keys and balances back, so the
+		// invoices have no gaps
+		tx.Rollback()
+		if method != nil && params.PaymentMethodID == "" {
+			discardPaymentMethod(ctx, r, method)
+		}
+		tx = a.db.Begin()
+		if order.UserID != "" {
+			tx.Model(order).Update("user_id", order.UserID)
+		}
+
 		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
 		tr.FailureDescription = err.Error()
 		tr.Status = models.FailedState
 		tx.Create(tr)
-		tx.Commit()
+		bestEffort(tx, log, "Error queuing payment failed email", func() error {
+			return models.EnqueueEmail(tx, models.NewTransactionEmail(models.PaymentFailedEmail, tr))
+		})
+		if rsp := tx.Commit(); rsp.Error != nil {
+			log.WithError(rsp.Error).Error("Error saving failed transaction")
+		}
 		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
 	}
 
 	// mark order and transaction as paid
-	tr.Status = models.PaidState
-	tx.Create(tr)
-	order.PaymentProcessor = provider.Name()
+	order.PaymentProcessor = models.BalanceProcessor
+	if remaining == 0 && len(tenders) > 0 {
+		tr = tenders[len(tenders)-1]
+	} else {
+		tr.Status = models.PaidState
+		if method != nil {
+			tr.PaymentMethodID = method.ID
+		}
+		tx.Create(tr)
+		if provider != nil {
+			order.PaymentProcessor = provider.Name()
+		}
+	}
 	order.PaymentState = models.PaidState
 	order.InvoiceNumber = invoiceNumber
+	order.FormattedInvoiceNumber = formattedNumber
 	tx.Save(order)
+	a.orderPaid(ctx, tx, order, tr, log)
+	if rsp := tx.Commit(); rsp.Error != nil {
+		// the provider already charged the payment, so it has to be
+		// reconciled by hand
+		log.WithError(rsp.Error).WithField("processor_id", tr.ProcessorID).Error("Error saving charged payment")
+		return internalServerError("Your payment went through, but we failed to save it. Please contact us.").WithInternalError(rsp.Error)
+	}
 
-	if config.Webhooks.Payment != "" {
-		hook, err := models.NewHook("payment", config.SiteURL, config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
-		}
-		tx.Save(hook)
+	return sendJSON(w, http.StatusOK, tr)
+}
+
+// ensurePaymentUnused fails for payments that already paid for an order, like
+// a confirmed PaymentIntent sent again to pay for another one.
+func ensurePaymentUnused(tx *gorm.DB, processorID string) error {
+	if processorID == "" {
+		return nil
+	}
+	var count int
+	query := tx.Model(&models.Transaction{}).Where("processor_id = ? AND type = ? AND status = ?", processorID, models.ChargeTransactionType, models.PaidState)
+	if result := query.Count(&count); result.Error != nil {
+		return errors.Wrap(result.Error, "Error checking payment")
+	}
+	if count > 0 {
+		return errors.New("This payment was already used for another order")
+	}
+	return nil
+}
+
+// prepareOrderPayment allocates the invoice number, license keys and gift
+// cards of an order, and starts or renews its subscriptions, before it is
+// charged. They are given back if the transaction rolls back, so the invoices
+// have no gaps and nobody pays for a product that ran out of keys or a
+// subscription that didn't start.
+func (a *API) prepareOrderPayment(ctx context.Context, tx *gorm.DB, order *models.Order) (int64, string, *HTTPError) {
+	numbering := invoiceNumbering(gcontext.GetConfig(ctx), models.InvoiceSequence)
+	invoiceNumber, formattedNumber, err := models.NextInvoiceNumber(tx, order.InstanceID, numbering, time.Now().UTC())
+	if err != nil {
+		return 0, "", internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
 	}
 
-	tx.Commit()
+	_, err = models.IssueLicenses(tx, order, func() (ed25519.PrivateKey, error) {
+		return models.ParseSigningKey(gcontext.GetConfig(ctx).Licenses.SigningKey)
+	})
+	if err != nil {
+		if errors.Cause(err) == models.ErrLicensePoolEmpty {
+			return 0, "", badRequestError("Some products of this order are sold out").WithErrorCode("license_keys_sold_out").WithInternalError(err)
+		}
+		return 0, "", internalServerError("We failed to issue license keys for this order").WithInternalError(err)
+	}
 
-	go func() {
-		err1 := mailer.OrderConfirmationMail(tr)
-		err2 := mailer.OrderReceivedMail(tr)
+	if _, err := models.IssueGiftCards(tx, order); err != nil {
+		return 0, "", internalServerError("We failed to issue gift cards for this order").WithInternalError(err)
+	}
 
-		if err1 != nil || err2 != nil {
-			log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
+	if order.SubscriptionID != "" {
+		_, err = models.RenewSubscription(tx, order)
+	} else {
+		_, err = models.StartSubscriptions(tx, order, time.Now())
+	}
+	if err != nil {
+		if err == models.ErrNotRenewalOrder {
+			return 0, "", badRequestError("This renewal of the subscription was replaced by a newer one").WithInternalError(err)
 		}
-	}()
+		return 0, "", internalServerError("We failed to start the subscriptions of this order").WithInternalError(err)
+	}
+	return invoiceNumber, formattedNumber, nil
+}
 
-	return sendJSON(w, http.StatusOK, tr)
+// orderPaid queues the webhooks and emails of an order that was just paid,
+// and starts its downloads. The payment already went through, so failures
+// don't roll it back, but are only logged.
+func (a *API) orderPaid(ctx context.Context, tx *gorm.DB, order *models.Order, tr *models.Transaction, log logrus.FieldLogger) {
+	bestEffort(tx, log, "Failed to process webhook", func() error {
+		return a.triggerWebhooks(ctx, tx, models.WebhookPaymentSucceeded, order.UserID, order)
+	})
+
+	for _, emailType := range []string{models.OrderConfirmationEmail, models.OrderReceivedEmail} {
+		email := models.NewTransactionEmail(emailType, tr)
+		bestEffort(tx, log, "Error queuing "+emailType+" email", func() error {
+			return models.EnqueueEmail(tx, email)
+		})
+	}
+	paidAt := time.Now()
+	bestEffort(tx, log, "Error starting downloads", func() error {
+		if err := models.StartOrderDownloadsExpiry(tx, order.ID, paidAt); err != nil {
+			return err
+		}
+		var downloads int
+		if result := tx.Model(&models.Download{}).Where("order_id = ?", order.ID).Count(&downloads); result.Error != nil {
+			return result.Error
+		}
+		if downloads == 0 {
+			return nil
+		}
+		return models.EnqueueEmail(tx, models.NewOrderEmail(models.DownloadReadyEmail, order))
+	})
+	bestEffort(tx, log, "Error saving payment method of subscriptions", func() error {
+		return models.SetSubscriptionPaymentMethod(tx, order, tr)
+	})
 }
 
 // PaymentList will list all the payments that meet the criteria. It is only available to admins.
@@ -233,7 +422,6 @@ func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 // refunds if desired. It is only available to admins.
 func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
-	config := gcontext.GetConfig(ctx)
 	params := PaymentParams{Currency: "USD"}
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
@@ -246,6 +434,10 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return httpErr
 	}
 
+	if trans.Type != models.ChargeTransactionType {
+		return badRequestError("Only charges can be refunded")
+	}
+
 	if trans.Currency != params.Currency {
 		return badRequestError("Currencies do not match - %v vs %v", trans.Currency, params.Currency)
 	}
@@ -267,17 +459,40 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	if httpErr != nil {
 		return httpErr
 	}
-	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
-	}
 
-	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
-	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
-	}
-	refund, err := provider.NewRefunder(ctx, r)
-	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+	// payments with a balance are refunded to it, and others to the
+	// provider or as store credit
+	var refund payments.Refunder
+	var account *models.BalanceAccount
+	provID := models.BalanceProcessor
+	switch {
+	case trans.BalanceAccountID != "":
+		account = &models.BalanceAccount{}
+		if result := a.db.First(account, "id = ?", trans.BalanceAccountID); result.Error != nil {
+			return internalServerError("Error loading balance of payment").WithInternalError(result.Error)
+		}
+	case params.StoreCredit:
+		if order.UserID == "" {
+			return badRequestError("Only payments of logged in customers can be refunded as store credit")
+		}
+		account, err = models.StoreCredit(a.db, order.InstanceID, order.UserID, trans.Currency)
+		if err != nil {
+			return internalServerError("Error loading store credit").WithInternalError(err)
+		}
+	default:
+		if order.PaymentProcessor == "" {
+			return badRequestError("Order does not specify a payment provider")
+		}
+
+		provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
+		if provider == nil {
+			return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+		}
+		refund, err = provider.NewRefunder(ctx, r)
+		if err != nil {
+			return badRequestError("Error creating payment provider: %v", err)
+		}
+		provID = provider.Name()
 	}
 
 	// ok make the refund
@@ -288,40 +503,112 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		Currency:   params.Currency,
 		UserID:     trans.UserID,
 		OrderID:    trans.OrderID,
+		ChargeID:   trans.ID,
 		Type:       models.RefundTransactionType,
 		Status:     models.PendingState,
 	}
 
 	tx := a.db.Begin()
+	// refunds to a balance have no provider that would reject refunding
+	// more than was charged
+	refundable, err := models.RefundableAmount(tx, trans)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error loading refunds of payment").WithInternalError(err)
+	}
+	if params.Amount > refundable {
+		tx.Rollback()
+		return badRequestError("The refund exceeds the amount of the payment that wasn't refunded yet")
+	}
+	numbering := invoiceNumbering(gcontext.GetConfig(ctx), models.CreditNoteSequence)
+	creditNoteNumber, formattedNumber, err := models.NextInvoiceNumber(tx, order.InstanceID, numbering, time.Now().UTC())
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("We failed to generate a valid credit note number, please try again later: %v", err)
+	}
+	if account != nil {
+		m.BalanceAccountID = account.ID
+		refund = balanceRefunder(tx, account, m)
+	}
 	tx.Create(m)
-	provID := provider.Name()
+	// gift cards bought with the order can't be spent once they're refunded
+	void, err := refundVoidsGiftCards(tx, order.ID, params.Amount)
+	if err == nil && void {
+		err = models.VoidGiftCards(tx, order.ID, m.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		if err == models.ErrGiftCardRedeemed {
+			return badRequestError("Can't refund an order whose gift cards were already redeemed")
+		}
+		return internalServerError("Error voiding gift cards of the order").WithInternalError(err)
+	}
 	log.Debugf("Starting refund to %s", provID)
 	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency)
 	if err != nil {
 		log.WithError(err).Info("Failed to refund value")
+		// give the credit note number back, so the credit notes have no gaps
+		tx.Rollback()
+		tx = a.db.Begin()
 		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
 		m.FailureDescription = err.Error()
 		m.Status = models.FailedState
+		tx.Create(m)
 	} else {
 		m.ProcessorID = refundID
 		m.Status = models.PaidState
+		m.InvoiceNumber = creditNoteNumber
+		m.FormattedInvoiceNumber = formattedNumber
 	}
 
 	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
 	tx.Save(m)
-	if config.Webhooks.Refund != "" {
-		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
+	bestEffort(tx, log, "Failed to process webhook", func() error {
+		return a.triggerWebhooks(ctx, tx, models.WebhookRefundCreated, m.UserID, m)
+	})
+	if m.Status == models.PaidState {
+		bestEffort(tx, log, "Error queuing refund issued email", func() error {
+			return models.EnqueueEmail(tx, models.NewTransactionEmail(models.RefundIssuedEmail, m))
+		})
+		revoke := params.Revoke
+		if !revoke {
+			bestEffort(tx, log, "Error checking refunds of order", func() (err error) {
+				revoke, err = models.OrderRefunded(tx, order.ID)
+				return err
+			})
 		}
-		tx.Save(hook)
+		if revoke {
+			bestEffort(tx, log, "Error revoking downloads of refunded order", func() error {
+				return models.RevokeOrderDownloads(tx, order.ID, models.RevokedByRefund)
+			})
+			bestEffort(tx, log, "Error revoking licenses of refunded order", func() error {
+				return models.RevokeOrderLicenses(tx, order.ID, models.RevokedByRefund)
+			})
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		// the provider may already have refunded the payment, so it has to
+		// be reconciled by hand
+		log.WithError(rsp.Error).WithField("processor_id", m.ProcessorID).Error("Error saving refund")
+		return internalServerError("Error saving refund").WithInternalError(rsp.Error)
+	}
+
+	// audited separately, as the refund must be saved even if auditing fails,
+	// and postgres can't commit a transaction after a failed statement
+	auditTx := a.db.Begin()
+	if httpErr := a.audit(auditTx, r, gcontext.GetInstanceID(ctx), "payment.refund", "transaction", m.ID, nil, m); httpErr != nil {
+		auditTx.Rollback()
+		log.WithError(httpErr.Cause()).Error("Failed to audit refund")
+	} else if rsp := auditTx.Commit(); rsp.Error != nil {
+		log.WithError(rsp.Error).Error("Failed to audit refund")
 	}
-	tx.Commit()
 	return sendJSON(w, http.StatusOK, m)
 }
 
-// PreauthorizePayment creates a new payment that can be authorized in the browser
-func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error {
+// PaymentPreauthorize creates a payment for an order that the customer
+// authorizes in the browser, like a PayPal order they approve. The payment is
+// for the total of the order, and the order must be paid with it.
+func (a *API) PaymentPreauthorize(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	params := PaymentParams{}
 	ct := r.Header.Get("Content-Type")
@@ -336,13 +623,7 @@ func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error
 			return badRequestError("Could not read params: %v", err)
 		}
 	case "application/x-www-form-urlencoded":
-		amt, err := strconv.ParseUint(r.FormValue("amount"), 10, 64)
-		if err != nil {
-			return badRequestError("Error parsing amount: %v", err)
-		}
 		params.ProviderType = r.FormValue("provider")
-		params.Amount = amt
-		params.Currency = r.FormValue("currency")
 		params.Description = r.FormValue("description")
 	default:
 		return badRequestError("Unsupported Content-Type: %s", ct)
@@ -357,16 +638,41 @@ func (a *API) PreauthorizePayment(w http.ResponseWriter, r *http.Request) error
 	if provider == nil {
 		return badRequestError("Payment provider '%s' not configured", providerType)
 	}
+
+	order := &models.Order{}
+	if result := a.db.Preload("LineItems").First(order, "id = ?", gcontext.GetOrderID(ctx)); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("No order with this ID found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if order.PaymentState == models.PaidState {
+		return badRequestError("This order has already been paid")
+	}
+	if order.State == models.CancelledState {
+		return badRequestError("This order has been cancelled")
+	}
+	if order.UserID != "" {
+		token := gcontext.GetToken(ctx)
+		if token == nil || token.Claims.(*claims.JWTClaims).Subject != order.UserID {
+			return unauthorizedError("You must be logged in to pay for this order")
+		}
+	}
+
+	ctx = gcontext.WithPaymentBreakdown(ctx, orderBreakdown(order))
 	preauthorize, err := provider.NewPreauthorizer(ctx, r)
 	if err != nil {
 		return badRequestError("Error creating payment provider: %v", err)
 	}
 
-	paymentResult, err := preauthorize(params.Amount, params.Currency, params.Description)
+	paymentResult, err := preauthorize(order.Total, order.Currency, params.Description)
 	if err != nil {
 		return internalServerError("Error preauthorizing payment: %v", err).WithInternalError(err)
 	}
 
+	if result := a.db.Model(order).Update("preauthorized_payment_id", paymentResult.ID); result.Error != nil {
+		return internalServerError("Error saving preauthorized payment").WithInternalError(result.Error)
+	}
 	return sendJSON(w, http.StatusOK, paymentResult)
 }
 
@@ -392,6 +698,53 @@ func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint
 	return nil
 }
 
+// orderBreakdown itemizes the amount of an order, for providers that show
+// customers what they pay for.
+func orderBreakdown(order *models.Order) *payments.Breakdown {
+	breakdown := &payments.Breakdown{
+		Reference: order.ID,
+		ItemTotal: order.SubTotal,
+		Tax:       order.Taxes,
+		Shipping:  order.Shipping,
+		Discount:  order.Discount,
+	}
+	for _, item := range order.LineItems {
+		breakdown.Items = append(breakdown.Items, payments.BreakdownItem{
+			Name:       item.Title,
+			SKU:        item.Sku,
+			Quantity:   item.Quantity,
+			UnitAmount: item.NetPrice,
+			Tax:        item.Taxes,
+		})
+	}
+	return breakdown
+}
+
+// refundVoidsGiftCards reports whether a refund takes back the gift cards
+// bought with an order, because it refunds the whole order or at least the
+// price of the gift cards.
+func refundVoidsGiftCards(tx *gorm.DB, orderID string, amount uint64) (bool, error) {
+	items := []models.LineItem{}
+	if rsp := tx.Where("order_id = ? AND type = ?", orderID, models.GiftCardType).Find(&items); rsp.Error != nil {
+		return false, rsp.Error
+	}
+	var giftCards uint64
+	for _, item := range items {
+		giftCards += item.Price * item.Quantity
+	}
+	if giftCards == 0 {
+		return false, nil
+	}
+	if amount >= giftCards {
+		return true, nil
+	}
+	charged, refunded, err := models.OrderPaidAmounts(tx, orderID)
+	if err != nil {
+		return false, err
+	}
+	return charged > 0 && refunded+amount >= charged, nil
+}
+
 func queryForOrder(db *gorm.DB, orderID string, log logrus.FieldLogger) (*models.Order, *HTTPError) {
 	order := &models.Order{}
 	if rsp := db.Preload("Transactions").Find(order, "id = ?", orderID); rsp.Error != nil {
@@ -416,24 +769,38 @@ func queryForTransactions(db *gorm.DB, log logrus.FieldLogger, clause, id string
 }
 
 // createPaymentProviders creates instance(s) of Provider based on the configuration
-// provided.
+// provided. Providers are created from the registry in the payments package,
+// so any provider package that is imported can be enabled.
 func createPaymentProviders(c *conf.Configuration) (map[string]payments.Provider, error) {
-	provs := map[string]payments.Provider{}
+	configs := map[string]interface{}{}
 	if c.Payment.Stripe.Enabled {
-		p, err := stripe.NewPaymentProvider(stripe.Config{
+		configs[payments.StripeProvider] = stripe.Config{
 			SecretKey: c.Payment.Stripe.SecretKey,
-		})
-		if err != nil {
-			return nil, err
 		}
-		provs[p.Name()] = p
 	}
 	if c.Payment.PayPal.Enabled {
-		p, err := paypal.NewPaymentProvider(paypal.Config{
+		configs[payments.PayPalProvider] = paypal.Config{
 			Env:      c.Payment.PayPal.Env,
 			ClientID: c.Payment.PayPal.ClientID,
 			Secret:   c.Payment.PayPal.Secret,
-		})
+		}
+	}
+	if c.Payment.Manual.Enabled {
+		configs[payments.ManualProvider] = manual.Config{
+			Instructions: c.Payment.Manual.Instructions,
+		}
+	}
+	for name, config := range c.Payment.Providers {
+		configs[name] = config
+	}
+
+	provs := map[string]payments.Provider{}
+	for name, config := range configs {
+		raw, err := json.Marshal(config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error encoding configuration of payment provider '%s'", name)
+		}
+		p, err := payments.NewProvider(name, raw)
 		if err != nil {
 			return nil, err
 		}
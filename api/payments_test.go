@@ -10,6 +10,7 @@ import (
 	"net/url"
 	"testing"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -23,6 +24,7 @@ import (
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
 	"github.com/netlify/gocommerce/payments"
+	"github.com/netlify/gocommerce/payments/paypal/paypaltest"
 	stripe "github.com/stripe/stripe-go"
 )
 
@@ -268,28 +270,71 @@ func TestPaymentsRefund(t *testing.T) {
 			assert.Equal(t, models.RefundTransactionType, payment.Type)
 			assert.Equal(t, models.PaidState, payment.Status)
 		}
+
+		// partial refunds keep the downloads
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.Nil(t, download.RevokedAt)
+	})
+	t.Run("Full", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		provider := &memProvider{name: payments.StripeProvider}
+		token := testAdminToken("magical-unicorn", "")
+
+		for _, amount := range []uint64{1, 99} {
+			body, err := json.Marshal(&stripePaymentParams{Amount: amount, Currency: "USD", StripeToken: "123"})
+			require.NoError(t, err)
+			recorder := providerRequest(test, provider, http.MethodPost, url, bytes.NewBuffer(body), token)
+			require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+		}
+
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.NotNil(t, download.RevokedAt)
+		assert.Equal(t, models.RevokedByRefund, download.RevokeReason)
+	})
+	t.Run("Revoke", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		provider := &memProvider{name: payments.StripeProvider}
+
+		body := jsonBody(t, map[string]interface{}{"amount": 1, "currency": "USD", "stripe_token": "123", "revoke": true})
+		recorder := providerRequest(test, provider, http.MethodPost, url, body, testAdminToken("magical-unicorn", ""))
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		download := &models.Download{}
+		require.NoError(t, test.DB.First(download, "id = ?", "first-download").Error)
+		assert.NotNil(t, download.RevokedAt)
+	})
+
+	t.Run("Refund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		provider := &memProvider{name: payments.StripeProvider}
+		token := testAdminToken("magical-unicorn", "")
+
+		body := jsonBody(t, map[string]interface{}{"amount": 1, "currency": "USD", "stripe_token": "123"})
+		recorder := providerRequest(test, provider, http.MethodPost, url, body, token)
+		refund := &models.Transaction{}
+		extractPayload(t, http.StatusOK, recorder, refund)
+		assert.Equal(t, test.Data.firstTransaction.ID, refund.ChargeID)
+
+		body = jsonBody(t, map[string]interface{}{"amount": 1, "currency": "USD", "stripe_token": "123"})
+		recorder = providerRequest(test, provider, http.MethodPost, "/payments/"+refund.ID+"/refund", body, token)
+		validateError(t, http.StatusBadRequest, recorder, "Only charges")
+
+		body = jsonBody(t, map[string]interface{}{"amount": test.Data.firstTransaction.Amount, "currency": "USD", "stripe_token": "123"})
+		recorder = providerRequest(test, provider, http.MethodPost, url, body, token)
+		validateError(t, http.StatusBadRequest, recorder, "wasn't refunded yet")
 	})
 
 	t.Run("PayPal", func(t *testing.T) {
 		test := NewRouteTest(t)
-		var loginCount, refundCount int
-		refundID := "4CF18861HF410323U"
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			switch r.URL.Path {
-			case "/v1/oauth2/token":
-				w.Header().Add("Content-Type", "application/json")
-				fmt.Fprint(w, `{"access_token":"EEwJ6tF9x5WCIZDYzyZGaz6Khbw7raYRIBV_WxVvgmsG","expires_in":100000}`)
-				loginCount++
-			case "/v1/payments/sale/" + test.Data.secondTransaction.ProcessorID + "/refund":
-				w.Header().Add("Content-Type", "application/json")
-				fmt.Fprint(w, `{"id":"`+refundID+`"}`)
-				refundCount++
-			default:
-				w.WriteHeader(500)
-				t.Fatalf("unknown PayPal API call to %s", r.URL.Path)
-			}
-		}))
+		server := paypaltest.NewServer()
 		defer server.Close()
+		capture := server.AddCapture("0.55", "USD")
+		require.NoError(t, test.DB.Model(test.Data.secondTransaction).Update("processor_id", capture.ID).Error)
 
 		test.Config.Payment.PayPal.Enabled = true
 		test.Config.Payment.PayPal.ClientID = "clientid"
@@ -297,10 +342,8 @@ func TestPaymentsRefund(t *testing.T) {
 		test.Config.Payment.PayPal.Env = server.URL
 
 		params := &paypalPaymentParams{
-			Amount:       1,
-			Currency:     test.Data.secondTransaction.Currency,
-			PaypalID:     "123",
-			PaypalUserID: "456",
+			Amount:   1,
+			Currency: test.Data.secondTransaction.Currency,
 		}
 
 		body, err := json.Marshal(params)
@@ -311,9 +354,12 @@ func TestPaymentsRefund(t *testing.T) {
 
 		rsp := models.Transaction{}
 		extractPayload(t, http.StatusOK, recorder, &rsp)
-		assert.Equal(t, refundID, rsp.ProcessorID)
-		assert.Equal(t, 1, loginCount, "too many login calls")
-		assert.Equal(t, 1, refundCount, "too many refund calls")
+		refunds := server.Refunds()
+		require.Len(t, refunds, 1, "too many refund calls")
+		assert.Equal(t, refunds[0].ID, rsp.ProcessorID)
+		assert.Equal(t, capture.ID, refunds[0].CaptureID)
+		assert.Equal(t, "0.01", refunds[0].Amount.Value)
+		assert.Equal(t, 1, server.Logins(), "too many login calls")
 	})
 }
 
@@ -326,59 +372,64 @@ func runPaymentRefund(test *RouteTest, url string, params interface{}) *httptest
 
 func TestPaymentCreate(t *testing.T) {
 	t.Run("PayPal", func(t *testing.T) {
-		t.Run("Simple", func(t *testing.T) {
-			test := NewRouteTest(t)
+		server := paypaltest.NewServer()
+		defer server.Close()
+		pay := func(test *RouteTest, orderID string) *httptest.ResponseRecorder {
 			test.Data.secondOrder.PaymentState = models.PendingState
 			rsp := test.DB.Save(test.Data.secondOrder)
 			require.NoError(t, rsp.Error, "Failed to update order")
-
-			var loginCount, paymentCount int
-			paymentID := "4CF18861HF410323V"
-			amtString := fmt.Sprintf("%.2f", float64(test.Data.secondOrder.Total)/100)
-			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				switch r.URL.Path {
-				case "/v1/oauth2/token":
-					w.Header().Add("Content-Type", "application/json")
-					fmt.Fprint(w, `{"access_token":"EEwJ6tF9x5WCIZDYzyZGaz6Khbw7raYRIBV_WxVvgmsG","expires_in":100000}`)
-					loginCount++
-				case "/v1/payments/payment/" + paymentID:
-					w.Header().Add("Content-Type", "application/json")
-					fmt.Fprint(w, `{"id":"`+paymentID+`","transactions":[{"amount":{"total":"`+amtString+`","currency":"`+test.Data.secondOrder.Currency+`"}}]}`)
-					paymentCount++
-				case "/v1/payments/payment/" + paymentID + "/execute":
-					w.Header().Add("Content-Type", "application/json")
-					fmt.Fprint(w, `{"id":"`+paymentID+`"}`)
-					paymentCount++
-				default:
-					w.WriteHeader(500)
-					t.Fatalf("unknown PayPal API call to %s", r.URL.Path)
-				}
-			}))
-			defer server.Close()
 			test.Config.Payment.PayPal.Enabled = true
 			test.Config.Payment.PayPal.ClientID = "clientid"
 			test.Config.Payment.PayPal.Secret = "secret"
 			test.Config.Payment.PayPal.Env = server.URL
 
-			params := &paypalPaymentParams{
-				Amount:       test.Data.secondOrder.Total,
-				Currency:     test.Data.secondOrder.Currency,
-				PaypalID:     paymentID,
-				PaypalUserID: "456",
-				Provider:     payments.PayPalProvider,
-			}
-
-			body, err := json.Marshal(params)
-			require.NoError(t, err)
+			return payPayPalOrder(test, orderID)
+		}
+		preauthorized := func(test *RouteTest, orderID string) {
+			require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("preauthorized_payment_id", orderID).Error)
+		}
 
-			recorder := test.TestEndpoint(http.MethodPost, "/orders/second-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		t.Run("Simple", func(t *testing.T) {
+			test := NewRouteTest(t)
+			amtString := fmt.Sprintf("%.2f", float64(test.Data.secondOrder.Total)/100)
+			order := server.AddOrder(amtString, test.Data.secondOrder.Currency)
+			preauthorized(test, order.ID)
+			logins := server.Logins()
 
+			recorder := pay(test, order.ID)
 			trans := models.Transaction{}
 			extractPayload(t, http.StatusOK, recorder, &trans)
-			assert.Equal(t, paymentID, trans.ProcessorID)
+			captured := server.Order(order.ID)
+			assert.Equal(t, "COMPLETED", captured.Status)
+			assert.Equal(t, captured.PurchaseUnits[0].Payments.Captures[0].ID, trans.ProcessorID)
 			assert.Equal(t, models.PaidState, trans.Status)
-			assert.Equal(t, 1, loginCount, "too many login calls")
-			assert.Equal(t, 2, paymentCount, "too many payment calls")
+			assert.Equal(t, 1, server.Logins()-logins, "too many login calls")
+		})
+
+		t.Run("AmountMismatch", func(t *testing.T) {
+			test := NewRouteTest(t)
+			order := server.AddOrder("0.01", test.Data.secondOrder.Currency)
+			preauthorized(test, order.ID)
+			validateError(t, http.StatusInternalServerError, pay(test, order.ID))
+			assert.Equal(t, "APPROVED", server.Order(order.ID).Status)
+		})
+
+		t.Run("NotApproved", func(t *testing.T) {
+			test := NewRouteTest(t)
+			amtString := fmt.Sprintf("%.2f", float64(test.Data.secondOrder.Total)/100)
+			order := server.AddOrder(amtString, test.Data.secondOrder.Currency)
+			order.Status = "CREATED"
+			preauthorized(test, order.ID)
+			validateError(t, http.StatusInternalServerError, pay(test, order.ID))
+		})
+
+		t.Run("NotPreauthorized", func(t *testing.T) {
+			test := NewRouteTest(t)
+			amtString := fmt.Sprintf("%.2f", float64(test.Data.secondOrder.Total)/100)
+			order := server.AddOrder(amtString, test.Data.secondOrder.Currency)
+			preauthorized(test, server.AddOrder(amtString, test.Data.secondOrder.Currency).ID)
+			validateError(t, http.StatusBadRequest, pay(test, order.ID))
+			assert.Equal(t, "APPROVED", server.Order(order.ID).Status)
 		})
 	})
 	t.Run("Stripe", func(t *testing.T) {
@@ -417,111 +468,207 @@ func TestPaymentCreate(t *testing.T) {
 	})
 }
 
+func payPayPalOrder(test *RouteTest, paypalOrderID string) *httptest.ResponseRecorder {
+	params := &paypalPaymentParams{
+		Amount:        test.Data.secondOrder.Total,
+		Currency:      test.Data.secondOrder.Currency,
+		PaypalOrderID: paypalOrderID,
+		Provider:      payments.PayPalProvider,
+	}
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+	return test.TestEndpoint(http.MethodPost, "/orders/second-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+}
+
 func TestPaymentPreauthorize(t *testing.T) {
 	t.Run("PayPal", func(t *testing.T) {
-		testURL := "/paypal"
-		var createData *paypalPaymentCreateParams
-		var loginCount, paymentCount int
-		paymentID := "4CF18861HF410323V"
-		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			switch r.URL.Path {
-			case "/v1/oauth2/token":
-				w.Header().Add("Content-Type", "application/json")
-				fmt.Fprint(w, `{"access_token":"EEwJ6tF9x5WCIZDYzyZGaz6Khbw7raYRIBV_WxVvgmsG","expires_in":100000}`)
-				loginCount++
-			case "/v1/payment-experience/web-profiles":
-				w.Header().Add("Content-Type", "application/json")
-				fmt.Fprint(w, `[{"id":"expid","name":"gocommerce"}]`)
-			case "/v1/payments/payment":
-				w.Header().Add("Content-Type", "application/json")
-				fmt.Fprint(w, `{"id":"`+paymentID+`"}`)
-				paymentCount++
-				require.NoError(t, json.NewDecoder(r.Body).Decode(createData))
-			default:
-				w.WriteHeader(500)
-				t.Fatalf("unknown PayPal API call to %s", r.URL.Path)
-			}
-		}))
+		testURL := "/orders/second-order/payments/preauthorize"
+		server := paypaltest.NewServer()
 		defer server.Close()
-
-		t.Run("Form", func(t *testing.T) {
-			loginCount = 0
-			paymentCount = 0
-			createData = new(paypalPaymentCreateParams)
-			test := NewRouteTest(t)
+		preauthorize := func(test *RouteTest, contentType string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
 			test.Config.Payment.PayPal.Enabled = true
 			test.Config.Payment.PayPal.ClientID = "clientid"
 			test.Config.Payment.PayPal.Secret = "secret"
 			test.Config.Payment.PayPal.Env = server.URL
 
-			form := url.Values{}
-			form.Add("provider", payments.PayPalProvider)
-			form.Add("amount", "1000")
-			form.Add("currency", "USD")
-			form.Add("description", "test")
-
 			recorder := httptest.NewRecorder()
-			req := httptest.NewRequest(http.MethodPost, baseURL+testURL, strings.NewReader(form.Encode()))
-			req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+			req := httptest.NewRequest(http.MethodPost, baseURL+testURL, body)
+			req.Header.Set("Content-Type", contentType)
+			if token != nil {
+				require.NoError(t, signHTTPRequest(req, token, test.Config.JWT.Secret))
+			}
 
 			globalConfig := new(conf.GlobalConfiguration)
 			ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
 			require.NoError(t, err)
 			NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler.ServeHTTP(recorder, req)
+			return recorder
+		}
+		preauthorizeJSON := func(test *RouteTest, params *paypalPreauthorizeParams, token *jwt.Token) *httptest.ResponseRecorder {
+			body, err := json.Marshal(params)
+			require.NoError(t, err)
+			return preauthorize(test, "application/json", bytes.NewBuffer(body), token)
+		}
+		unpaidOrder := func(t *testing.T) *RouteTest {
+			test := NewRouteTest(t)
+			require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("payment_state", models.PendingState).Error)
+			return test
+		}
+		storedPaymentID := func(test *RouteTest) string {
+			order := &models.Order{}
+			require.NoError(t, test.DB.First(order, "id = ?", test.Data.secondOrder.ID).Error)
+			return order.PreauthorizedPaymentID
+		}
+
+		t.Run("Form", func(t *testing.T) {
+			test := unpaidOrder(t)
+			form := url.Values{}
+			form.Add("provider", payments.PayPalProvider)
+			form.Add("description", "test")
+
+			logins := server.Logins()
+			recorder := preauthorize(test, "application/x-www-form-urlencoded; charset=utf-8", strings.NewReader(form.Encode()), test.Data.testUserToken)
 
 			rsp := payments.PreauthorizationResult{}
 			extractPayload(t, http.StatusOK, recorder, &rsp)
-			assert.Equal(t, paymentID, rsp.ID)
-			assert.Equal(t, 1, loginCount, "too many login calls")
-			assert.Equal(t, 1, paymentCount, "too many payment calls")
-
-			require.Len(t, createData.Transactions, 1)
-			assert.Equal(t, "sale", createData.Intent)
-			assert.Equal(t, "10.00", createData.Transactions[0].Amount.Total)
-			assert.Equal(t, "USD", createData.Transactions[0].Amount.Currency)
-			assert.Equal(t, "test", createData.Transactions[0].Description)
+			assert.Equal(t, 1, server.Logins()-logins, "too many login calls")
+
+			order := server.Order(rsp.ID)
+			require.NotNil(t, order)
+			require.Len(t, order.PurchaseUnits, 1)
+			assert.Equal(t, "CAPTURE", order.Intent)
+			assert.Equal(t, "0.55", order.PurchaseUnits[0].Amount.Value)
+			assert.Equal(t, "USD", order.PurchaseUnits[0].Amount.CurrencyCode)
+			assert.Equal(t, "test", order.PurchaseUnits[0].Description)
+			assert.Equal(t, rsp.ID, storedPaymentID(test))
 		})
 		t.Run("JSON", func(t *testing.T) {
-			loginCount = 0
-			paymentCount = 0
-			createData = new(paypalPaymentCreateParams)
-			test := NewRouteTest(t)
-			test.Config.Payment.PayPal.Enabled = true
-			test.Config.Payment.PayPal.ClientID = "clientid"
-			test.Config.Payment.PayPal.Secret = "secret"
-			test.Config.Payment.PayPal.Env = server.URL
-
-			params := paypalPreauthorizeParams{
-				Amount:      1000,
-				Currency:    "USD",
+			test := unpaidOrder(t)
+			recorder := preauthorizeJSON(test, &paypalPreauthorizeParams{
 				Description: "test",
 				Provider:    payments.PayPalProvider,
-			}
-
-			body, err := json.Marshal(params)
-			require.NoError(t, err)
+			}, test.Data.testUserToken)
 
-			recorder := httptest.NewRecorder()
-			req := httptest.NewRequest(http.MethodPost, baseURL+testURL, bytes.NewBuffer(body))
-			req.Header.Set("Content-Type", "application/json")
+			rsp := payments.PreauthorizationResult{}
+			extractPayload(t, http.StatusOK, recorder, &rsp)
+			unit := server.Order(rsp.ID).PurchaseUnits[0]
+			assert.Equal(t, test.Data.secondOrder.ID, unit.ReferenceID)
+			assert.Equal(t, "0.55", unit.Amount.Value)
+			assert.Equal(t, "test", unit.Description)
+			require.NotNil(t, unit.Amount.Breakdown)
+			assert.Equal(t, "0.55", unit.Amount.Breakdown.ItemTotal.Value)
+			assert.Equal(t, "0.00", unit.Amount.Breakdown.TaxTotal.Value)
+			assert.Nil(t, unit.Amount.Breakdown.Discount)
+			require.Len(t, unit.Items, 2)
+			assert.Equal(t, "tumbler", unit.Items[0].Name)
+			assert.Equal(t, "456-i-rollover-all-things", unit.Items[0].SKU)
+			assert.Equal(t, "2", unit.Items[0].Quantity)
+			assert.Equal(t, "0.05", unit.Items[0].UnitAmount.Value)
+			assert.Equal(t, rsp.ID, storedPaymentID(test))
+
+			// the approved PayPal order pays for the order
+			server.Approve(rsp.ID)
+			extractPayload(t, http.StatusOK, payPayPalOrder(test, rsp.ID), &models.Transaction{})
+		})
+		t.Run("WithDiscount", func(t *testing.T) {
+			test := unpaidOrder(t)
+			require.NoError(t, test.DB.Model(test.Data.secondOrder).Updates(map[string]interface{}{"discount": 10, "total": 45}).Error)
 
-			globalConfig := new(conf.GlobalConfiguration)
-			ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
-			require.NoError(t, err)
-			NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler.ServeHTTP(recorder, req)
+			recorder := preauthorizeJSON(test, &paypalPreauthorizeParams{Provider: payments.PayPalProvider}, test.Data.testUserToken)
+			rsp := payments.PreauthorizationResult{}
+			extractPayload(t, http.StatusOK, recorder, &rsp)
+			amount := server.Order(rsp.ID).PurchaseUnits[0].Amount
+			assert.Equal(t, "0.45", amount.Value)
+			require.NotNil(t, amount.Breakdown)
+			assert.Equal(t, "0.10", amount.Breakdown.Discount.Value)
+		})
+		t.Run("ZeroDecimalCurrency", func(t *testing.T) {
+			test := unpaidOrder(t)
+			require.NoError(t, test.DB.Model(test.Data.secondOrder).Update("currency", "JPY").Error)
+			test.Data.secondOrder.Currency = "JPY"
 
+			recorder := preauthorizeJSON(test, &paypalPreauthorizeParams{Provider: payments.PayPalProvider}, test.Data.testUserToken)
 			rsp := payments.PreauthorizationResult{}
 			extractPayload(t, http.StatusOK, recorder, &rsp)
-			assert.Equal(t, paymentID, rsp.ID)
-			assert.Equal(t, 1, loginCount, "too many login calls")
-			assert.Equal(t, 1, paymentCount, "too many payment calls")
-
-			require.Len(t, createData.Transactions, 1)
-			assert.Equal(t, "sale", createData.Intent)
-			assert.Equal(t, "10.00", createData.Transactions[0].Amount.Total)
-			assert.Equal(t, "USD", createData.Transactions[0].Amount.Currency)
-			assert.Equal(t, "test", createData.Transactions[0].Description)
+			unit := server.Order(rsp.ID).PurchaseUnits[0]
+			assert.Equal(t, "55", unit.Amount.Value)
+			assert.Equal(t, "JPY", unit.Amount.CurrencyCode)
+			assert.Equal(t, "5", unit.Items[0].UnitAmount.Value)
+
+			server.Approve(rsp.ID)
+			extractPayload(t, http.StatusOK, payPayPalOrder(test, rsp.ID), &models.Transaction{})
+		})
+		t.Run("Replaced", func(t *testing.T) {
+			test := unpaidOrder(t)
+			first := payments.PreauthorizationResult{}
+			extractPayload(t, http.StatusOK, preauthorizeJSON(test, &paypalPreauthorizeParams{Provider: payments.PayPalProvider}, test.Data.testUserToken), &first)
+			second := payments.PreauthorizationResult{}
+			extractPayload(t, http.StatusOK, preauthorizeJSON(test, &paypalPreauthorizeParams{Provider: payments.PayPalProvider}, test.Data.testUserToken), &second)
+			assert.Equal(t, second.ID, storedPaymentID(test))
+
+			// only the latest preauthorization pays for the order
+			server.Approve(first.ID)
+			validateError(t, http.StatusBadRequest, payPayPalOrder(test, first.ID))
+			assert.Equal(t, "APPROVED", server.Order(first.ID).Status)
+		})
+		t.Run("Stranger", func(t *testing.T) {
+			test := unpaidOrder(t)
+			recorder := preauthorizeJSON(test, &paypalPreauthorizeParams{Provider: payments.PayPalProvider}, testToken("stranger", "stranger@example.com"))
+			validateError(t, http.StatusUnauthorized, recorder)
+			assert.Empty(t, storedPaymentID(test))
 		})
+		t.Run("Paid", func(t *testing.T) {
+			test := NewRouteTest(t)
+			recorder := preauthorizeJSON(test, &paypalPreauthorizeParams{Provider: payments.PayPalProvider}, test.Data.testUserToken)
+			validateError(t, http.StatusBadRequest, recorder)
+		})
+	})
+}
+
+func TestCreatePaymentProviders(t *testing.T) {
+	t.Run("Providers", func(t *testing.T) {
+		config := &conf.Configuration{}
+		config.Payment.Stripe.Enabled = true
+		config.Payment.Stripe.SecretKey = "secret"
+		config.Payment.Providers = conf.PaymentProviders{
+			payments.ManualProvider: json.RawMessage(`{"instructions": "Pay {{ .Amount }}"}`),
+		}
+		provs, err := createPaymentProviders(config)
+		require.NoError(t, err)
+		require.Len(t, provs, 2)
+		assert.Equal(t, payments.StripeProvider, provs[payments.StripeProvider].Name())
+
+		instructions, err := provs[payments.ManualProvider].(payments.OfflineProvider).Instructions(1250, "USD", "first-order")
+		require.NoError(t, err)
+		assert.Equal(t, "Pay 12.50", instructions)
+
+		instructions, err = provs[payments.ManualProvider].(payments.OfflineProvider).Instructions(123456, "JPY", "first-order")
+		require.NoError(t, err)
+		assert.Equal(t, "Pay 123,456", instructions)
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		config := &conf.Configuration{}
+		config.Payment.Stripe.Enabled = true
+		config.Payment.Providers = conf.PaymentProviders{
+			payments.StripeProvider: json.RawMessage(`{"secret_key": "secret"}`),
+		}
+		provs, err := createPaymentProviders(config)
+		require.NoError(t, err)
+		assert.Len(t, provs, 1)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		config := &conf.Configuration{}
+		config.Payment.Providers = conf.PaymentProviders{"unknown": nil}
+		_, err := createPaymentProviders(config)
+		assert.Error(t, err)
+	})
+
+	t.Run("Environment", func(t *testing.T) {
+		provs := conf.PaymentProviders{}
+		require.NoError(t, provs.Decode(`{"manual": {}, "stripe": {"secret_key": "secret"}}`))
+		assert.Len(t, provs, 2)
 	})
 }
 
@@ -566,38 +713,32 @@ type stripePaymentParams struct {
 }
 
 type paypalPaymentParams struct {
-	Amount       uint64 `json:"amount"`
-	Currency     string `json:"currency"`
-	PaypalID     string `json:"paypal_payment_id"`
-	PaypalUserID string `json:"paypal_user_id"`
-	Provider     string `json:"provider"`
+	Amount        uint64 `json:"amount"`
+	Currency      string `json:"currency"`
+	PaypalOrderID string `json:"paypal_order_id"`
+	Provider      string `json:"provider"`
 }
 
 type paypalPreauthorizeParams struct {
-	Amount      uint64 `json:"amount"`
-	Currency    string `json:"currency"`
-	Description string `json:"description"`
+	Description string `json:"description,omitempty"`
 	Provider    string `json:"provider"`
 }
 
-type paypalAmount struct {
-	Total    string `json:"total"`
-	Currency string `json:"currency"`
-}
-
-type paypalTransaction struct {
-	Amount      paypalAmount `json:"amount"`
-	Description string       `json:"description"`
-}
-
-type paypalPaymentCreateParams struct {
-	Intent       string              `json:"intent"`
-	Transactions []paypalTransaction `json:"transactions"`
-}
-
+// memProvider is a payment provider that charges successfully, unless it is
+// told to fail, and saves payment methods like Stripe. It records the
+// charges and refunds it makes.
 type memProvider struct {
 	refundCalls []refundCall
 	name        string
+
+	charges int
+	amounts []uint64
+	fail    bool
+
+	customers int
+	charged   []string
+	removed   []string
+	keys      []string
 }
 
 type refundCall struct {
@@ -620,7 +761,12 @@ func (mp *memProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (p
 }
 
 func (mp *memProvider) charge(amount uint64, currency string) (string, error) {
-	return "", errors.New("Shouldn't have called this")
+	mp.charges++
+	mp.amounts = append(mp.amounts, amount)
+	if mp.fail {
+		return "", errors.New("Card declined")
+	}
+	return fmt.Sprintf("charge-%d", mp.charges), nil
 }
 
 func (mp *memProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
@@ -640,6 +786,45 @@ func (mp *memProvider) preauthorize(amount uint64, currency string, description
 	return nil, nil
 }
 
+func (mp *memProvider) SaveMethod(ctx context.Context, r *http.Request, customerID, email string) (*payments.SavedMethod, error) {
+	body, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	params := &stripePaymentParams{}
+	if err := json.NewDecoder(body).Decode(params); err != nil {
+		return nil, err
+	}
+	if params.StripeToken == "" {
+		return nil, errors.New("No stripe_token")
+	}
+	if customerID == "" {
+		mp.customers++
+		customerID = fmt.Sprintf("cus_%d", mp.customers)
+	}
+	return &payments.SavedMethod{
+		CustomerID: customerID,
+		MethodID:   "card_" + params.StripeToken,
+		Brand:      "Visa",
+		Last4:      "4242",
+		ExpMonth:   12,
+		ExpYear:    2030,
+	}, nil
+}
+
+func (mp *memProvider) RemoveMethod(ctx context.Context, customerID, methodID string) error {
+	mp.removed = append(mp.removed, methodID)
+	return nil
+}
+
+func (mp *memProvider) NewSavedMethodCharger(ctx context.Context, customerID, methodID string) (payments.Charger, error) {
+	mp.keys = append(mp.keys, gcontext.GetIdempotencyKey(ctx))
+	return func(amount uint64, currency string) (string, error) {
+		mp.charged = append(mp.charged, methodID)
+		return mp.charge(amount, currency)
+	}, nil
+}
+
 type stripeCallFunc func(method, path, key string, body *stripe.RequestValues, params *stripe.Params)
 
 func NewTrackingStripeBackend(fn stripeCallFunc) stripe.Backend {
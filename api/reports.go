@@ -1,10 +1,17 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
 )
 
 type salesRow struct {
@@ -21,45 +28,159 @@ type productsRow struct {
 	Currency string `json:"currency"`
 }
 
+type reportParams struct {
+	Type string `json:"type"`
+	From *int64 `json:"from"`
+	To   *int64 `json:"to"`
+}
+
 // SalesReport lists the sales numbers for a period
 func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
-	instanceID := gcontext.GetInstanceID(r.Context())
+	from, to, err := getTimeQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	result, err := salesReport(a.db, gcontext.GetInstanceID(r.Context()), from, to)
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// ProductsReport list the products sold within a period
+func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
+	from, to, err := getTimeQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	result, err := productsReport(a.db, gcontext.GetInstanceID(r.Context()), from, to)
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// ReportCreate queues a report to be generated by a worker, for periods that
+// take too long to report on right away.
+func (a *API) ReportCreate(w http.ResponseWriter, r *http.Request) error {
+	params := &reportParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read report params: %v", err)
+	}
+	if params.Type != models.SalesReportType && params.Type != models.ProductsReportType {
+		return badRequestError("Unknown report type '%s'", params.Type)
+	}
+
+	report := &models.Report{
+		InstanceID: gcontext.GetInstanceID(r.Context()),
+		Type:       params.Type,
+	}
+	if params.From != nil {
+		from := time.Unix(*params.From, 0)
+		report.From = &from
+	}
+	if params.To != nil {
+		to := time.Unix(*params.To, 0)
+		report.To = &to
+	}
+
+	tx := a.db.Begin()
+	if err := models.EnqueueReport(tx, report); err != nil {
+		tx.Rollback()
+		return internalServerError("Error queuing report").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error queuing report").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusAccepted, report)
+}
 
-	query := a.db.
+// ReportView shows a queued report, with its rows once it was generated.
+func (a *API) ReportView(w http.ResponseWriter, r *http.Request) error {
+	report := &models.Report{}
+	result := a.db.Where("id = ? AND instance_id = ?", chi.URLParam(r, "report_id"), gcontext.GetInstanceID(r.Context())).First(report)
+	if result.RecordNotFound() {
+		return notFoundError("Report not found")
+	} else if result.Error != nil {
+		return internalServerError("Database error").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, report)
+}
+
+// generateReport generates a queued report. It is only marked as failed
+// once the job used up its attempts.
+func (a *API) generateReport(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+	payload := models.ReportJob{}
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	report := &models.Report{}
+	if result := db.Where("id = ?", payload.ReportID).First(report); result.Error != nil {
+		if result.RecordNotFound() {
+			log.Warnf("Report %s doesn't exist anymore", payload.ReportID)
+			return nil
+		}
+		return result.Error
+	}
+	if report.Status != models.ReportPending {
+		return nil
+	}
+
+	var rows interface{}
+	var err error
+	switch report.Type {
+	case models.SalesReportType:
+		rows, err = salesReport(db, report.InstanceID, report.From, report.To)
+	case models.ProductsReportType:
+		rows, err = productsReport(db, report.InstanceID, report.From, report.To)
+	default:
+		return report.Fail(db, fmt.Errorf("unknown report type '%s'", report.Type))
+	}
+	if err != nil {
+		if job.Attempts >= job.MaxAttempts {
+			if failErr := report.Fail(db, err); failErr != nil {
+				log.WithError(failErr).Error("Error saving failed report")
+			}
+		}
+		return err
+	}
+	return report.Complete(db, rows)
+}
+
+func salesReport(db *gorm.DB, instanceID string, from, to *time.Time) ([]*salesRow, error) {
+	query := db.
 		Model(&models.Order{}).
 		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency").
 		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
 		Group("currency")
-
-	query, err := parseTimeQueryParams(query, r.URL.Query())
-	if err != nil {
-		return badRequestError(err.Error())
+	if from != nil {
+		query = query.Where("created_at >= ?", from)
+	}
+	if to != nil {
+		query = query.Where("created_at <= ?", to)
 	}
 
 	rows, err := query.Rows()
 	if err != nil {
-		return internalServerError("Database error").WithInternalError(err)
+		return nil, err
 	}
 	defer rows.Close()
 	result := []*salesRow{}
 	for rows.Next() {
 		row := &salesRow{}
-		err = rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency)
-		if err != nil {
-			return internalServerError("Database error").WithInternalError(err)
+		if err := rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency); err != nil {
+			return nil, err
 		}
 		result = append(result, row)
 	}
-
-	return sendJSON(w, http.StatusOK, result)
+	return result, nil
 }
 
-// ProductsReport list the products sold within a period
-func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
-	instanceID := gcontext.GetInstanceID(r.Context())
-	ordersTable := a.db.NewScope(models.Order{}).QuotedTableName()
-	itemsTable := a.db.NewScope(models.LineItem{}).QuotedTableName()
-	query := a.db.
+func productsReport(db *gorm.DB, instanceID string, from, to *time.Time) ([]*productsRow, error) {
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	query := db.
 		Model(&models.LineItem{}).
 		Select("sku, path, sum(quantity * price) as total, currency").
 		Joins("JOIN " + ordersTable + " as orders " + "ON orders.id = " + itemsTable + ".order_id " + "AND orders.payment_state = 'paid'").
@@ -67,31 +188,25 @@ func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 		Order("total desc")
 
 	query = query.Where("orders.instance_id = ?", instanceID)
-	from, to, err := getTimeQueryParams(r.URL.Query())
-	if err != nil {
-		return badRequestError(err.Error())
-	}
 	if from != nil {
 		query = query.Where("orders.created_at >= ?", from)
 	}
 	if to != nil {
-		query.Where("orders.created_at <= ?", to)
+		query = query.Where("orders.created_at <= ?", to)
 	}
 
 	rows, err := query.Rows()
 	if err != nil {
-		return internalServerError("Database error").WithInternalError(err)
+		return nil, err
 	}
 	defer rows.Close()
 	result := []*productsRow{}
 	for rows.Next() {
 		row := &productsRow{}
-		err = rows.Scan(&row.Sku, &row.Path, &row.Total, &row.Currency)
-		if err != nil {
-			return internalServerError("Database error").WithInternalError(err)
+		if err := rows.Scan(&row.Sku, &row.Path, &row.Total, &row.Currency); err != nil {
+			return nil, err
 		}
 		result = append(result, row)
 	}
-
-	return sendJSON(w, http.StatusOK, result)
+	return result, nil
 }
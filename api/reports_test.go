@@ -0,0 +1,52 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestReportQueued(t *testing.T) {
+	test := NewRouteTest(t)
+	token := testAdminToken("magical-unicorn", "")
+
+	recorder := test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token)
+	expected := []*salesRow{}
+	extractPayload(t, http.StatusOK, recorder, &expected)
+	require.NotEmpty(t, expected)
+
+	recorder = test.TestEndpoint(http.MethodPost, "/reports", jsonBody(t, map[string]interface{}{"type": "sales"}), token)
+	report := &models.Report{}
+	extractPayload(t, http.StatusAccepted, recorder, report)
+	assert.Equal(t, models.ReportPending, report.Status)
+
+	job := &models.Job{}
+	require.NoError(t, test.DB.Where("type = ?", models.ReportJobType).First(job).Error)
+	a := &API{config: test.GlobalConfig, db: test.DB, httpClient: &http.Client{}}
+	require.NoError(t, a.generateReport(context.Background(), test.DB, job, logrus.StandardLogger()))
+
+	recorder = test.TestEndpoint(http.MethodGet, "/reports/"+report.ID, nil, token)
+	generated := &struct {
+		Status string      `json:"status"`
+		Rows   []*salesRow `json:"rows"`
+	}{}
+	extractPayload(t, http.StatusOK, recorder, generated)
+	assert.Equal(t, models.ReportDone, generated.Status)
+	assert.Equal(t, expected, generated.Rows)
+
+	t.Run("UnknownType", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodPost, "/reports", jsonBody(t, map[string]interface{}{"type": "refunds"}), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/unknown", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
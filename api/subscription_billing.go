@@ -0,0 +1,379 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/jobs"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDunningRetries are the days after which a failed renewal is charged
+// again, unless the instance configures others.
+var defaultDunningRetries = []int{1, 3, 7}
+
+var errRenewalInProgress = errors.New("Subscription is renewed by another job")
+
+// renewSubscription bills a subscription that is due. Failed charges are
+// retried through dunning rather than the job, which only fails when the
+// subscription couldn't be billed at all.
+func (a *API) renewSubscription(w *jobs.Worker) jobs.Handler {
+	return func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+		payload := models.SubscriptionJob{}
+		if err := job.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		s := &models.Subscription{}
+		if result := db.Where("id = ?", payload.SubscriptionID).First(s); result.Error != nil {
+			if result.RecordNotFound() {
+				log.Warnf("Subscription %s doesn't exist anymore", payload.SubscriptionID)
+				return nil
+			}
+			return result.Error
+		}
+		if !s.DueAt(payload.BillingAt) {
+			// paused, canceled or rescheduled in the meantime
+			return nil
+		}
+
+		config, err := w.InstanceConfig(s.InstanceID)
+		if err != nil {
+			return err
+		}
+		ctx, err = WithInstanceConfig(ctx, a.config.SMTP, config, s.InstanceID)
+		if err != nil {
+			return err
+		}
+		return a.billSubscription(ctx, s, log.WithField("subscription_id", s.ID))
+	}
+}
+
+// billSubscription charges the renewal of a subscription to its saved payment
+// method.
+func (a *API) billSubscription(ctx context.Context, s *models.Subscription, log logrus.FieldLogger) error {
+	order, err := a.renewalOrder(ctx, s)
+	if err == errRenewalInProgress {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	log = log.WithField("order_id", order.ID)
+	if order.PaymentState == models.PaidState {
+		// paid by the customer since the last attempt
+		return nil
+	}
+
+	tx := a.db.Begin()
+	invoiceNumber, formattedNumber, httpErr := a.prepareOrderPayment(ctx, tx, order)
+	if httpErr != nil {
+		tx.Rollback()
+		if httpErr.Cause() == models.ErrNotRenewalOrder {
+			// renewed by a job that ran at the same time
+			return nil
+		}
+		if httpErr.Code == http.StatusBadRequest {
+			return a.renewalFailed(ctx, s, order, "", fmt.Errorf("%s", httpErr.Message), log)
+		}
+		return httpErr.Cause()
+	}
+
+	var processorID string
+	if order.Total > 0 {
+		// a job that is claimed again while the charge is still running
+		// charges the same order, which providers then only charge once
+		var charge payments.Charger
+		charge, err = a.savedMethodCharger(gcontext.WithIdempotencyKey(ctx, order.ID), s)
+		if err == nil {
+			processorID, err = chargeWithin(ctx, charge, order.Total, order.Currency)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		if ctx.Err() != nil {
+			// the charge may still go through, so it's retried with the job
+			// instead of counting as a failed renewal
+			return err
+		}
+		return a.renewalFailed(ctx, s, order, processorID, err, log)
+	}
+
+	result := tx.Model(order).Where("payment_state <> ?", models.PaidState).UpdateColumn("payment_state", models.PaidState)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return a.refundDuplicateCharge(ctx, s, order, processorID, log)
+	}
+
+	tr := models.NewTransaction(order)
+	tr.ProcessorID = processorID
+	tr.PaymentMethodID = s.PaymentMethodID
+	tr.Status = models.PaidState
+	if result := tx.Create(tr); result.Error != nil {
+		tx.Rollback()
+		log.WithError(result.Error).WithField("processor_id", processorID).Error("Error saving renewal charge")
+		return result.Error
+	}
+	order.PaymentProcessor = s.PaymentProcessor
+	order.PaymentState = models.PaidState
+	order.InvoiceNumber = invoiceNumber
+	order.FormattedInvoiceNumber = formattedNumber
+	if result := tx.Save(order); result.Error != nil {
+		tx.Rollback()
+		log.WithError(result.Error).WithField("processor_id", processorID).Error("Error saving renewal order")
+		return result.Error
+	}
+	a.orderPaid(ctx, tx, order, tr, log)
+	if result := tx.Commit(); result.Error != nil {
+		return result.Error
+	}
+
+	log.Infof("Renewed subscription with charge %s", processorID)
+	return nil
+}
+
+// refundDuplicateCharge refunds a charge of a renewal order that was paid
+// otherwise while it was charged. The charge is recorded with its refund, so
+// a refund that fails can be made by hand. A job that is claimed again
+// charges with the same idempotency key, and gets back the charge the order
+// was already paid with, which is kept.
+func (a *API) refundDuplicateCharge(ctx context.Context, s *models.Subscription, order *models.Order, processorID string, log logrus.FieldLogger) error {
+	if processorID == "" {
+		// nothing was charged
+		return nil
+	}
+	var charges int
+	if result := a.db.Model(&models.Transaction{}).Where("order_id = ? AND processor_id = ?", order.ID, processorID).Count(&charges); result.Error != nil {
+		return result.Error
+	}
+	if charges > 0 {
+		return nil
+	}
+
+	tr := models.NewTransaction(order)
+	tr.ProcessorID = processorID
+	tr.PaymentMethodID = s.PaymentMethodID
+	tr.Status = models.PaidState
+	if result := a.db.Create(tr); result.Error != nil {
+		log.WithError(result.Error).WithField("processor_id", processorID).Error("Error saving duplicate renewal charge")
+		return result.Error
+	}
+
+	m := &models.Transaction{
+		InstanceID: order.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		Amount:     tr.Amount,
+		Currency:   tr.Currency,
+		UserID:     tr.UserID,
+		OrderID:    order.ID,
+		ChargeID:   tr.ID,
+		Type:       models.RefundTransactionType,
+	}
+	var refundID string
+	var err error
+	provider := gcontext.GetPaymentProviders(ctx)[s.PaymentProcessor]
+	if provider == nil {
+		err = fmt.Errorf("Payment provider '%s' not configured", s.PaymentProcessor)
+	} else {
+		var refund payments.Refunder
+		refund, err = provider.NewRefunder(ctx, nil)
+		if err == nil {
+			refundID, err = refund(processorID, tr.Amount, tr.Currency)
+		}
+	}
+	if err != nil {
+		log.WithError(err).WithField("processor_id", processorID).Error("Failed to refund duplicate renewal charge")
+		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+		m.FailureDescription = err.Error()
+		m.Status = models.FailedState
+	} else {
+		log.Warnf("Refunded charge %s of renewal order that was already paid", processorID)
+		m.ProcessorID = refundID
+		m.Status = models.PaidState
+	}
+	if result := a.db.Create(m); result.Error != nil {
+		log.WithError(result.Error).WithField("processor_id", m.ProcessorID).Error("Error saving refund of duplicate renewal charge")
+		return result.Error
+	}
+	return nil
+}
+
+// chargeWithin charges in the background, and gives up waiting for the
+// provider when the context ends.
+func chargeWithin(ctx context.Context, charge payments.Charger, amount uint64, currency string) (string, error) {
+	type chargeResult struct {
+		processorID string
+		err         error
+	}
+	done := make(chan chargeResult, 1)
+	go func() {
+		processorID, err := charge(amount, currency)
+		done <- chargeResult{processorID, err}
+	}()
+	select {
+	case result := <-done:
+		return result.processorID, result.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (a *API) savedMethodCharger(ctx context.Context, s *models.Subscription) (payments.Charger, error) {
+	if s.PaymentMethodID == "" {
+		return nil, fmt.Errorf("Subscription has no saved payment method")
+	}
+	method := &models.PaymentMethod{}
+	if result := a.db.Where("id = ? AND user_id = ?", s.PaymentMethodID, s.UserID).First(method); result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, fmt.Errorf("Saved payment method %s was removed", s.PaymentMethodID)
+		}
+		return nil, result.Error
+	}
+	saver, err := savedMethodProvider(ctx, method.Provider)
+	if err != nil {
+		return nil, err
+	}
+	return saver.NewSavedMethodCharger(ctx, method.CustomerID, method.ProviderMethodID)
+}
+
+// renewalOrder loads the unpaid order of the last renewal, or creates the
+// order of a new one. It is committed right away, so the customer can pay it
+// when charging it fails.
+func (a *API) renewalOrder(ctx context.Context, s *models.Subscription) (*models.Order, error) {
+	if s.RenewalOrderID != "" {
+		order := &models.Order{}
+		if result := a.db.Preload("LineItems").Preload("BillingAddress").First(order, "id = ?", s.RenewalOrderID); result.Error != nil {
+			return nil, result.Error
+		}
+		return order, nil
+	}
+
+	first := &models.Order{}
+	if result := a.db.Preload("ShippingAddress").Preload("BillingAddress").First(first, "id = ?", s.OrderID); result.Error != nil {
+		return nil, result.Error
+	}
+	settings, err := a.loadSettings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order := models.NewOrder(s.InstanceID, "", s.Email, s.Currency)
+	order.UserID = s.UserID
+	order.Locale = first.Locale
+	order.VATNumber = first.VATNumber
+	order.ShippingAddress = first.ShippingAddress
+	order.ShippingAddressID = first.ShippingAddressID
+	order.BillingAddress = first.BillingAddress
+	order.BillingAddressID = first.BillingAddressID
+	order.SubscriptionID = s.ID
+	order.LineItems = []*models.LineItem{{
+		OrderID:  order.ID,
+		Title:    s.Title,
+		Sku:      s.Plan,
+		Type:     s.Type,
+		Path:     s.Path,
+		Price:    s.Price,
+		VAT:      s.VAT,
+		Quantity: s.Quantity,
+	}}
+	order.CalculateTotal(settings, nil)
+
+	tx := a.db.Begin()
+	if result := tx.Create(order); result.Error != nil {
+		tx.Rollback()
+		return nil, result.Error
+	}
+	// only one renewal order per period, even if two jobs bill at once
+	result := tx.Model(s).Where("renewal_order_id = ''").Update("renewal_order_id", order.ID)
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return nil, errRenewalInProgress
+	}
+	s.RenewalOrderID = order.ID
+	if err := a.triggerWebhooks(ctx, tx, models.WebhookOrderCreated, order.UserID, order); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return nil, result.Error
+	}
+	return order, nil
+}
+
+// renewalFailed records a failed renewal and schedules the next dunning
+// retry. The subscription is canceled when it has no retries left.
+func (a *API) renewalFailed(ctx context.Context, s *models.Subscription, order *models.Order, processorID string, chargeErr error, log logrus.FieldLogger) error {
+	retries := gcontext.GetConfig(ctx).Subscriptions.DunningRetries
+	if len(retries) == 0 {
+		retries = defaultDunningRetries
+	}
+
+	// the subscription is only changed while it's still billed with the
+	// order, and not paused, canceled or renewed in the meantime
+	tx := a.db.Begin()
+	query := tx.Model(&models.Subscription{}).Where("id = ? AND status = ? AND renewal_order_id = ? AND failed_attempts = ?", s.ID, s.Status, order.ID, s.FailedAttempts)
+	s.FailedAttempts++
+	updates := map[string]interface{}{"failed_attempts": s.FailedAttempts}
+	if s.FailedAttempts > len(retries) {
+		s.Cancel(models.CanceledUnpaid)
+		updates["canceled_at"] = s.CanceledAt
+		updates["cancel_reason"] = s.CancelReason
+	} else {
+		s.RetryAt(time.Now().AddDate(0, 0, retries[s.FailedAttempts-1]))
+	}
+	updates["status"] = s.Status
+	updates["next_billing_at"] = s.NextBillingAt
+	result := query.Updates(updates)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		log.WithError(chargeErr).Info("Renewal failed, but the subscription was changed in the meantime")
+		return nil
+	}
+
+	tr := models.NewTransaction(order)
+	tr.ProcessorID = processorID
+	tr.FailureCode = strconv.FormatInt(http.StatusPaymentRequired, 10)
+	tr.FailureDescription = chargeErr.Error()
+	tr.Status = models.FailedState
+	if result := tx.Create(tr); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	bestEffort(tx, log, "Error queuing payment failed email", func() error {
+		return models.EnqueueEmail(tx, models.NewTransactionEmail(models.PaymentFailedEmail, tr))
+	})
+
+	if s.Status == models.SubscriptionCanceled {
+		bestEffort(tx, log, "Error queuing subscription canceled email", func() error {
+			return models.EnqueueEmail(tx, models.NewOrderEmail(models.SubscriptionCanceledEmail, order))
+		})
+		log.WithError(chargeErr).Warnf("Renewal failed %d times, canceled subscription", s.FailedAttempts)
+	} else {
+		log.WithError(chargeErr).Warnf("Renewal failed, retrying at %v", s.NextBillingAt)
+	}
+	if err := models.ScheduleSubscription(tx, s); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+// SubscriptionList lists the subscriptions of the user, or all of them for
+// admins listing the subscriptions of the user "all".
+func (a *API) SubscriptionList(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	claims := gcontext.GetClaims(ctx)
+
+	query := a.db.Where("instance_id = ?", gcontext.GetInstanceID(ctx))
+	userID := gcontext.GetUserID(ctx)
+	if userID == "" {
+		userID = claims.Subject
+	}
+	if userID != "all" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Subscription{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	subscriptions := []models.Subscription{}
+	if result := query.Order("created_at desc").Offset(offset).Limit(limit).Find(&subscriptions); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, subscriptions)
+}
+
+// SubscriptionView shows a subscription.
+func (a *API) SubscriptionView(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, s)
+}
+
+// SubscriptionCancel stops renewing a subscription. It stays usable until the
+// end of the period that was paid for.
+func (a *API) SubscriptionCancel(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if s.Status == models.SubscriptionCanceled {
+		return badRequestError("Subscription is already canceled")
+	}
+
+	before := auditSnapshot(s)
+	reason := models.CanceledByCustomer
+	if claims := gcontext.GetClaims(r.Context()); gcontext.IsAdmin(r.Context()) && claims.Subject != s.UserID {
+		reason = models.CanceledByAdmin
+	}
+	s.Cancel(reason)
+	return a.saveSubscription(w, r, "subscription.cancel", before, s)
+}
+
+// SubscriptionPause stops billing a subscription until it is resumed.
+func (a *API) SubscriptionPause(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if s.Status != models.SubscriptionActive && s.Status != models.SubscriptionTrialing {
+		return badRequestError("Only active subscriptions can be paused")
+	}
+
+	before := auditSnapshot(s)
+	s.Pause()
+	return a.saveSubscription(w, r, "subscription.pause", before, s)
+}
+
+// SubscriptionResume bills a paused subscription again.
+func (a *API) SubscriptionResume(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if s.Status != models.SubscriptionPaused {
+		return badRequestError("Subscription is not paused")
+	}
+
+	before := auditSnapshot(s)
+	s.Resume()
+	return a.saveSubscription(w, r, "subscription.resume", before, s)
+}
+
+// loadSubscription loads a subscription of the instance that belongs to the
+// user, or any subscription for admins.
+func (a *API) loadSubscription(r *http.Request) (*models.Subscription, *HTTPError) {
+	ctx := r.Context()
+	subscriptionID := chi.URLParam(r, "subscription_id")
+	logEntrySetField(r, "subscription_id", subscriptionID)
+
+	s := &models.Subscription{}
+	if result := a.db.Where("id = ? AND instance_id = ?", subscriptionID, gcontext.GetInstanceID(ctx)).First(s); result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Subscription not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	claims := gcontext.GetClaims(ctx)
+	if !gcontext.IsAdmin(ctx) && (s.UserID == "" || claims == nil || claims.Subject != s.UserID) {
+		return nil, unauthorizedError("You don't have permission to access this subscription")
+	}
+	return s, nil
+}
+
+func (a *API) saveSubscription(w http.ResponseWriter, r *http.Request, action string, before interface{}, s *models.Subscription) error {
+	tx := a.db.Begin()
+	if result := tx.Save(s); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving subscription").WithInternalError(result.Error)
+	}
+	if err := models.ScheduleSubscription(tx, s); err != nil {
+		tx.Rollback()
+		return internalServerError("Error scheduling subscription").WithInternalError(err)
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(r.Context()), action, "subscription", s.ID, before, s); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error saving subscription").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,374 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/jobs"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// subscriptionTest sells the product of the unpaid order as a monthly
+// subscription of the site and pays for it.
+func subscriptionTest(t *testing.T, site *httptest.Server, trialDays uint64) (*RouteTest, *memProvider, *models.Subscription) {
+	test := NewRouteTest(t)
+	test.Config.SiteURL = site.URL
+	test.Config.Payment.Stripe.Enabled = true
+	test.Config.Payment.Stripe.SecretKey = "secret"
+	test.Config.Subscriptions.DunningRetries = []int{1, 2}
+	order := test.Data.unpaidOrder
+	require.NoError(t, test.DB.Model(test.Data.unpaidLineItem).Updates(map[string]interface{}{
+		"interval":        models.MonthInterval,
+		"interval_count":  1,
+		"trial_days":      trialDays,
+		"recurring_price": test.Data.unpaidLineItem.Price,
+	}).Error)
+	if trialDays > 0 {
+		require.NoError(t, test.DB.Model(order).Update("total", 0).Error)
+		order.Total = 0
+	}
+
+	provider := &memProvider{name: payments.StripeProvider}
+	recorder := payUnpaidOrder(test, provider)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	s := &models.Subscription{}
+	require.NoError(t, test.DB.Where("order_id = ?", order.ID).First(s).Error)
+	return test, provider, s
+}
+
+// monthsAfter is the same day some months after a time, or the last day of
+// shorter months.
+func monthsAfter(t time.Time, months int) time.Time {
+	later := t.AddDate(0, months, 0)
+	if later.Day() != t.Day() {
+		later = later.AddDate(0, 0, -later.Day())
+	}
+	return later
+}
+
+// billingAPI is the API of the renewal jobs, with the provider in place of
+// the configured Stripe provider.
+func billingAPI(test *RouteTest, provider payments.Provider) (*API, context.Context) {
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{payments.StripeProvider: provider})
+	return &API{config: test.GlobalConfig, db: test.DB, httpClient: &http.Client{}}, ctx
+}
+
+func billSubscription(test *RouteTest, provider payments.Provider, s *models.Subscription) {
+	a, ctx := billingAPI(test, provider)
+	require.NoError(test.T, a.billSubscription(ctx, s, logrus.StandardLogger()))
+}
+
+// runRenewalJob runs the last renewal job scheduled for a subscription
+// through the job handler.
+func runRenewalJob(test *RouteTest, s *models.Subscription) *models.Subscription {
+	job := &models.Job{}
+	require.NoError(test.T, test.DB.Where("type = ?", models.SubscriptionRenewalJobType).Order("id desc").First(job).Error)
+	w := jobs.NewWorker(test.DB, test.GlobalConfig, test.Config, logrus.StandardLogger())
+	a := &API{config: test.GlobalConfig, db: test.DB, httpClient: &http.Client{}}
+	require.NoError(test.T, a.renewSubscription(w)(context.Background(), test.DB, job, logrus.StandardLogger()))
+
+	reloaded := &models.Subscription{}
+	require.NoError(test.T, test.DB.First(reloaded, "id = ?", s.ID).Error)
+	return reloaded
+}
+
+func countEmails(test *RouteTest, emailType string) int {
+	var count int
+	require.NoError(test.T, test.DB.Model(&models.Email{}).Where("type = ?", emailType).Count(&count).Error)
+	return count
+}
+
+func TestSubscriptionStart(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 0)
+
+	assert.Equal(t, 1, provider.charges)
+	assert.Equal(t, models.SubscriptionActive, s.Status)
+	assert.Equal(t, test.Data.testUser.ID, s.UserID)
+	assert.Equal(t, "789-i-drive-at-night-012", s.Plan)
+	assert.Equal(t, test.Data.unpaidLineItem.Price, s.Price)
+	assert.Equal(t, monthsAfter(s.CurrentPeriodStart, 1).Unix(), s.CurrentPeriodEnd.Unix())
+	require.NotNil(t, s.NextBillingAt)
+	assert.Equal(t, s.CurrentPeriodEnd.Unix(), s.NextBillingAt.Unix())
+
+	job := &models.Job{}
+	require.NoError(t, test.DB.Where("type = ?", models.SubscriptionRenewalJobType).First(job).Error)
+	assert.Equal(t, s.NextBillingAt.Unix(), job.RunAfter.Unix())
+
+	recorder := test.TestEndpoint(http.MethodGet, "/subscriptions", nil, test.Data.testUserToken)
+	subscriptions := []models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, &subscriptions)
+	require.Len(t, subscriptions, 1)
+	assert.Equal(t, s.ID, subscriptions[0].ID)
+}
+
+func TestSubscriptionTrial(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 14)
+
+	assert.Equal(t, 0, provider.charges)
+	assert.Equal(t, models.SubscriptionTrialing, s.Status)
+	require.NotNil(t, s.TrialEndsAt)
+	assert.Equal(t, s.CurrentPeriodStart.AddDate(0, 0, 14).Unix(), s.TrialEndsAt.Unix())
+	assert.Equal(t, s.TrialEndsAt.Unix(), s.NextBillingAt.Unix())
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", "unpaid-order").Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+}
+
+func TestSubscriptionRenewal(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 0)
+	periodEnd := s.CurrentPeriodEnd
+	method := &models.PaymentMethod{ID: "method-1", UserID: s.UserID, Provider: payments.StripeProvider, CustomerID: "cus_1", ProviderMethodID: "card-1"}
+	require.NoError(t, test.DB.Create(method).Error)
+	s.PaymentMethodID = method.ID
+	require.NoError(t, test.DB.Save(s).Error)
+
+	billSubscription(test, provider, s)
+	assert.Equal(t, []string{"card-1"}, provider.charged)
+	assert.Equal(t, 2, provider.charges)
+
+	renewal := &models.Order{}
+	require.NoError(t, test.DB.Preload("LineItems").Where("subscription_id = ?", s.ID).First(renewal).Error)
+	assert.Equal(t, models.PaidState, renewal.PaymentState)
+	assert.NotZero(t, renewal.InvoiceNumber)
+	tr := &models.Transaction{}
+	require.NoError(t, test.DB.Where("order_id = ?", renewal.ID).First(tr).Error)
+	assert.Equal(t, method.ID, tr.PaymentMethodID)
+	assert.Equal(t, []string{renewal.ID}, provider.keys)
+	assert.Equal(t, test.Data.testUser.ID, renewal.UserID)
+	require.Len(t, renewal.LineItems, 1)
+	assert.Equal(t, s.Price, renewal.LineItems[0].Price)
+
+	reloaded := &models.Subscription{}
+	require.NoError(t, test.DB.First(reloaded, "id = ?", s.ID).Error)
+	assert.Equal(t, models.SubscriptionActive, reloaded.Status)
+	assert.Equal(t, periodEnd.Unix(), reloaded.CurrentPeriodStart.Unix())
+	assert.Equal(t, monthsAfter(s.CurrentPeriodStart, 2).Unix(), reloaded.CurrentPeriodEnd.Unix())
+	assert.Empty(t, reloaded.RenewalOrderID)
+
+	var scheduled int
+	require.NoError(t, test.DB.Model(&models.Job{}).Where("type = ?", models.SubscriptionRenewalJobType).Count(&scheduled).Error)
+	assert.Equal(t, 2, scheduled)
+}
+
+func TestSubscriptionRenewalEndOfMonth(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 0)
+
+	// started on January 31st, and renewed at the end of February
+	start := time.Date(2021, time.January, 31, 10, 0, 0, 0, time.UTC)
+	end := time.Date(2021, time.February, 28, 10, 0, 0, 0, time.UTC)
+	s.CurrentPeriodStart = start
+	s.CurrentPeriodEnd = end
+	s.NextBillingAt = &end
+	s.BillingAnchorDay = 31
+	method := &models.PaymentMethod{ID: "method-1", UserID: s.UserID, Provider: payments.StripeProvider, CustomerID: "cus_1", ProviderMethodID: "card-1"}
+	require.NoError(t, test.DB.Create(method).Error)
+	s.PaymentMethodID = method.ID
+	require.NoError(t, test.DB.Save(s).Error)
+
+	billSubscription(test, provider, s)
+	reloaded := &models.Subscription{}
+	require.NoError(t, test.DB.First(reloaded, "id = ?", s.ID).Error)
+	assert.Equal(t, end.Unix(), reloaded.CurrentPeriodStart.Unix())
+	assert.Equal(t, time.Date(2021, time.March, 31, 10, 0, 0, 0, time.UTC).Unix(), reloaded.CurrentPeriodEnd.Unix())
+}
+
+func TestSubscriptionDunning(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 0)
+
+	// the subscription has no saved payment method, so renewals fail
+	s = runRenewalJob(test, s)
+	assert.Equal(t, models.SubscriptionPastDue, s.Status)
+	assert.Equal(t, 1, s.FailedAttempts)
+	require.NotNil(t, s.NextBillingAt)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 1), *s.NextBillingAt, time.Minute)
+	require.NotEmpty(t, s.RenewalOrderID)
+	renewalOrderID := s.RenewalOrderID
+	assert.Equal(t, 1, countEmails(test, models.PaymentFailedEmail))
+
+	failed := &models.Transaction{}
+	require.NoError(t, test.DB.Where("order_id = ?", renewalOrderID).First(failed).Error)
+	assert.Equal(t, models.FailedState, failed.Status)
+
+	s = runRenewalJob(test, s)
+	assert.Equal(t, models.SubscriptionPastDue, s.Status)
+	assert.Equal(t, 2, s.FailedAttempts)
+	assert.Equal(t, renewalOrderID, s.RenewalOrderID)
+
+	s = runRenewalJob(test, s)
+	assert.Equal(t, models.SubscriptionCanceled, s.Status)
+	assert.Equal(t, models.CanceledUnpaid, s.CancelReason)
+	assert.Nil(t, s.NextBillingAt)
+	assert.Equal(t, 3, countEmails(test, models.PaymentFailedEmail))
+	assert.Equal(t, 1, countEmails(test, models.SubscriptionCanceledEmail))
+	assert.Equal(t, 1, provider.charges)
+
+	t.Run("PaidByCustomer", func(t *testing.T) {
+		renewal := &models.Order{}
+		require.NoError(t, test.DB.First(renewal, "id = ?", renewalOrderID).Error)
+		body, err := json.Marshal(&stripePaymentParams{
+			Amount:      renewal.Total,
+			Currency:    renewal.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		})
+		require.NoError(t, err)
+		recorder := providerRequest(test, provider, http.MethodPost, "/orders/"+renewal.ID+"/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		reloaded := &models.Subscription{}
+		require.NoError(t, test.DB.First(reloaded, "id = ?", s.ID).Error)
+		assert.Equal(t, models.SubscriptionActive, reloaded.Status)
+		assert.Zero(t, reloaded.FailedAttempts)
+		assert.NotNil(t, reloaded.NextBillingAt)
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		// the subscription was renewed, so its old renewal order can't be paid
+		// again
+		require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", renewalOrderID).Update("payment_state", models.PendingState).Error)
+		renewal := &models.Order{}
+		require.NoError(t, test.DB.First(renewal, "id = ?", renewalOrderID).Error)
+		charges := provider.charges
+		body, err := json.Marshal(&stripePaymentParams{
+			Amount:      renewal.Total,
+			Currency:    renewal.Currency,
+			StripeToken: "123456",
+			Provider:    payments.StripeProvider,
+		})
+		require.NoError(t, err)
+		recorder := providerRequest(test, provider, http.MethodPost, "/orders/"+renewal.ID+"/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Equal(t, charges, provider.charges)
+	})
+}
+
+func TestSubscriptionRenewalDuplicateCharge(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 0)
+
+	// the customer paid the renewal order while the job charged it
+	s = runRenewalJob(test, s)
+	renewal := &models.Order{}
+	require.NoError(t, test.DB.First(renewal, "id = ?", s.RenewalOrderID).Error)
+	require.NoError(t, test.DB.Model(renewal).Update("payment_state", models.PaidState).Error)
+
+	a, ctx := billingAPI(test, provider)
+	require.NoError(t, a.refundDuplicateCharge(ctx, s, renewal, "charge-9", logrus.StandardLogger()))
+	require.Len(t, provider.refundCalls, 1)
+	assert.Equal(t, "charge-9", provider.refundCalls[0].id)
+	assert.Equal(t, renewal.Total, provider.refundCalls[0].amount)
+
+	charge := &models.Transaction{}
+	require.NoError(t, test.DB.Where("order_id = ? AND processor_id = ?", renewal.ID, "charge-9").First(charge).Error)
+	assert.Equal(t, models.PaidState, charge.Status)
+	refund := &models.Transaction{}
+	require.NoError(t, test.DB.Where("charge_id = ?", charge.ID).First(refund).Error)
+	assert.Equal(t, models.RefundTransactionType, refund.Type)
+	assert.Equal(t, models.PaidState, refund.Status)
+	assert.Equal(t, "trans-1", refund.ProcessorID)
+
+	// the charge a job that ran twice gets back isn't refunded again
+	require.NoError(t, a.refundDuplicateCharge(ctx, s, renewal, "charge-9", logrus.StandardLogger()))
+	assert.Len(t, provider.refundCalls, 1)
+}
+
+func TestSubscriptionRenewalFailedAfterCancel(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, provider, s := subscriptionTest(t, server, 0)
+
+	a, ctx := billingAPI(test, provider)
+	order, err := a.renewalOrder(ctx, s)
+	require.NoError(t, err)
+	recorder := test.TestEndpoint(http.MethodPost, "/subscriptions/"+s.ID+"/cancel", nil, test.Data.testUserToken)
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+	// the failed charge leaves the cancellation by the customer as it is
+	require.NoError(t, a.renewalFailed(ctx, s, order, "", errors.New("Card declined"), logrus.StandardLogger()))
+	reloaded := &models.Subscription{}
+	require.NoError(t, test.DB.First(reloaded, "id = ?", s.ID).Error)
+	assert.Equal(t, models.SubscriptionCanceled, reloaded.Status)
+	assert.Equal(t, models.CanceledByCustomer, reloaded.CancelReason)
+	assert.Zero(t, reloaded.FailedAttempts)
+	assert.Nil(t, reloaded.NextBillingAt)
+	assert.Equal(t, 0, countEmails(test, models.PaymentFailedEmail))
+}
+
+func TestSubscriptionPauseResume(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, _, s := subscriptionTest(t, server, 0)
+	url := "/subscriptions/" + s.ID
+
+	recorder := test.TestEndpoint(http.MethodPost, url+"/pause", nil, test.Data.testUserToken)
+	paused := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, paused)
+	assert.Equal(t, models.SubscriptionPaused, paused.Status)
+	assert.Nil(t, paused.NextBillingAt)
+
+	// the renewal job scheduled before the pause does nothing
+	reloaded := runRenewalJob(test, s)
+	assert.Equal(t, models.SubscriptionPaused, reloaded.Status)
+	assert.Empty(t, reloaded.RenewalOrderID)
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/pause", nil, test.Data.testUserToken)
+	validateError(t, http.StatusBadRequest, recorder)
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/resume", nil, test.Data.testUserToken)
+	resumed := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, resumed)
+	assert.Equal(t, models.SubscriptionActive, resumed.Status)
+	require.NotNil(t, resumed.NextBillingAt)
+	assert.Equal(t, s.CurrentPeriodEnd.Unix(), resumed.NextBillingAt.Unix())
+}
+
+func TestSubscriptionCancel(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+	test, _, s := subscriptionTest(t, server, 0)
+	url := "/subscriptions/" + s.ID
+
+	recorder := test.TestEndpoint(http.MethodPost, url+"/cancel", nil, testToken("stranger", "stranger@example.com"))
+	validateError(t, http.StatusUnauthorized, recorder)
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/cancel", nil, test.Data.testUserToken)
+	canceled := &models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, canceled)
+	assert.Equal(t, models.SubscriptionCanceled, canceled.Status)
+	assert.Equal(t, models.CanceledByCustomer, canceled.CancelReason)
+	assert.Equal(t, s.CurrentPeriodEnd.Unix(), canceled.CurrentPeriodEnd.Unix())
+
+	recorder = test.TestEndpoint(http.MethodPost, url+"/cancel", nil, testAdminToken("magical-unicorn", ""))
+	validateError(t, http.StatusBadRequest, recorder)
+
+	recorder = test.TestEndpoint(http.MethodGet, "/subscriptions?status=active", nil, test.Data.testUserToken)
+	subscriptions := []models.Subscription{}
+	extractPayload(t, http.StatusOK, recorder, &subscriptions)
+	assert.Empty(t, subscriptions)
+}
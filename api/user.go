@@ -157,8 +157,17 @@ func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	rsp := a.db.Delete(user)
+	tx := a.db.Begin()
+	rsp := tx.Delete(user)
 	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("error while deleting user").WithInternalError(rsp.Error)
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "user.delete", "user", user.ID, user, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("error while deleting user").WithInternalError(rsp.Error)
 	}
 
@@ -179,14 +188,27 @@ func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	rsp := a.db.Delete(&models.Address{ID: addrID})
-	if rsp.RecordNotFound() {
+	addr := &models.Address{}
+	if rsp := a.db.First(addr, "id = ?", addrID); rsp.RecordNotFound() {
 		log.Warn("Attempted to delete an address that doesn't exist")
 		return nil
 	} else if rsp.Error != nil {
 		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
 	}
 
+	tx := a.db.Begin()
+	if rsp := tx.Delete(addr); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "address.delete", "address", addr.ID, addr, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
+	}
+
 	log.Info("deleted address")
 	return nil
 }
@@ -215,8 +237,16 @@ func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 		ID:             uuid.NewRandom().String(),
 		UserID:         userID,
 	}
-	rsp := a.db.Create(&addr)
-	if rsp.Error != nil {
+	tx := a.db.Begin()
+	if rsp := tx.Create(&addr); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("failed to save address").WithInternalError(rsp.Error)
+	}
+	if httpErr := a.audit(tx, r, gcontext.GetInstanceID(ctx), "address.create", "address", addr.ID, nil, addr); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("failed to save address").WithInternalError(rsp.Error)
 	}
 
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -251,6 +252,22 @@ func TestUserDelete(t *testing.T) {
 		assert.False(t, test.DB.Unscoped().First(&dyingLineItem).RecordNotFound())
 		assert.NotNil(t, dyingLineItem.DeletedAt, "line item wasn't deleted")
 	})
+	t.Run("Subscriptions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		next := time.Now().Add(24 * time.Hour)
+		s := &models.Subscription{ID: "subscription-1", UserID: test.Data.testUser.ID, OrderID: test.Data.firstOrder.ID, Status: models.SubscriptionActive, NextBillingAt: &next}
+		require.NoError(t, test.DB.Create(s).Error)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodDelete, "/users/"+test.Data.testUser.ID, nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+
+		require.NoError(t, test.DB.First(s, "id = ?", s.ID).Error)
+		assert.Equal(t, models.SubscriptionCanceled, s.Status)
+		assert.Equal(t, models.CanceledUserDeleted, s.CancelReason)
+		assert.Nil(t, s.NextBillingAt)
+		assert.False(t, s.DueAt(next))
+	})
 }
 
 func TestUserAddressDelete(t *testing.T) {
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -21,7 +22,9 @@ import (
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
 	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
 )
 
 const baseURL = "https://example.com"
@@ -129,6 +132,10 @@ type TestData struct {
 	secondTransaction *models.Transaction
 	secondLineItem1   *models.LineItem
 	secondLineItem2   *models.LineItem
+
+	// unpaidOrder hasn't been paid yet, for tests that pay for an order.
+	unpaidOrder    *models.Order
+	unpaidLineItem *models.LineItem
 }
 
 func setupTestData() *TestData {
@@ -224,6 +231,26 @@ func setupTestData() *TestData {
 	secondTransaction.Amount = secondOrder.Total
 	secondTransaction.Status = models.PaidState
 
+	unpaidOrder := models.NewOrder("", "session3", testUser.Email, "USD")
+	unpaidOrder.ID = "unpaid-order"
+	unpaidOrder.UserID = testUser.ID
+	unpaidLineItem := &models.LineItem{
+		ID:          31,
+		OrderID:     unpaidOrder.ID,
+		Title:       "batmobile",
+		Sku:         "789-i-drive-at-night-012",
+		Type:        "car",
+		Description: "it's the batmobile.",
+		Price:       12,
+		Quantity:    2,
+		Path:        "/i/drive/at/night",
+	}
+	unpaidOrder.LineItems = []*models.LineItem{unpaidLineItem}
+	unpaidOrder.CalculateTotal(&calculator.Settings{}, nil)
+	unpaidOrder.BillingAddress = testAddress
+	unpaidOrder.ShippingAddress = testAddress
+	unpaidOrder.User = testUser
+
 	return &TestData{
 		fmt.Sprintf("/users/%s/orders", testUser.ID),
 		fmt.Sprintf("/orders/%s", firstOrder.ID),
@@ -240,6 +267,9 @@ func setupTestData() *TestData {
 		secondTransaction,
 		secondLineItem1,
 		secondLineItem2,
+
+		unpaidOrder,
+		unpaidLineItem,
 	}
 }
 
@@ -260,6 +290,9 @@ func loadTestData(t *testing.T, db *gorm.DB) *TestData {
 	require.NoError(t, db.Create(testData.secondLineItem2).Error)
 	require.NoError(t, db.Create(testData.secondOrder).Error)
 	require.NoError(t, db.Create(testData.secondTransaction).Error)
+
+	require.NoError(t, db.Create(testData.unpaidLineItem).Error)
+	require.NoError(t, db.Create(testData.unpaidOrder).Error)
 	return testData
 }
 
@@ -356,6 +389,49 @@ func (r *RouteTest) TestEndpoint(method string, url string, body io.Reader, toke
 	return recorder
 }
 
+// providerRequest makes a request to the API with the provider in place of
+// the configured Stripe provider.
+func providerRequest(test *RouteTest, provider payments.Provider, method, url string, body io.Reader, token *jwt.Token) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, baseURL+url, body)
+	if token != nil {
+		require.NoError(test.T, signHTTPRequest(req, token, test.Config.JWT.Secret))
+	}
+	ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+	require.NoError(test.T, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{payments.StripeProvider: provider})
+	NewAPIWithVersion(ctx, test.GlobalConfig, test.DB, "").handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// payUnpaidOrder pays for the unpaid order with a card the provider charges.
+func payUnpaidOrder(test *RouteTest, provider payments.Provider) *httptest.ResponseRecorder {
+	return payUnpaidOrderWith(test, provider, map[string]interface{}{"stripe_token": "123456"})
+}
+
+// payUnpaidOrderWith pays for the unpaid order with the params, which default
+// to the total and currency of the order and to Stripe. The provider stands
+// in for Stripe, unless it is nil and the configured providers are used.
+func payUnpaidOrderWith(test *RouteTest, provider payments.Provider, params map[string]interface{}) *httptest.ResponseRecorder {
+	for key, value := range map[string]interface{}{
+		"amount":   test.Data.unpaidOrder.Total,
+		"currency": test.Data.unpaidOrder.Currency,
+		"provider": payments.StripeProvider,
+	} {
+		if _, ok := params[key]; !ok {
+			params[key] = value
+		}
+	}
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+
+	url := "/orders/" + test.Data.unpaidOrder.ID + "/payments"
+	if provider == nil {
+		return test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+	}
+	return providerRequest(test, provider, http.MethodPost, url, bytes.NewBuffer(body), test.Data.testUserToken)
+}
+
 func signHTTPRequest(req *http.Request, token *jwt.Token, jwtSecret string) error {
 	tokenStr, err := token.SignedString([]byte(jwtSecret))
 	if err != nil {
@@ -0,0 +1,290 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+)
+
+const maxWebhookRetries = 25
+
+// WebhookSubscriptionParams holds the parameters for creating or updating a
+// webhook subscription.
+type WebhookSubscriptionParams struct {
+	URL     string   `json:"url"`
+	Secret  *string  `json:"secret"`
+	Events  []string `json:"events"`
+	Enabled *bool    `json:"enabled"`
+
+	MaxRetries     *int `json:"max_retries"`
+	RetryBaseDelay *int `json:"retry_base_delay"`
+	RetryMaxDelay  *int `json:"retry_max_delay"`
+}
+
+func (p *WebhookSubscriptionParams) validate(create bool) *HTTPError {
+	if create || p.URL != "" {
+		u, err := url.Parse(p.URL)
+		if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+			return badRequestError("Webhook subscriptions require an absolute http or https URL")
+		}
+	}
+	if create || p.Events != nil {
+		if len(p.Events) == 0 {
+			return badRequestError("Webhook subscriptions require at least one event")
+		}
+		for _, event := range p.Events {
+			if !models.IsWebhookEvent(event) {
+				return badRequestError("Unknown webhook event '%v'", event)
+			}
+		}
+	}
+	// the retry policy uses the defaults for zero values, so 0 can't be set
+	if p.MaxRetries != nil && (*p.MaxRetries < 1 || *p.MaxRetries > maxWebhookRetries) {
+		return badRequestError("max_retries must be between 1 and %d", maxWebhookRetries)
+	}
+	for _, delay := range []*int{p.RetryBaseDelay, p.RetryMaxDelay} {
+		if delay != nil && *delay < 1 {
+			return badRequestError("Retry delays must be at least 1 second")
+		}
+	}
+	return nil
+}
+
+func (p *WebhookSubscriptionParams) applyRetryPolicy(policy *models.WebhookRetryPolicy) *HTTPError {
+	if p.MaxRetries != nil {
+		policy.MaxRetries = *p.MaxRetries
+	}
+	if p.RetryBaseDelay != nil {
+		policy.RetryBaseDelay = *p.RetryBaseDelay
+	}
+	if p.RetryMaxDelay != nil {
+		policy.RetryMaxDelay = *p.RetryMaxDelay
+	}
+	if policy.RetryBaseDelay > 0 && policy.RetryMaxDelay > 0 && policy.RetryBaseDelay > policy.RetryMaxDelay {
+		return badRequestError("retry_base_delay can't be larger than retry_max_delay")
+	}
+	return nil
+}
+
+// legacyWebhook returns the hook type and URL of the fixed webhook for the
+// event in the instance configuration.
+func legacyWebhook(config *conf.Configuration, event string) (string, string) {
+	switch event {
+	case models.WebhookOrderCreated:
+		return "order", config.Webhooks.Order
+	case models.WebhookOrderUpdated:
+		return "update", config.Webhooks.Update
+	case models.WebhookPaymentSucceeded:
+		return "payment", config.Webhooks.Payment
+	case models.WebhookRefundCreated:
+		return "refund", config.Webhooks.Refund
+	}
+	return "", ""
+}
+
+// triggerWebhooks queues a hook for the event for every matching subscription
+// and for the configured webhook URL of the event, if there is one.
+func (a *API) triggerWebhooks(ctx context.Context, tx *gorm.DB, event, userID string, payload interface{}) error {
+	config := gcontext.GetConfig(ctx)
+	instanceID := gcontext.GetInstanceID(ctx)
+	eventID := uuid.NewRandom().String()
+
+	if hookType, hookURL := legacyWebhook(config, event); hookURL != "" {
+		hook, err := models.NewHook(hookType, config.SiteURL, hookURL, userID, config.Webhooks.Secret, payload)
+		if err != nil {
+			return err
+		}
+		hook.InstanceID = instanceID
+		hook.EventID = eventID
+		if err := models.EnqueueHook(tx, hook); err != nil {
+			return err
+		}
+	}
+
+	subscriptions, err := models.MatchingWebhookSubscriptions(tx, instanceID, event)
+	if err != nil {
+		return err
+	}
+	for _, s := range subscriptions {
+		hook, err := models.NewHook(event, config.SiteURL, s.URL, userID, s.Secret, payload)
+		if err != nil {
+			return err
+		}
+		hook.InstanceID = instanceID
+		hook.EventID = eventID
+		hook.SubscriptionID = s.ID
+		hook.WebhookRetryPolicy = s.WebhookRetryPolicy
+		if err := models.EnqueueHook(tx, hook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *API) loadWebhookSubscription(r *http.Request) (*models.WebhookSubscription, *HTTPError) {
+	subscriptionID := chi.URLParam(r, "subscription_id")
+	logEntrySetField(r, "subscription_id", subscriptionID)
+
+	s := &models.WebhookSubscription{}
+	result := a.db.Where("id = ? AND instance_id = ?", subscriptionID, gcontext.GetInstanceID(r.Context())).First(s)
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Webhook subscription not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return s, nil
+}
+
+// WebhookEventList returns the catalog of events webhooks can subscribe to.
+func (a *API) WebhookEventList(w http.ResponseWriter, r *http.Request) error {
+	return sendJSON(w, http.StatusOK, models.WebhookEvents)
+}
+
+// WebhookSubscriptionList lists all webhook subscriptions of the instance.
+func (a *API) WebhookSubscriptionList(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	subscriptions := []models.WebhookSubscription{}
+	if result := a.db.Where("instance_id = ?", instanceID).Order("created_at asc").Find(&subscriptions); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, subscriptions)
+}
+
+// WebhookSubscriptionView returns a single webhook subscription.
+func (a *API) WebhookSubscriptionView(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadWebhookSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, s)
+}
+
+// WebhookSubscriptionCreate creates a new webhook subscription. Subscriptions
+// are enabled unless specified otherwise.
+func (a *API) WebhookSubscriptionCreate(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	params := &WebhookSubscriptionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read webhook subscription params: %v", err)
+	}
+	if httpErr := params.validate(true); httpErr != nil {
+		return httpErr
+	}
+
+	s := &models.WebhookSubscription{
+		ID:         uuid.NewRandom().String(),
+		InstanceID: instanceID,
+		URL:        params.URL,
+		Events:     params.Events,
+		Enabled:    true,
+	}
+	if params.Secret != nil {
+		s.Secret = *params.Secret
+	}
+	if params.Enabled != nil {
+		s.Enabled = *params.Enabled
+	}
+	if httpErr := params.applyRetryPolicy(&s.WebhookRetryPolicy); httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.db.Begin()
+	if result := tx.Create(s); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error creating webhook subscription").WithInternalError(result.Error)
+	}
+	if httpErr := a.audit(tx, r, instanceID, "webhook.create", "webhook_subscription", s.ID, nil, s); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error creating webhook subscription").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusCreated, s)
+}
+
+// WebhookSubscriptionUpdate changes the fields of a webhook subscription that
+// are present in the request.
+func (a *API) WebhookSubscriptionUpdate(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadWebhookSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	params := &WebhookSubscriptionParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read webhook subscription params: %v", err)
+	}
+	if httpErr := params.validate(false); httpErr != nil {
+		return httpErr
+	}
+
+	before := auditSnapshot(s)
+	if params.URL != "" {
+		s.URL = params.URL
+	}
+	if params.Secret != nil {
+		s.Secret = *params.Secret
+	}
+	if params.Events != nil {
+		s.Events = params.Events
+	}
+	if params.Enabled != nil {
+		s.Enabled = *params.Enabled
+	}
+	if httpErr := params.applyRetryPolicy(&s.WebhookRetryPolicy); httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.db.Begin()
+	if result := tx.Save(s); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error updating webhook subscription").WithInternalError(result.Error)
+	}
+	if httpErr := a.audit(tx, r, s.InstanceID, "webhook.update", "webhook_subscription", s.ID, before, s); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error updating webhook subscription").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, s)
+}
+
+// WebhookSubscriptionDelete deletes a webhook subscription. Hooks that have
+// already been queued are still delivered.
+func (a *API) WebhookSubscriptionDelete(w http.ResponseWriter, r *http.Request) error {
+	s, httpErr := a.loadWebhookSubscription(r)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	tx := a.db.Begin()
+	if result := tx.Delete(s); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error deleting webhook subscription").WithInternalError(result.Error)
+	}
+	if httpErr := a.audit(tx, r, s.InstanceID, "webhook.delete", "webhook_subscription", s.ID, s, nil); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error deleting webhook subscription").WithInternalError(rsp.Error)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createWebhookSubscription(test *RouteTest, params *WebhookSubscriptionParams) *models.WebhookSubscription {
+	body, err := json.Marshal(params)
+	require.NoError(test.T, err)
+
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder := test.TestEndpoint(http.MethodPost, "/webhooks", bytes.NewBuffer(body), token)
+	s := &models.WebhookSubscription{}
+	extractPayload(test.T, http.StatusCreated, recorder, s)
+	return s
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		s := createWebhookSubscription(test, &WebhookSubscriptionParams{
+			URL:    "https://example.com/hooks",
+			Events: []string{models.WebhookOrderCreated, models.WebhookRefundCreated},
+		})
+		assert.NotEmpty(t, s.ID)
+		assert.True(t, s.Enabled)
+		assert.Equal(t, []string{models.WebhookOrderCreated, models.WebhookRefundCreated}, s.Events)
+		assert.Equal(t, 0, s.MaxRetries)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/webhooks", nil, token)
+		subscriptions := []models.WebhookSubscription{}
+		extractPayload(t, http.StatusOK, recorder, &subscriptions)
+		require.Len(t, subscriptions, 1)
+		assert.Equal(t, s.ID, subscriptions[0].ID)
+	})
+
+	t.Run("BadRetryPolicy", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := bytes.NewBufferString(`{"url": "https://example.com/hooks", "events": ["order.created"], "retry_base_delay": 600, "retry_max_delay": 60}`)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("ZeroRetries", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := bytes.NewBufferString(`{"url": "https://example.com/hooks", "events": ["order.created"], "max_retries": 0}`)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, token)
+		assert.Contains(t, recorder.Body.String(), "between 1 and")
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("UnknownEvent", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := bytes.NewBufferString(`{"url": "https://example.com/hooks", "events": ["order.exploded"]}`)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/webhooks", body, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("UpdateAndDelete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		s := createWebhookSubscription(test, &WebhookSubscriptionParams{
+			URL:    "https://example.com/hooks",
+			Events: []string{models.WebhookOrderCreated},
+		})
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		body := bytes.NewBufferString(`{"enabled": false}`)
+		recorder := test.TestEndpoint(http.MethodPut, "/webhooks/"+s.ID, body, token)
+		updated := &models.WebhookSubscription{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.False(t, updated.Enabled)
+		assert.Equal(t, s.URL, updated.URL)
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/webhooks/"+s.ID, nil, token)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/webhooks/"+s.ID, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("AsNonAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/webhooks", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("TriggerMatching", func(t *testing.T) {
+		test := NewRouteTest(t)
+		maxRetries := 3
+		shipping := createWebhookSubscription(test, &WebhookSubscriptionParams{
+			URL:        "https://example.com/shipping",
+			Secret:     stringPtr("shh"),
+			Events:     []string{models.WebhookShipmentCreated},
+			MaxRetries: &maxRetries,
+		})
+		createWebhookSubscription(test, &WebhookSubscriptionParams{
+			URL:    "https://example.com/orders",
+			Events: []string{models.WebhookOrderCreated},
+		})
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.ShippedState}, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Find(&hooks).Error)
+		require.Len(t, hooks, 1, fmt.Sprintf("unexpected hooks: %+v", hooks))
+		assert.Equal(t, models.WebhookShipmentCreated, hooks[0].Type)
+		assert.Equal(t, shipping.ID, hooks[0].SubscriptionID)
+		assert.Equal(t, "https://example.com/shipping", hooks[0].URL)
+		assert.Equal(t, "shh", hooks[0].Secret)
+		assert.Equal(t, 3, hooks[0].MaxRetries)
+		assert.NotEmpty(t, hooks[0].EventID)
+	})
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
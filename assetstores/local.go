@@ -0,0 +1,122 @@
+package assetstores
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileServer is implemented by asset stores whose files are served by
+// gocommerce itself.
+type FileServer interface {
+	// OpenFile checks the signature of a signed URL and opens its file.
+	OpenFile(filePath string, query url.Values) (*os.File, error)
+}
+
+// Opener is implemented by asset stores that keep their files where
+// gocommerce can open them.
+type Opener interface {
+	// Open opens the file of a download URL.
+	Open(downloadURL string) (*os.File, error)
+}
+
+// localFilesPath is where gocommerce serves the files of the local store.
+const localFilesPath = "/downloads/files/"
+
+type localProvider struct {
+	dir      string
+	baseURL  string
+	secret   []byte
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+func newLocalProvider(dir, baseURL, secret string, lifetime time.Duration) (*localProvider, error) {
+	if dir == "" {
+		return nil, errors.New("No directory configured for local downloads")
+	}
+	if baseURL == "" {
+		return nil, errors.New("No URL configured for local downloads")
+	}
+	if secret == "" {
+		return nil, errors.New("No secret configured for local downloads")
+	}
+
+	return &localProvider{
+		dir:      dir,
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		secret:   []byte(secret),
+		lifetime: lifetime,
+		now:      time.Now,
+	}, nil
+}
+
+// SignURL signs the path of a download URL, which is relative to the
+// directory of the store.
+func (l *localProvider) SignURL(downloadURL string) (string, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	name, err := cleanFilePath(u.Path)
+	if err != nil {
+		return "", err
+	}
+
+	query := SignPath(l.secret, name, l.now().Add(l.lifetime))
+	escaped := (&url.URL{Path: name}).EscapedPath()
+	return l.baseURL + localFilesPath + escaped + "?" + query.Encode(), nil
+}
+
+func (l *localProvider) OpenFile(filePath string, query url.Values) (*os.File, error) {
+	name, err := cleanFilePath(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyPath(l.secret, name, query, l.now()); err != nil {
+		return nil, err
+	}
+	return l.Open(name)
+}
+
+// Open opens the file of a download URL without checking a signature.
+func (l *localProvider) Open(downloadURL string) (*os.File, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return nil, err
+	}
+	name, err := cleanFilePath(u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(l.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, os.ErrNotExist
+	}
+	return file, nil
+}
+
+// cleanFilePath turns a path into one relative to the directory of the
+// store, which can't point outside of it.
+func cleanFilePath(filePath string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	if name == "" {
+		return "", errors.New("Download URL has no file path")
+	}
+	return name, nil
+}
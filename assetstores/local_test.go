@@ -0,0 +1,102 @@
+package assetstores
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testLocalProvider(t *testing.T) (*localProvider, func()) {
+	dir, err := ioutil.TempDir("", "gocommerce-downloads")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "books"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "books", "the dark knight.pdf"), []byte("pdf"), 0644))
+
+	store, err := newLocalProvider(dir, "https://shop.example.com/.netlify/commerce/", "secret", time.Hour)
+	require.NoError(t, err)
+	return store, func() { os.RemoveAll(dir) }
+}
+
+// openSigned opens the file of a signed URL the way the API route does.
+func openSigned(store *localProvider, signed string) (*os.File, error) {
+	u, err := url.Parse(signed)
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenFile(strings.TrimPrefix(u.Path, "/.netlify/commerce"+localFilesPath), u.Query())
+}
+
+func TestLocalSignURL(t *testing.T) {
+	store, cleanup := testLocalProvider(t)
+	defer cleanup()
+	store.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	signed, err := store.SignURL("/books/the dark knight.pdf")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(signed, "https://shop.example.com/.netlify/commerce/downloads/files/books/the%20dark%20knight.pdf?expires=1500003600&signature="))
+
+	file, err := openSigned(store, signed)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "pdf", string(data))
+
+	t.Run("Expired", func(t *testing.T) {
+		store.now = func() time.Time { return time.Unix(1500003601, 0) }
+		_, err := openSigned(store, signed)
+		assert.Equal(t, ErrExpiredURL, err)
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		store.now = func() time.Time { return time.Unix(1500000000, 0) }
+		_, err := openSigned(store, strings.Replace(signed, "expires=1500003600", "expires=1600000000", 1))
+		assert.Equal(t, ErrInvalidSignature, err)
+		_, err = openSigned(store, strings.Replace(signed, "knight", "night", 1))
+		assert.Equal(t, ErrInvalidSignature, err)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		missing, err := store.SignURL("books/missing.pdf")
+		require.NoError(t, err)
+		_, err = openSigned(store, missing)
+		assert.True(t, os.IsNotExist(err))
+
+		dir, err := store.SignURL("books")
+		require.NoError(t, err)
+		_, err = openSigned(store, dir)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestLocalPathTraversal(t *testing.T) {
+	store, cleanup := testLocalProvider(t)
+	defer cleanup()
+
+	signed, err := store.SignURL("../../etc/passwd")
+	require.NoError(t, err)
+	assert.Contains(t, signed, localFilesPath+"etc/passwd?")
+
+	name, err := cleanFilePath("/books/../../../etc/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, "etc/passwd", name)
+
+	_, err = store.SignURL("/")
+	assert.Error(t, err)
+}
+
+func TestLocalConfig(t *testing.T) {
+	_, err := newLocalProvider("", "https://example.com", "secret", time.Hour)
+	assert.Error(t, err)
+	_, err = newLocalProvider("/tmp", "", "secret", time.Hour)
+	assert.Error(t, err)
+	_, err = newLocalProvider("/tmp", "https://example.com", "", time.Hour)
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package assetstores
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxS3URLLifetime is the longest time a presigned S3 URL can be valid.
+const maxS3URLLifetime = 7 * 24 * time.Hour
+
+type s3Provider struct {
+	endpoint        *url.URL
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	pathStyle       bool
+	lifetime        time.Duration
+	now             func() time.Time
+}
+
+func newS3Provider(endpoint, region, bucket, accessKeyID, secretAccessKey string, pathStyle bool, lifetime time.Duration) (*s3Provider, error) {
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, errors.New("No access keys configured for S3")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%v'", endpoint)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	if lifetime > maxS3URLLifetime {
+		lifetime = maxS3URLLifetime
+	}
+
+	return &s3Provider{
+		endpoint:        u,
+		region:          region,
+		bucket:          bucket,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		pathStyle:       pathStyle,
+		lifetime:        lifetime,
+		now:             time.Now,
+	}, nil
+}
+
+// SignURL presigns a GET request for an object with AWS Signature Version 4.
+// Download URLs are either like "s3://bucket/key", or the key of an object in
+// the configured bucket.
+func (s *s3Provider) SignURL(downloadURL string) (string, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", err
+	}
+	bucket := s.bucket
+	if u.Scheme == "s3" {
+		bucket = u.Host
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" {
+		return "", errors.New("No S3 bucket configured for download")
+	}
+	if key == "" {
+		return "", errors.New("Download URL has no S3 object key")
+	}
+
+	host := s.endpoint.Host
+	objectPath := s.endpoint.Path + "/" + key
+	if s.pathStyle {
+		objectPath = s.endpoint.Path + "/" + bucket + "/" + key
+	} else {
+		host = bucket + "." + host
+	}
+	canonicalURI := uriEncode(objectPath, false)
+
+	now := s.now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.accessKeyID + "/" + scope,
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(s.lifetime.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	canonicalQuery := canonicalQueryString(query)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		canonicalURI,
+		canonicalQuery,
+		"host:" + host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		query["X-Amz-Date"],
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	signingKey := []byte("AWS4" + s.secretAccessKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return s.endpoint.Scheme + "://" + host + canonicalURI + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+func canonicalQueryString(query map[string]string) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := []string{}
+	for _, key := range keys {
+		params = append(params, uriEncode(key, true)+"="+uriEncode(query[key], true))
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode escapes everything but the unreserved characters, as AWS expects
+// in signed requests. Slashes are kept in paths.
+func uriEncode(s string, encodeSlash bool) string {
+	buf := &bytes.Buffer{}
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			buf.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
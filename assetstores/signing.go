@@ -0,0 +1,48 @@
+package assetstores
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors of signed download URLs.
+var (
+	ErrInvalidSignature = errors.New("Invalid download signature")
+	ErrExpiredURL       = errors.New("Download URL has expired")
+)
+
+// SignPath signs a path of a URL served by gocommerce until it expires, and
+// returns the query parameters with the signature.
+func SignPath(secret []byte, name string, expires time.Time) url.Values {
+	timestamp := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", timestamp)
+	query.Set("signature", pathSignature(secret, name, timestamp))
+	return query
+}
+
+// VerifyPath checks the signature of a path signed with SignPath.
+func VerifyPath(secret []byte, name string, query url.Values, now time.Time) error {
+	timestamp := query.Get("expires")
+	expected := pathSignature(secret, name, timestamp)
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		return ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > expires {
+		return ErrExpiredURL
+	}
+	return nil
+}
+
+func pathSignature(secret []byte, name, timestamp string) string {
+	return hex.EncodeToString(hmacSHA256(secret, name+"\n"+timestamp))
+}
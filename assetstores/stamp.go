@@ -0,0 +1,138 @@
+package assetstores
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// stampFilename is the file Stamp adds to EPUBs.
+const stampFilename = "META-INF/license.txt"
+
+// Stamp is a transform that stamps the email of the buyer and the order
+// into PDFs and EPUBs. PDFs get it in their document info, and EPUBs in a
+// license file. Other files are served as they are.
+func Stamp(file []byte, info *TransformInfo) ([]byte, error) {
+	// EPUBs start with their uncompressed mimetype
+	head := file
+	if len(head) > 128 {
+		head = head[:128]
+	}
+
+	switch {
+	case bytes.HasPrefix(file, []byte("%PDF-")):
+		return stampPDF(file, info)
+	case bytes.HasPrefix(file, []byte("PK")) && bytes.Contains(head, []byte("application/epub+zip")):
+		return stampEPUB(file, info)
+	}
+	return file, nil
+}
+
+func stampText(info *TransformInfo) string {
+	return fmt.Sprintf("Licensed to %s with order %s", info.Email, info.OrderID)
+}
+
+var (
+	startxrefPattern = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+	rootPattern      = regexp.MustCompile(`/Root\s+(\d+\s+\d+\s+R)`)
+	sizePattern      = regexp.MustCompile(`/Size\s+(\d+)`)
+	infoPattern      = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+)
+
+// stampPDF appends an incremental update to a PDF, which replaces its
+// document info with one that has the stamp.
+func stampPDF(file []byte, info *TransformInfo) ([]byte, error) {
+	startxref := startxrefPattern.FindSubmatch(file)
+	roots := rootPattern.FindAllSubmatch(file, -1)
+	sizes := sizePattern.FindAllSubmatch(file, -1)
+	if startxref == nil || roots == nil || sizes == nil {
+		return nil, fmt.Errorf("Error stamping PDF: no trailer found")
+	}
+	root := roots[len(roots)-1][1]
+	size, err := strconv.Atoi(string(sizes[len(sizes)-1][1]))
+	if err != nil {
+		return nil, fmt.Errorf("Error stamping PDF: invalid trailer size")
+	}
+
+	// keep the existing document info, unless it is compressed in an
+	// object stream where it can't be found
+	entries := ""
+	if infos := infoPattern.FindAllSubmatch(file, -1); infos != nil {
+		last := infos[len(infos)-1]
+		object := regexp.MustCompile(`(?s)(?:^|\s)` + string(last[1]) + `\s+` + string(last[2]) + `\s+obj\s*<<(.*?)>>\s*endobj`)
+		if matches := object.FindAllSubmatch(file, -1); matches != nil {
+			entries = " " + strings.TrimSpace(string(matches[len(matches)-1][1]))
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(file)
+	if !bytes.HasSuffix(file, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	offset := buf.Len()
+	fmt.Fprintf(buf, "%d 0 obj\n<<%s /LicensedTo %s /LicensedOrder %s >>\nendobj\n", size, entries, pdfText(info.Email), pdfText(info.OrderID))
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n%d 1\n%010d 00000 n \n", size, offset)
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root %s /Info %d 0 R /Prev %s >>\n", size+1, root, size, startxref[1])
+	fmt.Fprintf(buf, "startxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes(), nil
+}
+
+// pdfText encodes a text as a PDF string literal.
+func pdfText(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+	return "(" + replacer.Replace(s) + ")"
+}
+
+// stampEPUB adds a license file to an EPUB. The entries keep their order, so
+// the mimetype stays the first one.
+func stampEPUB(file []byte, info *TransformInfo) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(file), int64(len(file)))
+	if err != nil {
+		return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for _, f := range r.File {
+		if f.Name == stampFilename {
+			continue
+		}
+		header := f.FileHeader
+		dst, err := w.CreateHeader(&header)
+		if err != nil {
+			return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+		}
+		src, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+		}
+	}
+
+	header := &zip.FileHeader{Name: stampFilename, Method: zip.Deflate}
+	if len(r.File) > 0 {
+		// the same time every time, so resumed downloads get the same file
+		header.Modified = r.File[0].Modified
+	}
+	dst, err := w.CreateHeader(header)
+	if err != nil {
+		return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+	}
+	if _, err := io.WriteString(dst, stampText(info)+"\n"); err != nil {
+		return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("Error stamping EPUB: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+package assetstores
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testStampInfo = &TransformInfo{DownloadID: "download", OrderID: "order-1", Email: "bruce@wayneindustries.com"}
+
+const testPDF = "%PDF-1.4\n" +
+	"1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n" +
+	"2 0 obj\n<< /Type /Pages /Kids [] /Count 0 >>\nendobj\n" +
+	"3 0 obj\n<< /Title (Manual) >>\nendobj\n" +
+	"xref\n0 4\n0000000000 65535 f \n0000000009 00000 n \n0000000058 00000 n \n0000000110 00000 n \n" +
+	"trailer\n<< /Size 4 /Root 1 0 R /Info 3 0 R >>\nstartxref\n147\n%%EOF\n"
+
+func TestStampPDF(t *testing.T) {
+	stamped, err := Stamp([]byte(testPDF), testStampInfo)
+	require.NoError(t, err)
+
+	pdf := string(stamped)
+	assert.True(t, strings.HasPrefix(pdf, testPDF))
+	update := pdf[len(testPDF):]
+	assert.Contains(t, update, "4 0 obj\n<< /Title (Manual) /LicensedTo (bruce@wayneindustries.com) /LicensedOrder (order-1) >>")
+	assert.Contains(t, update, "trailer\n<< /Size 5 /Root 1 0 R /Info 4 0 R /Prev 147 >>")
+
+	again, err := Stamp([]byte(testPDF), testStampInfo)
+	require.NoError(t, err)
+	assert.Equal(t, stamped, again)
+
+	_, err = Stamp([]byte("%PDF-1.4\nbroken"), testStampInfo)
+	assert.Error(t, err)
+}
+
+func TestStampEPUB(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	mimetype, err := w.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	require.NoError(t, err)
+	mimetype.Write([]byte("application/epub+zip"))
+	content, err := w.Create("OEBPS/chapter1.xhtml")
+	require.NoError(t, err)
+	content.Write([]byte("<html>It was a dark and stormy night.</html>"))
+	require.NoError(t, w.Close())
+
+	stamped, err := Stamp(buf.Bytes(), testStampInfo)
+	require.NoError(t, err)
+
+	r, err := zip.NewReader(bytes.NewReader(stamped), int64(len(stamped)))
+	require.NoError(t, err)
+	require.Len(t, r.File, 3)
+	assert.Equal(t, "mimetype", r.File[0].Name)
+	assert.Equal(t, zip.Store, r.File[0].Method)
+	assert.Equal(t, stampFilename, r.File[2].Name)
+
+	license, err := r.File[2].Open()
+	require.NoError(t, err)
+	text, err := ioutil.ReadAll(license)
+	require.NoError(t, err)
+	assert.Equal(t, "Licensed to bruce@wayneindustries.com with order order-1\n", string(text))
+
+	again, err := Stamp(buf.Bytes(), testStampInfo)
+	require.NoError(t, err)
+	assert.Equal(t, stamped, again)
+
+	// stamping a stamped EPUB replaces the license
+	restamped, err := Stamp(stamped, testStampInfo)
+	require.NoError(t, err)
+	r, err = zip.NewReader(bytes.NewReader(restamped), int64(len(restamped)))
+	require.NoError(t, err)
+	assert.Len(t, r.File, 3)
+}
+
+func TestStampOtherFiles(t *testing.T) {
+	stamped, err := Stamp([]byte("ID3 some mp3"), testStampInfo)
+	require.NoError(t, err)
+	assert.Equal(t, "ID3 some mp3", string(stamped))
+}
+
+func TestTransforms(t *testing.T) {
+	transform, err := GetTransform("")
+	require.NoError(t, err)
+	assert.Nil(t, transform)
+
+	transform, err = GetTransform("stamp")
+	require.NoError(t, err)
+	assert.NotNil(t, transform)
+
+	_, err = GetTransform("unknown")
+	assert.Error(t, err)
+
+	RegisterTransform("upper", func(file []byte, info *TransformInfo) ([]byte, error) {
+		return bytes.ToUpper(file), nil
+	})
+	transform, err = GetTransform("upper")
+	require.NoError(t, err)
+	upper, err := transform([]byte("abc"), testStampInfo)
+	require.NoError(t, err)
+	assert.Equal(t, "ABC", string(upper))
+}
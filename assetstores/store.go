@@ -2,6 +2,7 @@ package assetstores
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/netlify/gocommerce/conf"
 )
@@ -11,14 +12,33 @@ type Store interface {
 	SignURL(string) (string, error)
 }
 
+// defaultURLLifetime is how long signed URLs are valid unless configured.
+const defaultURLLifetime = time.Hour
+
+// URLLifetime is how long signed download URLs are valid.
+func URLLifetime(config *conf.Configuration) time.Duration {
+	if config.Downloads.URLLifetime <= 0 {
+		return defaultURLLifetime
+	}
+	return time.Duration(config.Downloads.URLLifetime) * time.Second
+}
+
 // NewStore creates an asset store based on the provided configuration.
 func NewStore(config *conf.Configuration) (Store, error) {
-	switch config.Downloads.Provider {
+	downloads := config.Downloads
+	lifetime := URLLifetime(config)
+
+	switch downloads.Provider {
 	case "netlify":
-		return newNetlifyProvider(config.Downloads.NetlifyToken)
+		return newNetlifyProvider(downloads.NetlifyToken)
+	case "local":
+		return newLocalProvider(downloads.Local.Dir, downloads.Local.URL, downloads.Local.Secret, lifetime)
+	case "s3":
+		s3 := downloads.S3
+		return newS3Provider(s3.Endpoint, s3.Region, s3.Bucket, s3.AccessKeyID, s3.SecretAccessKey, s3.PathStyle, lifetime)
 	case "":
 		return newNoopProvider()
 	default:
-		return nil, fmt.Errorf("Unknown asset store provider '%v'", config.Downloads.Provider)
+		return nil, fmt.Errorf("Unknown asset store provider '%v'", downloads.Provider)
 	}
 }
@@ -0,0 +1,53 @@
+package assetstores
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TransformInfo describes the download a file is transformed for.
+type TransformInfo struct {
+	DownloadID string
+	OrderID    string
+	Email      string
+	// Format is the format of the download, like "pdf", and Filename the
+	// name of its file.
+	Format   string
+	Filename string
+}
+
+// Transform changes a file before the download proxy serves it, like
+// stamping the buyer into it so leaked copies can be traced. Resumed
+// downloads continue in the transformed file, so transforms must return the
+// same file every time they are called for the same download.
+type Transform func(file []byte, info *TransformInfo) ([]byte, error)
+
+var (
+	transformsMutex sync.RWMutex
+	transforms      = map[string]Transform{
+		"stamp": Stamp,
+	}
+)
+
+// RegisterTransform makes a transform available to the instances that
+// configure its name.
+func RegisterTransform(name string, transform Transform) {
+	transformsMutex.Lock()
+	defer transformsMutex.Unlock()
+	transforms[name] = transform
+}
+
+// GetTransform returns the transform with a name, or nil for no name.
+func GetTransform(name string) (Transform, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	transformsMutex.RLock()
+	defer transformsMutex.RUnlock()
+	transform, ok := transforms[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown download transform '%v'", name)
+	}
+	return transform, nil
+}
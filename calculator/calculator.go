@@ -2,6 +2,7 @@ package calculator
 
 import (
 	"math"
+	"sort"
 	"strconv"
 
 	"github.com/netlify/gocommerce/claims"
@@ -15,6 +16,10 @@ type Price struct {
 	Discount uint64
 	Taxes    uint64
 	Total    uint64
+
+	// TaxRates sums up the subtotal and taxes by tax percentage, for the tax
+	// summary of invoices.
+	TaxRates []*TaxRate
 }
 
 // ItemPrice is the price of a single line item.
@@ -25,6 +30,27 @@ type ItemPrice struct {
 	Discount uint64
 	Taxes    uint64
 	Total    uint64
+
+	TaxRates []*TaxRate
+}
+
+// TaxRate is the part of a price that is taxed with one percentage.
+type TaxRate struct {
+	Percentage uint64 `json:"percentage"`
+	Net        uint64 `json:"net"`
+	Taxes      uint64 `json:"taxes"`
+}
+
+// addTaxRate adds an amount to the tax rate with the same percentage.
+func addTaxRate(rates []*TaxRate, percentage, net, taxes uint64) []*TaxRate {
+	for _, rate := range rates {
+		if rate.Percentage == percentage {
+			rate.Net += net
+			rate.Taxes += taxes
+			return rates
+		}
+	}
+	return append(rates, &TaxRate{Percentage: percentage, Net: net, Taxes: taxes})
 }
 
 // Settings represent the site-wide settings for price calculation.
@@ -189,8 +215,12 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, countr
 					tax.price = rint(float64(tax.price) / (100 + float64(tax.percentage)) * 100)
 					itemPrice.Subtotal += tax.price
 				}
-				itemPrice.Taxes += rint(float64(tax.price) * float64(tax.percentage) / 100)
+				taxes := rint(float64(tax.price) * float64(tax.percentage) / 100)
+				itemPrice.Taxes += taxes
+				itemPrice.TaxRates = addTaxRate(itemPrice.TaxRates, tax.percentage, tax.price, taxes)
 			}
+		} else {
+			itemPrice.TaxRates = addTaxRate(itemPrice.TaxRates, 0, itemPrice.Subtotal, 0)
 		}
 		if coupon != nil && coupon.ValidForType(item.ProductType()) && coupon.ValidForProduct(item.ProductSku()) {
 			itemPrice.Discount = calculateDiscount(itemPrice.Subtotal, itemPrice.Taxes, coupon.PercentageDiscount(), coupon.FixedDiscount(currency), includeTaxes)
@@ -214,9 +244,15 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, countr
 		price.Discount += (itemPrice.Discount * itemPrice.Quantity)
 		price.Taxes += (itemPrice.Taxes * itemPrice.Quantity)
 		price.Total += (itemPrice.Total * itemPrice.Quantity)
+		for _, rate := range itemPrice.TaxRates {
+			price.TaxRates = addTaxRate(price.TaxRates, rate.Percentage, rate.Net*itemPrice.Quantity, rate.Taxes*itemPrice.Quantity)
+		}
 	}
 
 	price.Total = price.Subtotal - price.Discount + price.Taxes
+	sort.Slice(price.TaxRates, func(i, j int) bool {
+		return price.TaxRates[i].Percentage < price.TaxRates[j].Percentage
+	})
 
 	return price
 }
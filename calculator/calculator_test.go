@@ -192,6 +192,29 @@ func TestPricingItems(t *testing.T) {
 	assert.Equal(t, uint64(110), price.Total)
 }
 
+func TestTaxRates(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{&Tax{
+		Percentage:   7,
+		ProductTypes: []string{"book"},
+	}, &Tax{
+		Percentage:   21,
+		ProductTypes: []string{"ebook"},
+	}}}
+	items := []Item{
+		&TestItem{price: 100, itemType: "book", quantity: 2},
+		&TestItem{price: 200, itemType: "ebook"},
+		&TestItem{price: 50, itemType: "ebook"},
+		&TestItem{price: 30, itemType: "gift"},
+	}
+	price := CalculatePrice(settings, nil, "DE", "USD", nil, items)
+
+	require.Len(t, price.TaxRates, 3)
+	assert.Equal(t, TaxRate{Percentage: 0, Net: 30, Taxes: 0}, *price.TaxRates[0])
+	assert.Equal(t, TaxRate{Percentage: 7, Net: 200, Taxes: 14}, *price.TaxRates[1])
+	assert.Equal(t, TaxRate{Percentage: 21, Net: 250, Taxes: 52}, *price.TaxRates[2])
+	assert.Equal(t, price.Taxes, uint64(14+52))
+}
+
 func TestMemberDiscounts(t *testing.T) {
 	settings := &Settings{PricesIncludeTaxes: true, MemberDiscounts: []*MemberDiscount{&MemberDiscount{
 		Claims:     map[string]string{"app_metadata.plan": "member"},
@@ -0,0 +1,73 @@
+package calculator
+
+import (
+	"strconv"
+	"strings"
+)
+
+// currencyExponents lists the ISO 4217 currencies that don't have 2 minor
+// units, like the Japanese Yen that has none.
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// currencySymbols holds the symbols used in place of the currency code.
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"GBP": "£",
+	"JPY": "¥",
+	"INR": "₹",
+	"KRW": "₩",
+}
+
+// CurrencyExponent returns the number of minor units of a currency, which is
+// how many digits of an amount in the lowest unit go after the decimal point.
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// FormatAmount formats an amount in the lowest unit of the currency, like
+// cents for USD, for display: 123456 USD is "$1,234.56" and 1234 JPY is "¥1,234".
+func FormatAmount(amount uint64, currency string) string {
+	currency = strings.ToUpper(currency)
+	number := FormatNumber(amount, currency)
+
+	if symbol, ok := currencySymbols[currency]; ok {
+		return symbol + number
+	}
+	if currency == "EUR" {
+		return number + "€"
+	}
+	return number + " " + currency
+}
+
+// FormatNumber formats an amount in the lowest unit of the currency without
+// the currency: 123456 USD is "1,234.56".
+func FormatNumber(amount uint64, currency string) string {
+	exp := CurrencyExponent(currency)
+
+	digits := strconv.FormatUint(amount, 10)
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-exp], digits[len(digits)-exp:]
+
+	var grouped []byte
+	for i := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped = append(grouped, ',')
+		}
+		grouped = append(grouped, whole[i])
+	}
+	number := string(grouped)
+	if exp > 0 {
+		number += "." + fraction
+	}
+	return number
+}
@@ -0,0 +1,36 @@
+package calculator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatAmount(t *testing.T) {
+	cases := []struct {
+		amount   uint64
+		currency string
+		expected string
+	}{
+		{1999, "USD", "$19.99"},
+		{123456789, "USD", "$1,234,567.89"},
+		{5, "usd", "$0.05"},
+		{0, "USD", "$0.00"},
+		{1999, "EUR", "19.99€"},
+		{1999, "GBP", "£19.99"},
+		{1999, "JPY", "¥1,999"},
+		{1999, "KWD", "1.999 KWD"},
+		{1999, "SEK", "19.99 SEK"},
+		{100000, "CLF", "10.0000 CLF"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, FormatAmount(c.amount, c.currency), "%d %s", c.amount, c.currency)
+	}
+}
+
+func TestCurrencyExponent(t *testing.T) {
+	assert.Equal(t, 2, CurrencyExponent("USD"))
+	assert.Equal(t, 0, CurrencyExponent("jpy"))
+	assert.Equal(t, 3, CurrencyExponent("BHD"))
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var auditInstanceID = ""
+
+var auditCmd = cobra.Command{
+	Use:  "audit",
+	Long: "Inspect the admin audit log",
+}
+
+var auditVerifyCmd = cobra.Command{
+	Use:  "verify",
+	Long: "Verify the hash chain of the admin audit log of one or all instances",
+	Run:  auditVerify,
+}
+
+func init() {
+	auditVerifyCmd.Flags().StringVarP(&auditInstanceID, "instance", "i", "", "Only verify the audit log of this instance")
+	auditCmd.AddCommand(&auditVerifyCmd)
+}
+
+func auditVerify(cmd *cobra.Command, args []string) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+	if globalConfig.DB.Namespace != "" {
+		models.Namespace = globalConfig.DB.Namespace
+	}
+
+	db, err := models.Connect(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	instanceIDs := []string{auditInstanceID}
+	if !cmd.Flags().Changed("instance") {
+		instanceIDs, err = models.AuditLogInstanceIDs(db)
+		if err != nil {
+			logrus.Fatalf("Error loading audit log: %+v", err)
+		}
+	}
+
+	if globalConfig.Audit.Key == "" {
+		logrus.Warn("No audit key configured, anyone with access to the database can rewrite the audit log")
+	}
+
+	failed := false
+	for _, instanceID := range instanceIDs {
+		verification, err := models.VerifyAuditLog(db, instanceID, []byte(globalConfig.Audit.Key))
+		if err != nil {
+			logrus.WithError(err).Errorf("Audit log verification failed for instance '%s'", instanceID)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s\t%d entries\t%s\n", instanceID, verification.Entries, verification.HeadHash)
+	}
+
+	if failed {
+		logrus.Fatal("Audit log has been tampered with")
+	}
+}
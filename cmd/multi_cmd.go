@@ -47,7 +47,8 @@ func multi(cmd *cobra.Command, args []string) {
 	l := fmt.Sprintf("%v:%v", globalConfig.API.Host, globalConfig.API.Port)
 	logrus.Infof("GoCommerce API started on: %s", l)
 
-	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	stopWorker := startWorker(bgDB, globalConfig, nil)
+	defer stopWorker()
 
 	api.ListenAndServe(l)
 }
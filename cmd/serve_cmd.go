@@ -41,7 +41,8 @@ func serve(globalConfig *conf.GlobalConfiguration, config *conf.Configuration) {
 	l := fmt.Sprintf("%v:%v", globalConfig.API.Host, globalConfig.API.Port)
 	logrus.Infof("GoCommerce API started on: %s", l)
 
-	models.RunHooks(bgDB, logrus.WithField("component", "hooks"))
+	stopWorker := startWorker(bgDB, globalConfig, config)
+	defer stopWorker()
 
 	api.ListenAndServe(l)
 }
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/api"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/jobs"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var workerCmd = cobra.Command{
+	Use:  "worker",
+	Long: "Run background jobs, separately from the API server",
+	Run:  worker,
+}
+
+func worker(cmd *cobra.Command, args []string) {
+	globalConfig, err := conf.LoadGlobal(configFile)
+	if err != nil {
+		logrus.Fatalf("Failed to load configuration: %+v", err)
+	}
+	if globalConfig.DB.Namespace != "" {
+		models.Namespace = globalConfig.DB.Namespace
+	}
+
+	db, err := models.Connect(globalConfig)
+	if err != nil {
+		logrus.Fatalf("Error opening database: %+v", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		logrus.Infof("Received %v, shutting down", sig)
+		cancel()
+	}()
+
+	// jobs without an instance need the single instance configuration
+	config, err := conf.LoadConfig(configFile)
+	if err != nil {
+		logrus.WithError(err).Info("No single instance configuration, only running jobs of instances")
+		config = nil
+	}
+
+	newWorker(db, globalConfig, config).Run(ctx)
+}
+
+// newWorker creates a worker for the built-in jobs, like hooks, emails and
+// order expiry, and the jobs that run through the API, like subscription
+// renewals and reports.
+func newWorker(db *gorm.DB, globalConfig *conf.GlobalConfiguration, config *conf.Configuration) *jobs.Worker {
+	w := jobs.NewWorker(db, globalConfig, config, logrus.WithField("component", "worker"))
+	api.RegisterJobs(w, globalConfig, db)
+	return w
+}
+
+// startWorker runs a worker in the background unless workers are disabled in
+// the API process. The returned function stops it and waits for running jobs.
+func startWorker(db *gorm.DB, globalConfig *conf.GlobalConfiguration, config *conf.Configuration) func() {
+	if globalConfig.Worker.Disabled {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		newWorker(db, globalConfig, config).Run(ctx)
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
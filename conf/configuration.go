@@ -1,7 +1,9 @@
 package conf
 
 import (
+	"encoding/json"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
@@ -23,12 +25,48 @@ type JWTConfiguration struct {
 	AdminGroupName string `json:"admin_group_name" split_words:"true"`
 }
 
+// SMTPConfiguration holds the configuration for sending emails.
 type SMTPConfiguration struct {
 	Host       string `json:"host"`
 	Port       int    `json:"port" default:"587"`
 	User       string `json:"user"`
 	Pass       string `json:"pass"`
 	AdminEmail string `json:"admin_email" split_words:"true"`
+
+	// Transport selects how emails are delivered: smtp (the default), http,
+	// file or capture.
+	Transport string `json:"transport"`
+	// APIURL and APIKey configure the http transport.
+	APIURL string `json:"api_url" split_words:"true"`
+	APIKey string `json:"api_key" split_words:"true"`
+	// Dir is the directory the file transport writes emails to.
+	Dir string `json:"dir"`
+}
+
+// WorkerConfiguration holds the configuration of the background job workers.
+type WorkerConfiguration struct {
+	// Disabled stops the API server from running jobs itself, when they are
+	// run by separate `gocommerce worker` processes instead.
+	Disabled          bool          `json:"disabled"`
+	Concurrency       int           `json:"concurrency" default:"5"`
+	PollInterval      time.Duration `json:"poll_interval" split_words:"true" default:"5s"`
+	VisibilityTimeout time.Duration `json:"visibility_timeout" split_words:"true" default:"5m"`
+}
+
+// AuditConfiguration holds the configuration of the admin audit log.
+type AuditConfiguration struct {
+	// Key signs the hash chain of the audit log, so it can't be rewritten
+	// with access to the database alone.
+	Key string `json:"key"`
+}
+
+// PaymentProviders maps the names of payment providers to their raw JSON
+// configuration.
+type PaymentProviders map[string]json.RawMessage
+
+// Decode reads payment providers from a JSON object in the environment.
+func (p *PaymentProviders) Decode(value string) error {
+	return json.Unmarshal([]byte(value), p)
 }
 
 // GlobalConfiguration holds all the global configuration for gocommerce
@@ -42,13 +80,22 @@ type GlobalConfiguration struct {
 	Logging           nconf.LoggingConfig `envconfig:"LOG"`
 	OperatorToken     string              `split_words:"true"`
 	MultiInstanceMode bool
-	SMTP              SMTPConfiguration `json:"smtp"`
+	SMTP              SMTPConfiguration   `json:"smtp"`
+	Worker            WorkerConfiguration `json:"worker"`
+	Audit             AuditConfiguration  `json:"audit"`
 }
 
 // EmailContentConfiguration holds the configuration for emails, both subjects and template URLs.
 type EmailContentConfiguration struct {
-	OrderConfirmation string `json:"order_confirmation" split_words:"true"`
-	OrderReceived     string `json:"order_received" split_words:"true"`
+	OrderConfirmation    string `json:"order_confirmation" split_words:"true"`
+	OrderReceived        string `json:"order_received" split_words:"true"`
+	RefundIssued         string `json:"refund_issued" split_words:"true"`
+	OrderShipped         string `json:"order_shipped" split_words:"true"`
+	OrderCancelled       string `json:"order_cancelled" split_words:"true"`
+	PaymentFailed        string `json:"payment_failed" split_words:"true"`
+	DownloadReady        string `json:"download_ready" split_words:"true"`
+	AbandonedCart        string `json:"abandoned_cart" split_words:"true"`
+	SubscriptionCanceled string `json:"subscription_canceled" split_words:"true"`
 }
 
 // Configuration holds all the per-tenant configuration for gocommerce
@@ -61,8 +108,18 @@ type Configuration struct {
 	Mailer struct {
 		Subjects  EmailContentConfiguration `json:"subjects"`
 		Templates EmailContentConfiguration `json:"templates"`
+
+		// AbandonedCartDelay is the number of hours after which the user
+		// is reminded of an unpaid order. Reminders are off when it is 0.
+		AbandonedCartDelay int `json:"abandoned_cart_delay" split_words:"true"`
 	} `json:"mailer"`
 
+	Orders struct {
+		// ExpireAfter is the number of hours after which unpaid orders are
+		// cancelled. Orders don't expire when it is 0.
+		ExpireAfter int `json:"expire_after" split_words:"true"`
+	} `json:"orders"`
+
 	Payment struct {
 		Stripe struct {
 			Enabled   bool   `json:"enabled"`
@@ -74,13 +131,92 @@ type Configuration struct {
 			Secret   string `json:"secret"`
 			Env      string `json:"env"`
 		} `json:"paypal"`
+		Manual struct {
+			Enabled bool `json:"enabled"`
+			// Instructions is a template of the instructions customers get
+			// to pay, like the account to transfer the money to.
+			Instructions string `json:"instructions"`
+		} `json:"manual"`
+
+		// Providers enables payment providers by name, with the JSON
+		// configuration block of each. It takes precedence over the
+		// settings of the built-in providers above.
+		Providers PaymentProviders `json:"providers"`
 	} `json:"payment"`
 
 	Downloads struct {
 		Provider     string `json:"provider"`
 		NetlifyToken string `json:"netlify_token" split_words:"true"`
+		// URLLifetime is how many seconds the URLs signed by the local and
+		// s3 providers are valid.
+		URLLifetime int `json:"url_lifetime" split_words:"true"`
+		Local       struct {
+			// Dir is the directory with the files, and URL the public URL of
+			// gocommerce that serves them.
+			Dir    string `json:"dir"`
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+		} `json:"local"`
+		S3 struct {
+			Endpoint        string `json:"endpoint"`
+			Region          string `json:"region"`
+			Bucket          string `json:"bucket"`
+			AccessKeyID     string `json:"access_key_id" split_words:"true"`
+			SecretAccessKey string `json:"secret_access_key" split_words:"true"`
+			// PathStyle puts the bucket into the path instead of the host
+			// name, which stores like MinIO need.
+			PathStyle bool `json:"path_style" split_words:"true"`
+		} `json:"s3"`
+		// Proxy streams the files of downloads through gocommerce instead of
+		// handing out URLs of the asset store.
+		Proxy struct {
+			Enabled bool `json:"enabled"`
+			// URL is the public URL of gocommerce, and Secret signs the
+			// links to the files.
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+			// Transform names a transform the files are changed with before
+			// they are served, like "stamp".
+			Transform string `json:"transform"`
+			// CacheDir is the directory transformed files are cached in,
+			// by default one in the temporary directory of the system.
+			CacheDir string `json:"cache_dir" split_words:"true"`
+		} `json:"proxy"`
 	} `json:"downloads"`
 
+	Invoices struct {
+		// Template is the URL of the invoice template on the site.
+		Template string `json:"template"`
+		// AttachToEmail attaches the invoice to order confirmation emails.
+		AttachToEmail bool `json:"attach_to_email" split_words:"true"`
+		// NumberFormat and CreditNoteFormat format the numbers of invoices
+		// and credit notes, like "INV-{year}-{number:6}". NumberReset starts
+		// the numbers over every "year" or "month".
+		NumberFormat     string `json:"number_format" split_words:"true"`
+		CreditNoteFormat string `json:"credit_note_format" split_words:"true"`
+		NumberReset      string `json:"number_reset" split_words:"true"`
+		Seller           struct {
+			Name      string   `json:"name"`
+			Address   []string `json:"address"`
+			Email     string   `json:"email"`
+			VATNumber string   `json:"vat_number" split_words:"true"`
+		} `json:"seller"`
+		Footer string `json:"footer"`
+	} `json:"invoices"`
+
+	Subscriptions struct {
+		// DunningRetries are the days after which a failed renewal is
+		// charged again. The subscription is canceled when the last retry
+		// fails.
+		DunningRetries []int `json:"dunning_retries" split_words:"true"`
+	} `json:"subscriptions"`
+
+	Licenses struct {
+		// SigningKey is the base64 encoded Ed25519 private key, or its seed,
+		// that signs the license keys of products with signed keys.
+		SigningKey string `json:"signing_key" split_words:"true"`
+	} `json:"licenses"`
+
 	Coupons struct {
 		URL      string `json:"url"`
 		User     string `json:"user"`
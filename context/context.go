@@ -31,6 +31,8 @@ const (
 	mailerKey          = contextKey("mailer")
 	assetStoreKey      = contextKey("asset_store")
 	paymentProviderKey = contextKey("payment-provider")
+	breakdownKey       = contextKey("payment-breakdown")
+	idempotencyKey     = contextKey("idempotency-key")
 	userIDKey          = contextKey("user_id")
 	userKey            = contextKey("user")
 	orderIDKey         = contextKey("order_id")
@@ -137,6 +139,31 @@ func GetPaymentProviders(ctx context.Context) map[string]payments.Provider {
 	return provs
 }
 
+// WithPaymentBreakdown adds the itemized amount of a payment to the context.
+func WithPaymentBreakdown(ctx context.Context, breakdown *payments.Breakdown) context.Context {
+	return context.WithValue(ctx, breakdownKey, breakdown)
+}
+
+// GetPaymentBreakdown reads the itemized amount of a payment from the
+// context, if the payment is for an order.
+func GetPaymentBreakdown(ctx context.Context) *payments.Breakdown {
+	breakdown, _ := ctx.Value(breakdownKey).(*payments.Breakdown)
+	return breakdown
+}
+
+// WithIdempotencyKey adds the key of a payment to the context, so providers
+// that support it can make sure it is only charged once, even when it is
+// retried.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+// GetIdempotencyKey reads the key of a payment from the context.
+func GetIdempotencyKey(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey).(string)
+	return key
+}
+
 // GetClaims reads the claims contained within the JWT token stored in the context.
 func GetClaims(ctx context.Context) *claims.JWTClaims {
 	token := GetToken(ctx)
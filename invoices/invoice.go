@@ -0,0 +1,336 @@
+// Package invoices renders invoices and credit notes for orders as PDF.
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pkg/errors"
+)
+
+// Party is the seller or the buyer on an invoice.
+type Party struct {
+	Name      string
+	Company   string
+	Address   []string
+	Email     string
+	VATNumber string
+}
+
+// Line is a line item on an invoice.
+type Line struct {
+	Title    string
+	Sku      string
+	Quantity uint64
+
+	// UnitPrice and Amount are without taxes when the order has its net
+	// prices, and as listed in the shop otherwise.
+	UnitPrice uint64
+	Taxes     uint64
+	Amount    uint64
+}
+
+// Invoice is the content of an invoice or a credit note.
+type Invoice struct {
+	Number string
+	Date   time.Time
+
+	// CreditNote is set for credit notes, which refer to the invoice they
+	// correct with the InvoiceNumber.
+	CreditNote    bool
+	InvoiceNumber string
+
+	Order  *models.Order
+	Seller Party
+	Buyer  Party
+
+	Currency string
+	Lines    []*Line
+	Subtotal uint64
+	Discount uint64
+	Taxes    uint64
+	Total    uint64
+	TaxRates []*calculator.TaxRate
+
+	Footer string
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Filename is the name of the PDF file of the invoice.
+func (i *Invoice) Filename() string {
+	// numbers like "INV/2017/123" can't be used in file names as they are
+	number := unsafeFilename.ReplaceAllString(i.Number, "-")
+	if i.CreditNote {
+		return "credit-note-" + number + ".pdf"
+	}
+	return "invoice-" + number + ".pdf"
+}
+
+// invoiceNumber is the formatted number, or the plain number for invoices
+// from before numbers were formatted.
+func invoiceNumber(number int64, formatted string) string {
+	if formatted != "" {
+		return formatted
+	}
+	return strconv.FormatInt(number, 10)
+}
+
+// NewInvoice creates the invoice of a paid order.
+func NewInvoice(order *models.Order, config *conf.Configuration) (*Invoice, error) {
+	if order.InvoiceNumber == 0 {
+		return nil, errors.New("The order has no invoice")
+	}
+
+	invoice := newDocument(order, config)
+	invoice.Number = invoiceNumber(order.InvoiceNumber, order.FormattedInvoiceNumber)
+	invoice.Date = order.UpdatedAt
+	for _, tr := range order.Transactions {
+		if tr.Type == models.ChargeTransactionType && tr.Status == models.PaidState {
+			invoice.Date = tr.CreatedAt
+		}
+	}
+
+	invoice.Lines = invoiceLines(order)
+	invoice.Subtotal = order.SubTotal
+	invoice.Discount = order.Discount
+	invoice.Taxes = order.Taxes
+	invoice.Total = order.Total
+	invoice.TaxRates = order.TaxRates
+	return invoice, nil
+}
+
+// NewCreditNote creates the credit note of a refund. A partial refund is
+// split into the tax rates of the order in proportion to their share of the
+// total.
+func NewCreditNote(order *models.Order, refund *models.Transaction, config *conf.Configuration) (*Invoice, error) {
+	if refund.Type != models.RefundTransactionType || refund.InvoiceNumber == 0 {
+		return nil, errors.New("The transaction has no credit note")
+	}
+	if order.InvoiceNumber == 0 {
+		return nil, errors.New("The order has no invoice")
+	}
+
+	note := newDocument(order, config)
+	note.Number = invoiceNumber(refund.InvoiceNumber, refund.FormattedInvoiceNumber)
+	note.Date = refund.CreatedAt
+	note.CreditNote = true
+	note.InvoiceNumber = invoiceNumber(order.InvoiceNumber, order.FormattedInvoiceNumber)
+
+	if refund.Amount >= order.Total {
+		note.Lines = invoiceLines(order)
+		note.Subtotal = order.SubTotal
+		note.Discount = order.Discount
+		note.Taxes = order.Taxes
+		note.Total = order.Total
+		note.TaxRates = order.TaxRates
+		return note, nil
+	}
+
+	share := float64(refund.Amount) / float64(order.Total)
+	var discounted uint64
+	if order.Discount < order.SubTotal {
+		discounted = order.SubTotal - order.Discount
+	}
+	for _, rate := range order.TaxRates {
+		net := float64(rate.Net)
+		if order.SubTotal > 0 {
+			// the discount lowers the net amount of every rate alike
+			net = net * float64(discounted) / float64(order.SubTotal)
+		}
+		prorated := &calculator.TaxRate{
+			Percentage: rate.Percentage,
+			Net:        round(net * share),
+			Taxes:      round(float64(rate.Taxes) * share),
+		}
+		note.Taxes += prorated.Taxes
+		note.TaxRates = append(note.TaxRates, prorated)
+	}
+	if order.TaxRates == nil {
+		note.Taxes = round(float64(order.Taxes) * share)
+	}
+	// rounding can make the taxes of tiny refunds exceed the refund
+	if note.Taxes > refund.Amount {
+		note.Taxes = refund.Amount
+	}
+	note.Total = refund.Amount
+	note.Subtotal = refund.Amount - note.Taxes
+	note.Lines = []*Line{{
+		Title:     "Partial refund of order " + order.ID,
+		Quantity:  1,
+		UnitPrice: note.Subtotal,
+		Taxes:     note.Taxes,
+		Amount:    note.Subtotal,
+	}}
+	return note, nil
+}
+
+func newDocument(order *models.Order, config *conf.Configuration) *Invoice {
+	seller := config.Invoices.Seller
+	address := order.BillingAddress
+	if address.Address1 == "" {
+		address = order.ShippingAddress
+	}
+
+	buyer := Party{
+		Name:      address.Name,
+		Company:   address.Company,
+		Email:     order.Email,
+		VATNumber: order.VATNumber,
+	}
+	if buyer.Name == "" {
+		buyer.Name = strings.TrimSpace(address.FirstName + " " + address.LastName)
+	}
+	for _, line := range []string{address.Address1, address.Address2, strings.TrimSpace(address.Zip + " " + address.City), address.State, address.Country} {
+		if line != "" {
+			buyer.Address = append(buyer.Address, line)
+		}
+	}
+
+	return &Invoice{
+		Order: order,
+		Seller: Party{
+			Name:      seller.Name,
+			Address:   seller.Address,
+			Email:     seller.Email,
+			VATNumber: seller.VATNumber,
+		},
+		Buyer:    buyer,
+		Currency: order.Currency,
+		Footer:   config.Invoices.Footer,
+	}
+}
+
+func invoiceLines(order *models.Order) []*Line {
+	lines := []*Line{}
+	for _, item := range order.LineItems {
+		unitPrice := item.NetPrice
+		if unitPrice == 0 && item.Taxes == 0 {
+			// orders from before net prices were kept
+			unitPrice = item.Price + item.AddonPrice
+		}
+		lines = append(lines, &Line{
+			Title:     item.Title,
+			Sku:       item.Sku,
+			Quantity:  item.Quantity,
+			UnitPrice: unitPrice,
+			Taxes:     item.Taxes * item.Quantity,
+			Amount:    unitPrice * item.Quantity,
+		})
+	}
+	return lines
+}
+
+func round(amount float64) uint64 {
+	return uint64(amount + 0.5)
+}
+
+// Render renders the invoice with a template and writes it as PDF.
+func Render(w io.Writer, invoice *Invoice, tmpl string) error {
+	funcs := template.FuncMap{
+		"price": func(amount uint64) string {
+			formatted := calculator.FormatAmount(amount, invoice.Currency)
+			if !encodable(formatted) {
+				// the standard PDF fonts lack symbols like ₹
+				return calculator.FormatNumber(amount, invoice.Currency) + " " + strings.ToUpper(invoice.Currency)
+			}
+			return formatted
+		},
+		"date": func(date time.Time) string {
+			return date.Format("January 2, 2006")
+		},
+		"dateFormat": func(layout string, date time.Time) string {
+			return date.Format(layout)
+		},
+		"cell": func(text string) string {
+			return strings.Replace(text, "|", "\\|", -1)
+		},
+	}
+
+	t, err := template.New("invoice").Funcs(funcs).Parse(tmpl)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing invoice template")
+	}
+	markup := &bytes.Buffer{}
+	if err := t.Execute(markup, invoice); err != nil {
+		return errors.Wrap(err, "Error rendering invoice template")
+	}
+
+	title := "Invoice " + invoice.Number
+	if invoice.CreditNote {
+		title = "Credit note " + invoice.Number
+	}
+	_, err = render(title, markup.String()).WriteTo(w)
+	return err
+}
+
+// LoadTemplate loads the invoice template of the site, or returns the
+// default template if the site doesn't configure one.
+func LoadTemplate(config *conf.Configuration) (string, error) {
+	if config.Invoices.Template == "" {
+		return DefaultTemplate, nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	rsp, err := client.Get(config.SiteURL + config.Invoices.Template)
+	if err != nil {
+		return "", errors.Wrap(err, "Error loading invoice template")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error loading invoice template: unexpected status %d", rsp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Error loading invoice template")
+	}
+	return string(body), nil
+}
+
+// DefaultTemplate is used when the site has no invoice template.
+const DefaultTemplate = `# {{ if .CreditNote }}Credit note{{ else }}Invoice{{ end }} {{ .Number }}
+
+Date: {{ date .Date }}
+{{ if .CreditNote }}Corrects invoice: {{ .InvoiceNumber }}{{ end }}
+Order: {{ .Order.ID }}
+
+{{ with .Seller }}{{ if .Name }}
+## {{ .Name }}
+{{ range .Address }}{{ . }}
+{{ end }}{{ if .Email }}{{ .Email }}
+{{ end }}{{ if .VATNumber }}VAT number: {{ .VATNumber }}
+{{ end }}{{ end }}{{ end }}
+## Bill to
+{{ with .Buyer }}{{ if .Company }}{{ .Company }}
+{{ end }}{{ if .Name }}{{ .Name }}
+{{ end }}{{ range .Address }}{{ . }}
+{{ end }}{{ .Email }}
+{{ if .VATNumber }}VAT number: {{ .VATNumber }}
+{{ end }}{{ end }}
+---
+## | Description | Quantity | Unit price | Tax | Amount
+{{ range .Lines }}| {{ cell .Title }} | {{ .Quantity }} | {{ price .UnitPrice }} | {{ price .Taxes }} | {{ price .Amount }}
+{{ end }}---
+| | | | Subtotal | {{ price .Subtotal }}
+{{ if .Discount }}| | | | Discount | -{{ price .Discount }}
+{{ end }}| | | | Tax | {{ price .Taxes }}
+## | | | | Total | {{ price .Total }}
+{{ if .TaxRates }}
+## Tax summary
+## | Rate | Net | Tax
+{{ range .TaxRates }}| {{ .Percentage }}% | {{ price .Net }} | {{ price .Taxes }}
+{{ end }}{{ end }}
+{{ if .CreditNote }}The total amount has been refunded.{{ end }}
+{{ .Footer }}
+`
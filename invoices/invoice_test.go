@@ -0,0 +1,193 @@
+package invoices
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func testConfig() *conf.Configuration {
+	config := &conf.Configuration{SiteURL: "https://example.com"}
+	config.Invoices.Seller.Name = "Wayne Industries"
+	config.Invoices.Seller.Address = []string{"1007 Mountain Drive", "Gotham City"}
+	config.Invoices.Seller.VATNumber = "DE123456789"
+	config.Invoices.Footer = "Thank you for your business"
+	return config
+}
+
+func testOrder() *models.Order {
+	order := models.NewOrder("", "session", "bruce@wayneindustries.com", "EUR")
+	order.ID = "test-order"
+	order.InvoiceNumber = 1001
+	order.VATNumber = "FR987654321"
+	order.BillingAddress = models.Address{AddressRequest: models.AddressRequest{
+		Name:     "Bruce Wayne",
+		Company:  "Wayne (Enterprises)",
+		Address1: "1 Rue de Rivoli",
+		City:     "Paris",
+		Zip:      "75001",
+		Country:  "France",
+	}}
+	order.LineItems = []*models.LineItem{
+		{Title: "Utility Belt", Sku: "belt", Quantity: 2, Price: 1210, NetPrice: 1000, Taxes: 210},
+		{Title: "Batarang | Classic", Sku: "batarang", Quantity: 1, Price: 1070, NetPrice: 1000, Taxes: 70},
+	}
+	order.SubTotal = 3000
+	order.Taxes = 490
+	order.Total = 3490
+	order.TaxRates = []*calculator.TaxRate{
+		{Percentage: 7, Net: 1000, Taxes: 70},
+		{Percentage: 21, Net: 2000, Taxes: 420},
+	}
+	return order
+}
+
+func renderPDF(t *testing.T, invoice *Invoice, tmpl string) string {
+	buf := &bytes.Buffer{}
+	require.NoError(t, Render(buf, invoice, tmpl))
+	return buf.String()
+}
+
+// validateXref checks that the cross-reference table points at the objects.
+func validateXref(t *testing.T, pdf string) {
+	match := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindStringSubmatch(pdf)
+	require.NotNil(t, match)
+	xref, _ := strconv.Atoi(match[1])
+	require.True(t, strings.HasPrefix(pdf[xref:], "xref\n"))
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllStringSubmatch(pdf[xref:], -1)
+	require.NotEmpty(t, entries)
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(entry[1])
+		assert.True(t, strings.HasPrefix(pdf[offset:], strconv.Itoa(i+1)+" 0 obj\n"), "object %d", i+1)
+	}
+}
+
+func TestRenderInvoice(t *testing.T) {
+	invoice, err := NewInvoice(testOrder(), testConfig())
+	require.NoError(t, err)
+	assert.Equal(t, "invoice-1001.pdf", invoice.Filename())
+
+	pdf := renderPDF(t, invoice, DefaultTemplate)
+	assert.True(t, strings.HasPrefix(pdf, "%PDF-1.4\n"))
+	validateXref(t, pdf)
+
+	for _, text := range []string{
+		"(Invoice 1001)",
+		"(Wayne Industries)",
+		"(VAT number: DE123456789)",
+		`(Wayne \(Enterprises\))`,
+		"(75001 Paris)",
+		"(VAT number: FR987654321)",
+		"(Utility Belt)",
+		"(Batarang | Classic)",
+		`(20.00\200)`,
+		`(34.90\200)`,
+		"(21%)",
+		"(Thank you for your business)",
+	} {
+		assert.Contains(t, pdf, text)
+	}
+}
+
+func TestRenderCreditNote(t *testing.T) {
+	order := testOrder()
+	refund := &models.Transaction{
+		Type:          models.RefundTransactionType,
+		Amount:        1745,
+		Currency:      "EUR",
+		InvoiceNumber: 1002,
+		CreatedAt:     time.Now(),
+	}
+
+	note, err := NewCreditNote(order, refund, testConfig())
+	require.NoError(t, err)
+	assert.True(t, note.CreditNote)
+	assert.Equal(t, "1001", note.InvoiceNumber)
+	assert.Equal(t, "credit-note-1002.pdf", note.Filename())
+	assert.Equal(t, uint64(1745), note.Total)
+	assert.Equal(t, uint64(35+210), note.Taxes)
+	assert.Equal(t, uint64(1500), note.Subtotal)
+	require.Len(t, note.TaxRates, 2)
+	assert.Equal(t, calculator.TaxRate{Percentage: 7, Net: 500, Taxes: 35}, *note.TaxRates[0])
+
+	pdf := renderPDF(t, note, DefaultTemplate)
+	assert.Contains(t, pdf, "(Credit note 1002)")
+	assert.Contains(t, pdf, "(Corrects invoice: 1001)")
+
+	refund.Amount = order.Total
+	note, err = NewCreditNote(order, refund, testConfig())
+	require.NoError(t, err)
+	assert.Len(t, note.Lines, 2)
+	assert.Equal(t, order.Taxes, note.Taxes)
+
+	_, err = NewCreditNote(order, &models.Transaction{Type: models.ChargeTransactionType}, testConfig())
+	assert.Error(t, err)
+}
+
+func TestCreditNoteRounding(t *testing.T) {
+	order := testOrder()
+	order.SubTotal = 1
+	order.Discount = 2
+	order.Taxes = 4
+	order.Total = 3
+	order.TaxRates = []*calculator.TaxRate{
+		{Percentage: 7, Net: 1, Taxes: 2},
+		{Percentage: 21, Net: 1, Taxes: 2},
+	}
+	refund := &models.Transaction{Type: models.RefundTransactionType, Amount: 1, Currency: "EUR", InvoiceNumber: 1002}
+
+	note, err := NewCreditNote(order, refund, testConfig())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), note.Total)
+	assert.Equal(t, uint64(1), note.Taxes)
+	assert.Equal(t, uint64(0), note.Subtotal)
+	require.Len(t, note.TaxRates, 2)
+	assert.Equal(t, uint64(0), note.TaxRates[0].Net)
+}
+
+func TestRenderWithoutInvoiceNumber(t *testing.T) {
+	order := testOrder()
+	order.InvoiceNumber = 0
+	_, err := NewInvoice(order, testConfig())
+	assert.Error(t, err)
+}
+
+func TestRenderCustomTemplate(t *testing.T) {
+	invoice, err := NewInvoice(testOrder(), testConfig())
+	require.NoError(t, err)
+	invoice.Currency = "INR"
+
+	pdf := renderPDF(t, invoice, "# Rechnung {{ .Number }}\nSumme: {{ price .Total }}\n")
+	assert.Contains(t, pdf, "(Rechnung 1001)")
+	assert.Contains(t, pdf, "(Summe: 34.90 INR)")
+
+	err = Render(&bytes.Buffer{}, invoice, "{{ .Nope }}")
+	assert.Error(t, err)
+}
+
+func TestLayout(t *testing.T) {
+	assert.Equal(t, []string{"a", "b | c", ""}, splitCells(` a | b \| c | | `))
+	assert.Equal(t, []string{"", "Total", "1"}, splitCells(" | Total | 1"))
+
+	lines := wrap(strings.Repeat("word ", 200), regular, fontSize, 200)
+	assert.True(t, len(lines) > 1)
+	for _, line := range lines {
+		assert.True(t, textWidth(line, regular, fontSize) <= 200)
+	}
+
+	doc := render("Long", strings.Repeat("line\n", 200))
+	assert.True(t, len(doc.pages) > 1)
+
+	assert.Equal(t, `(caf\351 \(1\) \\ ?)`, pdfString("café (1) \\ ₹"))
+}
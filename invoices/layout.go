@@ -0,0 +1,166 @@
+package invoices
+
+import (
+	"strings"
+)
+
+const (
+	margin      = 50.0
+	fontSize    = 10.0
+	titleSize   = 18.0
+	lineHeight  = 14.0
+	columnWidth = 80.0
+)
+
+// layout lays out the output of an invoice template on pages. The template
+// output is made of lines:
+//
+//	# Title          a title
+//	## Text          bold text, which also works for table rows
+//	---              a horizontal rule
+//	| a | b | c      a table row, with the first cell on the left and the
+//	                 others right aligned in columns along the right margin
+//	Text             text, wrapped at the margin
+//
+// Empty lines add some space, and "\|" is a "|" inside a table cell.
+type layout struct {
+	doc  *document
+	page *page
+	y    float64
+}
+
+func render(title, markup string) *document {
+	l := &layout{doc: &document{title: title}}
+	l.newPage()
+
+	blank := false
+	for _, line := range strings.Split(markup, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			// runs of empty lines, like the ones left by template actions,
+			// only add space once
+			if !blank {
+				l.space(lineHeight / 2)
+			}
+			blank = true
+			continue
+		}
+		blank = false
+
+		switch {
+		case line == "---":
+			l.space(lineHeight / 2)
+			l.page.line(margin, l.y, pageWidth-margin, l.y, 0.5)
+			l.space(lineHeight / 2)
+		case strings.HasPrefix(line, "# "):
+			l.space(titleSize - lineHeight)
+			l.write(strings.TrimSpace(line[2:]), bold, titleSize)
+			l.space(lineHeight / 2)
+		case strings.HasPrefix(line, "## "):
+			l.write(strings.TrimSpace(line[3:]), bold, fontSize)
+		default:
+			l.write(line, regular, fontSize)
+		}
+	}
+	return l.doc
+}
+
+func (l *layout) newPage() {
+	l.page = l.doc.addPage()
+	l.y = margin
+}
+
+// space moves down, starting a new page when there's no room for a line.
+func (l *layout) space(height float64) {
+	l.y += height
+	if l.y > pageHeight-margin-lineHeight {
+		l.newPage()
+	}
+}
+
+func (l *layout) write(line string, f font, size float64) {
+	if strings.HasPrefix(line, "|") {
+		l.row(splitCells(line[1:]), f, size)
+		return
+	}
+
+	for _, text := range wrap(line, f, size, pageWidth-2*margin) {
+		l.space(lineHeight)
+		l.page.text(margin, l.y, f, size, text)
+	}
+}
+
+// row writes a table row. The first cell takes up the room the other cells
+// leave, and is truncated when it doesn't fit.
+func (l *layout) row(cells []string, f font, size float64) {
+	l.space(lineHeight)
+	if len(cells) == 0 {
+		return
+	}
+
+	right := pageWidth - margin
+	firstWidth := right - margin - float64(len(cells)-1)*columnWidth - 10
+	if firstWidth < columnWidth {
+		firstWidth = columnWidth
+	}
+	l.page.text(margin, l.y, f, size, truncate(cells[0], f, size, firstWidth))
+
+	for i := len(cells) - 1; i > 0; i-- {
+		text := truncate(cells[i], f, size, columnWidth-5)
+		l.page.text(right-textWidth(text, f, size), l.y, f, size, text)
+		right -= columnWidth
+	}
+}
+
+// splitCells splits a table row at unescaped "|". A trailing "|" doesn't
+// start another cell.
+func splitCells(line string) []string {
+	cells := []string{}
+	cell := []rune{}
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			if r != '|' {
+				cell = append(cell, '\\')
+			}
+			cell = append(cell, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '|':
+			cells = append(cells, strings.TrimSpace(string(cell)))
+			cell = cell[:0]
+		default:
+			cell = append(cell, r)
+		}
+	}
+	if escaped {
+		cell = append(cell, '\\')
+	}
+	if last := strings.TrimSpace(string(cell)); last != "" || len(cells) == 0 {
+		cells = append(cells, last)
+	}
+	return cells
+}
+
+// wrap breaks a text into lines that fit into a width.
+func wrap(text string, f font, size, width float64) []string {
+	lines := []string{}
+	current := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if current != "" {
+			candidate = current + " " + word
+		}
+		if current != "" && textWidth(candidate, f, size) > width {
+			lines = append(lines, truncate(current, f, size, width))
+			candidate = word
+		}
+		current = candidate
+	}
+	if current != "" {
+		lines = append(lines, truncate(current, f, size, width))
+	}
+	return lines
+}
@@ -0,0 +1,209 @@
+package invoices
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// A4 in points.
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+)
+
+type font int
+
+const (
+	regular font = iota
+	bold
+)
+
+// fontNames are the standard fonts used for the text. Every PDF reader has
+// them, so they don't need to be embedded.
+var fontNames = map[font]string{
+	regular: "Helvetica",
+	bold:    "Helvetica-Bold",
+}
+
+// Glyph widths of the printable ASCII characters, from space to tilde, in
+// thousandths of the font size.
+var fontWidths = map[font][]int{
+	regular: {
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	},
+	bold: {
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	},
+}
+
+// defaultWidth is used for the characters outside of ASCII.
+const defaultWidth = 556
+
+// winAnsi maps the characters of the Windows-1252 code page that aren't in
+// Latin-1 to their code.
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// encodeChar returns the WinAnsiEncoding code of a character, and false if
+// the standard fonts can't show it.
+func encodeChar(r rune) (byte, bool) {
+	switch {
+	case r >= 0x20 && r < 0x7F:
+		return byte(r), true
+	case r >= 0xA0 && r <= 0xFF:
+		return byte(r), true
+	}
+	c, ok := winAnsi[r]
+	return c, ok
+}
+
+// encodable checks whether the standard fonts can show all of a text.
+func encodable(s string) bool {
+	for _, r := range s {
+		if _, ok := encodeChar(r); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// textWidth measures a text in points.
+func textWidth(s string, f font, size float64) float64 {
+	widths := fontWidths[f]
+	total := 0
+	for _, r := range s {
+		if r >= 0x20 && r < 0x7F {
+			total += widths[r-0x20]
+		} else {
+			total += defaultWidth
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// pdfString encodes a text as a PDF string literal. Characters the fonts
+// can't show are replaced with a question mark.
+func pdfString(s string) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('(')
+	for _, r := range s {
+		c, ok := encodeChar(r)
+		if !ok {
+			c = '?'
+		}
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c >= 0x80:
+			fmt.Fprintf(buf, "\\%03o", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// page is the content stream of a page. Coordinates start at the top left
+// corner of the page, unlike in PDF.
+type page struct {
+	content bytes.Buffer
+}
+
+func (p *page) text(x, y float64, f font, size float64, s string) {
+	fmt.Fprintf(&p.content, "BT /F%d %.2f Tf %.2f %.2f Td %s Tj ET\n", f+1, size, x, pageHeight-y, pdfString(s))
+}
+
+func (p *page) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&p.content, "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, pageHeight-y1, x2, pageHeight-y2)
+}
+
+// document is a minimal PDF writer for text documents.
+type document struct {
+	title string
+	pages []*page
+}
+
+func (d *document) addPage() *page {
+	p := &page{}
+	d.pages = append(d.pages, p)
+	return p
+}
+
+// WriteTo writes the document as PDF.
+func (d *document) WriteTo(w io.Writer) (int64, error) {
+	buf := &bytes.Buffer{}
+	offsets := []int{}
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// the header has binary characters so that tools treat the file as binary
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// objects 1 to 5 are the catalog, the page tree, the fonts and the
+	// document info, followed by a page and its content for every page
+	const firstPage = 6
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPage+2*i)
+	}
+
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	for _, f := range []font{regular, bold} {
+		object(fmt.Sprintf("<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>", fontNames[f]))
+	}
+	object(fmt.Sprintf("<< /Title %s /Producer (gocommerce) >>", pdfString(d.title)))
+
+	for i, p := range d.pages {
+		object(fmt.Sprintf(
+			"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, firstPage+2*i+1,
+		))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.WriteTo(w)
+}
+
+// truncate shortens a text with an ellipsis to fit into a width.
+func truncate(s string, f font, size, width float64) string {
+	if textWidth(s, f, size) <= width {
+		return s
+	}
+	for len(s) > 0 {
+		_, n := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-n]
+		if textWidth(s+"...", f, size) <= width {
+			return s + "..."
+		}
+	}
+	return ""
+}
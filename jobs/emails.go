@@ -0,0 +1,133 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/invoices"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+)
+
+// sendEmail renders and sends an email from the outbox with the mailer of its
+// instance. The email is marked as failed once the job is out of attempts.
+func (w *Worker) sendEmail(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+	payload := models.EmailJob{}
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	email := &models.Email{}
+	if result := db.Where("id = ?", payload.EmailID).First(email); result.Error != nil {
+		if result.RecordNotFound() {
+			log.Warnf("Email %d doesn't exist anymore", payload.EmailID)
+			return nil
+		}
+		return result.Error
+	}
+	if email.Status == models.EmailSent {
+		return nil
+	}
+	log = log.WithFields(logrus.Fields{
+		"email_id":   email.ID,
+		"email_type": email.Type,
+	})
+
+	skip, err := w.deliverEmail(db, email)
+	updates := map[string]interface{}{"attempts": email.Attempts + 1}
+	switch {
+	case skip:
+		updates["status"] = models.EmailSkipped
+		log.Info("Skipped email that is no longer relevant")
+	case err == nil:
+		now := time.Now()
+		updates["status"] = models.EmailSent
+		updates["last_error"] = nil
+		updates["sent_at"] = &now
+		log.Info("Sent email")
+	default:
+		updates["last_error"] = err.Error()
+		if job.Attempts >= job.MaxAttempts {
+			updates["status"] = models.EmailFailed
+		}
+	}
+	if result := db.Model(email).Updates(updates); result.Error != nil {
+		log.WithError(result.Error).Error("Error updating email")
+	}
+	return err
+}
+
+// deliverEmail sends the email, unless the order has changed in a way that
+// makes it irrelevant.
+func (w *Worker) deliverEmail(db *gorm.DB, email *models.Email) (bool, error) {
+	config, err := w.InstanceConfig(email.InstanceID)
+	if err != nil {
+		return false, err
+	}
+	m := mailer.NewMailer(w.globalConfig.SMTP, config)
+
+	order := &models.Order{}
+	result := db.
+		Preload("LineItems").
+		Preload("Downloads").
+		Preload("Licenses").
+		Preload("GiftCards").
+		Preload("ShippingAddress").
+		Preload("BillingAddress").
+		Preload("Transactions").
+		Where("id = ?", email.OrderID).
+		First(order)
+	if result.Error != nil {
+		return false, fmt.Errorf("Error loading order %s: %v", email.OrderID, result.Error)
+	}
+	if email.To != "" {
+		order.Email = email.To
+	}
+
+	var transaction *models.Transaction
+	if email.TransactionID != "" {
+		transaction = &models.Transaction{}
+		if result := db.Where("id = ?", email.TransactionID).First(transaction); result.Error != nil {
+			return false, fmt.Errorf("Error loading transaction %s: %v", email.TransactionID, result.Error)
+		}
+		transaction.Order = order
+	}
+
+	if email.Type == models.AbandonedCartEmail && (order.PaymentState == models.PaidState || order.State == models.CancelledState) {
+		return true, nil
+	}
+
+	msg, err := m.Render(email.Type, order, transaction, "")
+	if err != nil {
+		return false, err
+	}
+	if email.Type == models.OrderConfirmationEmail && config.Invoices.AttachToEmail && order.InvoiceNumber != 0 {
+		attachment, err := invoiceAttachment(order, config)
+		if err != nil {
+			return false, err
+		}
+		msg.Attachments = append(msg.Attachments, attachment)
+	}
+	return false, m.Send(msg)
+}
+
+func invoiceAttachment(order *models.Order, config *conf.Configuration) (*mailer.Attachment, error) {
+	invoice, err := invoices.NewInvoice(order, config)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := invoices.LoadTemplate(config)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := invoices.Render(buf, invoice, tmpl); err != nil {
+		return nil, err
+	}
+	return &mailer.Attachment{Filename: invoice.Filename(), ContentType: "application/pdf", Data: buf.Bytes()}, nil
+}
@@ -0,0 +1,115 @@
+package jobs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/mailer"
+	"github.com/netlify/gocommerce/models"
+)
+
+func createTestTransaction(t *testing.T, db *gorm.DB, instanceID string) *models.Transaction {
+	order := models.NewOrder("", "session1", "bruce@wayneindustries.com", "USD")
+	order.InstanceID = instanceID
+	require.NoError(t, db.Create(order).Error)
+	tr := models.NewTransaction(order)
+	tr.Status = models.PaidState
+	require.NoError(t, db.Create(tr).Error)
+	return tr
+}
+
+func reloadEmail(t *testing.T, db *gorm.DB, email *models.Email) *models.Email {
+	found := &models.Email{}
+	require.NoError(t, db.Where("id = ?", email.ID).First(found).Error)
+	return found
+}
+
+func TestSendEmail(t *testing.T) {
+	t.Run("Sent", func(t *testing.T) {
+		db := testDB(t)
+		email := models.NewTransactionEmail(models.OrderConfirmationEmail, createTestTransaction(t, db, ""))
+		require.NoError(t, models.EnqueueEmail(db, email))
+
+		mailer.Captured.Reset()
+		config := &conf.Configuration{}
+		config.SMTP.Transport = mailer.CaptureTransport
+		w := NewWorker(db, testGlobalConfig, config, testLogger)
+		runUntil(t, w, func() bool { return reloadEmail(t, db, email).Status == models.EmailSent })
+
+		sent := reloadEmail(t, db, email)
+		assert.Equal(t, 1, sent.Attempts)
+		assert.NotNil(t, sent.SentAt)
+		assert.Equal(t, models.JobDone, reload(t, db, &models.Job{ID: *email.JobID}).Status)
+
+		messages := mailer.Captured.Messages()
+		require.Len(t, messages, 1)
+		assert.Equal(t, "bruce@wayneindustries.com", messages[0].To)
+		assert.Equal(t, "Order Confirmation", messages[0].Subject)
+	})
+
+	t.Run("InvoiceAttachment", func(t *testing.T) {
+		db := testDB(t)
+		tr := createTestTransaction(t, db, "")
+		require.NoError(t, db.Model(tr.Order).Update("invoice_number", 1001).Error)
+		email := models.NewTransactionEmail(models.OrderConfirmationEmail, tr)
+		require.NoError(t, models.EnqueueEmail(db, email))
+
+		mailer.Captured.Reset()
+		config := &conf.Configuration{}
+		config.SMTP.Transport = mailer.CaptureTransport
+		config.Invoices.AttachToEmail = true
+		w := NewWorker(db, testGlobalConfig, config, testLogger)
+		runUntil(t, w, func() bool { return reloadEmail(t, db, email).Status == models.EmailSent })
+
+		messages := mailer.Captured.Messages()
+		require.Len(t, messages, 1)
+		require.Len(t, messages[0].Attachments, 1)
+		attachment := messages[0].Attachments[0]
+		assert.Equal(t, "invoice-1001.pdf", attachment.Filename)
+		assert.Equal(t, "application/pdf", attachment.ContentType)
+		assert.True(t, bytes.HasPrefix(attachment.Data, []byte("%PDF-")))
+	})
+
+	t.Run("AbandonedCartPaid", func(t *testing.T) {
+		db := testDB(t)
+		tr := createTestTransaction(t, db, "")
+		require.NoError(t, db.Model(tr.Order).Update("payment_state", models.PaidState).Error)
+		email := models.NewOrderEmail(models.AbandonedCartEmail, tr.Order)
+		require.NoError(t, models.EnqueueEmail(db, email))
+
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		runUntil(t, w, func() bool { return reloadEmail(t, db, email).Status == models.EmailSkipped })
+		assert.Nil(t, reloadEmail(t, db, email).SentAt)
+	})
+
+	t.Run("MissingTransaction", func(t *testing.T) {
+		db := testDB(t)
+		email := models.NewOrderEmail(models.RefundIssuedEmail, createTestTransaction(t, db, "").Order)
+		require.NoError(t, models.EnqueueEmail(db, email))
+
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		runUntil(t, w, func() bool { return reloadEmail(t, db, email).LastError != nil })
+		assert.Equal(t, models.EmailPending, reloadEmail(t, db, email).Status)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		db := testDB(t)
+		email := models.NewTransactionEmail(models.OrderReceivedEmail, createTestTransaction(t, db, "missing-instance"))
+		require.NoError(t, models.EnqueueEmail(db, email))
+		require.NoError(t, db.Model(&models.Job{ID: *email.JobID}).Update("max_attempts", 1).Error)
+
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		runUntil(t, w, func() bool { return reloadEmail(t, db, email).Status == models.EmailFailed })
+
+		failed := reloadEmail(t, db, email)
+		assert.Equal(t, 1, failed.Attempts)
+		assert.NotNil(t, failed.LastError)
+		assert.Nil(t, failed.SentAt)
+		assert.Equal(t, models.JobFailed, reload(t, db, &models.Job{ID: *email.JobID}).Status)
+	})
+}
@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+)
+
+// deliverHook sends a stored hook. Failed hooks are retried following the
+// retry policy of the hook rather than the default job backoff.
+func deliverHook(client *http.Client) Handler {
+	return func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+		payload := models.HookJob{}
+		if err := job.DecodePayload(&payload); err != nil {
+			return err
+		}
+
+		hook := &models.Hook{}
+		if result := db.Where("id = ?", payload.HookID).First(hook); result.Error != nil {
+			if result.RecordNotFound() {
+				log.Warnf("Hook %d doesn't exist anymore", payload.HookID)
+				return nil
+			}
+			return result.Error
+		}
+		if hook.Done {
+			// canceled in the meantime
+			return nil
+		}
+
+		// the request ends with the job, before another worker can claim it
+		hook.Deliver(ctx, db, client, log)
+		if hook.Done || hook.RunAfter == nil {
+			return nil
+		}
+
+		msg := "hook delivery failed with status " + hook.ResponseStatus
+		if hook.ErrorMessage != nil {
+			msg = *hook.ErrorMessage
+		}
+		return RetryAt(errors.New(msg), *hook.RunAfter)
+	}
+}
@@ -0,0 +1,35 @@
+package jobs
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
+)
+
+// expireOrder cancels an order that wasn't paid before it expired.
+func expireOrder(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+	payload := models.OrderExpiryJob{}
+	if err := job.DecodePayload(&payload); err != nil {
+		return err
+	}
+
+	tx := db.Begin()
+	expired, err := models.ExpireOrder(tx, payload.OrderID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if !expired {
+		// paid or cancelled in the meantime
+		tx.Rollback()
+		return nil
+	}
+	models.LogEvent(tx, "", "", payload.OrderID, models.EventUpdated, []string{"state"})
+	if result := tx.Commit(); result.Error != nil {
+		return result.Error
+	}
+	log.Infof("Order %s expired", payload.OrderID)
+	return nil
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestExpireOrder(t *testing.T) {
+	db := testDB(t)
+	unpaid := models.NewOrder("", "session1", "bruce@wayneindustries.com", "USD")
+	paid := models.NewOrder("", "session1", "bruce@wayneindustries.com", "USD")
+	paid.PaymentState = models.PaidState
+	transfer := createTestTransaction(t, db, "")
+	require.NoError(t, db.Model(transfer).Update("status", models.PendingState).Error)
+
+	jobs := []*models.Job{}
+	for _, order := range []*models.Order{unpaid, paid} {
+		require.NoError(t, db.Create(order).Error)
+	}
+	for _, order := range []*models.Order{unpaid, paid, transfer.Order} {
+		require.NoError(t, models.ScheduleOrderExpiry(db, order, time.Now()))
+		job := &models.Job{}
+		require.NoError(t, db.Order("id desc").First(job).Error)
+		jobs = append(jobs, job)
+	}
+
+	w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+	runUntil(t, w, func() bool {
+		for _, job := range jobs {
+			if reload(t, db, job).Status != models.JobDone {
+				return false
+			}
+		}
+		return true
+	})
+
+	states := []string{}
+	for _, order := range []*models.Order{unpaid, paid, transfer.Order} {
+		reloaded := &models.Order{}
+		require.NoError(t, db.First(reloaded, "id = ?", order.ID).Error)
+		states = append(states, reloaded.State)
+	}
+	assert.Equal(t, []string{models.CancelledState, models.PendingState, models.PendingState}, states)
+}
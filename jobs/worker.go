@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	retryBaseDelay = 10 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// Handler runs a job. When it returns an error the job is retried later,
+// until it has used up its attempts.
+type Handler func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error
+
+type retryError struct {
+	error
+	at time.Time
+}
+
+// RetryAt wraps the error of a failed job to retry it at a specific time
+// instead of after the default backoff.
+func RetryAt(err error, at time.Time) error {
+	return &retryError{err, at}
+}
+
+// Worker runs the jobs queued in the database. Any number of workers can run
+// side by side, in the API process or as separate `gocommerce worker`
+// processes.
+type Worker struct {
+	db           *gorm.DB
+	id           string
+	config       conf.WorkerConfiguration
+	globalConfig *conf.GlobalConfiguration
+	// instanceConf is the configuration of jobs without an instance. It is
+	// only set when running in single instance mode.
+	instanceConf *conf.Configuration
+	log          logrus.FieldLogger
+	handlers     map[string]Handler
+}
+
+// NewWorker creates a Worker with handlers for all built-in job types. The
+// instance configuration is used for jobs that don't belong to an instance
+// and can be nil in multi instance mode.
+func NewWorker(db *gorm.DB, globalConfig *conf.GlobalConfiguration, instanceConf *conf.Configuration, log logrus.FieldLogger) *Worker {
+	config := globalConfig.Worker
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = 5 * time.Second
+	}
+	if config.VisibilityTimeout <= 0 {
+		config.VisibilityTimeout = 5 * time.Minute
+	}
+
+	id := uuid.NewRandom().String()
+	w := &Worker{
+		db:           db,
+		id:           id,
+		config:       config,
+		globalConfig: globalConfig,
+		instanceConf: instanceConf,
+		log:          log.WithField("worker_id", id),
+		handlers:     map[string]Handler{},
+	}
+	w.Register(models.HookJobType, deliverHook(&http.Client{}))
+	w.Register(models.EmailJobType, w.sendEmail)
+	w.Register(models.OrderExpiryJobType, expireOrder)
+	return w
+}
+
+// InstanceConfig loads the configuration of an instance, or the single
+// instance configuration for jobs without an instance.
+func (w *Worker) InstanceConfig(instanceID string) (*conf.Configuration, error) {
+	if instanceID == "" {
+		if w.instanceConf == nil {
+			return nil, errors.New("no configuration for jobs without an instance")
+		}
+		return w.instanceConf, nil
+	}
+
+	instance, err := models.GetInstance(w.db, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return instance.Config()
+}
+
+// Register sets the handler for a job type. The worker only claims jobs of
+// types it has a handler for.
+func (w *Worker) Register(jobType string, handler Handler) {
+	w.handlers[jobType] = handler
+}
+
+// Run claims and runs jobs until the context is canceled. It then stops
+// claiming new jobs and returns once the running jobs have finished.
+func (w *Worker) Run(ctx context.Context) {
+	if n, err := models.EnqueueOrphanedHooks(w.db); err != nil {
+		w.log.WithError(err).Error("Error enqueuing pending hooks")
+	} else if n > 0 {
+		w.log.Infof("Enqueued %d pending hooks", n)
+	}
+
+	jobTypes := make([]string, 0, len(w.handlers))
+	for jobType := range w.handlers {
+		jobTypes = append(jobTypes, jobType)
+	}
+
+	w.log.WithField("job_types", jobTypes).Info("Worker started")
+	sem := make(chan bool, w.config.Concurrency)
+	var wg sync.WaitGroup
+	for {
+		claimed := 0
+		if free := w.config.Concurrency - len(sem); free > 0 {
+			jobs, err := models.ClaimJobs(w.db, w.id, jobTypes, free, w.config.VisibilityTimeout)
+			if err != nil {
+				w.log.WithError(err).Error("Error claiming jobs")
+			}
+			claimed = len(jobs)
+			for _, job := range jobs {
+				sem <- true
+				wg.Add(1)
+				go func(job *models.Job) {
+					defer wg.Done()
+					w.runJob(job)
+					<-sem
+				}(job)
+			}
+		}
+
+		if claimed == 0 {
+			select {
+			case <-ctx.Done():
+				w.log.Info("Worker stopping, waiting for running jobs")
+				wg.Wait()
+				w.log.Info("Worker stopped")
+				return
+			case <-time.After(w.config.PollInterval):
+			}
+		} else if ctx.Err() != nil {
+			wg.Wait()
+			return
+		}
+	}
+}
+
+func (w *Worker) runJob(job *models.Job) {
+	log := w.log.WithFields(logrus.Fields{
+		"job_id":      job.ID,
+		"job_type":    job.Type,
+		"instance_id": job.InstanceID,
+		"attempt":     job.Attempts,
+	})
+
+	// jobs must finish before their lock expires and another worker runs them
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.VisibilityTimeout)
+	defer cancel()
+
+	err := w.handle(ctx, job, log)
+	if err == nil {
+		if err := job.Complete(w.db); err != nil {
+			log.WithError(err).Error("Error completing job")
+		}
+		return
+	}
+
+	retryAt := time.Now().Add(models.Backoff(job.Attempts, retryBaseDelay, retryMaxDelay))
+	if r, ok := err.(*retryError); ok {
+		retryAt = r.at
+	}
+	if err := job.Retry(w.db, err, retryAt); err != nil {
+		log.WithError(err).Error("Error rescheduling job")
+		return
+	}
+	if job.Status == models.JobFailed {
+		log.WithError(err).Errorf("Job failed %d times, giving up", job.Attempts)
+	} else {
+		log.WithError(err).Warnf("Job failed, retrying at %v", retryAt)
+	}
+}
+
+func (w *Worker) handle(ctx context.Context, job *models.Job, log logrus.FieldLogger) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	handler, ok := w.handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("no handler for job type '%s'", job.Type)
+	}
+	return handler(ctx, w.db, job, log)
+}
@@ -0,0 +1,262 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+var dbFiles []string
+var testLogger = logrus.NewEntry(logrus.StandardLogger())
+
+var testGlobalConfig = &conf.GlobalConfiguration{
+	Worker: conf.WorkerConfiguration{
+		Concurrency:       2,
+		PollInterval:      10 * time.Millisecond,
+		VisibilityTimeout: time.Minute,
+	},
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	for _, f := range dbFiles {
+		os.Remove(f)
+	}
+	os.Exit(code)
+}
+
+func testDB(t *testing.T) *gorm.DB {
+	f, err := ioutil.TempFile("", "test-db")
+	require.NoError(t, err)
+	f.Close()
+	dbFiles = append(dbFiles, f.Name())
+
+	globalConfig := &conf.GlobalConfiguration{}
+	globalConfig.DB.Driver = "sqlite3"
+	globalConfig.DB.URL = f.Name()
+	globalConfig.DB.Automigrate = true
+
+	db, err := models.Connect(globalConfig)
+	require.NoError(t, err)
+	return db
+}
+
+func enqueue(t *testing.T, db *gorm.DB, jobType string) *models.Job {
+	job, err := models.NewJob("", jobType, map[string]string{"hello": "world"})
+	require.NoError(t, err)
+	require.NoError(t, models.EnqueueJob(db, job))
+	return job
+}
+
+// runUntil runs the worker until the condition holds or the test times out.
+func runUntil(t *testing.T, w *Worker, cond func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	require.True(t, cond(), "condition not met before timeout")
+}
+
+func reload(t *testing.T, db *gorm.DB, job *models.Job) *models.Job {
+	found := &models.Job{}
+	require.NoError(t, db.Where("id = ?", job.ID).First(found).Error)
+	return found
+}
+
+func TestWorker(t *testing.T) {
+	t.Run("Complete", func(t *testing.T) {
+		db := testDB(t)
+		job := enqueue(t, db, "test")
+
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		var payload map[string]string
+		w.Register("test", func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+			return job.DecodePayload(&payload)
+		})
+		runUntil(t, w, func() bool { return reload(t, db, job).Status == models.JobDone })
+
+		done := reload(t, db, job)
+		assert.Equal(t, 1, done.Attempts)
+		assert.Nil(t, done.LockedBy)
+		assert.NotNil(t, done.CompletedAt)
+		assert.Equal(t, "world", payload["hello"])
+	})
+
+	t.Run("RetryAndFail", func(t *testing.T) {
+		db := testDB(t)
+		job := enqueue(t, db, "test")
+		require.NoError(t, db.Model(job).Update("max_attempts", 2).Error)
+
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		w.Register("test", func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+			return RetryAt(errors.New("nope"), time.Now())
+		})
+		runUntil(t, w, func() bool { return reload(t, db, job).Status == models.JobFailed })
+
+		failed := reload(t, db, job)
+		assert.Equal(t, 2, failed.Attempts)
+		require.NotNil(t, failed.LastError)
+		assert.Equal(t, "nope", *failed.LastError)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		db := testDB(t)
+		job := enqueue(t, db, "test")
+
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		w.Register("test", func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+			panic("boom")
+		})
+		runUntil(t, w, func() bool { return reload(t, db, job).LastError != nil })
+
+		retried := reload(t, db, job)
+		assert.Equal(t, models.JobPending, retried.Status)
+		assert.True(t, retried.RunAfter.After(time.Now()))
+	})
+
+	t.Run("VisibilityTimeout", func(t *testing.T) {
+		db := testDB(t)
+		job := enqueue(t, db, "test")
+
+		crashed, err := models.ClaimJobs(db, "crashed-worker", []string{"test"}, 10, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, crashed, 1)
+
+		claimed, err := models.ClaimJobs(db, "other-worker", []string{"test"}, 10, time.Minute)
+		require.NoError(t, err)
+		assert.Len(t, claimed, 0)
+
+		past := time.Now().Add(-2 * time.Minute)
+		require.NoError(t, db.Model(job).Update("locked_at", past).Error)
+		reclaimed, err := models.ClaimJobs(db, "other-worker", []string{"test"}, 10, time.Minute)
+		require.NoError(t, err)
+		require.Len(t, reclaimed, 1)
+		assert.Equal(t, 2, reclaimed[0].Attempts)
+
+		// the crashed worker can't finish the job anymore
+		assert.Equal(t, models.ErrJobLockLost, crashed[0].Complete(db))
+		assert.NoError(t, reclaimed[0].Complete(db))
+	})
+
+	t.Run("OnlyRegisteredTypes", func(t *testing.T) {
+		db := testDB(t)
+		enqueue(t, db, "other")
+
+		claimed, err := models.ClaimJobs(db, "worker", []string{"test"}, 10, time.Minute)
+		require.NoError(t, err)
+		assert.Len(t, claimed, 0)
+	})
+
+	t.Run("GracefulShutdown", func(t *testing.T) {
+		db := testDB(t)
+		job := enqueue(t, db, "test")
+
+		started := make(chan bool)
+		var finished int32
+		w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+		w.Register("test", func(ctx context.Context, db *gorm.DB, job *models.Job, log logrus.FieldLogger) error {
+			close(started)
+			time.Sleep(100 * time.Millisecond)
+			atomic.StoreInt32(&finished, 1)
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan bool)
+		go func() {
+			w.Run(ctx)
+			close(done)
+		}()
+		<-started
+		cancel()
+		<-done
+
+		assert.EqualValues(t, 1, atomic.LoadInt32(&finished))
+		assert.Equal(t, models.JobDone, reload(t, db, job).Status)
+	})
+}
+
+func TestDeliverHook(t *testing.T) {
+	db := testDB(t)
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	hook, err := models.NewHook(models.WebhookOrderCreated, "", server.URL, "", "", map[string]string{"id": "first-order"})
+	require.NoError(t, err)
+	hook.RetryBaseDelay = 1
+	hook.RetryMaxDelay = 1
+	require.NoError(t, models.EnqueueHook(db, hook))
+	require.NotNil(t, hook.JobID)
+
+	w := NewWorker(db, testGlobalConfig, &conf.Configuration{}, testLogger)
+	runUntil(t, w, func() bool {
+		found := &models.Hook{}
+		require.NoError(t, db.Where("id = ?", hook.ID).First(found).Error)
+		return found.Done
+	})
+
+	found := &models.Hook{}
+	require.NoError(t, db.Where("id = ?", hook.ID).First(found).Error)
+	assert.False(t, found.Failed)
+	assert.Equal(t, 2, found.Tries)
+	assert.Equal(t, 2, calls)
+
+	job := reload(t, db, &models.Job{ID: *hook.JobID})
+	assert.Equal(t, models.JobDone, job.Status)
+}
+
+func TestDeliverHookTimeout(t *testing.T) {
+	db := testDB(t)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	hook, err := models.NewHook(models.WebhookOrderCreated, "", server.URL, "", "", map[string]string{"id": "first-order"})
+	require.NoError(t, err)
+	require.NoError(t, models.EnqueueHook(db, hook))
+	job := reload(t, db, &models.Job{ID: *hook.JobID})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = deliverHook(&http.Client{})(ctx, db, job, testLogger)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "delivery outlived the job")
+
+	found := &models.Hook{}
+	require.NoError(t, db.Where("id = ?", hook.ID).First(found).Error)
+	assert.False(t, found.Done)
+	assert.Equal(t, 1, found.Tries)
+}
@@ -2,12 +2,12 @@ package mailer
 
 import (
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
-	"github.com/netlify/mailme"
 )
 
 // Mailer will send mail and use templates from the site for easy mail styling
@@ -15,11 +15,45 @@ type Mailer interface {
 	OrderConfirmationMail(transaction *models.Transaction) error
 	OrderReceivedMail(transaction *models.Transaction) error
 	OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error)
+	RefundIssuedMail(transaction *models.Transaction) error
+	OrderShippedMail(order *models.Order) error
+	OrderCancelledMail(order *models.Order) error
+	PaymentFailedMail(transaction *models.Transaction) error
+	DownloadReadyMail(order *models.Order) error
+	AbandonedCartMail(order *models.Order) error
+
+	// Render renders an email of any type without sending it. Emails about a
+	// payment or refund need its transaction. The template URL overrides the
+	// configured template of the type when it is set.
+	Render(emailType string, order *models.Order, transaction *models.Transaction, templateURL string) (*Message, error)
+	// Send delivers a rendered email.
+	Send(msg *Message) error
+}
+
+// Message is a rendered email with a plain text and an HTML version.
+type Message struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+
+	Attachments []*Attachment `json:"attachments,omitempty"`
+}
+
+// Attachment is a file attached to an email.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
 }
 
 type mailer struct {
-	Config         *conf.Configuration
-	TemplateMailer *mailme.Mailer
+	Config    *conf.Configuration
+	From      string
+	Transport Transport
+	FuncMap   map[string]interface{}
+	templates *templateCache
 }
 
 // MailSubjects holds the subject lines for the emails
@@ -27,47 +61,60 @@ type MailSubjects struct {
 	OrderConfirmationMail string
 }
 
-// NewMailer returns a new authlify mailer
+// mailContent describes a type of email: its configured subject and template
+// and the built-in versions used when those aren't set or can't be found.
+type mailContent struct {
+	subject        string
+	defaultSubject string
+	templateURL    string
+	defaultHTML    string
+	defaultText    string
+
+	// aboutTransaction is set for emails about a payment or refund.
+	aboutTransaction bool
+	// toAdmin is set for emails to the shop admin instead of the customer.
+	toAdmin bool
+}
+
+// NewMailer returns a new authlify mailer. The settings of the instance take
+// precedence over the global ones.
 func NewMailer(smtp conf.SMTPConfiguration, instanceConfig *conf.Configuration) Mailer {
-	if smtp.Host == "" && instanceConfig.SMTP.Host == "" {
-		return newNoopMailer()
+	settings := instanceConfig.SMTP
+	settings.Transport = withDefault(settings.Transport, smtp.Transport)
+	settings.Host = withDefault(settings.Host, smtp.Host)
+	if settings.Host == "" && (settings.Transport == "" || settings.Transport == SMTPTransport) {
+		return newNoopMailer(instanceConfig)
 	}
 
-	smtpHost := instanceConfig.SMTP.Host
-	if smtpHost == "" {
-		smtpHost = smtp.Host
-	}
-	smtpPort := instanceConfig.SMTP.Port
-	if smtpPort == 0 {
-		smtpPort = smtp.Port
-	}
-	smtpUser := instanceConfig.SMTP.User
-	if smtpUser == "" {
-		smtpUser = smtp.User
-	}
-	smtpPass := instanceConfig.SMTP.Pass
-	if smtpPass == "" {
-		smtpPass = smtp.Pass
-	}
-	smtpAdminEmail := instanceConfig.SMTP.AdminEmail
-	if smtpAdminEmail == "" {
-		smtpAdminEmail = smtp.AdminEmail
+	if settings.Port == 0 {
+		settings.Port = smtp.Port
 	}
+	settings.User = withDefault(settings.User, smtp.User)
+	settings.Pass = withDefault(settings.Pass, smtp.Pass)
+	settings.AdminEmail = withDefault(settings.AdminEmail, smtp.AdminEmail)
+	settings.APIURL = withDefault(settings.APIURL, smtp.APIURL)
+	settings.APIKey = withDefault(settings.APIKey, smtp.APIKey)
+	settings.Dir = withDefault(settings.Dir, smtp.Dir)
+
+	return newMailer(instanceConfig, settings.AdminEmail, newTransport(settings))
+}
 
+// NewMailerWithTransport returns a mailer that delivers emails with the
+// transport, like a Capture in tests.
+func NewMailerWithTransport(instanceConfig *conf.Configuration, from string, transport Transport) Mailer {
+	return newMailer(instanceConfig, from, transport)
+}
+
+func newMailer(instanceConfig *conf.Configuration, from string, transport Transport) *mailer {
 	return &mailer{
-		Config: instanceConfig,
-		TemplateMailer: &mailme.Mailer{
-			Host:    smtpHost,
-			Port:    smtpPort,
-			User:    smtpUser,
-			Pass:    smtpPass,
-			From:    smtpAdminEmail,
-			BaseURL: instanceConfig.SiteURL,
-			FuncMap: map[string]interface{}{
-				"dateFormat":     dateFormat,
-				"price":          price,
-				"hasProductType": hasProductType,
-			},
+		Config:    instanceConfig,
+		From:      from,
+		Transport: transport,
+		templates: siteTemplates(instanceConfig.SiteURL),
+		FuncMap: map[string]interface{}{
+			"dateFormat":     dateFormat,
+			"price":          price,
+			"hasProductType": hasProductType,
 		},
 	}
 }
@@ -77,14 +124,7 @@ func dateFormat(layout string, date time.Time) string {
 }
 
 func price(amount uint64, currency string) string {
-	switch currency {
-	case "USD":
-		return fmt.Sprintf("$%.2f", float64(amount)/100)
-	case "EUR":
-		return fmt.Sprintf("%.2f€", float64(amount)/100)
-	default:
-		return fmt.Sprintf("%.2f %v", float64(amount)/100, currency)
-	}
+	return calculator.FormatAmount(amount, currency)
 }
 
 func hasProductType(order *models.Order, productType string) bool {
@@ -96,71 +136,423 @@ func hasProductType(order *models.Order, productType string) bool {
 	return false
 }
 
+func withDefault(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func (m *mailer) content(emailType string) (mailContent, bool) {
+	subjects := m.Config.Mailer.Subjects
+	templates := m.Config.Mailer.Templates
+
+	switch emailType {
+	case models.OrderConfirmationEmail:
+		return mailContent{
+			subject:          subjects.OrderConfirmation,
+			defaultSubject:   "Order Confirmation",
+			templateURL:      templates.OrderConfirmation,
+			defaultHTML:      defaultConfirmationTemplate,
+			defaultText:      defaultConfirmationText,
+			aboutTransaction: true,
+		}, true
+	case models.OrderReceivedEmail:
+		return mailContent{
+			subject:          subjects.OrderReceived,
+			defaultSubject:   "Order Received From {{ .Order.Email }}",
+			templateURL:      templates.OrderReceived,
+			defaultHTML:      defaultReceivedTemplate,
+			defaultText:      defaultReceivedText,
+			aboutTransaction: true,
+			toAdmin:          true,
+		}, true
+	case models.RefundIssuedEmail:
+		return mailContent{
+			subject:          subjects.RefundIssued,
+			defaultSubject:   "Refund Issued",
+			templateURL:      templates.RefundIssued,
+			defaultHTML:      defaultRefundIssuedTemplate,
+			defaultText:      defaultRefundIssuedText,
+			aboutTransaction: true,
+		}, true
+	case models.OrderShippedEmail:
+		return mailContent{
+			subject:        subjects.OrderShipped,
+			defaultSubject: "Your Order Has Shipped",
+			templateURL:    templates.OrderShipped,
+			defaultHTML:    defaultOrderShippedTemplate,
+			defaultText:    defaultOrderShippedText,
+		}, true
+	case models.OrderCancelledEmail:
+		return mailContent{
+			subject:        subjects.OrderCancelled,
+			defaultSubject: "Order Cancelled",
+			templateURL:    templates.OrderCancelled,
+			defaultHTML:    defaultOrderCancelledTemplate,
+			defaultText:    defaultOrderCancelledText,
+		}, true
+	case models.PaymentFailedEmail:
+		return mailContent{
+			subject:          subjects.PaymentFailed,
+			defaultSubject:   "Payment Failed",
+			templateURL:      templates.PaymentFailed,
+			defaultHTML:      defaultPaymentFailedTemplate,
+			defaultText:      defaultPaymentFailedText,
+			aboutTransaction: true,
+		}, true
+	case models.DownloadReadyEmail:
+		return mailContent{
+			subject:        subjects.DownloadReady,
+			defaultSubject: "Your Downloads Are Ready",
+			templateURL:    templates.DownloadReady,
+			defaultHTML:    defaultDownloadReadyTemplate,
+			defaultText:    defaultDownloadReadyText,
+		}, true
+	case models.AbandonedCartEmail:
+		return mailContent{
+			subject:        subjects.AbandonedCart,
+			defaultSubject: "You Left Something in Your Cart",
+			templateURL:    templates.AbandonedCart,
+			defaultHTML:    defaultAbandonedCartTemplate,
+			defaultText:    defaultAbandonedCartText,
+		}, true
+	case models.SubscriptionCanceledEmail:
+		return mailContent{
+			subject:        subjects.SubscriptionCanceled,
+			defaultSubject: "Your Subscription Was Canceled",
+			templateURL:    templates.SubscriptionCanceled,
+			defaultHTML:    defaultSubscriptionCanceledTemplate,
+			defaultText:    defaultSubscriptionCanceledText,
+		}, true
+	}
+	return mailContent{}, false
+}
+
+// Render renders an email of any type without sending it.
+func (m *mailer) Render(emailType string, order *models.Order, transaction *models.Transaction, templateURL string) (*Message, error) {
+	content, ok := m.content(emailType)
+	if !ok {
+		return nil, fmt.Errorf("Unknown email type '%s'", emailType)
+	}
+	if templateURL != "" {
+		content.templateURL = templateURL
+	}
+
+	data := map[string]interface{}{"Order": order}
+	if content.aboutTransaction {
+		if transaction == nil {
+			return nil, fmt.Errorf("The %s email needs a transaction", emailType)
+		}
+		data["Transaction"] = transaction
+	}
+
+	if content.toAdmin {
+		// the shop admin doesn't get the templates of the customer's locale
+		return m.render(m.From, "", content, data)
+	}
+	return m.render(order.Email, order.Locale, content, data)
+}
+
+// Send delivers a rendered email.
+func (m *mailer) Send(msg *Message) error {
+	return m.Transport.Send(msg)
+}
+
+// render renders an email with the site's template for the locale if there
+// is one. When the site has no plain text version of a template, the text is
+// generated from the HTML.
+func (m *mailer) render(to, locale string, content mailContent, data map[string]interface{}) (*Message, error) {
+	subject, err := renderText("subject", withDefault(content.subject, content.defaultSubject), m.FuncMap, data)
+	if err != nil {
+		return nil, &TemplateError{Template: "subject", Err: err}
+	}
+	msg := &Message{
+		From:    m.From,
+		To:      to,
+		Subject: strings.TrimSpace(subject),
+	}
+
+	// the email is retried when the site can't be reached, instead of being
+	// sent with the built-in template
+	body, found, err := m.templates.lookup(content.templateURL, locale)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		if msg.HTML, err = renderHTML("default", content.defaultHTML, m.FuncMap, data); err != nil {
+			return nil, &TemplateError{Template: "built-in HTML", Err: err}
+		}
+		if msg.Text, err = renderText("default", content.defaultText, m.FuncMap, data); err != nil {
+			return nil, &TemplateError{Template: "built-in text", Err: err}
+		}
+		return msg, nil
+	}
+
+	if msg.HTML, err = renderHTML(content.templateURL, body, m.FuncMap, data); err != nil {
+		return nil, &TemplateError{Template: content.templateURL, Err: err}
+	}
+	textURL := textTemplatePath(content.templateURL)
+	text, found, err := m.templates.lookup(textURL, locale)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if msg.Text, err = renderText(textURL, text, m.FuncMap, data); err != nil {
+			return nil, &TemplateError{Template: textURL, Err: err}
+		}
+	} else {
+		msg.Text = htmlToText(msg.HTML)
+	}
+	return msg, nil
+}
+
+func (m *mailer) mail(emailType string, order *models.Order, transaction *models.Transaction) error {
+	msg, err := m.Render(emailType, order, transaction, "")
+	if err != nil {
+		return err
+	}
+	return m.Send(msg)
+}
+
+// OrderConfirmationMail sends an order confirmation to the user
+func (m *mailer) OrderConfirmationMail(transaction *models.Transaction) error {
+	return m.mail(models.OrderConfirmationEmail, transaction.Order, transaction)
+}
+
+// OrderReceivedMail sends a notification to the shop admin
+func (m *mailer) OrderReceivedMail(transaction *models.Transaction) error {
+	return m.mail(models.OrderReceivedEmail, transaction.Order, transaction)
+}
+
+func (m *mailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
+	msg, err := m.Render(models.OrderConfirmationEmail, transaction.Order, transaction, templateURL)
+	if err != nil {
+		return "", err
+	}
+	return msg.HTML, nil
+}
+
+// RefundIssuedMail tells the user about a refund of their order
+func (m *mailer) RefundIssuedMail(transaction *models.Transaction) error {
+	return m.mail(models.RefundIssuedEmail, transaction.Order, transaction)
+}
+
+// OrderShippedMail tells the user that their order has shipped
+func (m *mailer) OrderShippedMail(order *models.Order) error {
+	return m.mail(models.OrderShippedEmail, order, nil)
+}
+
+// OrderCancelledMail tells the user that their order has been cancelled
+func (m *mailer) OrderCancelledMail(order *models.Order) error {
+	return m.mail(models.OrderCancelledEmail, order, nil)
+}
+
+// PaymentFailedMail tells the user that the payment for their order failed
+func (m *mailer) PaymentFailedMail(transaction *models.Transaction) error {
+	return m.mail(models.PaymentFailedEmail, transaction.Order, transaction)
+}
+
+// DownloadReadyMail tells the user that the downloads of their order are available
+func (m *mailer) DownloadReadyMail(order *models.Order) error {
+	return m.mail(models.DownloadReadyEmail, order, nil)
+}
+
+// AbandonedCartMail reminds the user of an order they didn't pay for
+func (m *mailer) AbandonedCartMail(order *models.Order) error {
+	return m.mail(models.AbandonedCartEmail, order, nil)
+}
+
 const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
 
 <ul>
 {{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ price .Price $.Order.Currency }}</strong></li>
 {{ end }}
 </ul>
 
-<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
-`
+<p>Total amount: <strong>{{ price .Order.Total .Order.Currency }}</strong></p>
+{{ if .Order.Licenses }}
+<h3>Your license keys</h3>
 
-// OrderConfirmationMail sends an order confirmation to the user
-func (m *mailer) OrderConfirmationMail(transaction *models.Transaction) error {
-	log.Printf("Sending order confirmation to %v with template %v", transaction.Order.Email, m.Config.Mailer.Templates.OrderConfirmation)
-	return m.TemplateMailer.Mail(
-		transaction.Order.Email,
-		withDefault(m.Config.Mailer.Subjects.OrderConfirmation, "Order Confirmation"),
-		m.Config.Mailer.Templates.OrderConfirmation,
-		defaultConfirmationTemplate,
-		map[string]interface{}{
-			"Order":       transaction.Order,
-			"Transaction": transaction,
-		},
-	)
-}
+<ul>
+{{ range .Order.Licenses }}
+<li>{{ .Title }}: <code>{{ .Key }}</code></li>
+{{ end }}
+</ul>
+{{ end }}
+{{ if .Order.GiftCards }}
+<h3>Your gift cards</h3>
+
+<ul>
+{{ range .Order.GiftCards }}
+<li><code>{{ .Code }}</code>: {{ price .Balance .Currency }}</li>
+{{ end }}
+</ul>
+{{ end }}`
+
+const defaultConfirmationText = `Thank you for your order!
+{{ range .Order.LineItems }}
+- {{ .Title }}: {{ .Quantity }} x {{ price .Price $.Order.Currency }}
+{{- end }}
+
+Total amount: {{ price .Order.Total .Order.Currency }}
+{{ if .Order.Licenses }}
+Your license keys:
+{{ range .Order.Licenses }}
+- {{ .Title }}: {{ .Key }}
+{{- end }}
+{{ end }}
+{{- if .Order.GiftCards }}
+Your gift cards:
+{{ range .Order.GiftCards }}
+- {{ .Code }}: {{ price .Balance .Currency }}
+{{- end }}
+{{ end }}`
 
 const defaultReceivedTemplate = `<h2>Order Received From {{ .Order.Email }}</h2>
 
 <ul>
 {{ range .Order.LineItems }}
-<li>{{ .Title }} <strong>{{ .Quantity }} x {{ .Price }}</strong></li>
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ price .Price $.Order.Currency }}</strong></li>
 {{ end }}
 </ul>
 
-<p>Total amount: <strong>{{ .Order.Total }}</strong></p>
+<p>Total amount: <strong>{{ price .Order.Total .Order.Currency }}</strong></p>
 `
 
-// OrderReceivedMail sends a notification to the shop admin
-func (m *mailer) OrderReceivedMail(transaction *models.Transaction) error {
-	return m.TemplateMailer.Mail(
-		m.TemplateMailer.From,
-		withDefault(m.Config.Mailer.Subjects.OrderReceived, "Order Received From {{ .Order.Email }}"),
-		m.Config.Mailer.Templates.OrderReceived,
-		defaultReceivedTemplate,
-		map[string]interface{}{
-			"Order":       transaction.Order,
-			"Transaction": transaction,
-		},
-	)
-}
+const defaultReceivedText = `Order Received From {{ .Order.Email }}
+{{ range .Order.LineItems }}
+- {{ .Title }}: {{ .Quantity }} x {{ price .Price $.Order.Currency }}
+{{- end }}
 
-func (m *mailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
-	if templateURL == "" {
-		templateURL = m.Config.Mailer.Templates.OrderConfirmation
-	}
+Total amount: {{ price .Order.Total .Order.Currency }}
+`
 
-	return m.TemplateMailer.MailBody(templateURL, defaultReceivedTemplate, map[string]interface{}{
-		"Order":       transaction.Order,
-		"Transaction": transaction,
-	})
-}
+const defaultRefundIssuedTemplate = `<h2>We refunded your order</h2>
 
-func withDefault(value string, defaultValue string) string {
-	if value == "" {
-		return defaultValue
-	}
-	return value
-}
+<p>We refunded <strong>{{ price .Transaction.Amount .Transaction.Currency }}</strong> of your order from {{ dateFormat "January 2, 2006" .Order.CreatedAt }}.</p>
+
+<p>It can take a few days for the refund to show up on your statement.</p>
+`
+
+const defaultRefundIssuedText = `We refunded your order
+
+We refunded {{ price .Transaction.Amount .Transaction.Currency }} of your order from {{ dateFormat "January 2, 2006" .Order.CreatedAt }}.
+
+It can take a few days for the refund to show up on your statement.
+`
+
+const defaultOrderShippedTemplate = `<h2>Your order is on its way!</h2>
+
+<ul>
+{{ range .Order.LineItems }}
+<li>{{ .Title }} <strong>{{ .Quantity }}</strong></li>
+{{ end }}
+</ul>
+
+{{ if .Order.TrackingNumber }}
+<p>Tracking number: {{ if .Order.TrackingURL }}<a href="{{ .Order.TrackingURL }}">{{ .Order.TrackingNumber }}</a>{{ else }}<strong>{{ .Order.TrackingNumber }}</strong>{{ end }}{{ if .Order.Carrier }} ({{ .Order.Carrier }}){{ end }}</p>
+{{ end }}
+`
+
+const defaultOrderShippedText = `Your order is on its way!
+{{ range .Order.LineItems }}
+- {{ .Title }}: {{ .Quantity }}
+{{- end }}
+{{ if .Order.TrackingNumber }}
+Tracking number: {{ .Order.TrackingNumber }}{{ if .Order.Carrier }} ({{ .Order.Carrier }}){{ end }}
+{{- if .Order.TrackingURL }}
+Track your package: {{ .Order.TrackingURL }}
+{{- end }}
+{{ end }}`
+
+const defaultOrderCancelledTemplate = `<h2>Your order has been cancelled</h2>
+
+<ul>
+{{ range .Order.LineItems }}
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ price .Price $.Order.Currency }}</strong></li>
+{{ end }}
+</ul>
+`
+
+const defaultOrderCancelledText = `Your order has been cancelled
+{{ range .Order.LineItems }}
+- {{ .Title }}: {{ .Quantity }} x {{ price .Price $.Order.Currency }}
+{{- end }}
+`
+
+const defaultPaymentFailedTemplate = `<h2>We couldn't process your payment</h2>
+
+<p>Your payment of <strong>{{ price .Transaction.Amount .Transaction.Currency }}</strong> failed{{ if .Transaction.FailureDescription }}: {{ .Transaction.FailureDescription }}{{ end }}.</p>
+
+<p>Your order has not been placed. Please try again with another payment method.</p>
+`
+
+const defaultPaymentFailedText = `We couldn't process your payment
+
+Your payment of {{ price .Transaction.Amount .Transaction.Currency }} failed{{ if .Transaction.FailureDescription }}: {{ .Transaction.FailureDescription }}{{ end }}.
+
+Your order has not been placed. Please try again with another payment method.
+`
+
+const defaultDownloadReadyTemplate = `<h2>Your downloads are ready</h2>
+
+<ul>
+{{ range .Order.Downloads }}
+<li>{{ .Title }}{{ if .Format }} ({{ .Format }}){{ end }}</li>
+{{ end }}
+</ul>
+
+<p>You can download them from your order history.</p>
+`
+
+const defaultDownloadReadyText = `Your downloads are ready
+{{ range .Order.Downloads }}
+- {{ .Title }}{{ if .Format }} ({{ .Format }}){{ end }}
+{{- end }}
+
+You can download them from your order history.
+`
+
+const defaultAbandonedCartTemplate = `<h2>You left something behind</h2>
+
+<ul>
+{{ range .Order.LineItems }}
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ price .Price $.Order.Currency }}</strong></li>
+{{ end }}
+</ul>
+
+<p>Your order is still waiting for you. Complete it at any time.</p>
+`
+
+const defaultAbandonedCartText = `You left something behind
+{{ range .Order.LineItems }}
+- {{ .Title }}: {{ .Quantity }} x {{ price .Price $.Order.Currency }}
+{{- end }}
+
+Your order is still waiting for you. Complete it at any time.
+`
+
+const defaultSubscriptionCanceledTemplate = `<h2>Your subscription was canceled</h2>
+
+<p>We couldn't charge the renewal of your subscription, so it was canceled:</p>
+
+<ul>
+{{ range .Order.LineItems }}
+<li>{{ .Title }} <strong>{{ .Quantity }} x {{ price .Price $.Order.Currency }}</strong></li>
+{{ end }}
+</ul>
+
+<p>You can still pay the renewal to continue your subscription.</p>
+`
+
+const defaultSubscriptionCanceledText = `Your subscription was canceled
+
+We couldn't charge the renewal of your subscription, so it was canceled:
+{{ range .Order.LineItems }}
+- {{ .Title }}: {{ .Quantity }} x {{ price .Price $.Order.Currency }}
+{{- end }}
+
+You can still pay the renewal to continue your subscription.
+`
@@ -1,11 +1,18 @@
 package mailer
 
-import "github.com/netlify/gocommerce/models"
+import (
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
 
-type noopMailer struct{}
+// noopMailer is used when no mail server is configured. It renders emails,
+// so they can still be previewed, but doesn't send them.
+type noopMailer struct {
+	*mailer
+}
 
-func newNoopMailer() Mailer {
-	return &noopMailer{}
+func newNoopMailer(instanceConfig *conf.Configuration) Mailer {
+	return &noopMailer{newMailer(instanceConfig, "", nil)}
 }
 
 func (m *noopMailer) OrderConfirmationMail(transaction *models.Transaction) error {
@@ -18,3 +25,31 @@ func (m *noopMailer) OrderReceivedMail(transaction *models.Transaction) error {
 func (m *noopMailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
 	return "Order Confirmed", nil
 }
+
+func (m *noopMailer) RefundIssuedMail(transaction *models.Transaction) error {
+	return nil
+}
+
+func (m *noopMailer) OrderShippedMail(order *models.Order) error {
+	return nil
+}
+
+func (m *noopMailer) OrderCancelledMail(order *models.Order) error {
+	return nil
+}
+
+func (m *noopMailer) PaymentFailedMail(transaction *models.Transaction) error {
+	return nil
+}
+
+func (m *noopMailer) DownloadReadyMail(order *models.Order) error {
+	return nil
+}
+
+func (m *noopMailer) AbandonedCartMail(order *models.Order) error {
+	return nil
+}
+
+func (m *noopMailer) Send(msg *Message) error {
+	return nil
+}
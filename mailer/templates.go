@@ -0,0 +1,243 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const templateExpiration = 10 * time.Second
+
+// TemplateError is an error in an email template, like a syntax error or a
+// variable that doesn't exist.
+type TemplateError struct {
+	Template string
+	Err      error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("Error in %s template: %v", e.Template, e.Err)
+}
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// ValidLocale checks that a locale is a language tag like "en" or "pt-BR".
+func ValidLocale(locale string) bool {
+	return localePattern.MatchString(locale)
+}
+
+// localeCandidates lists the localized variants of a template path, from most
+// to least specific. "/mail/receipt.html" in "pt-BR" is looked up as
+// "/mail/receipt.pt-BR.html", "/mail/receipt.pt.html" and "/mail/receipt.html".
+func localeCandidates(templatePath, locale string) []string {
+	ext := path.Ext(templatePath)
+	base := strings.TrimSuffix(templatePath, ext)
+
+	candidates := []string{}
+	if ValidLocale(locale) {
+		parts := strings.Split(locale, "-")
+		for i := len(parts); i > 0; i-- {
+			candidates = append(candidates, base+"."+strings.Join(parts[:i], "-")+ext)
+		}
+	}
+	return append(candidates, templatePath)
+}
+
+// textTemplatePath is the path of the plain text version of an HTML template.
+func textTemplatePath(templatePath string) string {
+	return strings.TrimSuffix(templatePath, path.Ext(templatePath)) + ".txt"
+}
+
+type cachedTemplate struct {
+	body      string
+	found     bool
+	expiresAt time.Time
+}
+
+// templateCache loads email templates from the site and keeps them for a
+// short while, so sending a batch of emails doesn't fetch them every time.
+type templateCache struct {
+	baseURL string
+	client  *http.Client
+
+	mutex     sync.Mutex
+	templates map[string]*cachedTemplate
+}
+
+// templateCaches holds the template cache of every site. A mailer is created
+// for every request and every queued email, so the cache can't belong to one.
+var templateCaches = struct {
+	sync.Mutex
+	sites map[string]*templateCache
+}{sites: map[string]*templateCache{}}
+
+// siteTemplates returns the template cache of the site at the URL.
+func siteTemplates(baseURL string) *templateCache {
+	templateCaches.Lock()
+	defer templateCaches.Unlock()
+	cache, ok := templateCaches.sites[baseURL]
+	if !ok {
+		cache = newTemplateCache(baseURL)
+		templateCaches.sites[baseURL] = cache
+	}
+	return cache
+}
+
+func newTemplateCache(baseURL string) *templateCache {
+	return &templateCache{
+		baseURL:   baseURL,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		templates: map[string]*cachedTemplate{},
+	}
+}
+
+// get returns the template at the path relative to the site, and false if
+// there is none. Only templates the site doesn't have are cached as missing,
+// errors loading them aren't cached at all.
+func (c *templateCache) get(templatePath string) (string, bool, error) {
+	c.mutex.Lock()
+	cached, ok := c.templates[templatePath]
+	c.mutex.Unlock()
+	if ok && cached.expiresAt.After(time.Now()) {
+		return cached.body, cached.found, nil
+	}
+
+	body, found, err := c.fetch(templatePath)
+	if err != nil {
+		return "", false, fmt.Errorf("Error loading template from %v: %v", templatePath, err)
+	}
+
+	c.mutex.Lock()
+	c.templates[templatePath] = &cachedTemplate{body: body, found: found, expiresAt: time.Now().Add(templateExpiration)}
+	c.mutex.Unlock()
+	return body, found, nil
+}
+
+func (c *templateCache) fetch(templatePath string) (string, bool, error) {
+	rsp, err := c.client.Get(c.baseURL + templatePath)
+	if err != nil {
+		return "", false, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", false, err
+	}
+	return string(body), true, nil
+}
+
+// lookup returns the best match for the locale among the variants of a
+// template, and false if the site has none of them.
+func (c *templateCache) lookup(templatePath, locale string) (string, bool, error) {
+	if templatePath == "" {
+		return "", false, nil
+	}
+	for _, candidate := range localeCandidates(templatePath, locale) {
+		body, found, err := c.get(candidate)
+		if err != nil || found {
+			return body, found, err
+		}
+	}
+	return "", false, nil
+}
+
+func renderHTML(name, body string, funcMap map[string]interface{}, data interface{}) (string, error) {
+	tmpl, err := htmltemplate.New(name).Funcs(funcMap).Parse(body)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func renderText(name, body string, funcMap map[string]interface{}, data interface{}) (string, error) {
+	tmpl, err := texttemplate.New(name).Funcs(funcMap).Parse(body)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "tr": true, "table": true,
+	"ul": true, "ol": true, "li": true, "hr": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+var blankLines = regexp.MustCompile(`\n[ \t]*(\n[ \t]*)+`)
+
+// htmlToText turns rendered HTML into a plain text alternative for sites that
+// only provide HTML templates.
+func htmlToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+
+	buf := &bytes.Buffer{}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			buf.WriteString(strings.Join(strings.Fields(n.Data), " "))
+			if strings.HasSuffix(n.Data, " ") {
+				buf.WriteString(" ")
+			}
+			return
+		case html.ElementNode:
+			switch n.Data {
+			case "head", "script", "style":
+				return
+			case "li":
+				buf.WriteString("\n- ")
+			default:
+				if blockElements[n.Data] {
+					buf.WriteString("\n")
+				}
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+		if n.Type == html.ElementNode {
+			if n.Data == "a" {
+				for _, attr := range n.Attr {
+					if attr.Key == "href" && !strings.HasPrefix(attr.Val, "mailto:") {
+						buf.WriteString(" (" + attr.Val + ")")
+					}
+				}
+			}
+			if blockElements[n.Data] {
+				buf.WriteString("\n")
+			}
+		}
+	}
+	walk(doc)
+
+	text := blankLines.ReplaceAllString(buf.String(), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
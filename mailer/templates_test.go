@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/netlify/gocommerce/models"
+)
+
+func testMailer(t *testing.T, templates map[string]string) (*mailer, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := templates[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+
+	config := &conf.Configuration{SiteURL: server.URL}
+	config.SMTP.AdminEmail = "shop@example.com"
+	config.Mailer.Templates.OrderConfirmation = "/mail/confirmation.html"
+	m := NewMailer(conf.SMTPConfiguration{Host: "localhost", Port: 25}, config)
+	require.IsType(t, &mailer{}, m)
+	return m.(*mailer), server.Close
+}
+
+func testTransaction(locale string) *models.Transaction {
+	order := models.NewOrder("", "session", "bruce@wayneindustries.com", "USD")
+	order.Locale = locale
+	order.Total = 123456
+	order.LineItems = []*models.LineItem{{Title: "Batarang", Quantity: 2, Price: 61728}}
+	return models.NewTransaction(order)
+}
+
+func TestLocaleCandidates(t *testing.T) {
+	assert.Equal(t, []string{"/mail/receipt.pt-BR.html", "/mail/receipt.pt.html", "/mail/receipt.html"}, localeCandidates("/mail/receipt.html", "pt-BR"))
+	assert.Equal(t, []string{"/mail/receipt"}, localeCandidates("/mail/receipt", ""))
+	assert.Equal(t, []string{"/mail/receipt.html"}, localeCandidates("/mail/receipt.html", "../../etc"))
+}
+
+func TestRenderDefaultTemplates(t *testing.T) {
+	m, done := testMailer(t, map[string]string{})
+	defer done()
+
+	tr := testTransaction("")
+	msg, err := m.Render(models.OrderConfirmationEmail, tr.Order, tr, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Order Confirmation", msg.Subject)
+	assert.Equal(t, "shop@example.com", msg.From)
+	assert.Contains(t, msg.HTML, "<strong>$1,234.56</strong>")
+	assert.Contains(t, msg.HTML, "2 x $617.28")
+	assert.Contains(t, msg.Text, "- Batarang: 2 x $617.28")
+	assert.Contains(t, msg.Text, "Total amount: $1,234.56")
+}
+
+func TestRenderLocalizedTemplates(t *testing.T) {
+	m, done := testMailer(t, map[string]string{
+		"/mail/confirmation.html":    `<h1>Thanks</h1>`,
+		"/mail/confirmation.de.html": `<h1>Danke</h1><p>Summe: {{ price .Order.Total .Order.Currency }}</p>`,
+		"/mail/confirmation.de.txt":  `Danke! Summe: {{ price .Order.Total .Order.Currency }}`,
+		"/mail/confirmation.fr.html": `<h1>Merci</h1><ul><li>Un</li></ul><p>Voir <a href="https://example.com">le site</a></p>`,
+	})
+	defer done()
+
+	for locale, expected := range map[string][]string{
+		"de-AT": {"<h1>Danke</h1><p>Summe: $1,234.56</p>", "Danke! Summe: $1,234.56"},
+		"fr":    {`<h1>Merci</h1><ul><li>Un</li></ul><p>Voir <a href="https://example.com">le site</a></p>`, "Merci\n\n- Un\n\nVoir le site (https://example.com)\n"},
+		"es":    {"<h1>Thanks</h1>", "Thanks\n"},
+	} {
+		tr := testTransaction(locale)
+		msg, err := m.Render(models.OrderConfirmationEmail, tr.Order, tr, "")
+		require.NoError(t, err, locale)
+		assert.Equal(t, expected[0], msg.HTML, locale)
+		assert.Equal(t, expected[1], msg.Text, locale)
+	}
+}
+
+func TestRenderTemplateError(t *testing.T) {
+	m, done := testMailer(t, map[string]string{
+		"/mail/confirmation.html": `{{ .Order.Nope }`,
+	})
+	defer done()
+
+	tr := testTransaction("")
+	_, err := m.Render(models.OrderConfirmationEmail, tr.Order, tr, "")
+	require.IsType(t, &TemplateError{}, err)
+	assert.Equal(t, "/mail/confirmation.html", err.(*TemplateError).Template)
+}
+
+func TestRenderTemplateUnavailable(t *testing.T) {
+	var available int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&available) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`<h1>Thanks</h1>`))
+	}))
+	defer server.Close()
+	config := &conf.Configuration{SiteURL: server.URL}
+	config.Mailer.Templates.OrderConfirmation = "/mail/confirmation.html"
+	m := NewMailerWithTransport(config, "shop@example.com", nil)
+
+	tr := testTransaction("")
+	_, err := m.Render(models.OrderConfirmationEmail, tr.Order, tr, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+
+	// the failure isn't cached, so the next attempt uses the template
+	atomic.StoreInt32(&available, 1)
+	msg, err := m.Render(models.OrderConfirmationEmail, tr.Order, tr, "")
+	require.NoError(t, err)
+	assert.Equal(t, "<h1>Thanks</h1>", msg.HTML)
+}
+
+func TestTemplatesCachedAcrossMailers(t *testing.T) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(`<h1>Thanks</h1>`))
+	}))
+	defer server.Close()
+	config := &conf.Configuration{SiteURL: server.URL}
+	config.Mailer.Templates.OrderConfirmation = "/mail/confirmation.html"
+
+	tr := testTransaction("")
+	for i := 0; i < 3; i++ {
+		m := NewMailerWithTransport(config, "shop@example.com", nil)
+		msg, err := m.Render(models.OrderConfirmationEmail, tr.Order, tr, "")
+		require.NoError(t, err)
+		assert.Equal(t, "<h1>Thanks</h1>", msg.HTML)
+	}
+	// the HTML and the plain text template are fetched once
+	assert.EqualValues(t, 2, atomic.LoadInt32(&fetches))
+}
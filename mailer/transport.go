@@ -0,0 +1,185 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	gomail "gopkg.in/gomail.v2"
+)
+
+// Transport types.
+const (
+	SMTPTransport    = "smtp"
+	HTTPTransport    = "http"
+	FileTransport    = "file"
+	CaptureTransport = "capture"
+)
+
+// Transport delivers rendered emails.
+type Transport interface {
+	Send(msg *Message) error
+}
+
+// mimeMessage builds a multipart message with the text and HTML versions.
+func (msg *Message) mimeMessage() *gomail.Message {
+	mail := gomail.NewMessage()
+	mail.SetHeader("From", msg.From)
+	mail.SetHeader("To", msg.To)
+	mail.SetHeader("Subject", msg.Subject)
+	mail.SetBody("text/plain", msg.Text)
+	mail.AddAlternative("text/html", msg.HTML)
+	for _, attachment := range msg.Attachments {
+		data := attachment.Data
+		mail.Attach(attachment.Filename,
+			gomail.SetHeader(map[string][]string{"Content-Type": {attachment.ContentType}}),
+			gomail.SetCopyFunc(func(w io.Writer) error {
+				_, err := w.Write(data)
+				return err
+			}),
+		)
+	}
+	return mail
+}
+
+type smtpTransport struct {
+	dialer *gomail.Dialer
+}
+
+func (t *smtpTransport) Send(msg *Message) error {
+	return t.dialer.DialAndSend(msg.mimeMessage())
+}
+
+// httpTransport posts emails as JSON to an email API, or to a local stand-in
+// for one.
+type httpTransport struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+func (t *httpTransport) Send(msg *Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+t.apiKey)
+	}
+
+	rsp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error sending email")
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		detail, _ := ioutil.ReadAll(&io.LimitedReader{R: rsp.Body, N: 512})
+		return fmt.Errorf("Email API responded with %d: %s", rsp.StatusCode, detail)
+	}
+	return nil
+}
+
+// fileTransport writes every email to an .eml file instead of sending it,
+// for inspecting the emails of staging instances.
+type fileTransport struct {
+	dir string
+}
+
+func (t *fileTransport) Send(msg *Message) error {
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return errors.Wrap(err, "Error creating email directory")
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.NewRandom().String())
+	tmp, err := ioutil.TempFile(t.dir, ".tmp-")
+	if err != nil {
+		return errors.Wrap(err, "Error writing email")
+	}
+	_, err = msg.mimeMessage().WriteTo(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "Error writing email")
+	}
+	// only complete files show up under their final name
+	return os.Rename(tmp.Name(), filepath.Join(t.dir, name))
+}
+
+// Capture keeps sent emails in memory, for tests to inspect them.
+type Capture struct {
+	mutex    sync.Mutex
+	messages []*Message
+}
+
+// Captured holds the emails of all mailers using the capture transport.
+var Captured = &Capture{}
+
+// Send keeps a copy of the email.
+func (c *Capture) Send(msg *Message) error {
+	captured := *msg
+	c.mutex.Lock()
+	c.messages = append(c.messages, &captured)
+	c.mutex.Unlock()
+	return nil
+}
+
+// Messages returns the captured emails, oldest first.
+func (c *Capture) Messages() []*Message {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]*Message{}, c.messages...)
+}
+
+// Reset forgets the captured emails.
+func (c *Capture) Reset() {
+	c.mutex.Lock()
+	c.messages = nil
+	c.mutex.Unlock()
+}
+
+// failingTransport fails every email, so misconfigured mailers show up in the
+// outbox instead of dropping emails.
+type failingTransport struct {
+	err error
+}
+
+func (t *failingTransport) Send(msg *Message) error {
+	return t.err
+}
+
+func newTransport(smtp conf.SMTPConfiguration) Transport {
+	switch smtp.Transport {
+	case "", SMTPTransport:
+		return &smtpTransport{gomail.NewDialer(smtp.Host, smtp.Port, smtp.User, smtp.Pass)}
+	case HTTPTransport:
+		if smtp.APIURL == "" {
+			return &failingTransport{errors.New("The http mail transport requires an API URL")}
+		}
+		return &httpTransport{url: smtp.APIURL, apiKey: smtp.APIKey, client: &http.Client{Timeout: 30 * time.Second}}
+	case FileTransport:
+		if smtp.Dir == "" {
+			return &failingTransport{errors.New("The file mail transport requires a directory")}
+		}
+		return &fileTransport{dir: smtp.Dir}
+	case CaptureTransport:
+		return Captured
+	}
+	return &failingTransport{fmt.Errorf("Unknown mail transport '%s'", smtp.Transport)}
+}
@@ -0,0 +1,119 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/conf"
+)
+
+var testMessage = &Message{
+	From:    "shop@example.com",
+	To:      "bruce@wayneindustries.com",
+	Subject: "Order Confirmation",
+	HTML:    "<h2>Thanks!</h2>",
+	Text:    "Thanks!",
+}
+
+func TestTransportSelection(t *testing.T) {
+	config := &conf.Configuration{}
+
+	m := NewMailer(conf.SMTPConfiguration{Host: "localhost", Port: 25}, config)
+	assert.IsType(t, &smtpTransport{}, m.(*mailer).Transport)
+
+	config.SMTP.Transport = FileTransport
+	config.SMTP.Dir = "/tmp/mails"
+	m = NewMailer(conf.SMTPConfiguration{}, config)
+	assert.IsType(t, &fileTransport{}, m.(*mailer).Transport)
+
+	// instance settings take precedence over the global ones
+	m = NewMailer(conf.SMTPConfiguration{Transport: HTTPTransport, APIURL: "http://localhost"}, config)
+	assert.IsType(t, &fileTransport{}, m.(*mailer).Transport)
+
+	config.SMTP = conf.SMTPConfiguration{}
+	m = NewMailer(conf.SMTPConfiguration{Transport: CaptureTransport}, config)
+	assert.Equal(t, Captured, m.(*mailer).Transport)
+
+	m = NewMailer(conf.SMTPConfiguration{Transport: "pigeon"}, config)
+	assert.EqualError(t, m.(*mailer).Transport.Send(testMessage), "Unknown mail transport 'pigeon'")
+
+	m = NewMailer(conf.SMTPConfiguration{Transport: HTTPTransport}, config)
+	assert.Error(t, m.(*mailer).Transport.Send(testMessage))
+}
+
+func TestHTTPTransport(t *testing.T) {
+	received := &Message{}
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(received))
+		w.WriteHeader(status)
+		w.Write([]byte("nope"))
+	}))
+	defer server.Close()
+
+	transport := newTransport(conf.SMTPConfiguration{Transport: HTTPTransport, APIURL: server.URL, APIKey: "secret"})
+	require.NoError(t, transport.Send(testMessage))
+	assert.Equal(t, testMessage, received)
+
+	status = http.StatusBadRequest
+	assert.EqualError(t, transport.Send(testMessage), "Email API responded with 400: nope")
+}
+
+func TestFileTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mails")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	transport := newTransport(conf.SMTPConfiguration{Transport: FileTransport, Dir: filepath.Join(dir, "staging")})
+	require.NoError(t, transport.Send(testMessage))
+
+	files, err := filepath.Glob(filepath.Join(dir, "staging", "*.eml"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	eml, err := ioutil.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(eml), "To: bruce@wayneindustries.com")
+	assert.Contains(t, string(eml), "Subject: Order Confirmation")
+	assert.Contains(t, string(eml), "Content-Type: multipart/alternative")
+	assert.Contains(t, string(eml), "Content-Type: text/plain; charset=UTF-8")
+	assert.Contains(t, string(eml), "Content-Type: text/html; charset=UTF-8")
+}
+
+func TestAttachments(t *testing.T) {
+	msg := *testMessage
+	msg.Attachments = []*Attachment{{Filename: "invoice-1001.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4")}}
+
+	eml := &bytes.Buffer{}
+	_, err := msg.mimeMessage().WriteTo(eml)
+	require.NoError(t, err)
+	assert.Contains(t, eml.String(), "Content-Type: multipart/mixed")
+	assert.Contains(t, eml.String(), "Content-Type: application/pdf")
+	assert.Contains(t, eml.String(), `filename="invoice-1001.pdf"`)
+	assert.Contains(t, eml.String(), "JVBERi0xLjQ=")
+}
+
+func TestCaptureTransport(t *testing.T) {
+	capture := &Capture{}
+	m := NewMailerWithTransport(&conf.Configuration{}, "shop@example.com", capture)
+	require.NoError(t, m.OrderShippedMail(testTransaction("").Order))
+
+	messages := capture.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "bruce@wayneindustries.com", messages[0].To)
+	assert.Equal(t, "Your Order Has Shipped", messages[0].Subject)
+	assert.Contains(t, messages[0].Text, "Batarang")
+
+	capture.Reset()
+	assert.Len(t, capture.Messages(), 0)
+}
@@ -0,0 +1,357 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/claims"
+	"github.com/pkg/errors"
+)
+
+const auditVerifyBatchSize = 500
+
+var auditSecretKeyRegexp = regexp.MustCompile(`(?i)(secret|password|pass|token|key)`)
+
+// AuditLog is an append-only record of an administrative action. Entries are
+// hash-chained per instance so tampering with or removing an entry can be
+// detected with VerifyAuditLog.
+type AuditLog struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"unique_index:idx_audit_logs_instance_sequence"`
+	Sequence   uint64 `json:"sequence" sql:"unique_index:idx_audit_logs_instance_sequence"`
+
+	ActorID        string          `json:"actor_id"`
+	ActorEmail     string          `json:"actor_email"`
+	ActorClaims    json.RawMessage `json:"actor_claims,omitempty" sql:"-"`
+	RawActorClaims string          `json:"-" sql:"type:text"`
+
+	IP        string `json:"ip"`
+	RequestID string `json:"request_id"`
+	Route     string `json:"route"`
+
+	Action    string `json:"action"`
+	ModelType string `json:"model_type"`
+	ModelID   string `json:"model_id"`
+
+	Before    json.RawMessage `json:"before,omitempty" sql:"-"`
+	RawBefore string          `json:"-" sql:"type:text"`
+	After     json.RawMessage `json:"after,omitempty" sql:"-"`
+	RawAfter  string          `json:"-" sql:"type:text"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the AuditLog model.
+func (AuditLog) TableName() string {
+	return tableName("audit_logs")
+}
+
+// AfterFind database callback.
+func (a *AuditLog) AfterFind() error {
+	if a.RawActorClaims != "" {
+		a.ActorClaims = json.RawMessage(a.RawActorClaims)
+	}
+	if a.RawBefore != "" {
+		a.Before = json.RawMessage(a.RawBefore)
+	}
+	if a.RawAfter != "" {
+		a.After = json.RawMessage(a.RawAfter)
+	}
+	return nil
+}
+
+// NewAuditLog creates an AuditLog entry for an action on a model. Only the
+// top level fields that differ between before and after are recorded, and
+// values of secret looking fields are replaced by a digest.
+func NewAuditLog(instanceID, action, modelType, modelID string, before, after interface{}) (*AuditLog, error) {
+	rawBefore, rawAfter, err := auditDiff(before, after)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error computing audit diff")
+	}
+
+	return &AuditLog{
+		InstanceID: instanceID,
+		Action:     action,
+		ModelType:  modelType,
+		ModelID:    modelID,
+		RawBefore:  rawBefore,
+		RawAfter:   rawAfter,
+	}, nil
+}
+
+// SetActorClaims records the user performing the action from their claims.
+func (a *AuditLog) SetActorClaims(actor *claims.JWTClaims) error {
+	if actor == nil {
+		a.RawActorClaims = ""
+		return nil
+	}
+	a.ActorID = actor.Subject
+	a.ActorEmail = actor.Email
+	data, err := json.Marshal(actor)
+	if err != nil {
+		return err
+	}
+	a.RawActorClaims = string(data)
+	return nil
+}
+
+// ComputeHash calculates the chained hash of the entry from its content and
+// the hash of the previous entry. It is an HMAC with the audit key, so the
+// chain can't be recomputed by someone who can only write to the database.
+func (a *AuditLog) ComputeHash(key []byte) string {
+	h := hmac.New(sha256.New, key)
+	for _, field := range []string{
+		a.InstanceID,
+		strconv.FormatUint(a.Sequence, 10),
+		a.ActorID,
+		a.ActorEmail,
+		a.RawActorClaims,
+		a.IP,
+		a.RequestID,
+		a.Route,
+		a.Action,
+		a.ModelType,
+		a.ModelID,
+		a.RawBefore,
+		a.RawAfter,
+		strconv.FormatInt(a.CreatedAt.Unix(), 10),
+		a.PrevHash,
+	} {
+		// length prefix every field so values can't be shifted between fields
+		fmt.Fprintf(h, "%d:%s;", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditLogHead is the end of the audit log chain of an instance. Appending
+// an entry locks it, so concurrent entries get consecutive sequences.
+type AuditLogHead struct {
+	InstanceID string `gorm:"primary_key"`
+	Sequence   uint64
+	Hash       string
+}
+
+// TableName returns the database table name for the AuditLogHead model.
+func (AuditLogHead) TableName() string {
+	return tableName("audit_log_heads")
+}
+
+// AppendAuditLog links the entry to the end of the instance's chain and
+// stores it. It should be called within the transaction of the audited change.
+func AppendAuditLog(tx *gorm.DB, entry *AuditLog, key []byte) error {
+	instanceID := auditLogHeadID(entry.InstanceID)
+
+	// incrementing the sequence locks the head until the transaction ends
+	query := tx.Model(&AuditLogHead{}).Where("instance_id = ?", instanceID)
+	result := query.UpdateColumn("sequence", gorm.Expr("sequence + 1"))
+	if result.Error == nil && result.RowsAffected == 0 {
+		if err := createAuditLogHead(tx, instanceID); err != nil {
+			return errors.Wrap(err, "Error creating audit log head")
+		}
+		result = query.UpdateColumn("sequence", gorm.Expr("sequence + 1"))
+	}
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error locking audit log head")
+	}
+	head := &AuditLogHead{}
+	if result := query.First(head); result.Error != nil {
+		return errors.Wrap(result.Error, "Error loading audit log head")
+	}
+
+	entry.Sequence = head.Sequence
+	entry.PrevHash = head.Hash
+	// the database may not keep sub-second precision
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	entry.Hash = entry.ComputeHash(key)
+
+	if result := tx.Create(entry); result.Error != nil {
+		return errors.Wrap(result.Error, "Error creating audit log entry")
+	}
+	if result := query.UpdateColumn("hash", entry.Hash); result.Error != nil {
+		return errors.Wrap(result.Error, "Error updating audit log head")
+	}
+	return nil
+}
+
+// auditLogHeadID is the key of the head of an instance's chain.
+func auditLogHeadID(instanceID string) string {
+	if instanceID == "" {
+		return "global-instance"
+	}
+	return instanceID
+}
+
+// createAuditLogHead creates the head of an instance's chain unless it
+// exists. A chain whose head was removed can't be continued, as its first
+// new entry conflicts with the sequence of an existing one.
+func createAuditLogHead(tx *gorm.DB, headID string) error {
+	supported, err := insertIgnore(tx, AuditLogHead{}, []string{"instance_id", "sequence", "hash"}, headID, 0, "")
+	if supported || err != nil {
+		return err
+	}
+	head := &AuditLogHead{InstanceID: headID}
+	return tx.Where(head).FirstOrCreate(head).Error
+}
+
+// AuditChainError describes where the audit log chain of an instance is broken.
+type AuditChainError struct {
+	InstanceID string
+	Sequence   uint64
+	Reason     string
+}
+
+func (e AuditChainError) Error() string {
+	return fmt.Sprintf("audit log for instance '%s' is broken at sequence %d: %s", e.InstanceID, e.Sequence, e.Reason)
+}
+
+// AuditVerification is the result of a successful audit log verification.
+type AuditVerification struct {
+	InstanceID string `json:"instance_id"`
+	Entries    uint64 `json:"entries"`
+	HeadHash   string `json:"head_hash"`
+}
+
+// VerifyAuditLog walks the audit log of an instance and checks every entry
+// against its hash and its predecessor, and the last one against the head of
+// the chain. It returns an AuditChainError when the chain has been tampered
+// with, or when it was signed with another key.
+func VerifyAuditLog(db *gorm.DB, instanceID string, key []byte) (*AuditVerification, error) {
+	verification := &AuditVerification{InstanceID: instanceID}
+	for {
+		entries := []AuditLog{}
+		result := db.
+			Where("instance_id = ? AND sequence > ?", instanceID, verification.Entries).
+			Order("sequence asc").
+			Limit(auditVerifyBatchSize).
+			Find(&entries)
+		if result.Error != nil {
+			return nil, errors.Wrap(result.Error, "Error loading audit log entries")
+		}
+
+		for _, entry := range entries {
+			expected := verification.Entries + 1
+			if entry.Sequence != expected {
+				return nil, AuditChainError{instanceID, expected, fmt.Sprintf("entry is missing, found sequence %d instead", entry.Sequence)}
+			}
+			if entry.PrevHash != verification.HeadHash {
+				return nil, AuditChainError{instanceID, entry.Sequence, "previous hash doesn't match"}
+			}
+			if entry.ComputeHash(key) != entry.Hash {
+				return nil, AuditChainError{instanceID, entry.Sequence, "entry content doesn't match its hash"}
+			}
+			verification.Entries = entry.Sequence
+			verification.HeadHash = entry.Hash
+		}
+
+		if len(entries) < auditVerifyBatchSize {
+			break
+		}
+	}
+
+	// removing the newest entries leaves a valid chain, but not its head
+	head := &AuditLogHead{}
+	result := db.Where("instance_id = ?", auditLogHeadID(instanceID)).First(head)
+	if result.RecordNotFound() {
+		if verification.Entries == 0 {
+			return verification, nil
+		}
+		return nil, AuditChainError{instanceID, verification.Entries + 1, "the head of the chain is missing"}
+	} else if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading audit log head")
+	}
+	if head.Sequence != verification.Entries || head.Hash != verification.HeadHash {
+		return nil, AuditChainError{instanceID, verification.Entries + 1, fmt.Sprintf("entry is missing, the head is at sequence %d", head.Sequence)}
+	}
+	return verification, nil
+}
+
+// AuditLogInstanceIDs returns the IDs of all instances with audit log entries.
+func AuditLogInstanceIDs(db *gorm.DB) ([]string, error) {
+	ids := []string{}
+	if result := db.Model(&AuditLog{}).Pluck("distinct instance_id", &ids); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading audited instances")
+	}
+	return ids, nil
+}
+
+func auditDiff(before, after interface{}) (string, string, error) {
+	beforeFields, err := auditFields(before)
+	if err != nil {
+		return "", "", err
+	}
+	afterFields, err := auditFields(after)
+	if err != nil {
+		return "", "", err
+	}
+
+	if beforeFields != nil && afterFields != nil {
+		for key, value := range beforeFields {
+			if other, ok := afterFields[key]; ok && reflect.DeepEqual(value, other) {
+				delete(beforeFields, key)
+				delete(afterFields, key)
+			}
+		}
+	}
+
+	rawBefore, err := marshalAuditFields(beforeFields)
+	if err != nil {
+		return "", "", err
+	}
+	rawAfter, err := marshalAuditFields(afterFields)
+	if err != nil {
+		return "", "", err
+	}
+	return rawBefore, rawAfter, nil
+}
+
+func auditFields(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	redactAuditSecrets(fields)
+	return fields, nil
+}
+
+func marshalAuditFields(fields map[string]interface{}) (string, error) {
+	if fields == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func redactAuditSecrets(fields map[string]interface{}) {
+	for key, value := range fields {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			redactAuditSecrets(v)
+		case string:
+			if v != "" && auditSecretKeyRegexp.MatchString(key) {
+				sum := sha256.Sum256([]byte(v))
+				fields[key] = "redacted:" + hex.EncodeToString(sum[:])[:12]
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package models
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// GiftCardType is the product type of gift cards. Buying one issues a gift
+// card with the price of the product as its balance.
+const GiftCardType = "gift_card"
+
+// BalanceProcessor is the payment processor of orders paid entirely with
+// gift cards or store credit.
+const BalanceProcessor = "balance"
+
+// Kinds of balance accounts.
+const (
+	GiftCardAccount    = "gift_card"
+	StoreCreditAccount = "store_credit"
+)
+
+// Types of balance entries.
+const (
+	BalanceIssued   = "issue"
+	BalanceGranted  = "grant"
+	BalanceRedeemed = "redeem"
+	BalanceRefunded = "refund"
+	BalanceVoided   = "void"
+)
+
+// ErrInsufficientBalance is returned when debiting more than the balance of
+// an account.
+var ErrInsufficientBalance = errors.New("Insufficient balance")
+
+// ErrGiftCardRedeemed is returned when voiding a gift card that was already
+// spent.
+var ErrGiftCardRedeemed = errors.New("Gift card was already redeemed")
+
+// giftCardAlphabet leaves out characters that are easily confused.
+const giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// BalanceAccount is a balance that pays for orders, either a gift card or
+// the store credit of a user. Its balance only changes with a BalanceEntry.
+type BalanceAccount struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-"`
+	Kind       string `json:"kind"`
+
+	// Code redeems a gift card.
+	Code string `json:"code,omitempty" sql:"index:idx_balance_accounts_code"`
+	// UserID is the owner of store credit.
+	UserID string `json:"user_id,omitempty" sql:"index:idx_balance_accounts_user_id"`
+	// OrderID is the order a gift card was bought with, and LineItemID its
+	// item with the gift card.
+	OrderID    string `json:"order_id,omitempty" sql:"index:idx_balance_accounts_order_id"`
+	LineItemID int64  `json:"line_item_id,omitempty"`
+
+	Currency string `json:"currency"`
+	Balance  uint64 `json:"balance"`
+
+	Entries []BalanceEntry `json:"entries,omitempty" gorm:"ForeignKey:AccountID"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the BalanceAccount model.
+func (BalanceAccount) TableName() string {
+	return tableName("balance_accounts")
+}
+
+// BalanceEntry is an entry in the ledger of a balance account. Credits have
+// a positive amount, debits a negative one.
+type BalanceEntry struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-"`
+	AccountID  string `json:"account_id" sql:"index:idx_balance_entries_account_id"`
+
+	Type   string `json:"type"`
+	Amount int64  `json:"amount"`
+	// Balance is the balance of the account after the entry.
+	Balance uint64 `json:"balance"`
+
+	OrderID       string `json:"order_id,omitempty"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	Note          string `json:"note,omitempty" sql:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the BalanceEntry model.
+func (BalanceEntry) TableName() string {
+	return tableName("balance_entries")
+}
+
+// NewGiftCardCode generates a random gift card code, like
+// ABCD-EFGH-JKLM-NPQR.
+func NewGiftCardCode() (string, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return "", errors.Wrap(err, "Error generating gift card code")
+	}
+	code := make([]byte, 0, 19)
+	for i, b := range data {
+		if i > 0 && i%4 == 0 {
+			code = append(code, '-')
+		}
+		code = append(code, giftCardAlphabet[int(b)%len(giftCardAlphabet)])
+	}
+	return string(code), nil
+}
+
+// NormalizeGiftCardCode formats a code like NewGiftCardCode, so codes can be
+// entered in lower case or without dashes.
+func NormalizeGiftCardCode(code string) string {
+	code = strings.ToUpper(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	parts := []string{}
+	for len(code) > 4 {
+		parts = append(parts, code[:4])
+		code = code[4:]
+	}
+	return strings.Join(append(parts, code), "-")
+}
+
+// IssueGiftCards issues a gift card for every gift card bought with an
+// order.
+func IssueGiftCards(tx *gorm.DB, order *Order) ([]*BalanceAccount, error) {
+	cards := []*BalanceAccount{}
+	for _, item := range order.LineItems {
+		if item.Type != GiftCardType {
+			continue
+		}
+		for i := uint64(0); i < item.Quantity; i++ {
+			code, err := NewGiftCardCode()
+			if err != nil {
+				return nil, err
+			}
+			card := &BalanceAccount{
+				ID:         uuid.NewRandom().String(),
+				InstanceID: order.InstanceID,
+				Kind:       GiftCardAccount,
+				Code:       code,
+				OrderID:    order.ID,
+				LineItemID: item.ID,
+				Currency:   order.Currency,
+			}
+			if result := tx.Create(card); result.Error != nil {
+				return nil, errors.Wrap(result.Error, "Error creating gift card")
+			}
+			if _, err := CreditBalance(tx, card, item.Price, &BalanceEntry{Type: BalanceIssued, OrderID: order.ID}); err != nil {
+				return nil, err
+			}
+			cards = append(cards, card)
+		}
+	}
+	return cards, nil
+}
+
+// VoidGiftCards takes the balance of the gift cards bought with an order, like
+// when it is refunded. It fails with ErrGiftCardRedeemed if a card was spent,
+// and skips the cards that were voided already.
+func VoidGiftCards(tx *gorm.DB, orderID, transactionID string) error {
+	cards := []*BalanceAccount{}
+	if result := tx.Where("kind = ? AND order_id = ?", GiftCardAccount, orderID).Find(&cards); result.Error != nil {
+		return errors.Wrap(result.Error, "Error loading gift cards")
+	}
+	for _, card := range cards {
+		entries := []BalanceEntry{}
+		if result := tx.Where("account_id = ? AND type IN (?)", card.ID, []string{BalanceIssued, BalanceVoided}).Find(&entries); result.Error != nil {
+			return errors.Wrap(result.Error, "Error loading gift card entries")
+		}
+		var issued uint64
+		voided := false
+		for _, entry := range entries {
+			switch entry.Type {
+			case BalanceIssued:
+				issued += uint64(entry.Amount)
+			case BalanceVoided:
+				voided = true
+			}
+		}
+		if voided || issued == 0 {
+			continue
+		}
+		_, err := DebitBalance(tx, card, issued, &BalanceEntry{Type: BalanceVoided, OrderID: orderID, TransactionID: transactionID})
+		if err == ErrInsufficientBalance {
+			return ErrGiftCardRedeemed
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetGiftCard loads the gift card with a code.
+func GetGiftCard(db *gorm.DB, instanceID, code string) (*BalanceAccount, error) {
+	card := &BalanceAccount{}
+	result := db.Where("instance_id = ? AND kind = ? AND code = ?", instanceID, GiftCardAccount, NormalizeGiftCardCode(code)).First(card)
+	if result.RecordNotFound() {
+		return nil, nil
+	} else if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading gift card")
+	}
+	return card, nil
+}
+
+// StoreCredit loads the store credit of a user in a currency, and creates it
+// if the user has none yet.
+func StoreCredit(tx *gorm.DB, instanceID, userID, currency string) (*BalanceAccount, error) {
+	currency = strings.ToUpper(currency)
+	credit := &BalanceAccount{}
+	attrs := BalanceAccount{
+		// one account per instance, user and currency, even if two requests
+		// create it
+		ID:         fmt.Sprintf("credit-%s-%s-%s", instanceID, userID, currency),
+		InstanceID: instanceID,
+		Kind:       StoreCreditAccount,
+		UserID:     userID,
+		Currency:   currency,
+	}
+	if result := tx.Where("id = ? AND instance_id = ?", attrs.ID, instanceID).Attrs(attrs).FirstOrCreate(credit); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading store credit")
+	}
+	return credit, nil
+}
+
+// CreditBalance adds an amount to the balance of an account, and records it
+// with the entry.
+func CreditBalance(tx *gorm.DB, account *BalanceAccount, amount uint64, entry *BalanceEntry) (*BalanceEntry, error) {
+	result := tx.Model(&BalanceAccount{}).Where("id = ?", account.ID).UpdateColumn("balance", gorm.Expr("balance + ?", amount))
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error crediting balance")
+	}
+	return recordBalanceEntry(tx, account, int64(amount), entry)
+}
+
+// DebitBalance takes an amount from the balance of an account, and records
+// it with the entry. It fails with ErrInsufficientBalance rather than
+// letting the balance go negative.
+func DebitBalance(tx *gorm.DB, account *BalanceAccount, amount uint64, entry *BalanceEntry) (*BalanceEntry, error) {
+	result := tx.Model(&BalanceAccount{}).Where("id = ? AND balance >= ?", account.ID, amount).UpdateColumn("balance", gorm.Expr("balance - ?", amount))
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error debiting balance")
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInsufficientBalance
+	}
+	return recordBalanceEntry(tx, account, -int64(amount), entry)
+}
+
+func recordBalanceEntry(tx *gorm.DB, account *BalanceAccount, amount int64, entry *BalanceEntry) (*BalanceEntry, error) {
+	if result := tx.Select("balance").Where("id = ?", account.ID).First(account); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading balance")
+	}
+	if entry.ID == "" {
+		entry.ID = uuid.NewRandom().String()
+	}
+	entry.InstanceID = account.InstanceID
+	entry.AccountID = account.ID
+	entry.Amount = amount
+	entry.Balance = account.Balance
+	if result := tx.Create(entry); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error recording balance entry")
+	}
+	return entry, nil
+}
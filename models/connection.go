@@ -1,6 +1,10 @@
 package models
 
 import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
 	// this is where we do the connections
 	_ "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/dialers/mysql"
 	_ "github.com/GoogleCloudPlatform/cloudsql-proxy/proxy/dialers/postgres"
@@ -55,6 +59,54 @@ func tableName(defaultName string) string {
 	return defaultName
 }
 
+// insertIgnore inserts a row unless a row with the same key exists, and
+// reports if the database supports it. Inserting a row that another
+// transaction created at the same time must not fail, or abort the
+// transaction on postgres.
+func insertIgnore(tx *gorm.DB, model interface{}, columns []string, values ...interface{}) (bool, error) {
+	scope := tx.NewScope(model)
+	quoted := []string{}
+	for _, column := range columns {
+		quoted = append(quoted, scope.Quote(column))
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	into := fmt.Sprintf("INTO %s (%s) VALUES (%s)", scope.QuotedTableName(), strings.Join(quoted, ", "), placeholders)
+
+	switch tx.Dialect().GetName() {
+	case "postgres":
+		return true, tx.Exec("INSERT "+into+" ON CONFLICT DO NOTHING", values...).Error
+	case "mysql":
+		return true, tx.Exec("INSERT IGNORE "+into, values...).Error
+	case "sqlite3":
+		return true, tx.Exec("INSERT OR IGNORE "+into, values...).Error
+	}
+	return false, nil
+}
+
+var savepoints uint64
+
+// Savepoint runs writes within a savepoint of a transaction. When they fail,
+// only they are rolled back, and the transaction can still be committed,
+// which postgres refuses after a failed statement otherwise.
+func Savepoint(tx *gorm.DB, write func() error) error {
+	// every savepoint has its own name, so nested ones don't replace each
+	// other on mysql
+	name := fmt.Sprintf("gocommerce_%d", atomic.AddUint64(&savepoints, 1))
+	if result := tx.Exec("SAVEPOINT " + name); result.Error != nil {
+		return errors.Wrap(result.Error, "Error creating savepoint")
+	}
+	if err := write(); err != nil {
+		if result := tx.Exec("ROLLBACK TO SAVEPOINT " + name); result.Error != nil {
+			return errors.Wrap(result.Error, "Error rolling back to savepoint")
+		}
+		return err
+	}
+	if result := tx.Exec("RELEASE SAVEPOINT " + name); result.Error != nil {
+		return errors.Wrap(result.Error, "Error releasing savepoint")
+	}
+	return nil
+}
+
 // AutoMigrate runs the gorm automigration for all models
 func AutoMigrate(db *gorm.DB) error {
 	db = db.AutoMigrate(Address{},
@@ -63,6 +115,13 @@ func AutoMigrate(db *gorm.DB) error {
 		PriceItem{},
 		Hook{},
 		Download{},
+		DownloadAccess{},
+		License{},
+		LicensePoolKey{},
+		Subscription{},
+		PaymentMethod{},
+		BalanceAccount{},
+		BalanceEntry{},
 		Order{},
 		OrderNote{},
 		Transaction{},
@@ -70,6 +129,13 @@ func AutoMigrate(db *gorm.DB) error {
 		Event{},
 		Instance{},
 		InvoiceNumber{},
+		InvoiceSequenceNumber{},
+		AuditLog{},
+		AuditLogHead{},
+		Report{},
+		WebhookSubscription{},
+		Job{},
+		Email{},
 	)
 	return db.Error
 }
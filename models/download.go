@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/assetstores"
 )
 
@@ -19,6 +20,20 @@ type Download struct {
 	URL    string `json:"url"`
 
 	DownloadCount uint64 `json:"downloads"`
+	// BytesServed counts the bytes the download proxy served.
+	BytesServed uint64 `json:"bytes_served,omitempty"`
+
+	// ExpiresAfter is how many seconds after the payment the download
+	// expires. It, MaxDownloads and MaxIPs come from the product metadata,
+	// and zero means no limit.
+	ExpiresAfter uint64     `json:"expires_after,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads uint64     `json:"max_downloads,omitempty"`
+	MaxIPs       uint64     `json:"max_ips,omitempty"`
+
+	// RevokedAt is set while the download is revoked by an admin or a refund.
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
@@ -40,3 +55,93 @@ func (d *Download) SignURL(store assetstores.Store) error {
 
 	return nil
 }
+
+// Download revoke reasons.
+const (
+	RevokedByAdmin  = "admin"
+	RevokedByRefund = "refund"
+)
+
+// StartExpiry sets when the download expires for a payment at a time.
+func (d *Download) StartExpiry(paidAt time.Time) {
+	if d.ExpiresAfter == 0 {
+		return
+	}
+	expiresAt := paidAt.Add(time.Duration(d.ExpiresAfter) * time.Second)
+	d.ExpiresAt = &expiresAt
+}
+
+// StartOrderDownloadsExpiry sets when the downloads of an order paid at a time
+// expire.
+func StartOrderDownloadsExpiry(tx *gorm.DB, orderID string, paidAt time.Time) error {
+	downloads := []*Download{}
+	if result := tx.Where("order_id = ? AND expires_after > 0", orderID).Find(&downloads); result.Error != nil {
+		return result.Error
+	}
+	for _, d := range downloads {
+		d.StartExpiry(paidAt)
+		if result := tx.Model(d).Update("expires_at", d.ExpiresAt); result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// Expired checks whether the download expired at a time.
+func (d *Download) Expired(at time.Time) bool {
+	return d.ExpiresAt != nil && at.After(*d.ExpiresAt)
+}
+
+// Revoke revokes the download for a reason.
+func (d *Download) Revoke(reason string) {
+	now := time.Now()
+	d.RevokedAt = &now
+	d.RevokeReason = reason
+}
+
+// Reinstate gives access to a revoked download again.
+func (d *Download) Reinstate() {
+	d.RevokedAt = nil
+	d.RevokeReason = ""
+}
+
+// RevokeOrderDownloads revokes all downloads of an order that aren't revoked
+// already.
+func RevokeOrderDownloads(tx *gorm.DB, orderID, reason string) error {
+	return tx.Model(&Download{}).
+		Where("order_id = ? AND revoked_at IS NULL", orderID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoke_reason": reason}).Error
+}
+
+// DownloadAccess records an IP a download was accessed from. Accesses
+// through the download proxy also record the byte range that was served.
+type DownloadAccess struct {
+	ID         int64  `json:"id"`
+	DownloadID string `json:"download_id" sql:"index:idx_download_accesses_download_id"`
+	IP         string `json:"ip"`
+	Range      string `json:"range,omitempty"`
+	Bytes      uint64 `json:"bytes,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the DownloadAccess model.
+func (DownloadAccess) TableName() string {
+	return tableName("download_accesses")
+}
+
+// DownloadIPs counts the distinct IPs a download was accessed from, and
+// checks whether one of them is an IP.
+func DownloadIPs(tx *gorm.DB, downloadID, ip string) (uint64, bool, error) {
+	var ips []string
+	if result := tx.Model(&DownloadAccess{}).Where("download_id = ?", downloadID).Pluck("distinct(ip)", &ips); result.Error != nil {
+		return 0, false, result.Error
+	}
+	known := false
+	for _, other := range ips {
+		if other == ip {
+			known = true
+		}
+	}
+	return uint64(len(ips)), known, nil
+}
@@ -0,0 +1,154 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Email types.
+const (
+	OrderConfirmationEmail    = "order_confirmation"
+	OrderReceivedEmail        = "order_received"
+	RefundIssuedEmail         = "refund_issued"
+	OrderShippedEmail         = "order_shipped"
+	OrderCancelledEmail       = "order_cancelled"
+	PaymentFailedEmail        = "payment_failed"
+	DownloadReadyEmail        = "download_ready"
+	AbandonedCartEmail        = "abandoned_cart"
+	SubscriptionCanceledEmail = "subscription_canceled"
+)
+
+// EmailTypes lists all email types.
+var EmailTypes = []string{
+	OrderConfirmationEmail,
+	OrderReceivedEmail,
+	RefundIssuedEmail,
+	OrderShippedEmail,
+	OrderCancelledEmail,
+	PaymentFailedEmail,
+	DownloadReadyEmail,
+	AbandonedCartEmail,
+	SubscriptionCanceledEmail,
+}
+
+// Email states.
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailFailed  = "failed"
+	// EmailSkipped is the state of an email that was no longer relevant
+	// when it was due, like a cart reminder for an order that was paid.
+	EmailSkipped = "skipped"
+)
+
+// EmailJobType is the job type that sends emails from the outbox.
+const EmailJobType = "email"
+
+const emailMaxAttempts = 8
+
+// EmailJob is the payload of a job sending an email.
+type EmailJob struct {
+	EmailID uint64 `json:"email_id"`
+}
+
+// Email is an email in the outbox. It is rendered and sent by a worker, which
+// retries it until it has been sent or failed too often.
+type Email struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_emails_instance_id"`
+
+	Type          string `json:"type"`
+	OrderID       string `json:"order_id" sql:"index:idx_emails_order_id"`
+	TransactionID string `json:"transaction_id,omitempty"`
+
+	// To overrides the default recipient of the email type.
+	To string `json:"to,omitempty"`
+
+	Status    string  `json:"status"`
+	Attempts  int     `json:"attempts"`
+	LastError *string `json:"last_error" sql:"type:text"`
+
+	JobID *uint64 `json:"-"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	SentAt    *time.Time `json:"sent_at"`
+}
+
+// TableName returns the database table name for the Email model.
+func (Email) TableName() string {
+	return tableName("emails")
+}
+
+// NewTransactionEmail creates an outbox email about a transaction.
+func NewTransactionEmail(emailType string, transaction *Transaction) *Email {
+	return &Email{
+		InstanceID:    transaction.InstanceID,
+		Type:          emailType,
+		OrderID:       transaction.OrderID,
+		TransactionID: transaction.ID,
+		Status:        EmailPending,
+	}
+}
+
+// NewOrderEmail creates an outbox email about an order.
+func NewOrderEmail(emailType string, order *Order) *Email {
+	return &Email{
+		InstanceID: order.InstanceID,
+		Type:       emailType,
+		OrderID:    order.ID,
+		Status:     EmailPending,
+	}
+}
+
+// EnqueueEmail stores the email in the outbox if it is new and queues a job
+// to send it. Call it within the transaction of the change the email is
+// about, so the email is sent if and only if the change is committed.
+func EnqueueEmail(tx *gorm.DB, email *Email) error {
+	return EnqueueEmailAt(tx, email, time.Now())
+}
+
+// EnqueueEmailAt is like EnqueueEmail, but doesn't send the email before the
+// given time.
+func EnqueueEmailAt(tx *gorm.DB, email *Email, at time.Time) error {
+	email.Status = EmailPending
+	if email.ID == 0 {
+		if result := tx.Create(email); result.Error != nil {
+			return errors.Wrap(result.Error, "Error saving email")
+		}
+	}
+
+	job, err := NewJob(email.InstanceID, EmailJobType, EmailJob{EmailID: email.ID})
+	if err != nil {
+		return err
+	}
+	job.MaxAttempts = emailMaxAttempts
+	job.RunAfter = at
+	if err := EnqueueJob(tx, job); err != nil {
+		return err
+	}
+
+	email.JobID = &job.ID
+	if result := tx.Model(email).Updates(map[string]interface{}{"status": EmailPending, "job_id": job.ID}); result.Error != nil {
+		return errors.Wrap(result.Error, "Error saving email")
+	}
+	return nil
+}
+
+// ResendEmail sends an email from the outbox again. Pending emails are sent
+// right away instead of waiting for their next retry.
+func ResendEmail(tx *gorm.DB, email *Email) error {
+	if email.Status != EmailPending || email.JobID == nil {
+		return EnqueueEmail(tx, email)
+	}
+
+	result := tx.Model(&Job{}).
+		Where("id = ? AND status = ? AND locked_at IS NULL", *email.JobID, JobPending).
+		Update("run_after", time.Now())
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error rescheduling email")
+	}
+	return nil
+}
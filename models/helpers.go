@@ -2,7 +2,9 @@ package models
 
 import (
 	"fmt"
+	"math/rand"
 	"reflect"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
@@ -25,3 +27,18 @@ func cascadeDelete(tx *gorm.DB, query string, id interface{}, name string, cm in
 	}
 	return nil
 }
+
+// Backoff is the delay before retrying something that failed a number of
+// times. It doubles from base for every failure up to max, and randomizes the
+// second half, so things that failed together don't all retry together.
+func Backoff(failures int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
@@ -2,11 +2,15 @@ package models
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"sync"
+	"strconv"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -16,38 +20,100 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const maxConcurrentHooks = 5
-const maxRetries = 5
-const retryPeriod = 30 * time.Second
 const signatureExpiration = 5 * time.Minute
 
+const (
+	defaultMaxRetries     = 5
+	defaultRetryBaseDelay = 30
+	defaultRetryMaxDelay  = 60 * 60
+)
+
+// WebhookRetryPolicy controls how often and how quickly failed hooks are
+// retried. Delays are in seconds and grow exponentially from RetryBaseDelay
+// up to RetryMaxDelay, with random jitter. Zero values use the defaults.
+type WebhookRetryPolicy struct {
+	MaxRetries     int `json:"max_retries"`
+	RetryBaseDelay int `json:"retry_base_delay"`
+	RetryMaxDelay  int `json:"retry_max_delay"`
+}
+
+func (p WebhookRetryPolicy) maxRetries() int {
+	if p.MaxRetries > 0 {
+		return p.MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+// Backoff returns the delay before the next try after the given number of
+// failed tries.
+func (p WebhookRetryPolicy) Backoff(tries int) time.Duration {
+	base := time.Duration(p.RetryBaseDelay) * time.Second
+	if base <= 0 {
+		base = defaultRetryBaseDelay * time.Second
+	}
+	max := time.Duration(p.RetryMaxDelay) * time.Second
+	if max <= 0 {
+		max = defaultRetryMaxDelay * time.Second
+	}
+	return Backoff(tries, base, max)
+}
+
 // Hook represents a webhook.
 type Hook struct {
-	ID uint64
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_hooks_instance_id"`
+
+	UserID string `json:"user_id"`
+
+	Type string `json:"type"`
+
+	// SubscriptionID is set for hooks sent to a webhook subscription.
+	SubscriptionID string `json:"subscription_id,omitempty"`
 
-	UserID string
+	// EventID identifies the event across all hooks sent for it and replays.
+	EventID string `json:"event_id" sql:"index:idx_hooks_event_id"`
 
-	Type string
+	WebhookRetryPolicy
 
-	Done   bool
-	Failed bool
+	Done   bool `json:"done"`
+	Failed bool `json:"failed"`
 
-	URL     string
-	Payload string `sql:"type:text"`
-	Secret  string
+	URL     string `json:"url"`
+	Payload string `json:"payload" sql:"type:text"`
+	Secret  string `json:"-"`
 
-	ResponseStatus  string
-	ResponseHeaders string  `sql:"type:text"`
-	ResponseBody    string  `sql:"type:text"`
-	ErrorMessage    *string `sql:"type:text"`
+	ResponseStatus  string  `json:"response_status"`
+	ResponseHeaders string  `json:"response_headers" sql:"type:text"`
+	ResponseBody    string  `json:"response_body" sql:"type:text"`
+	ErrorMessage    *string `json:"error_message" sql:"type:text"`
 
-	Tries int
+	Tries int `json:"tries"`
 
-	CreatedAt   time.Time
-	RunAfter    *time.Time
-	LockedAt    *time.Time
-	LockedBy    *string
-	CompletedAt *time.Time
+	// JobID is the job delivering the hook.
+	JobID *uint64 `json:"-"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    *time.Time `json:"run_after"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// Hook delivery states.
+const (
+	HookPending   = "pending"
+	HookSucceeded = "succeeded"
+	HookFailed    = "failed"
+)
+
+// Status returns the delivery state of the hook.
+func (h *Hook) Status() string {
+	switch {
+	case !h.Done:
+		return HookPending
+	case h.Failed:
+		return HookFailed
+	default:
+		return HookSucceeded
+	}
 }
 
 // TableName returns the database table name for the Hook model.
@@ -76,23 +142,32 @@ func NewHook(hookType, siteURL, hookURL, userID, secret string, payload interfac
 	return &Hook{
 		Type:    hookType,
 		UserID:  userID,
+		EventID: uuid.NewRandom().String(),
 		URL:     fullHookURL.String(),
 		Secret:  secret,
 		Payload: string(json),
 	}, nil
 }
 
-// Trigger creates and executes the HTTP request for a Hook.
-func (h *Hook) Trigger(client *http.Client, log *logrus.Entry) (*http.Response, error) {
+// Trigger creates and executes the HTTP request for a Hook. The request is
+// canceled when the context ends.
+func (h *Hook) Trigger(ctx context.Context, client *http.Client, log logrus.FieldLogger) (*http.Response, error) {
 	log.Infof("Triggering hook %v: %v", h.ID, h.URL)
 	h.Tries++
 	body := bytes.NewBufferString(h.Payload)
-	req, err := http.NewRequest("POST", h.URL, body)
-	req.Header.Set("Content-Type", "application/json")
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, body)
 	if err != nil {
 		return nil, err
 	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Commerce-Event", h.Type)
+	req.Header.Set("X-Commerce-Event-Id", h.EventID)
+	req.Header.Set("X-Commerce-Delivery-Attempt", strconv.Itoa(h.Tries))
+	req.Header.Set("X-Commerce-Timestamp", strconv.FormatInt(timestamp, 10))
 	if h.Secret != "" {
+		req.Header.Set("X-Commerce-Signature-256", "sha256="+SignHookPayload(h.Secret, timestamp, []byte(h.Payload)))
+
 		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 			"sub": h.UserID,
 			"exp": time.Now().Add(signatureExpiration).Unix(),
@@ -106,7 +181,63 @@ func (h *Hook) Trigger(client *http.Client, log *logrus.Entry) (*http.Response,
 	return client.Do(req)
 }
 
-func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response, err error) {
+// SignHookPayload computes the hex encoded HMAC-SHA256 of a webhook body sent
+// at timestamp. The signed message is the timestamp, a dot and the body.
+func SignHookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver triggers the hook and records the response. Failed hooks are
+// scheduled for a retry according to their retry policy.
+func (h *Hook) Deliver(ctx context.Context, db *gorm.DB, client *http.Client, log logrus.FieldLogger) {
+	resp, err := h.Trigger(ctx, client, log)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil || !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
+		h.handleError(db, log, resp, err)
+	} else {
+		h.handleSuccess(db, log, resp)
+	}
+}
+
+// Replay creates a new pending Hook with the same request as this one.
+func (h *Hook) Replay() *Hook {
+	return &Hook{
+		InstanceID:         h.InstanceID,
+		UserID:             h.UserID,
+		Type:               h.Type,
+		SubscriptionID:     h.SubscriptionID,
+		EventID:            h.EventID,
+		WebhookRetryPolicy: h.WebhookRetryPolicy,
+		URL:                h.URL,
+		Payload:            h.Payload,
+		Secret:             h.Secret,
+	}
+}
+
+// CancelHook stops a pending hook from being retried. It returns false if the
+// hook isn't pending anymore.
+func CancelHook(db *gorm.DB, h *Hook, reason string) (bool, error) {
+	now := time.Now()
+	result := db.Model(h).Where("done = ?", false).Updates(map[string]interface{}{
+		"done":          true,
+		"failed":        true,
+		"error_message": reason,
+		"run_after":     nil,
+		"completed_at":  now,
+	})
+	if result.Error != nil {
+		return false, errors.Wrap(result.Error, "Error canceling hook")
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (h *Hook) handleError(db *gorm.DB, log logrus.FieldLogger, resp *http.Response, err error) {
 	if err != nil {
 		errString := err.Error()
 		h.ErrorMessage = &errString
@@ -123,20 +254,20 @@ func (h *Hook) handleError(db *gorm.DB, log *logrus.Entry, resp *http.Response,
 	}
 
 	now := time.Now()
-	if h.Tries >= maxRetries {
+	if maxRetries := h.maxRetries(); h.Tries >= maxRetries {
 		log.Errorf("Hook %v failed more than %v times. %v. Giving up.", h.ID, maxRetries, err)
 		h.Failed = true
 		h.Done = true
 		h.CompletedAt = &now
 	} else {
-		runAfter := now.Add(time.Duration(h.Tries) * retryPeriod)
+		runAfter := now.Add(h.Backoff(h.Tries))
 		h.RunAfter = &runAfter
 		log.Errorf("Hook %v failed %v - retrying at %v", h.ID, err, runAfter)
 	}
 	db.Save(h)
 }
 
-func (h *Hook) handleSuccess(db *gorm.DB, log *logrus.Entry, resp *http.Response) {
+func (h *Hook) handleSuccess(db *gorm.DB, log logrus.FieldLogger, resp *http.Response) {
 	log.Infof("Hook %v triggered. %v", h.ID, resp.Status)
 	now := time.Now()
 	h.Done = true
@@ -150,49 +281,57 @@ func (h *Hook) handleSuccess(db *gorm.DB, log *logrus.Entry, resp *http.Response
 	db.Save(h)
 }
 
-// RunHooks creates a goroutine that triggers stored webhooks every 5 seconds.
-func RunHooks(db *gorm.DB, log *logrus.Entry) {
-	go func() {
-		id := uuid.NewRandom().String()
-		sem := make(chan bool, maxConcurrentHooks)
-		table := Hook{}.TableName()
-		client := &http.Client{}
-		for {
-			hooks := []*Hook{}
-			tx := db.Begin()
-			now := time.Now()
-
-			tx.Table(table).
-				Where("done = ? AND (locked_at IS NULL OR locked_at < ?) AND (run_after IS NULL OR run_after < ?)", false, now.Add(-5*time.Minute), now).
-				Updates(map[string]interface{}{"locked_at": now, "locked_by": id})
-
-			tx.Where("locked_by = ?", id).Find(&hooks)
-			if rsp := tx.Commit(); rsp.Error != nil {
-				log.WithError(rsp.Error).Error("Error querying for hooks")
-			}
-
-			var wg sync.WaitGroup
-			for _, hook := range hooks {
-				sem <- true
-				wg.Add(1)
-				go func(hook *Hook) {
-					defer wg.Done()
-					resp, err := hook.Trigger(client, log)
-					hook.LockedAt = nil
-					hook.LockedBy = nil
-					tx := db.Begin()
-					if err != nil || !(resp.StatusCode >= 200 && resp.StatusCode < 300) {
-						hook.handleError(tx, log, resp, err)
-					} else {
-						hook.handleSuccess(tx, log, resp)
-					}
-					tx.Commit()
-					<-sem
-				}(hook)
-			}
-
-			wg.Wait()
-			time.Sleep(5 * time.Second)
+// HookJobType is the job type that delivers hooks.
+const HookJobType = "hook"
+
+// HookJob is the payload of a job delivering a hook.
+type HookJob struct {
+	HookID uint64 `json:"hook_id"`
+}
+
+// EnqueueHook stores the hook if it is new and queues a job to deliver it.
+func EnqueueHook(tx *gorm.DB, h *Hook) error {
+	if h.ID == 0 {
+		if result := tx.Create(h); result.Error != nil {
+			return errors.Wrap(result.Error, "Error saving hook")
 		}
-	}()
+	}
+
+	job, err := NewJob(h.InstanceID, HookJobType, HookJob{HookID: h.ID})
+	if err != nil {
+		return err
+	}
+	job.MaxAttempts = h.maxRetries()
+	if h.RunAfter != nil {
+		job.RunAfter = *h.RunAfter
+	}
+	if err := EnqueueJob(tx, job); err != nil {
+		return err
+	}
+
+	h.JobID = &job.ID
+	if result := tx.Model(h).Update("job_id", job.ID); result.Error != nil {
+		return errors.Wrap(result.Error, "Error saving hook")
+	}
+	return nil
+}
+
+// EnqueueOrphanedHooks queues jobs for pending hooks that were stored without
+// one, such as hooks created before hooks were delivered by jobs.
+func EnqueueOrphanedHooks(db *gorm.DB) (int, error) {
+	hooks := []*Hook{}
+	if result := db.Where("done = ? AND job_id IS NULL", false).Find(&hooks); result.Error != nil {
+		return 0, errors.Wrap(result.Error, "Error loading pending hooks")
+	}
+	for _, h := range hooks {
+		tx := db.Begin()
+		if err := EnqueueHook(tx, h); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if result := tx.Commit(); result.Error != nil {
+			return 0, errors.Wrap(result.Error, "Error enqueuing hook")
+		}
+	}
+	return len(hooks), nil
 }
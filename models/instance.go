@@ -119,8 +119,19 @@ func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"transaction":    Transaction{},
-		"invoice number": InvoiceNumber{},
+		"transaction":          Transaction{},
+		"invoice number":       InvoiceNumber{},
+		"invoice sequence":     InvoiceSequenceNumber{},
+		"hook":                 Hook{},
+		"license":              License{},
+		"license pool key":     LicensePoolKey{},
+		"subscription":         Subscription{},
+		"payment method":       PaymentMethod{},
+		"balance account":      BalanceAccount{},
+		"balance entry":        BalanceEntry{},
+		"job":                  Job{},
+		"email":                Email{},
+		"webhook subscription": WebhookSubscription{},
 	}
 
 	for name, dm := range delModels {
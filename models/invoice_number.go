@@ -1,44 +1,182 @@
 package models
 
 import (
-	"log"
+	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
 )
 
+// Invoice number sequences. Invoices and credit notes are numbered
+// separately.
+const (
+	InvoiceSequence    = "invoice"
+	CreditNoteSequence = "credit_note"
+)
+
+// Invoice number resets.
+const (
+	ResetNever   = ""
+	ResetYearly  = "year"
+	ResetMonthly = "month"
+)
+
+// InvoiceNumber is the invoice counter of an instance from before invoice
+// sequences. It is where the invoice sequence of the instance starts.
 type InvoiceNumber struct {
 	InstanceID string `gorm:"primary_key"`
 	Number     int64
 }
 
-// TableName returns the database table name for the LineItem model.
+// TableName returns the database table name for the InvoiceNumber model.
 func (InvoiceNumber) TableName() string {
 	return tableName("invoice_numbers")
 }
 
-// NextInvoiceNumber updates and returns the next invoice number for the instance
-func NextInvoiceNumber(tx *gorm.DB, instanceID string) (int64, error) {
-	number := InvoiceNumber{}
+// InvoiceSequenceNumber is the last number of a sequence of an instance in a
+// period, like a year when the numbers start over every year.
+type InvoiceSequenceNumber struct {
+	InstanceID string `gorm:"primary_key"`
+	Name       string `gorm:"primary_key"`
+	Period     string `gorm:"primary_key"`
+	Number     int64
+}
+
+// TableName returns the database table name for the InvoiceSequenceNumber model.
+func (InvoiceSequenceNumber) TableName() string {
+	return tableName("invoice_sequence_numbers")
+}
+
+// InvoiceNumbering configures the numbers of a sequence.
+type InvoiceNumbering struct {
+	Sequence string
+	// Format is like "INV-{year}-{number:6}", which is "INV-2017-000123"
+	// for the 123rd invoice of 2017. Besides {number}, it can contain the
+	// {year} and {month} the number was given out in.
+	Format string
+	// Reset starts the numbers over every year or month.
+	Reset string
+}
+
+var placeholderPattern = regexp.MustCompile(`\{([a-z]+)(?::(\d+))?\}`)
+
+// Validate checks that the format has the placeholders that make the numbers
+// unique.
+func (n InvoiceNumbering) Validate() error {
+	placeholders := map[string]bool{}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(n.Format, -1) {
+		switch match[1] {
+		case "number", "year", "month":
+			placeholders[match[1]] = true
+		default:
+			return fmt.Errorf("Unknown placeholder {%s} in invoice number format '%s'", match[1], n.Format)
+		}
+	}
+	if n.Format != "" && !placeholders["number"] {
+		return fmt.Errorf("Invoice number format '%s' needs a {number}", n.Format)
+	}
+
+	switch n.Reset {
+	case ResetNever:
+	case ResetYearly:
+		if !placeholders["year"] {
+			return fmt.Errorf("Invoice number format '%s' needs a {year} to start over every year", n.Format)
+		}
+	case ResetMonthly:
+		if !placeholders["year"] || !placeholders["month"] {
+			return fmt.Errorf("Invoice number format '%s' needs a {year} and {month} to start over every month", n.Format)
+		}
+	default:
+		return fmt.Errorf("Unknown invoice number reset '%s'", n.Reset)
+	}
+	return nil
+}
+
+// period is the period in which the numbers don't start over.
+func (n InvoiceNumbering) period(at time.Time) string {
+	switch n.Reset {
+	case ResetYearly:
+		return at.Format("2006")
+	case ResetMonthly:
+		return at.Format("2006-01")
+	}
+	return ""
+}
+
+// FormatNumber formats a number given out at a time.
+func (n InvoiceNumbering) FormatNumber(number int64, at time.Time) string {
+	if n.Format == "" {
+		return strconv.FormatInt(number, 10)
+	}
+	return placeholderPattern.ReplaceAllStringFunc(n.Format, func(placeholder string) string {
+		match := placeholderPattern.FindStringSubmatch(placeholder)
+		switch match[1] {
+		case "year":
+			return at.Format("2006")
+		case "month":
+			return at.Format("01")
+		}
+		digits := strconv.FormatInt(number, 10)
+		if width, _ := strconv.Atoi(match[2]); width > len(digits) {
+			digits = strings.Repeat("0", width-len(digits)) + digits
+		}
+		return digits
+	})
+}
+
+// NextInvoiceNumber gives out the next number of a sequence of the instance,
+// and returns it with its formatted version.
+//
+// The counter is incremented before it is read, which locks it until the
+// transaction ends on every database. A transaction that rolls back gives its
+// number back, so there are no gaps.
+func NextInvoiceNumber(tx *gorm.DB, instanceID string, numbering InvoiceNumbering, at time.Time) (int64, string, error) {
+	if err := numbering.Validate(); err != nil {
+		return 0, "", err
+	}
 	if instanceID == "" {
 		instanceID = "global-instance"
 	}
+	period := numbering.period(at)
 
-	if result := tx.Where(InvoiceNumber{InstanceID: instanceID}).Attrs(InvoiceNumber{Number: 0}).FirstOrCreate(&number); result.Error != nil {
-		return 0, result.Error
+	if err := createInvoiceSequence(tx, instanceID, numbering.Sequence, period); err != nil {
+		return 0, "", errors.Wrap(err, "Error creating invoice sequence")
 	}
 
-	numberTable := tx.NewScope(InvoiceNumber{}).QuotedTableName()
-	if result := tx.Raw("select number from "+numberTable+" where instance_id = ? for update", instanceID).Scan(&number); result.Error != nil {
-		if strings.Contains(result.Error.Error(), "syntax error") {
-			log.Println("This DB driver doesn't support select for update, hoping for the best...")
-		} else {
-			return 0, result.Error
-		}
+	query := tx.Model(&InvoiceSequenceNumber{}).Where("instance_id = ? AND name = ? AND period = ?", instanceID, numbering.Sequence, period)
+	if result := query.Update("number", gorm.Expr("number + 1")); result.Error != nil {
+		return 0, "", errors.Wrap(result.Error, "Error incrementing invoice number")
 	}
-	if result := tx.Model(number).Update("number", gorm.Expr("number + 1")); result.Error != nil {
-		return 0, result.Error
+	sequence := &InvoiceSequenceNumber{}
+	if result := query.First(sequence); result.Error != nil {
+		return 0, "", errors.Wrap(result.Error, "Error reading invoice number")
 	}
 
-	return number.Number + 1, nil
+	return sequence.Number, numbering.FormatNumber(sequence.Number, at), nil
+}
+
+// createInvoiceSequence creates the counter of a sequence unless it exists.
+// Invoices of instances that numbered them before sequences existed continue
+// where the old counter stopped.
+func createInvoiceSequence(tx *gorm.DB, instanceID, name, period string) error {
+	var start int64
+	if name == InvoiceSequence && period == "" {
+		legacy := &InvoiceNumber{}
+		result := tx.Where("instance_id = ?", instanceID).First(legacy)
+		if result.Error != nil && !result.RecordNotFound() {
+			return result.Error
+		}
+		start = legacy.Number
+	}
+
+	supported, err := insertIgnore(tx, InvoiceSequenceNumber{}, []string{"instance_id", "name", "period", "number"}, instanceID, name, period, start)
+	if supported || err != nil {
+		return err
+	}
+	sequence := &InvoiceSequenceNumber{InstanceID: instanceID, Name: name, Period: period}
+	return tx.Where(sequence).Attrs(InvoiceSequenceNumber{Number: start}).FirstOrCreate(sequence).Error
 }
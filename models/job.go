@@ -0,0 +1,209 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// Job states.
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+const defaultJobMaxAttempts = 5
+
+// Job is a unit of background work that is picked up by a worker. Workers
+// lock the jobs they run, and a job whose lock is older than the visibility
+// timeout is considered abandoned and run again.
+type Job struct {
+	ID         uint64 `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_jobs_instance_id"`
+
+	Type    string `json:"type" sql:"index:idx_jobs_type"`
+	Payload string `json:"payload" sql:"type:text"`
+	Status  string `json:"status" sql:"index:idx_jobs_status_run_after"`
+
+	Attempts    int     `json:"attempts"`
+	MaxAttempts int     `json:"max_attempts"`
+	LastError   *string `json:"last_error" sql:"type:text"`
+
+	RunAfter time.Time  `json:"run_after" sql:"index:idx_jobs_status_run_after"`
+	LockedAt *time.Time `json:"-"`
+	LockedBy *string    `json:"-"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// TableName returns the database table name for the Job model.
+func (Job) TableName() string {
+	return tableName("jobs")
+}
+
+// NewJob creates a Job of the given type that runs as soon as possible.
+func NewJob(instanceID, jobType string, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error encoding job payload")
+	}
+	return &Job{
+		InstanceID:  instanceID,
+		Type:        jobType,
+		Payload:     string(data),
+		Status:      JobPending,
+		MaxAttempts: defaultJobMaxAttempts,
+		RunAfter:    time.Now(),
+	}, nil
+}
+
+// DecodePayload decodes the JSON payload of the job into v.
+func (j *Job) DecodePayload(v interface{}) error {
+	return json.Unmarshal([]byte(j.Payload), v)
+}
+
+// EnqueueJob stores a job so a worker picks it up. Call it within the
+// transaction that creates the work, so the job only exists if the
+// transaction commits.
+func EnqueueJob(tx *gorm.DB, job *Job) error {
+	if job.Status == "" {
+		job.Status = JobPending
+	}
+	if job.RunAfter.IsZero() {
+		job.RunAfter = time.Now()
+	}
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = defaultJobMaxAttempts
+	}
+	if result := tx.Create(job); result.Error != nil {
+		return errors.Wrap(result.Error, "Error enqueuing job")
+	}
+	return nil
+}
+
+// ClaimJobs locks up to limit runnable jobs of the given types for a worker
+// and counts the attempt. Jobs locked longer ago than the visibility timeout
+// are claimed again.
+func ClaimJobs(db *gorm.DB, workerID string, jobTypes []string, limit int, visibilityTimeout time.Duration) ([]*Job, error) {
+	now := time.Now()
+	table := db.NewScope(Job{}).QuotedTableName()
+	runnable := "status = ? AND type IN (?) AND run_after <= ? AND (locked_at IS NULL OR locked_at < ?)"
+	args := []interface{}{JobPending, jobTypes, now, now.Add(-visibilityTimeout)}
+
+	// every claim gets its own lock token, so a worker only ever finishes the
+	// attempts it claimed itself
+	lockToken := workerID + "/" + uuid.NewRandom().String()
+
+	tx := db.Begin()
+	ids := []uint64{}
+	if supportsSkipLocked(db) {
+		// let concurrent workers skip the rows we are about to lock instead of
+		// waiting for our transaction
+		rows, err := tx.Raw("SELECT id FROM "+table+" WHERE "+runnable+" ORDER BY run_after LIMIT ? FOR UPDATE SKIP LOCKED", append(args, limit)...).Rows()
+		if err != nil {
+			tx.Rollback()
+			return nil, errors.Wrap(err, "Error querying for jobs")
+		}
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				tx.Rollback()
+				return nil, errors.Wrap(err, "Error querying for jobs")
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+	} else if result := tx.Model(&Job{}).Where(runnable, args...).Order("run_after").Limit(limit).Pluck("id", &ids); result.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(result.Error, "Error querying for jobs")
+	}
+
+	if len(ids) == 0 {
+		tx.Rollback()
+		return nil, nil
+	}
+
+	// repeat the conditions, so a job claimed by another worker in the meantime
+	// isn't claimed twice on databases without row locks
+	result := tx.Model(&Job{}).Where("id IN (?) AND "+runnable, append([]interface{}{ids}, args...)...).Updates(map[string]interface{}{
+		"locked_at": now,
+		"locked_by": lockToken,
+		"attempts":  gorm.Expr("attempts + 1"),
+	})
+	if result.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(result.Error, "Error locking jobs")
+	}
+
+	jobs := []*Job{}
+	if result := tx.Where("locked_by = ?", lockToken).Find(&jobs); result.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(result.Error, "Error loading jobs")
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error locking jobs")
+	}
+	return jobs, nil
+}
+
+func supportsSkipLocked(db *gorm.DB) bool {
+	return db.Dialect().GetName() == "postgres"
+}
+
+// ErrJobLockLost is returned when a job is finished by a worker after its
+// lock expired and the job was claimed again.
+var ErrJobLockLost = errors.New("job lock has expired")
+
+// Complete marks the job as done.
+func (j *Job) Complete(db *gorm.DB) error {
+	now := time.Now()
+	j.Status = JobDone
+	j.LastError = nil
+	j.CompletedAt = &now
+	return j.unlock(db)
+}
+
+// Retry records the error of a failed attempt and schedules the job to run
+// again at runAfter. The job fails for good once it used up its attempts.
+func (j *Job) Retry(db *gorm.DB, jobErr error, runAfter time.Time) error {
+	errString := jobErr.Error()
+	j.LastError = &errString
+	if j.Attempts >= j.MaxAttempts {
+		now := time.Now()
+		j.Status = JobFailed
+		j.CompletedAt = &now
+	} else {
+		j.RunAfter = runAfter
+	}
+	return j.unlock(db)
+}
+
+func (j *Job) unlock(db *gorm.DB) error {
+	if j.LockedBy == nil {
+		return ErrJobLockLost
+	}
+	result := db.Model(&Job{}).Where("id = ? AND locked_by = ?", j.ID, *j.LockedBy).Updates(map[string]interface{}{
+		"status":       j.Status,
+		"last_error":   j.LastError,
+		"run_after":    j.RunAfter,
+		"completed_at": j.CompletedAt,
+		"locked_at":    nil,
+		"locked_by":    nil,
+	})
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error saving job")
+	}
+	if result.RowsAffected == 0 {
+		return ErrJobLockLost
+	}
+	j.LockedAt = nil
+	j.LockedBy = nil
+	return nil
+}
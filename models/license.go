@@ -0,0 +1,225 @@
+package models
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// License key sources. Pool keys are imported in advance, and signed keys
+// are generated and signed when they are issued.
+const (
+	LicensePoolSource   = "pool"
+	LicenseSignedSource = "signed"
+)
+
+// ErrLicensePoolEmpty is returned when a pool has no keys left to issue.
+var ErrLicensePoolEmpty = errors.New("No license keys left in pool")
+
+// LicenseKeyMetadata configures the license keys of a product. Every item
+// bought gets a key.
+type LicenseKeyMetadata struct {
+	Source string `json:"source"`
+	// Pool is the pool keys are taken from, the sku of the product by default.
+	Pool string `json:"pool"`
+}
+
+// License is a license key issued for a line item of a paid order.
+type License struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-"`
+	OrderID    string `json:"order_id"`
+	LineItemID int64  `json:"line_item_id"`
+
+	Sku    string `json:"sku"`
+	Title  string `json:"title"`
+	Source string `json:"source"`
+	// Key is stored as license_key, since key is reserved in MySQL.
+	Key string `json:"key" sql:"type:text" gorm:"column:license_key"`
+
+	// RevokedAt is set when an admin or a refund revoked the license.
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-" sql:"index:idx_licenses_deleted_at"`
+}
+
+// TableName returns the database table name for the License model.
+func (License) TableName() string {
+	return tableName("licenses")
+}
+
+// LicensePoolKey is a key imported into a pool of license keys. It is issued
+// to a single license.
+type LicensePoolKey struct {
+	ID         int64  `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_license_pool_keys_pool"`
+	Pool       string `json:"pool" sql:"index:idx_license_pool_keys_pool"`
+	Key        string `json:"key" sql:"type:text" gorm:"column:license_key"`
+	LicenseID  string `json:"license_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the LicensePoolKey model.
+func (LicensePoolKey) TableName() string {
+	return tableName("license_pool_keys")
+}
+
+// SignedLicense is the payload of a signed license key.
+type SignedLicense struct {
+	ID       string    `json:"id"`
+	Sku      string    `json:"sku"`
+	OrderID  string    `json:"order_id"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// ParseSigningKey parses a base64 encoded Ed25519 private key, or the seed
+// it is generated from.
+func ParseSigningKey(encoded string) (ed25519.PrivateKey, error) {
+	if encoded == "" {
+		return nil, errors.New("No signing key configured for license keys")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error decoding license signing key")
+	}
+	switch len(data) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(data), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(data), nil
+	}
+	return nil, errors.New("License signing key must be an Ed25519 seed or private key")
+}
+
+// SignLicenseKey generates a key with the base64 encoded payload of a license
+// and its signature, separated by a dot.
+func SignLicenseKey(license *License, signingKey ed25519.PrivateKey) (string, error) {
+	payload, err := json.Marshal(&SignedLicense{
+		ID:       license.ID,
+		Sku:      license.Sku,
+		OrderID:  license.OrderID,
+		IssuedAt: license.CreatedAt.UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signature := ed25519.Sign(signingKey, payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// VerifyLicenseKey checks the signature of a signed license key and returns
+// its payload.
+func VerifyLicenseKey(key string, publicKey ed25519.PublicKey) (*SignedLicense, error) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Not a signed license key")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Not a signed license key")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Not a signed license key")
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return nil, errors.New("Invalid license key signature")
+	}
+
+	signed := &SignedLicense{}
+	if err := json.Unmarshal(payload, signed); err != nil {
+		return nil, errors.Wrap(err, "Error parsing license key")
+	}
+	return signed, nil
+}
+
+// IssueLicenses issues license keys for the items of an order that have
+// them. Pool keys are claimed within the transaction, so they go back to the
+// pool if it rolls back.
+func IssueLicenses(tx *gorm.DB, order *Order, signingKey func() (ed25519.PrivateKey, error)) ([]*License, error) {
+	licenses := []*License{}
+	for _, item := range order.LineItems {
+		if item.LicenseSource == "" {
+			continue
+		}
+		for i := uint64(0); i < item.Quantity; i++ {
+			license := &License{
+				ID:         uuid.NewRandom().String(),
+				InstanceID: order.InstanceID,
+				OrderID:    order.ID,
+				LineItemID: item.ID,
+				Sku:        item.Sku,
+				Title:      item.Title,
+				Source:     item.LicenseSource,
+				CreatedAt:  time.Now(),
+			}
+
+			switch item.LicenseSource {
+			case LicensePoolSource:
+				key, err := claimPoolKey(tx, order.InstanceID, item.LicensePool, license.ID)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Error issuing license key for %s", item.Sku)
+				}
+				license.Key = key
+			case LicenseSignedSource:
+				privateKey, err := signingKey()
+				if err != nil {
+					return nil, err
+				}
+				if license.Key, err = SignLicenseKey(license, privateKey); err != nil {
+					return nil, errors.Wrap(err, "Error signing license key")
+				}
+			default:
+				return nil, errors.Errorf("Unknown license key source '%s' for %s", item.LicenseSource, item.Sku)
+			}
+
+			if result := tx.Create(license); result.Error != nil {
+				return nil, errors.Wrap(result.Error, "Error creating license")
+			}
+			licenses = append(licenses, license)
+		}
+	}
+	return licenses, nil
+}
+
+// claimPoolKey takes the oldest unused key from a pool. Another transaction
+// can claim the same key at the same time, in which case the next one is
+// tried.
+func claimPoolKey(tx *gorm.DB, instanceID, pool, licenseID string) (string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		key := &LicensePoolKey{}
+		result := tx.Where("instance_id = ? AND pool = ? AND license_id = ''", instanceID, pool).Order("id").First(key)
+		if result.RecordNotFound() {
+			return "", ErrLicensePoolEmpty
+		} else if result.Error != nil {
+			return "", result.Error
+		}
+
+		claim := tx.Model(key).Where("license_id = ''").Update("license_id", licenseID)
+		if claim.Error != nil {
+			return "", claim.Error
+		}
+		if claim.RowsAffected == 1 {
+			return key.Key, nil
+		}
+	}
+	return "", errors.New("Too many concurrent claims of license keys")
+}
+
+// RevokeOrderLicenses revokes all licenses of an order that aren't revoked
+// already.
+func RevokeOrderLicenses(tx *gorm.DB, orderID, reason string) error {
+	return tx.Model(&License{}).
+		Where("order_id = ? AND revoked_at IS NULL", orderID).
+		Updates(map[string]interface{}{"revoked_at": time.Now(), "revoke_reason": reason}).Error
+}
@@ -34,6 +34,24 @@ type LineItem struct {
 
 	Quantity uint64 `json:"quantity"`
 
+	// NetPrice and Taxes are the price of a single item without taxes and
+	// the taxes on it, as calculated for the order.
+	NetPrice uint64 `json:"net_price"`
+	Taxes    uint64 `json:"taxes"`
+
+	// Interval and IntervalCount are how often an item with a recurring
+	// price is billed, and RecurringPrice what it costs each time. Items with
+	// a trial cost nothing at first.
+	Interval       string `json:"interval,omitempty"`
+	IntervalCount  uint64 `json:"interval_count,omitempty"`
+	TrialDays      uint64 `json:"trial_days,omitempty"`
+	RecurringPrice uint64 `json:"recurring_price,omitempty"`
+
+	// LicenseSource and LicensePool are where the license keys of the item
+	// come from, if it has any.
+	LicenseSource string `json:"license_source,omitempty"`
+	LicensePool   string `json:"-"`
+
 	MetaData    map[string]interface{} `sql:"-" json:"meta"`
 	RawMetaData string                 `json:"-" sql:"type:text"`
 
@@ -150,6 +168,13 @@ type PriceMetadata struct {
 	Items    []PriceMetaItem   `json:"items"`
 	Claims   map[string]string `json:"claims"`
 
+	// Interval makes the price recurring, billed every IntervalCount days,
+	// weeks, months or years. The first bill of a subscription with
+	// TrialDays comes after the trial.
+	Interval      string `json:"interval"`
+	IntervalCount uint64 `json:"interval_count"`
+	TrialDays     uint64 `json:"trial_days"`
+
 	cents uint64
 }
 
@@ -180,6 +205,8 @@ type LineItemMetadata struct {
 	Downloads []Download      `json:"downloads"`
 	Addons    []AddonMetaItem `json:"addons"`
 
+	LicenseKeys *LicenseKeyMetadata `json:"license_keys"`
+
 	Webhook string `json:"webhook"`
 }
 
@@ -268,6 +295,19 @@ func (i *LineItem) Process(userClaims map[string]interface{}, order *Order, meta
 		order.Downloads = append(order.Downloads, download)
 	}
 
+	if meta.LicenseKeys != nil {
+		switch meta.LicenseKeys.Source {
+		case LicensePoolSource, LicenseSignedSource:
+		default:
+			return fmt.Errorf("Unknown license key source %v for item %v", meta.LicenseKeys.Source, i.Sku)
+		}
+		i.LicenseSource = meta.LicenseKeys.Source
+		i.LicensePool = meta.LicenseKeys.Pool
+		if i.LicensePool == "" {
+			i.LicensePool = i.Sku
+		}
+	}
+
 	return i.calculatePrice(userClaims, meta.Prices, order.Currency)
 }
 
@@ -289,6 +329,24 @@ func (i *LineItem) calculatePrice(userClaims map[string]interface{}, prices []Pr
 		i.AddonPrice += addon.Price
 	}
 
+	if lowestPrice.Interval != "" {
+		if !IsInterval(lowestPrice.Interval) {
+			return fmt.Errorf("Unknown billing interval %v for item %v", lowestPrice.Interval, i.Sku)
+		}
+		i.Interval = lowestPrice.Interval
+		i.IntervalCount = lowestPrice.IntervalCount
+		if i.IntervalCount == 0 {
+			i.IntervalCount = 1
+		}
+		i.TrialDays = lowestPrice.TrialDays
+		i.RecurringPrice = i.Price + i.AddonPrice
+		if i.TrialDays > 0 {
+			i.Price = 0
+			i.AddonPrice = 0
+			i.PriceItems = nil
+		}
+	}
+
 	return nil
 }
 
@@ -23,6 +23,18 @@ const ShippedState = "shipped"
 // FailedState is the failed state of an Order
 const FailedState = "failed"
 
+// CancelledState is the state of a cancelled Order
+const CancelledState = "cancelled"
+
+// OrderExpiryJobType is the job type that cancels orders that weren't paid
+// in time.
+const OrderExpiryJobType = "order_expiry"
+
+// OrderExpiryJob is the payload of a job expiring an order.
+type OrderExpiryJob struct {
+	OrderID string `json:"order_id"`
+}
+
 // NumberType | StringType | BoolType are the different types supported in custom data for orders
 const (
 	NumberType = iota
@@ -35,6 +47,9 @@ type Order struct {
 	InstanceID    string `json:"-"`
 	ID            string `json:"id"`
 	InvoiceNumber int64  `json:"invoice_number,omitempty"`
+	// FormattedInvoiceNumber is the invoice number in the format of the
+	// instance, like "INV-2017-000123".
+	FormattedInvoiceNumber string `json:"formatted_invoice_number,omitempty"`
 
 	IP string `json:"ip"`
 
@@ -44,10 +59,20 @@ type Order struct {
 
 	Email string `json:"email"`
 
+	// Locale selects the localized email templates for the order.
+	Locale string `json:"locale,omitempty"`
+
 	LineItems []*LineItem `json:"line_items"`
 
 	Downloads []Download `json:"downloads"`
 
+	Licenses []License `json:"licenses,omitempty"`
+
+	GiftCards []BalanceAccount `json:"gift_cards,omitempty" gorm:"ForeignKey:OrderID"`
+
+	// SubscriptionID is set on the orders that renew a subscription.
+	SubscriptionID string `json:"subscription_id,omitempty"`
+
 	Currency string `json:"currency"`
 	Taxes    uint64 `json:"taxes"`
 	Shipping uint64 `json:"shipping"`
@@ -56,11 +81,22 @@ type Order struct {
 
 	Total uint64 `json:"total"`
 
+	// TaxRates sums up the subtotal and taxes by tax percentage.
+	TaxRates    []*calculator.TaxRate `json:"tax_rates,omitempty" sql:"-"`
+	RawTaxRates string                `json:"-" sql:"type:text"`
+
 	PaymentState     string `json:"payment_state"`
 	FulfillmentState string `json:"fulfillment_state"`
 	State            string `json:"state"`
 
+	Carrier        string `json:"carrier,omitempty"`
+	TrackingNumber string `json:"tracking_number,omitempty"`
+	TrackingURL    string `json:"tracking_url,omitempty"`
+
 	PaymentProcessor string `json:"payment_processor"`
+	// PreauthorizedPaymentID is the payment with the provider that was
+	// preauthorized for the order, which the order must be paid with.
+	PreauthorizedPaymentID string `json:"preauthorized_payment_id,omitempty"`
 
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
@@ -106,6 +142,12 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawTaxRates != "" {
+		err := json.Unmarshal([]byte(o.RawTaxRates), &o.TaxRates)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -126,6 +168,13 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawCoupon = string(data)
 	}
+	if o.TaxRates != nil {
+		data, err := json.Marshal(o.TaxRates)
+		if err != nil {
+			return err
+		}
+		o.RawTaxRates = string(data)
+	}
 
 	return nil
 }
@@ -158,6 +207,40 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 	o.Taxes = price.Taxes
 	o.Discount = price.Discount
 	o.Total = price.Total
+	o.TaxRates = price.TaxRates
+	for i, item := range o.LineItems {
+		item.NetPrice = price.Items[i].Subtotal
+		item.Taxes = price.Items[i].Taxes
+	}
+}
+
+// ScheduleOrderExpiry queues a job that cancels the order at a time, unless it
+// was paid by then.
+func ScheduleOrderExpiry(tx *gorm.DB, order *Order, at time.Time) error {
+	job, err := NewJob(order.InstanceID, OrderExpiryJobType, OrderExpiryJob{OrderID: order.ID})
+	if err != nil {
+		return err
+	}
+	job.RunAfter = at
+	return EnqueueJob(tx, job)
+}
+
+// ExpireOrder cancels an order that is still unpaid, and reports whether it
+// did. Orders with a pending payment, like a bank transfer, don't expire.
+func ExpireOrder(tx *gorm.DB, orderID string) (bool, error) {
+	var pending int
+	if result := tx.Model(&Transaction{}).Where("order_id = ? AND status = ?", orderID, PendingState).Count(&pending); result.Error != nil {
+		return false, errors.Wrap(result.Error, "Error counting pending payments")
+	}
+	if pending > 0 {
+		return false, nil
+	}
+
+	result := tx.Model(&Order{}).Where("id = ? AND payment_state = ? AND state = ?", orderID, PendingState, PendingState).UpdateColumn("state", CancelledState)
+	if result.Error != nil {
+		return false, errors.Wrap(result.Error, "Error expiring order")
+	}
+	return result.RowsAffected > 0, nil
 }
 
 func (o *Order) BeforeDelete(tx *gorm.DB) error {
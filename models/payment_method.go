@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pborman/uuid"
+)
+
+// PaymentMethod is a payment method a user saved with a payment provider.
+// Only the references of the provider are stored, never card data.
+type PaymentMethod struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-"`
+	UserID     string `json:"user_id" sql:"index:idx_payment_methods_user_id"`
+
+	Provider string `json:"provider"`
+	// CustomerID and ProviderMethodID reference the customer and the
+	// payment method with the provider.
+	CustomerID       string `json:"-"`
+	ProviderMethodID string `json:"-"`
+
+	Brand    string `json:"brand,omitempty"`
+	Last4    string `json:"last4,omitempty"`
+	ExpMonth uint   `json:"exp_month,omitempty"`
+	ExpYear  uint   `json:"exp_year,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the PaymentMethod model.
+func (PaymentMethod) TableName() string {
+	return tableName("payment_methods")
+}
+
+// NewPaymentMethod creates the PaymentMethod of a method saved with a
+// provider.
+func NewPaymentMethod(instanceID, userID, provider string, saved *payments.SavedMethod) *PaymentMethod {
+	return &PaymentMethod{
+		ID:               uuid.NewRandom().String(),
+		InstanceID:       instanceID,
+		UserID:           userID,
+		Provider:         provider,
+		CustomerID:       saved.CustomerID,
+		ProviderMethodID: saved.MethodID,
+		Brand:            saved.Brand,
+		Last4:            saved.Last4,
+		ExpMonth:         saved.ExpMonth,
+		ExpYear:          saved.ExpYear,
+	}
+}
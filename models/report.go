@@ -0,0 +1,109 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// Types of reports.
+const (
+	SalesReportType    = "sales"
+	ProductsReportType = "products"
+)
+
+// Report states.
+const (
+	ReportPending = "pending"
+	ReportDone    = "done"
+	ReportFailed  = "failed"
+)
+
+// ReportJobType is the job type that generates reports.
+const ReportJobType = "report"
+
+// ReportJob is the payload of a job generating a report.
+type ReportJob struct {
+	ReportID string `json:"report_id"`
+}
+
+// Report is a report that is generated by a worker, for periods too long to
+// query while the admin waits.
+type Report struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_reports_instance_id"`
+	Type       string `json:"type"`
+
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+
+	Status string  `json:"status"`
+	Error  *string `json:"error,omitempty" sql:"type:text"`
+
+	Rows    interface{} `json:"rows,omitempty" sql:"-"`
+	RawRows string      `json:"-" sql:"type:text"`
+
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// TableName returns the database table name for the Report model.
+func (Report) TableName() string {
+	return tableName("reports")
+}
+
+// AfterFind database callback.
+func (r *Report) AfterFind() error {
+	if r.RawRows != "" {
+		return json.Unmarshal([]byte(r.RawRows), &r.Rows)
+	}
+	return nil
+}
+
+// EnqueueReport stores a pending report and queues the job that generates
+// it.
+func EnqueueReport(tx *gorm.DB, report *Report) error {
+	report.ID = uuid.NewRandom().String()
+	report.Status = ReportPending
+	if result := tx.Create(report); result.Error != nil {
+		return errors.Wrap(result.Error, "Error creating report")
+	}
+	job, err := NewJob(report.InstanceID, ReportJobType, ReportJob{ReportID: report.ID})
+	if err != nil {
+		return err
+	}
+	return EnqueueJob(tx, job)
+}
+
+// Complete stores the rows of the generated report.
+func (r *Report) Complete(db *gorm.DB, rows interface{}) error {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return errors.Wrap(err, "Error encoding report")
+	}
+	now := time.Now()
+	r.Rows = rows
+	r.RawRows = string(data)
+	r.Status = ReportDone
+	r.CompletedAt = &now
+	if result := db.Save(r); result.Error != nil {
+		return errors.Wrap(result.Error, "Error saving report")
+	}
+	return nil
+}
+
+// Fail marks the report as failed with the error of generating it.
+func (r *Report) Fail(db *gorm.DB, reportErr error) error {
+	now := time.Now()
+	errString := reportErr.Error()
+	r.Status = ReportFailed
+	r.Error = &errString
+	r.CompletedAt = &now
+	if result := db.Save(r); result.Error != nil {
+		return errors.Wrap(result.Error, "Error saving report")
+	}
+	return nil
+}
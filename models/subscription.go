@@ -0,0 +1,348 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// Subscription states.
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive   = "active"
+	// SubscriptionPastDue is the state of a subscription whose renewal
+	// failed and is retried.
+	SubscriptionPastDue  = "past_due"
+	SubscriptionPaused   = "paused"
+	SubscriptionCanceled = "canceled"
+)
+
+// Reasons a subscription was canceled for.
+const (
+	CanceledByCustomer  = "customer"
+	CanceledByAdmin     = "admin"
+	CanceledUnpaid      = "unpaid"
+	CanceledUserDeleted = "user_deleted"
+)
+
+// Billing intervals of recurring prices.
+const (
+	DayInterval   = "day"
+	WeekInterval  = "week"
+	MonthInterval = "month"
+	YearInterval  = "year"
+)
+
+// SubscriptionRenewalJobType is the job type that bills subscriptions.
+const SubscriptionRenewalJobType = "subscription_renewal"
+
+// ErrNotRenewalOrder is returned when paying for a renewal order of a
+// subscription that was renewed with another order since.
+var ErrNotRenewalOrder = errors.New("Order isn't the current renewal of its subscription")
+
+// SubscriptionJob is the payload of a job billing a subscription.
+type SubscriptionJob struct {
+	SubscriptionID string `json:"subscription_id"`
+	// BillingAt is the billing date the job was scheduled for. The job does
+	// nothing when the subscription was rescheduled since.
+	BillingAt time.Time `json:"billing_at"`
+}
+
+// Subscription is a product bought with a recurring price. It is renewed
+// with a new order every interval, until it is canceled.
+type Subscription struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-"`
+	UserID     string `json:"user_id,omitempty" sql:"index:idx_subscriptions_user_id"`
+	Email      string `json:"email"`
+
+	// OrderID is the order that started the subscription, and LineItemID
+	// its item with the plan.
+	OrderID    string `json:"order_id"`
+	LineItemID int64  `json:"line_item_id"`
+
+	// Plan is the sku of the product subscribed to.
+	Plan     string `json:"plan"`
+	Title    string `json:"title"`
+	Type     string `json:"type"`
+	Path     string `json:"path"`
+	Price    uint64 `json:"price"`
+	VAT      uint64 `json:"vat"`
+	Quantity uint64 `json:"quantity"`
+	Currency string `json:"currency"`
+
+	Interval      string     `json:"interval"`
+	IntervalCount uint64     `json:"interval_count"`
+	TrialEndsAt   *time.Time `json:"trial_ends_at,omitempty"`
+
+	Status             string    `json:"status"`
+	CurrentPeriodStart time.Time `json:"current_period_start"`
+	CurrentPeriodEnd   time.Time `json:"current_period_end"`
+	// BillingAnchorDay is the day of the month monthly and yearly periods
+	// end on, or the last day of shorter months.
+	BillingAnchorDay int `json:"-"`
+	// NextBillingAt is when the subscription is renewed, or its failed
+	// renewal retried. It isn't set while the subscription isn't billed.
+	NextBillingAt *time.Time `json:"next_billing_at,omitempty" sql:"index:idx_subscriptions_next_billing_at"`
+
+	PaymentProcessor string `json:"payment_processor"`
+	PaymentMethodID  string `json:"payment_method_id,omitempty"`
+
+	// RenewalOrderID is the unpaid order of a failed renewal, and
+	// FailedAttempts how often charging it failed.
+	RenewalOrderID string `json:"renewal_order_id,omitempty"`
+	FailedAttempts int    `json:"failed_attempts"`
+
+	PausedAt     *time.Time `json:"paused_at,omitempty"`
+	CanceledAt   *time.Time `json:"canceled_at,omitempty"`
+	CancelReason string     `json:"cancel_reason,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Subscription model.
+func (Subscription) TableName() string {
+	return tableName("subscriptions")
+}
+
+// IsInterval checks if an interval of a recurring price is known.
+func IsInterval(interval string) bool {
+	switch interval {
+	case DayInterval, WeekInterval, MonthInterval, YearInterval:
+		return true
+	}
+	return false
+}
+
+// addInterval adds count intervals to a time. Monthly and yearly intervals
+// end on the anchor day of the month, or the last day of shorter months, so
+// a period starting on the 31st ends on the 30th in months without a 31st.
+func addInterval(t time.Time, interval string, count uint64, anchorDay int) time.Time {
+	n := int(count)
+	if n < 1 {
+		n = 1
+	}
+	switch interval {
+	case DayInterval:
+		return t.AddDate(0, 0, n)
+	case WeekInterval:
+		return t.AddDate(0, 0, 7*n)
+	case YearInterval:
+		n *= 12
+	}
+	if anchorDay < 1 {
+		anchorDay = t.Day()
+	}
+	month := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if lastDay := month.AddDate(0, 1, -1).Day(); anchorDay > lastDay {
+		anchorDay = lastDay
+	}
+	return month.AddDate(0, 0, anchorDay-1)
+}
+
+// billingTime is a time as precise as all databases store it, so the billing
+// date of a job matches the one of its subscription.
+func billingTime(t time.Time) *time.Time {
+	t = t.UTC().Truncate(time.Second)
+	return &t
+}
+
+// StartSubscriptions creates the subscriptions of the items of an order that
+// have a recurring price, and schedules their first renewal. It is called
+// before the order is charged, so a subscription that can't be started
+// rolls the payment back.
+func StartSubscriptions(tx *gorm.DB, order *Order, paidAt time.Time) ([]*Subscription, error) {
+	subscriptions := []*Subscription{}
+	for _, item := range order.LineItems {
+		if item.Interval == "" {
+			continue
+		}
+
+		s := &Subscription{
+			ID:                 uuid.NewRandom().String(),
+			InstanceID:         order.InstanceID,
+			UserID:             order.UserID,
+			Email:              order.Email,
+			OrderID:            order.ID,
+			LineItemID:         item.ID,
+			Plan:               item.Sku,
+			Title:              item.Title,
+			Type:               item.Type,
+			Path:               item.Path,
+			Price:              item.RecurringPrice,
+			VAT:                item.VAT,
+			Quantity:           item.Quantity,
+			Currency:           order.Currency,
+			Interval:           item.Interval,
+			IntervalCount:      item.IntervalCount,
+			Status:             SubscriptionActive,
+			CurrentPeriodStart: *billingTime(paidAt),
+			BillingAnchorDay:   billingTime(paidAt).Day(),
+		}
+		if item.TrialDays > 0 {
+			s.Status = SubscriptionTrialing
+			s.TrialEndsAt = billingTime(paidAt.AddDate(0, 0, int(item.TrialDays)))
+			s.CurrentPeriodEnd = *s.TrialEndsAt
+			s.BillingAnchorDay = s.TrialEndsAt.Day()
+		} else {
+			s.CurrentPeriodEnd = *billingTime(addInterval(s.CurrentPeriodStart, s.Interval, s.IntervalCount, s.BillingAnchorDay))
+		}
+		s.NextBillingAt = billingTime(s.CurrentPeriodEnd)
+
+		if result := tx.Create(s); result.Error != nil {
+			return nil, errors.Wrap(result.Error, "Error creating subscription")
+		}
+		if err := ScheduleSubscription(tx, s); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, nil
+}
+
+// ScheduleSubscription queues a job that bills the subscription at its next
+// billing date.
+func ScheduleSubscription(tx *gorm.DB, s *Subscription) error {
+	if s.NextBillingAt == nil {
+		return nil
+	}
+	job, err := NewJob(s.InstanceID, SubscriptionRenewalJobType, SubscriptionJob{SubscriptionID: s.ID, BillingAt: *s.NextBillingAt})
+	if err != nil {
+		return err
+	}
+	job.RunAfter = *s.NextBillingAt
+	return EnqueueJob(tx, job)
+}
+
+// DueAt checks if the subscription is still billed at the billing date of a
+// job.
+func (s *Subscription) DueAt(billingAt time.Time) bool {
+	switch s.Status {
+	case SubscriptionActive, SubscriptionTrialing, SubscriptionPastDue:
+	default:
+		return false
+	}
+	return s.NextBillingAt != nil && s.NextBillingAt.Unix() == billingAt.Unix()
+}
+
+// Renew starts the next period of the subscription after its renewal was
+// paid.
+func (s *Subscription) Renew() {
+	s.CurrentPeriodStart = s.CurrentPeriodEnd
+	s.CurrentPeriodEnd = *billingTime(addInterval(s.CurrentPeriodStart, s.Interval, s.IntervalCount, s.BillingAnchorDay))
+	s.NextBillingAt = billingTime(s.CurrentPeriodEnd)
+	s.Status = SubscriptionActive
+	s.RenewalOrderID = ""
+	s.FailedAttempts = 0
+	s.CanceledAt = nil
+	s.CancelReason = ""
+}
+
+// RetryAt marks the subscription as past due and bills it again at a later
+// time.
+func (s *Subscription) RetryAt(at time.Time) {
+	s.Status = SubscriptionPastDue
+	s.NextBillingAt = billingTime(at)
+}
+
+// Pause stops billing the subscription until it is resumed.
+func (s *Subscription) Pause() {
+	now := time.Now()
+	s.Status = SubscriptionPaused
+	s.PausedAt = &now
+	s.NextBillingAt = nil
+}
+
+// Resume bills a paused subscription again. A subscription whose period
+// ended while it was paused starts a new period right away.
+func (s *Subscription) Resume() {
+	now := time.Now()
+	if s.CurrentPeriodEnd.Before(now) {
+		s.CurrentPeriodEnd = *billingTime(now)
+		s.BillingAnchorDay = s.CurrentPeriodEnd.Day()
+	}
+	s.Status = SubscriptionActive
+	s.PausedAt = nil
+	s.NextBillingAt = billingTime(s.CurrentPeriodEnd)
+}
+
+// Cancel stops renewing the subscription. It stays usable until the end of
+// the current period.
+func (s *Subscription) Cancel(reason string) {
+	now := time.Now()
+	s.Status = SubscriptionCanceled
+	s.CanceledAt = &now
+	s.CancelReason = reason
+	s.NextBillingAt = nil
+}
+
+// CancelUserSubscriptions cancels the subscriptions of a user that are still
+// billed or paused.
+func CancelUserSubscriptions(tx *gorm.DB, userID, reason string) error {
+	subscriptions := []*Subscription{}
+	if result := tx.Where("user_id = ? AND status <> ?", userID, SubscriptionCanceled).Find(&subscriptions); result.Error != nil {
+		return errors.Wrap(result.Error, "Error loading subscriptions")
+	}
+	for _, s := range subscriptions {
+		s.Cancel(reason)
+		if result := tx.Save(s); result.Error != nil {
+			return errors.Wrap(result.Error, "Error canceling subscription")
+		}
+	}
+	return nil
+}
+
+// RenewSubscription renews the subscription of a renewal order. Like
+// StartSubscriptions, it is called before the order is charged. The renewal
+// only goes through while the order is still the renewal of the
+// subscription, so the customer and the billing job can't both charge it.
+func RenewSubscription(tx *gorm.DB, order *Order) (*Subscription, error) {
+	s := &Subscription{}
+	if result := tx.Where("id = ?", order.SubscriptionID).First(s); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading subscription")
+	}
+	if s.RenewalOrderID != order.ID {
+		return nil, ErrNotRenewalOrder
+	}
+	s.Renew()
+	result := tx.Model(&Subscription{}).Where("id = ? AND renewal_order_id = ?", s.ID, order.ID).Updates(map[string]interface{}{
+		"current_period_start": s.CurrentPeriodStart,
+		"current_period_end":   s.CurrentPeriodEnd,
+		"next_billing_at":      s.NextBillingAt,
+		"status":               s.Status,
+		"renewal_order_id":     s.RenewalOrderID,
+		"failed_attempts":      s.FailedAttempts,
+		"canceled_at":          s.CanceledAt,
+		"cancel_reason":        s.CancelReason,
+	})
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error saving subscription")
+	}
+	if result.RowsAffected == 0 {
+		// renewed by a payment that ran at the same time
+		return nil, ErrNotRenewalOrder
+	}
+	return s, ScheduleSubscription(tx, s)
+}
+
+// SetSubscriptionPaymentMethod records how an order was paid on the
+// subscriptions it started, which are renewed with the saved payment method
+// it was paid with, if any. A renewal the customer paid with a saved payment
+// method changes the method of its subscription.
+func SetSubscriptionPaymentMethod(tx *gorm.DB, order *Order, tr *Transaction) error {
+	query := tx.Model(&Subscription{}).Where("order_id = ?", order.ID)
+	if order.SubscriptionID != "" {
+		if tr.PaymentMethodID == "" {
+			return nil
+		}
+		query = tx.Model(&Subscription{}).Where("id = ?", order.SubscriptionID)
+	}
+	result := query.Updates(map[string]interface{}{
+		"payment_processor": order.PaymentProcessor,
+		"payment_method_id": tr.PaymentMethodID,
+	})
+	return errors.Wrap(result.Error, "Error saving payment method of subscriptions")
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
 )
 
 // ChargeTransactionType is the charge transaction type.
@@ -21,6 +22,13 @@ type Transaction struct {
 	OrderID    string `json:"order_id"`
 
 	ProcessorID string `json:"processor_id"`
+	// PaymentMethodID is the saved payment method that was charged.
+	PaymentMethodID string `json:"payment_method_id,omitempty"`
+	// BalanceAccountID is the gift card or store credit that paid, or was
+	// refunded.
+	BalanceAccountID string `json:"balance_account_id,omitempty"`
+	// ChargeID is the charge that a refund refunds.
+	ChargeID string `json:"charge_id,omitempty"`
 
 	User   *User  `json:"-"`
 	UserID string `json:"user_id,omitempty"`
@@ -28,12 +36,20 @@ type Transaction struct {
 	Amount   uint64 `json:"amount"`
 	Currency string `json:"currency"`
 
+	// Instructions tell the customer how to pay a pending payment, like
+	// where to transfer the money to.
+	Instructions string `json:"instructions,omitempty" sql:"type:text"`
+
 	FailureCode        string `json:"failure_code,omitempty"`
 	FailureDescription string `json:"failure_description,omitempty" sql:"type:text"`
 
 	Status string `json:"status"`
 	Type   string `json:"type"`
 
+	// InvoiceNumber is the number of the credit note of a refund.
+	InvoiceNumber          int64  `json:"invoice_number,omitempty"`
+	FormattedInvoiceNumber string `json:"formatted_invoice_number,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"-"`
 }
@@ -68,3 +84,52 @@ func GetTransaction(db *gorm.DB, id string) (*Transaction, error) {
 	}
 	return trans, nil
 }
+
+// OrderRefunded reports whether the paid refunds of an order add up to its
+// paid charges.
+func OrderRefunded(db *gorm.DB, orderID string) (bool, error) {
+	charged, refunded, err := OrderPaidAmounts(db, orderID)
+	if err != nil {
+		return false, err
+	}
+	return charged > 0 && refunded >= charged, nil
+}
+
+// RefundableAmount returns how much of a charge wasn't refunded yet. The
+// charge is written before its refunds are read, which locks it until the
+// transaction ends, so concurrent refunds can't both refund the same amount.
+func RefundableAmount(tx *gorm.DB, charge *Transaction) (uint64, error) {
+	if result := tx.Model(&Transaction{}).Where("id = ?", charge.ID).UpdateColumn("status", gorm.Expr("status")); result.Error != nil {
+		return 0, errors.Wrap(result.Error, "Error locking charge")
+	}
+	refunds := []Transaction{}
+	query := tx.Where("charge_id = ? AND type = ? AND status = ?", charge.ID, RefundTransactionType, PaidState)
+	if result := query.Find(&refunds); result.Error != nil {
+		return 0, errors.Wrap(result.Error, "Error loading refunds of charge")
+	}
+	var refunded uint64
+	for _, refund := range refunds {
+		refunded += refund.Amount
+	}
+	if refunded >= charge.Amount {
+		return 0, nil
+	}
+	return charge.Amount - refunded, nil
+}
+
+// OrderPaidAmounts sums up the paid charges and refunds of an order.
+func OrderPaidAmounts(db *gorm.DB, orderID string) (charged, refunded uint64, err error) {
+	trans := []Transaction{}
+	if rsp := db.Where("order_id = ? AND status = ?", orderID, PaidState).Find(&trans); rsp.Error != nil {
+		return 0, 0, rsp.Error
+	}
+	for _, t := range trans {
+		switch t.Type {
+		case ChargeTransactionType:
+			charged += t.Amount
+		case RefundTransactionType:
+			refunded += t.Amount
+		}
+	}
+	return charged, refunded, nil
+}
@@ -38,6 +38,11 @@ func GetUser(db *gorm.DB, userID string) (*User, error) {
 }
 
 func (u *User) BeforeDelete(tx *gorm.DB) error {
+	// the orders the subscriptions renew are deleted along with the user
+	if err := CancelUserSubscriptions(tx, u.ID, CanceledUserDeleted); err != nil {
+		return err
+	}
+
 	cascadeModels := map[string]interface{}{
 		"order": &[]Order{},
 	}
@@ -48,10 +53,12 @@ func (u *User) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"address":     Address{},
-		"hook":        Hook{},
-		"transaction": Transaction{},
-		"order note":  OrderNote{},
+		"address":        Address{},
+		"hook":           Hook{},
+		"transaction":    Transaction{},
+		"order note":     OrderNote{},
+		"payment method": PaymentMethod{},
+		"store credit":   BalanceAccount{},
 	}
 	for name, dm := range delModels {
 		if result := tx.Delete(dm, "user_id = ?", u.ID); result.Error != nil {
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Webhook events that can be subscribed to.
+const (
+	// WebhookOrderCreated is sent with the order when a new order is placed.
+	WebhookOrderCreated = "order.created"
+	// WebhookOrderUpdated is sent with the order when an admin updates an order.
+	WebhookOrderUpdated = "order.updated"
+	// WebhookPaymentSucceeded is sent with the order when it has been paid.
+	WebhookPaymentSucceeded = "payment.succeeded"
+	// WebhookRefundCreated is sent with the refund transaction when a payment is refunded.
+	WebhookRefundCreated = "refund.created"
+	// WebhookShipmentCreated is sent with the order when its fulfillment state changes to shipped.
+	WebhookShipmentCreated = "shipment.created"
+	// WebhookDownloadIssued is sent with the download when a signed download URL is handed out.
+	WebhookDownloadIssued = "download.issued"
+)
+
+// WebhookEvent describes an event in the webhook event catalog.
+type WebhookEvent struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Payload     string `json:"payload"`
+}
+
+// WebhookEvents is the catalog of all events webhooks can subscribe to.
+var WebhookEvents = []WebhookEvent{
+	{WebhookOrderCreated, "A new order has been placed", "order"},
+	{WebhookOrderUpdated, "An admin has updated an order", "order"},
+	{WebhookPaymentSucceeded, "An order has been paid", "order"},
+	{WebhookRefundCreated, "A payment has been refunded", "transaction"},
+	{WebhookShipmentCreated, "An order has been marked as shipped", "order"},
+	{WebhookDownloadIssued, "A download URL has been issued for a purchased asset", "download"},
+}
+
+// IsWebhookEvent checks if the event is part of the webhook event catalog.
+func IsWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e.Name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookSubscription sends webhooks for a set of events to a URL.
+type WebhookSubscription struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" sql:"index:idx_webhook_subscriptions_instance_id"`
+
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+
+	Events    []string `json:"events" sql:"-"`
+	RawEvents string   `json:"-" sql:"type:text"`
+
+	Enabled bool `json:"enabled"`
+
+	WebhookRetryPolicy
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"-"`
+}
+
+// TableName returns the database table name for the WebhookSubscription model.
+func (WebhookSubscription) TableName() string {
+	return tableName("webhook_subscriptions")
+}
+
+// BeforeSave database callback.
+func (s *WebhookSubscription) BeforeSave() error {
+	data, err := json.Marshal(s.Events)
+	if err == nil {
+		s.RawEvents = string(data)
+	}
+	return err
+}
+
+// AfterFind database callback.
+func (s *WebhookSubscription) AfterFind() error {
+	if s.RawEvents != "" {
+		return json.Unmarshal([]byte(s.RawEvents), &s.Events)
+	}
+	return nil
+}
+
+// Subscribes checks if the subscription wants to receive the event.
+func (s *WebhookSubscription) Subscribes(event string) bool {
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchingWebhookSubscriptions finds the enabled subscriptions of an instance
+// that subscribe to the event.
+func MatchingWebhookSubscriptions(db *gorm.DB, instanceID, event string) ([]WebhookSubscription, error) {
+	subscriptions := []WebhookSubscription{}
+	if result := db.Where("instance_id = ? AND enabled = ?", instanceID, true).Find(&subscriptions); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error loading webhook subscriptions")
+	}
+
+	matching := []WebhookSubscription{}
+	for _, s := range subscriptions {
+		if s.Subscribes(event) {
+			matching = append(matching, s)
+		}
+	}
+	return matching, nil
+}
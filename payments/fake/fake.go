@@ -0,0 +1,280 @@
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pkg/errors"
+)
+
+// ProviderName is the string identifier for the fake payment provider.
+const ProviderName = "fake"
+
+// Magic values of fake_token, which decide how a payment behaves.
+const (
+	// TokenSuccess charges and refunds successfully.
+	TokenSuccess = "tok_success"
+	// TokenDecline fails to charge like a declined card.
+	TokenDecline = "tok_decline"
+	// TokenNetworkError fails to charge like a provider that can't be
+	// reached.
+	TokenNetworkError = "tok_network_error"
+	// TokenSlow charges successfully after the configured delay.
+	TokenSlow = "tok_slow"
+	// TokenPartialRefundFailure charges successfully, but fails to refund
+	// anything but the full remaining amount.
+	TokenPartialRefundFailure = "tok_partial_refund_failure"
+)
+
+// Statuses of charges and refunds.
+const (
+	StatusSucceeded    = "succeeded"
+	StatusDeclined     = "declined"
+	StatusNetworkError = "network_error"
+	StatusFailed       = "failed"
+)
+
+// defaultSlowResponse is how long TokenSlow takes without a configured delay.
+const defaultSlowResponse = 3 * time.Second
+
+// Config contains the configuration of the fake payment provider.
+type Config struct {
+	// Enabled must be set, so the fake provider can't be enabled in
+	// production by accident.
+	Enabled bool `mapstructure:"enabled" json:"enabled"`
+	// SlowResponseMS is how many milliseconds TokenSlow takes.
+	SlowResponseMS int `mapstructure:"slow_response_ms" json:"slow_response_ms"`
+}
+
+// Charge is a payment with the fake provider.
+type Charge struct {
+	ID       string `json:"id"`
+	Token    string `json:"token"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+	Refunded uint64 `json:"refunded"`
+}
+
+// Refund is a refund with the fake provider.
+type Refund struct {
+	ID       string `json:"id"`
+	ChargeID string `json:"charge_id"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+}
+
+// Preauthorization is a preauthorized payment with the fake provider.
+type Preauthorization struct {
+	ID          string `json:"id"`
+	Amount      uint64 `json:"amount"`
+	Currency    string `json:"currency"`
+	Description string `json:"description"`
+}
+
+// State is everything the fake provider did since it was last reset,
+// including the attempts that failed.
+type State struct {
+	Charges           []Charge           `json:"charges"`
+	Refunds           []Refund           `json:"refunds"`
+	Preauthorizations []Preauthorization `json:"preauthorizations"`
+}
+
+// store holds the state of the fake providers by instance ID. Providers are
+// created with the configuration of every request, so it can't belong to one
+// of them.
+var store = struct {
+	sync.Mutex
+	states map[string]*State
+}{states: map[string]*State{}}
+
+// instanceState returns the state of an instance. The store must be locked.
+func instanceState(instanceID string) *State {
+	state := store.states[instanceID]
+	if state == nil {
+		state = &State{}
+		store.states[instanceID] = state
+	}
+	return state
+}
+
+func init() {
+	payments.Register(ProviderName, func(raw json.RawMessage) (payments.Provider, error) {
+		config := Config{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error parsing fake payment configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
+type fakePaymentProvider struct {
+	slowResponse time.Duration
+}
+
+type fakeBodyParams struct {
+	FakeToken string `json:"fake_token"`
+}
+
+// NewPaymentProvider creates a fake payment provider for tests and staging,
+// which behaves according to the magic fake_token of a payment.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	if !config.Enabled {
+		return nil, errors.New("The fake payment provider must be enabled explicitly with \"enabled\": true")
+	}
+	slowResponse := defaultSlowResponse
+	if config.SlowResponseMS > 0 {
+		slowResponse = time.Duration(config.SlowResponseMS) * time.Millisecond
+	}
+	return &fakePaymentProvider{slowResponse: slowResponse}, nil
+}
+
+// CurrentState returns a copy of the state of the fake provider of an
+// instance.
+func CurrentState(instanceID string) State {
+	store.Lock()
+	defer store.Unlock()
+	state := instanceState(instanceID)
+	return State{
+		Charges:           append([]Charge{}, state.Charges...),
+		Refunds:           append([]Refund{}, state.Refunds...),
+		Preauthorizations: append([]Preauthorization{}, state.Preauthorizations...),
+	}
+}
+
+// Reset forgets everything the fake provider of an instance did, so IDs
+// start over.
+func Reset(instanceID string) {
+	store.Lock()
+	defer store.Unlock()
+	delete(store.states, instanceID)
+}
+
+func (f *fakePaymentProvider) Name() string {
+	return ProviderName
+}
+
+func (f *fakePaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	bp := &fakeBodyParams{}
+	if err := json.NewDecoder(bod).Decode(bp); err != nil {
+		return nil, err
+	}
+	switch bp.FakeToken {
+	case TokenSuccess, TokenDecline, TokenNetworkError, TokenSlow, TokenPartialRefundFailure:
+	case "":
+		return nil, errors.New("The fake provider requires a fake_token for creating a payment")
+	default:
+		return nil, fmt.Errorf("Unknown fake_token '%s'", bp.FakeToken)
+	}
+
+	instanceID := gcontext.GetInstanceID(ctx)
+	return func(amount uint64, currency string) (string, error) {
+		return f.charge(instanceID, bp.FakeToken, amount, currency)
+	}, nil
+}
+
+func (f *fakePaymentProvider) charge(instanceID, token string, amount uint64, currency string) (string, error) {
+	if token == TokenSlow {
+		time.Sleep(f.slowResponse)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	state := instanceState(instanceID)
+	ch := Charge{
+		ID:       fmt.Sprintf("fake_ch_%d", len(state.Charges)+1),
+		Token:    token,
+		Amount:   amount,
+		Currency: currency,
+		Status:   StatusSucceeded,
+	}
+	var err error
+	switch token {
+	case TokenDecline:
+		ch.Status = StatusDeclined
+		err = errors.New("Your card was declined")
+	case TokenNetworkError:
+		ch.Status = StatusNetworkError
+		err = errors.New("Error communicating with the fake provider: connection reset by peer")
+	}
+	state.Charges = append(state.Charges, ch)
+	if err != nil {
+		return "", err
+	}
+	return ch.ID, nil
+}
+
+func (f *fakePaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
+	instanceID := gcontext.GetInstanceID(ctx)
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		return f.refund(instanceID, transactionID, amount, currency)
+	}, nil
+}
+
+func (f *fakePaymentProvider) refund(instanceID, transactionID string, amount uint64, currency string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+	state := instanceState(instanceID)
+	var ch *Charge
+	for i := range state.Charges {
+		if state.Charges[i].ID == transactionID && state.Charges[i].Status == StatusSucceeded {
+			ch = &state.Charges[i]
+		}
+	}
+	if ch == nil {
+		return "", fmt.Errorf("No such charge: %s", transactionID)
+	}
+
+	refund := Refund{
+		ID:       fmt.Sprintf("fake_re_%d", len(state.Refunds)+1),
+		ChargeID: ch.ID,
+		Amount:   amount,
+		Currency: currency,
+		Status:   StatusSucceeded,
+	}
+	var err error
+	switch {
+	case amount > ch.Amount-ch.Refunded:
+		err = fmt.Errorf("Refund of %d is greater than the unrefunded amount %d", amount, ch.Amount-ch.Refunded)
+	case ch.Token == TokenPartialRefundFailure && amount < ch.Amount-ch.Refunded:
+		err = errors.New("Partial refunds of this charge fail")
+	}
+	if err != nil {
+		refund.Status = StatusFailed
+	} else {
+		ch.Refunded += amount
+	}
+	state.Refunds = append(state.Refunds, refund)
+	if err != nil {
+		return "", err
+	}
+	return refund.ID, nil
+}
+
+func (f *fakePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
+	instanceID := gcontext.GetInstanceID(ctx)
+	return func(amount uint64, currency string, description string) (*payments.PreauthorizationResult, error) {
+		store.Lock()
+		defer store.Unlock()
+		state := instanceState(instanceID)
+		pa := Preauthorization{
+			ID:          fmt.Sprintf("fake_pa_%d", len(state.Preauthorizations)+1),
+			Amount:      amount,
+			Currency:    currency,
+			Description: description,
+		}
+		state.Preauthorizations = append(state.Preauthorizations, pa)
+		return &payments.PreauthorizationResult{ID: pa.ID}, nil
+	}, nil
+}
@@ -0,0 +1,89 @@
+package manual
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"text/template"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/pkg/errors"
+)
+
+// defaultInstructions are shown when the configuration has none.
+const defaultInstructions = `Please transfer {{ .Amount }} {{ .Currency }} and mention {{ .Reference }} as the reference of the transfer.`
+
+type manualPaymentProvider struct {
+	instructions *template.Template
+}
+
+// Config contains the configuration of the manual payment provider.
+type Config struct {
+	// Instructions is a template of the instructions to pay, with the
+	// .Amount, .Currency and .Reference of the payment.
+	Instructions string `mapstructure:"instructions" json:"instructions"`
+}
+
+type instructionsData struct {
+	Amount    string
+	Currency  string
+	Reference string
+}
+
+func init() {
+	payments.Register(payments.ManualProvider, func(raw json.RawMessage) (payments.Provider, error) {
+		config := Config{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error parsing manual payment configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
+// NewPaymentProvider creates a payment provider for payments made outside of
+// gocommerce, like bank transfers, using the provided configuration.
+func NewPaymentProvider(config Config) (payments.Provider, error) {
+	instructions := config.Instructions
+	if instructions == "" {
+		instructions = defaultInstructions
+	}
+	tmpl, err := template.New("instructions").Parse(instructions)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing manual payment instructions")
+	}
+	return &manualPaymentProvider{instructions: tmpl}, nil
+}
+
+func (m *manualPaymentProvider) Name() string {
+	return payments.ManualProvider
+}
+
+func (m *manualPaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
+	return nil, errors.New("Manual payments are confirmed by an admin instead of charged")
+}
+
+// NewRefunder only records refunds, the money is sent back by hand.
+func (m *manualPaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
+	return func(transactionID string, amount uint64, currency string) (string, error) {
+		return "", nil
+	}, nil
+}
+
+func (m *manualPaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
+	return nil, errors.New("Manual payments do not require preauthorization")
+}
+
+func (m *manualPaymentProvider) Instructions(amount uint64, currency, reference string) (string, error) {
+	data := &instructionsData{
+		Amount:    calculator.FormatNumber(amount, currency),
+		Currency:  currency,
+		Reference: reference,
+	}
+	buf := &bytes.Buffer{}
+	if err := m.instructions.Execute(buf, data); err != nil {
+		return "", errors.Wrap(err, "Error rendering manual payment instructions")
+	}
+	return buf.String(), nil
+}
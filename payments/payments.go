@@ -10,6 +10,9 @@ const (
 	StripeProvider = "stripe"
 	// PayPalProvider is the string identifier for the PayPal payment provider.
 	PayPalProvider = "paypal"
+	// ManualProvider is the string identifier for payments made outside of
+	// gocommerce, like bank transfers.
+	ManualProvider = "manual"
 )
 
 // Provider represents a payment provider that can optionally charge, refund,
@@ -21,6 +24,44 @@ type Provider interface {
 	NewPreauthorizer(ctx context.Context, r *http.Request) (Preauthorizer, error)
 }
 
+// SavedMethodProvider is implemented by providers that can save the payment
+// methods of customers, and charge them later without the customer, like for
+// the renewal of a subscription.
+type SavedMethodProvider interface {
+	SaveMethod(ctx context.Context, r *http.Request, customerID, email string) (*SavedMethod, error)
+	RemoveMethod(ctx context.Context, customerID, methodID string) error
+	NewSavedMethodCharger(ctx context.Context, customerID, methodID string) (Charger, error)
+}
+
+// SavedMethod is a payment method saved with a provider. It only references
+// the method and the customer it belongs to, and describes it for display.
+type SavedMethod struct {
+	// CustomerID is the customer of the provider. Methods saved for a
+	// customer that doesn't exist with the provider yet get a new one.
+	CustomerID string
+	MethodID   string
+
+	Brand    string
+	Last4    string
+	ExpMonth uint
+	ExpYear  uint
+}
+
+// OfflineProvider is implemented by providers whose payments are made
+// outside of gocommerce, like bank transfers. They aren't charged, but stay
+// pending until an admin confirms them.
+type OfflineProvider interface {
+	Instructions(amount uint64, currency, reference string) (string, error)
+}
+
+// PreauthorizedProvider is implemented by providers that pay for orders with
+// payments preauthorized for them, like approved PayPal orders. It returns
+// the ID of the preauthorized payment a request pays with, or an empty
+// string if it pays without one.
+type PreauthorizedProvider interface {
+	PreauthorizedPaymentID(r *http.Request) (string, error)
+}
+
 // Charger wraps the Charge method which creates new payments with the provider.
 type Charger func(amount uint64, currency string) (string, error)
 
@@ -31,7 +72,53 @@ type Refunder func(transactionID string, amount uint64, currency string) (string
 // with the provider.
 type Preauthorizer func(amount uint64, currency string, description string) (*PreauthorizationResult, error)
 
+// Breakdown itemizes the amount of a payment, for providers that show
+// customers what they pay for.
+type Breakdown struct {
+	// Reference identifies what is paid for, like the ID of an order.
+	Reference string
+
+	ItemTotal uint64
+	Tax       uint64
+	Shipping  uint64
+	Discount  uint64
+
+	Items []BreakdownItem
+}
+
+// BreakdownItem is an item of a payment. Its amount and tax are per unit.
+type BreakdownItem struct {
+	Name       string
+	SKU        string
+	Quantity   uint64
+	UnitAmount uint64
+	Tax        uint64
+}
+
+// Total is the amount the breakdown adds up to.
+func (b *Breakdown) Total() uint64 {
+	total := b.ItemTotal + b.Tax + b.Shipping
+	if b.Discount > total {
+		return 0
+	}
+	return total - b.Discount
+}
+
+// ItemsAddUp reports whether the items add up to the item total and tax of
+// the breakdown, which providers may require to list them.
+func (b *Breakdown) ItemsAddUp() bool {
+	var amount, tax uint64
+	for _, item := range b.Items {
+		amount += item.UnitAmount * item.Quantity
+		tax += item.Tax * item.Quantity
+	}
+	return len(b.Items) > 0 && amount == b.ItemTotal && tax == b.Tax
+}
+
 // PreauthorizationResult contains the data returned from a Preauthorization.
 type PreauthorizationResult struct {
 	ID string `json:"id"`
+	// ClientSecret lets the client confirm the payment with the provider,
+	// like the client secret of a Stripe PaymentIntent.
+	ClientSecret string `json:"client_secret,omitempty"`
 }
@@ -0,0 +1,139 @@
+package paypal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Base URLs of the PayPal REST API.
+const (
+	apiBaseLive    = "https://api-m.paypal.com"
+	apiBaseSandbox = "https://api-m.sandbox.paypal.com"
+)
+
+// client calls the PayPal REST API with an OAuth access token, which it
+// renews before it expires.
+type client struct {
+	clientID string
+	secret   string
+	apiBase  string
+	http     *http.Client
+
+	tokenMutex  sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type apiError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+	Details []struct {
+		Issue       string `json:"issue"`
+		Description string `json:"description"`
+	} `json:"details"`
+}
+
+func (e *apiError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = e.Name
+	}
+	for _, detail := range e.Details {
+		msg += fmt.Sprintf(" (%s: %s)", detail.Issue, detail.Description)
+	}
+	return msg
+}
+
+func newClient(clientID, secret, apiBase string) *client {
+	return &client{
+		clientID: clientID,
+		secret:   secret,
+		apiBase:  strings.TrimSuffix(apiBase, "/"),
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *client) accessToken() (string, error) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	if c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err := http.NewRequest(http.MethodPost, c.apiBase+"/v1/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(c.clientID, c.secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	token := &tokenResponse{}
+	if err := c.do(req, token); err != nil {
+		return "", err
+	}
+
+	c.token = token.AccessToken
+	// renew the token a minute early, so it doesn't expire during a request
+	c.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// send calls the API with a JSON payload, and reads the JSON response into v.
+func (c *client) send(method, path string, payload, v interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return errors.Wrap(err, "Error authorizing with PayPal")
+	}
+
+	body := &bytes.Buffer{}
+	if payload != nil {
+		if err := json.NewEncoder(body).Encode(payload); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.apiBase+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(req, v)
+}
+
+func (c *client) do(req *http.Request, v interface{}) error {
+	rsp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Error calling PayPal")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= http.StatusBadRequest {
+		apiErr := &apiError{}
+		if err := json.NewDecoder(rsp.Body).Decode(apiErr); err != nil || (apiErr.Name == "" && apiErr.Message == "") {
+			return fmt.Errorf("PayPal responded with status %d", rsp.StatusCode)
+		}
+		return apiErr
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "Error reading PayPal response")
+	}
+	return nil
+}
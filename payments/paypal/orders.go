@@ -0,0 +1,72 @@
+package paypal
+
+// Types of the PayPal Orders v2 API.
+
+// Statuses of PayPal orders and captures.
+const (
+	orderApproved    = "APPROVED"
+	captureCompleted = "COMPLETED"
+)
+
+type money struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type amountBreakdown struct {
+	ItemTotal *money `json:"item_total,omitempty"`
+	TaxTotal  *money `json:"tax_total,omitempty"`
+	Shipping  *money `json:"shipping,omitempty"`
+	Discount  *money `json:"discount,omitempty"`
+}
+
+type orderAmount struct {
+	money
+	Breakdown *amountBreakdown `json:"breakdown,omitempty"`
+}
+
+type item struct {
+	Name       string `json:"name"`
+	SKU        string `json:"sku,omitempty"`
+	Quantity   string `json:"quantity"`
+	UnitAmount money  `json:"unit_amount"`
+	Tax        *money `json:"tax,omitempty"`
+}
+
+type capture struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+type purchaseUnit struct {
+	ReferenceID string      `json:"reference_id,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Amount      orderAmount `json:"amount"`
+	Items       []item      `json:"items,omitempty"`
+	Payments    *struct {
+		Captures []capture `json:"captures"`
+	} `json:"payments,omitempty"`
+}
+
+type applicationContext struct {
+	ShippingPreference string `json:"shipping_preference,omitempty"`
+	ReturnURL          string `json:"return_url,omitempty"`
+	CancelURL          string `json:"cancel_url,omitempty"`
+}
+
+type order struct {
+	ID                 string              `json:"id,omitempty"`
+	Intent             string              `json:"intent,omitempty"`
+	Status             string              `json:"status,omitempty"`
+	PurchaseUnits      []purchaseUnit      `json:"purchase_units"`
+	ApplicationContext *applicationContext `json:"application_context,omitempty"`
+}
+
+type refundRequest struct {
+	Amount money `json:"amount"`
+}
+
+type refund struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
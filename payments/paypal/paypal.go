@@ -4,26 +4,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
-	"sync"
 
-	paypalsdk "github.com/logpacker/PayPal-Go-SDK"
+	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/payments"
 	"github.com/pkg/errors"
 )
 
+// maxTextLength is the longest name or description PayPal accepts.
+const maxTextLength = 127
+
 type paypalPaymentProvider struct {
-	client       *paypalsdk.Client
-	profile      *paypalsdk.WebProfile
-	profileMutex sync.Mutex
+	client *client
 }
 
 type paypalBodyParams struct {
-	PaypalID     string `json:"paypal_payment_id"`
-	PaypalUserID string `json:"paypal_user_id"`
+	PaypalOrderID string `json:"paypal_order_id"`
 }
 
 // Config contains PayPal-specific configuration for payment providers.
@@ -33,37 +34,38 @@ type Config struct {
 	Env      string `mapstructure:"env" json:"env"`
 }
 
+func init() {
+	payments.Register(payments.PayPalProvider, func(raw json.RawMessage) (payments.Provider, error) {
+		config := Config{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error parsing PayPal configuration")
+		}
+		return NewPaymentProvider(config)
+	})
+}
+
 // NewPaymentProvider creates a new PayPal payment provider using the provided configuration.
 func NewPaymentProvider(config Config) (payments.Provider, error) {
-	var paypal *paypalsdk.Client
 	if config.ClientID == "" || config.Secret == "" {
 		return nil, errors.New("missing PayPal client_id and/or secret")
 	}
 	var ppEnv string
 	if config.Env == "production" {
-		ppEnv = paypalsdk.APIBaseLive
+		ppEnv = apiBaseLive
 	} else if config.Env == "sandbox" {
-		ppEnv = paypalsdk.APIBaseSandBox
+		ppEnv = apiBaseSandbox
 	} else {
 		// used for testing
 		ppEnv = config.Env
 	}
 
-	paypal, err := paypalsdk.NewClient(
-		config.ClientID,
-		config.Secret,
-		ppEnv,
-	)
-	if err != nil {
-		return nil, errors.Wrap(err, "Error configuring paypal")
-	}
-	_, err = paypal.GetAccessToken()
-	if err != nil {
+	c := newClient(config.ClientID, config.Secret, ppEnv)
+	if _, err := c.accessToken(); err != nil {
 		return nil, errors.Wrap(err, "Error authorizing with paypal")
 	}
 
 	return &paypalPaymentProvider{
-		client: paypal,
+		client: c,
 	}, nil
 }
 
@@ -72,49 +74,72 @@ func (p *paypalPaymentProvider) Name() string {
 }
 
 func (p *paypalPaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
-	var bp paypalBodyParams
-	bod, err := r.GetBody()
-	if err != nil {
-		return nil, err
-	}
-	err = json.NewDecoder(bod).Decode(&bp)
+	bp, err := readBodyParams(r)
 	if err != nil {
 		return nil, err
 	}
-	if bp.PaypalID == "" || bp.PaypalUserID == "" {
-		return nil, errors.New("Payments requires a paypal_payment_id and paypal_user_id pair")
+	if bp.PaypalOrderID == "" {
+		return nil, errors.New("Payments require the paypal_order_id the customer approved")
 	}
 
 	return func(amount uint64, currency string) (string, error) {
-		return p.charge(bp.PaypalID, bp.PaypalUserID, amount, currency)
+		return p.charge(bp.PaypalOrderID, amount, currency)
 	}, nil
 }
 
-func (p *paypalPaymentProvider) charge(paymentID string, userID string, amount uint64, currency string) (string, error) {
-	payment, err := p.client.GetPayment(paymentID)
+// PreauthorizedPaymentID returns the PayPal order a request pays with.
+func (p *paypalPaymentProvider) PreauthorizedPaymentID(r *http.Request) (string, error) {
+	bp, err := readBodyParams(r)
 	if err != nil {
 		return "", err
 	}
-	if len(payment.Transactions) != 1 {
-		return "", fmt.Errorf("The paypal payment must have exactly 1 transaction, had %v", len(payment.Transactions))
-	}
+	return bp.PaypalOrderID, nil
+}
 
-	if payment.Transactions[0].Amount == nil {
-		return "", fmt.Errorf("No amount in this transaction %v", payment.Transactions[0])
+func readBodyParams(r *http.Request) (*paypalBodyParams, error) {
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
 	}
+	bp := &paypalBodyParams{}
+	if err := json.NewDecoder(bod).Decode(bp); err != nil {
+		return nil, err
+	}
+	return bp, nil
+}
 
-	transactionValue := fmt.Sprintf("%.2f", float64(amount)/100)
+// charge captures a PayPal order the customer approved, and returns the ID
+// of the capture, which refunds refer to.
+func (p *paypalPaymentProvider) charge(orderID string, amount uint64, currency string) (string, error) {
+	path := "/v2/checkout/orders/" + url.PathEscape(orderID)
+	ppOrder := &order{}
+	if err := p.client.send(http.MethodGet, path, nil, ppOrder); err != nil {
+		return "", err
+	}
+	if len(ppOrder.PurchaseUnits) != 1 {
+		return "", fmt.Errorf("The paypal order must have exactly 1 purchase unit, had %v", len(ppOrder.PurchaseUnits))
+	}
 
-	if transactionValue != payment.Transactions[0].Amount.Total || payment.Transactions[0].Amount.Currency != currency {
-		return "", fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v", payment.Transactions[0].Amount)
+	total := ppOrder.PurchaseUnits[0].Amount
+	if total.Value != formatAmount(amount, currency) || total.CurrencyCode != currency {
+		return "", fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v %v", total.Value, total.CurrencyCode)
+	}
+	if ppOrder.Status != orderApproved {
+		return "", fmt.Errorf("The paypal order can't be captured in status %s", ppOrder.Status)
 	}
 
-	executeResult, err := p.client.ExecuteApprovedPayment(paymentID, userID)
-	if err != nil {
+	captured := &order{}
+	if err := p.client.send(http.MethodPost, path+"/capture", struct{}{}, captured); err != nil {
 		return "", err
 	}
-
-	return executeResult.ID, nil
+	if len(captured.PurchaseUnits) == 0 || captured.PurchaseUnits[0].Payments == nil || len(captured.PurchaseUnits[0].Payments.Captures) == 0 {
+		return "", errors.New("The paypal order was captured without a payment")
+	}
+	c := captured.PurchaseUnits[0].Payments.Captures[0]
+	if c.Status != captureCompleted {
+		return "", fmt.Errorf("The paypal capture %s is %s", c.ID, c.Status)
+	}
+	return c.ID, nil
 }
 
 func (p *paypalPaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
@@ -122,12 +147,9 @@ func (p *paypalPaymentProvider) NewRefunder(ctx context.Context, r *http.Request
 }
 
 func (p *paypalPaymentProvider) refund(transactionID string, amount uint64, currency string) (string, error) {
-	amt := &paypalsdk.Amount{
-		Total:    formatAmount(amount),
-		Currency: currency,
-	}
-	ref, err := p.client.RefundSale(transactionID, amt)
-	if err != nil {
+	ref := &refund{}
+	req := &refundRequest{Amount: newMoney(amount, currency)}
+	if err := p.client.send(http.MethodPost, "/v2/payments/captures/"+url.PathEscape(transactionID)+"/refund", req, ref); err != nil {
 		return "", err
 	}
 	return ref.ID, nil
@@ -135,81 +157,84 @@ func (p *paypalPaymentProvider) refund(transactionID string, amount uint64, curr
 
 func (p *paypalPaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
 	config := gcontext.GetConfig(ctx)
+	breakdown := gcontext.GetPaymentBreakdown(ctx)
 	return func(amount uint64, currency string, description string) (*payments.PreauthorizationResult, error) {
-		return p.preauthorize(config, amount, currency, description)
+		return p.preauthorize(config, breakdown, amount, currency, description)
 	}, nil
 }
 
-func (p *paypalPaymentProvider) preauthorize(config *conf.Configuration, amount uint64, currency string, description string) (*payments.PreauthorizationResult, error) {
-	profile, err := p.getExperience()
-	if err != nil {
-		return nil, errors.Wrap(err, "error creating paypal experience")
+// preauthorize creates a PayPal order for the customer to approve. Payments
+// for an order are itemized, as far as PayPal accepts the breakdown.
+func (p *paypalPaymentProvider) preauthorize(config *conf.Configuration, breakdown *payments.Breakdown, amount uint64, currency string, description string) (*payments.PreauthorizationResult, error) {
+	unit := purchaseUnit{
+		Description: truncate(description),
+		Amount:      orderAmount{money: newMoney(amount, currency)},
+	}
+	// PayPal rejects amounts that don't add up, so they must match the
+	// amount of the payment, which was verified against the order
+	if breakdown != nil && breakdown.Total() == amount {
+		unit.ReferenceID = breakdown.Reference
+		itemTotal := newMoney(breakdown.ItemTotal, currency)
+		taxTotal := newMoney(breakdown.Tax, currency)
+		unit.Amount.Breakdown = &amountBreakdown{ItemTotal: &itemTotal, TaxTotal: &taxTotal}
+		if breakdown.Shipping > 0 {
+			shipping := newMoney(breakdown.Shipping, currency)
+			unit.Amount.Breakdown.Shipping = &shipping
+		}
+		if breakdown.Discount > 0 {
+			discount := newMoney(breakdown.Discount, currency)
+			unit.Amount.Breakdown.Discount = &discount
+		}
+		if breakdown.ItemsAddUp() {
+			for _, bi := range breakdown.Items {
+				tax := newMoney(bi.Tax, currency)
+				it := item{
+					Name:       truncate(bi.Name),
+					SKU:        bi.SKU,
+					Quantity:   strconv.FormatUint(bi.Quantity, 10),
+					UnitAmount: newMoney(bi.UnitAmount, currency),
+					Tax:        &tax,
+				}
+				if it.Name == "" {
+					it.Name = bi.SKU
+				}
+				unit.Items = append(unit.Items, it)
+			}
+		}
 	}
 
-	redirectURI := config.SiteURL + "/gocommerce/paypal"
-	cancelURI := config.SiteURL + "/gocommerce/paypal/cancel"
-	paymentResult, err := p.client.CreatePayment(paypalsdk.Payment{
-		Intent: "sale",
-		Payer: &paypalsdk.Payer{
-			PaymentMethod: "paypal",
-		},
-		ExperienceProfileID: profile.ID,
-		Transactions: []paypalsdk.Transaction{paypalsdk.Transaction{
-			Amount: &paypalsdk.Amount{
-				Total:    formatAmount(amount),
-				Currency: currency,
-			},
-			Description: description,
-		}},
-		RedirectURLs: &paypalsdk.RedirectURLs{
-			ReturnURL: redirectURI,
-			CancelURL: cancelURI,
+	created := &order{}
+	err := p.client.send(http.MethodPost, "/v2/checkout/orders", &order{
+		Intent:        "CAPTURE",
+		PurchaseUnits: []purchaseUnit{unit},
+		ApplicationContext: &applicationContext{
+			ShippingPreference: "NO_SHIPPING",
+			ReturnURL:          config.SiteURL + "/gocommerce/paypal",
+			CancelURL:          config.SiteURL + "/gocommerce/paypal/cancel",
 		},
-	})
-
+	}, created)
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating paypal payment")
+		return nil, errors.Wrap(err, "error creating paypal order")
 	}
 	return &payments.PreauthorizationResult{
-		ID: paymentResult.ID,
+		ID: created.ID,
 	}, nil
 }
 
-func (p *paypalPaymentProvider) getExperience() (*paypalsdk.WebProfile, error) {
-	p.profileMutex.Lock()
-	defer p.profileMutex.Unlock()
-
-	if p.profile != nil {
-		return p.profile, nil
-	}
-
-	experiences, err := p.client.GetWebProfiles()
-	if err != nil {
-		return nil, errors.Wrap(err, "failed getting web profiles")
-	}
-
-	for _, profile := range experiences {
-		if profile.Name == "gocommerce" {
-			p.profile = &profile
-			return p.profile, nil
-		}
-	}
-
-	profile, err := p.client.CreateWebProfile(paypalsdk.WebProfile{
-		Name: "gocommerce",
-		InputFields: paypalsdk.InputFields{
-			NoShipping: 1,
-		},
-	})
+func newMoney(amount uint64, currency string) money {
+	return money{CurrencyCode: currency, Value: formatAmount(amount, currency)}
+}
 
-	if err != nil {
-		return nil, errors.Wrap(err, "failed creating web profile")
+func truncate(text string) string {
+	if runes := []rune(text); len(runes) > maxTextLength {
+		return string(runes[:maxTextLength])
 	}
-
-	p.profile = profile
-	return profile, nil
+	return text
 }
 
-func formatAmount(amount uint64) string {
-	return strconv.FormatFloat(float64(amount)/100, 'f', 2, 64)
+// formatAmount formats an amount in the lowest unit of the currency with the
+// decimals PayPal expects: 1050 USD is "10.50" and 1000 JPY is "1000".
+func formatAmount(amount uint64, currency string) string {
+	exp := calculator.CurrencyExponent(currency)
+	return strconv.FormatFloat(float64(amount)/math.Pow10(exp), 'f', exp, 64)
 }
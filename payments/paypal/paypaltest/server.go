@@ -0,0 +1,354 @@
+// Package paypaltest provides a stand-in for the PayPal REST API, so the
+// PayPal payment provider can be tested offline.
+package paypaltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// accessToken is the only token the server issues.
+const accessToken = "A21AAFEpH4PsADK7qSS7pSRsgzfENtu-Q1ysgEDVDESseMHBYXVJYE8ovjj68elIDy8nF26AwPhfXTIeWAZHSLIsQkSYz9ifg"
+
+// Money is an amount of the Orders v2 API.
+type Money struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+// Breakdown itemizes the amount of a purchase unit.
+type Breakdown struct {
+	ItemTotal *Money `json:"item_total,omitempty"`
+	TaxTotal  *Money `json:"tax_total,omitempty"`
+	Shipping  *Money `json:"shipping,omitempty"`
+	Discount  *Money `json:"discount,omitempty"`
+}
+
+// Amount is the amount of a purchase unit.
+type Amount struct {
+	Money
+	Breakdown *Breakdown `json:"breakdown,omitempty"`
+}
+
+// Item is an item of a purchase unit.
+type Item struct {
+	Name       string `json:"name"`
+	SKU        string `json:"sku,omitempty"`
+	Quantity   string `json:"quantity"`
+	UnitAmount Money  `json:"unit_amount"`
+	Tax        *Money `json:"tax,omitempty"`
+}
+
+// Capture is a payment of an order.
+type Capture struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Amount   Money  `json:"amount"`
+	Refunded uint64 `json:"-"`
+}
+
+// PurchaseUnit is what an order pays for.
+type PurchaseUnit struct {
+	ReferenceID string `json:"reference_id,omitempty"`
+	Description string `json:"description,omitempty"`
+	Amount      Amount `json:"amount"`
+	Items       []Item `json:"items,omitempty"`
+	Payments    *struct {
+		Captures []*Capture `json:"captures"`
+	} `json:"payments,omitempty"`
+}
+
+// Order is a PayPal order.
+type Order struct {
+	ID            string         `json:"id"`
+	Intent        string         `json:"intent"`
+	Status        string         `json:"status"`
+	PurchaseUnits []PurchaseUnit `json:"purchase_units"`
+}
+
+// Refund is a refund of a capture.
+type Refund struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	CaptureID string `json:"-"`
+	Amount    Money  `json:"amount"`
+}
+
+// Server stands in for the PayPal API. Like PayPal, it rejects orders whose
+// amounts don't add up, and orders that are captured before the customer
+// approved them.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	logins   int
+	orders   map[string]*Order
+	captures map[string]*Capture
+	refunds  []*Refund
+	ids      int
+}
+
+// NewServer starts a PayPal stand-in. It must be closed after use.
+func NewServer() *Server {
+	s := &Server{orders: map[string]*Order{}, captures: map[string]*Capture{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Logins is how many access tokens were requested.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// Order returns the order with an ID, or nil.
+func (s *Server) Order(id string) *Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.orders[id]
+}
+
+// AddOrder creates an order for an amount, like "10.00", which the customer
+// already approved.
+func (s *Server) AddOrder(value, currency string) *Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := &Order{
+		ID:     s.newID("ORDER"),
+		Intent: "CAPTURE",
+		Status: "APPROVED",
+		PurchaseUnits: []PurchaseUnit{{
+			Amount: Amount{Money: Money{CurrencyCode: currency, Value: value}},
+		}},
+	}
+	s.orders[o.ID] = o
+	return o
+}
+
+// AddCapture creates a captured order for an amount, and returns its
+// capture.
+func (s *Server) AddCapture(value, currency string) *Capture {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &Capture{ID: s.newID("CAPTURE"), Status: "COMPLETED", Amount: Money{CurrencyCode: currency, Value: value}}
+	s.captures[c.ID] = c
+	return c
+}
+
+// Approve approves an order, like the customer does on PayPal.
+func (s *Server) Approve(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if o := s.orders[id]; o != nil && o.Status == "CREATED" {
+		o.Status = "APPROVED"
+	}
+}
+
+// Refunds returns the refunds that were made.
+func (s *Server) Refunds() []Refund {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refunds := []Refund{}
+	for _, r := range s.refunds {
+		refunds = append(refunds, *r)
+	}
+	return refunds
+}
+
+func (s *Server) newID(prefix string) string {
+	s.ids++
+	return fmt.Sprintf("%s-%d", prefix, s.ids)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/v1/oauth2/token" {
+		if id, secret, ok := r.BasicAuth(); !ok || id == "" || secret == "" {
+			writeError(w, http.StatusUnauthorized, "invalid_client", "")
+			return
+		}
+		s.logins++
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": accessToken, "expires_in": 32400})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+accessToken {
+		writeError(w, http.StatusUnauthorized, "AUTHENTICATION_FAILURE", "")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/checkout/orders":
+		s.createOrder(w, r)
+	case r.Method == http.MethodGet && len(parts) == 4 && parts[1] == "checkout":
+		if o := s.orders[parts[3]]; o != nil {
+			writeJSON(w, http.StatusOK, o)
+		} else {
+			writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "")
+		}
+	case r.Method == http.MethodPost && len(parts) == 5 && parts[1] == "checkout" && parts[4] == "capture":
+		s.captureOrder(w, parts[3])
+	case r.Method == http.MethodPost && len(parts) == 5 && parts[1] == "payments" && parts[4] == "refund":
+		s.refundCapture(w, r, parts[3])
+	default:
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "")
+	}
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	o := &Order{}
+	if err := json.NewDecoder(r.Body).Decode(o); err != nil || len(o.PurchaseUnits) == 0 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "MALFORMED_REQUEST_JSON")
+		return
+	}
+	for _, unit := range o.PurchaseUnits {
+		if issue := checkAmounts(&unit); issue != "" {
+			writeError(w, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY", issue)
+			return
+		}
+	}
+	o.ID = s.newID("ORDER")
+	o.Status = "CREATED"
+	s.orders[o.ID] = o
+	writeJSON(w, http.StatusCreated, o)
+}
+
+// zeroDecimalCurrencies are the currencies PayPal rejects decimals for.
+var zeroDecimalCurrencies = map[string]bool{"HUF": true, "JPY": true, "TWD": true}
+
+// validPrecision checks that an amount has no decimals its currency doesn't.
+func validPrecision(amounts ...*Money) bool {
+	for _, m := range amounts {
+		if m != nil && zeroDecimalCurrencies[m.CurrencyCode] && strings.Contains(m.Value, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// checkAmounts validates the amounts of a purchase unit like PayPal does.
+func checkAmounts(unit *PurchaseUnit) string {
+	if !validPrecision(&unit.Amount.Money) {
+		return "DECIMAL_PRECISION"
+	}
+	for _, item := range unit.Items {
+		if !validPrecision(&item.UnitAmount, item.Tax) {
+			return "DECIMAL_PRECISION"
+		}
+	}
+	b := unit.Amount.Breakdown
+	if b == nil {
+		if len(unit.Items) > 0 {
+			return "ITEM_TOTAL_REQUIRED"
+		}
+		return ""
+	}
+	total := cents(b.ItemTotal) + cents(b.TaxTotal) + cents(b.Shipping) - cents(b.Discount)
+	if !validPrecision(b.ItemTotal, b.TaxTotal, b.Shipping, b.Discount) {
+		return "DECIMAL_PRECISION"
+	}
+	if total != cents(&unit.Amount.Money) {
+		return "AMOUNT_MISMATCH"
+	}
+	if len(unit.Items) == 0 {
+		return ""
+	}
+	var items, taxes int64
+	for _, item := range unit.Items {
+		quantity, err := strconv.ParseInt(item.Quantity, 10, 64)
+		if err != nil || item.Name == "" {
+			return "INVALID_PARAMETER_VALUE"
+		}
+		items += cents(&item.UnitAmount) * quantity
+		taxes += cents(item.Tax) * quantity
+	}
+	if items != cents(b.ItemTotal) {
+		return "ITEM_TOTAL_MISMATCH"
+	}
+	if taxes != cents(b.TaxTotal) {
+		return "TAX_TOTAL_MISMATCH"
+	}
+	return ""
+}
+
+func (s *Server) captureOrder(w http.ResponseWriter, id string) {
+	o := s.orders[id]
+	if o == nil {
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "")
+		return
+	}
+	if o.Status != "APPROVED" {
+		writeError(w, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY", "ORDER_NOT_APPROVED")
+		return
+	}
+	o.Status = "COMPLETED"
+	unit := &o.PurchaseUnits[0]
+	c := &Capture{ID: s.newID("CAPTURE"), Status: "COMPLETED", Amount: unit.Amount.Money}
+	unit.Payments = &struct {
+		Captures []*Capture `json:"captures"`
+	}{Captures: []*Capture{c}}
+	s.captures[c.ID] = c
+	writeJSON(w, http.StatusCreated, o)
+}
+
+func (s *Server) refundCapture(w http.ResponseWriter, r *http.Request, id string) {
+	c := s.captures[id]
+	if c == nil {
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND", "")
+		return
+	}
+	refund := &Refund{}
+	if err := json.NewDecoder(r.Body).Decode(refund); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "MALFORMED_REQUEST_JSON")
+		return
+	}
+	if !validPrecision(&refund.Amount) {
+		writeError(w, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY", "DECIMAL_PRECISION")
+		return
+	}
+	amount := uint64(cents(&refund.Amount))
+	if refund.Amount.CurrencyCode != c.Amount.CurrencyCode || c.Refunded+amount > uint64(cents(&c.Amount)) {
+		writeError(w, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY", "REFUND_AMOUNT_EXCEEDED")
+		return
+	}
+	c.Refunded += amount
+	refund.ID = s.newID("REFUND")
+	refund.Status = "COMPLETED"
+	refund.CaptureID = c.ID
+	s.refunds = append(s.refunds, refund)
+	writeJSON(w, http.StatusCreated, refund)
+}
+
+func cents(m *Money) int64 {
+	if m == nil {
+		return 0
+	}
+	value, err := strconv.ParseFloat(m.Value, 64)
+	if err != nil {
+		return math.MinInt32
+	}
+	return int64(value*100 + 0.5)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, name, issue string) {
+	body := map[string]interface{}{"name": name, "message": strings.Replace(strings.ToLower(name), "_", " ", -1)}
+	if issue != "" {
+		body["details"] = []map[string]string{{"issue": issue, "description": issue}}
+	}
+	writeJSON(w, status, body)
+}
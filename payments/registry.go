@@ -0,0 +1,58 @@
+package payments
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates a provider from its raw JSON configuration block.
+type Factory func(config json.RawMessage) (Provider, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a provider available by name. Provider packages call it
+// from their init function, so importing a package is enough to enable its
+// provider in the configuration. It panics if a name is registered twice.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if factory == nil {
+		panic("payments: Register factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("payments: Register called twice for provider " + name)
+	}
+	factories[name] = factory
+}
+
+// NewProvider creates the provider registered with a name from its
+// configuration.
+func NewProvider(name string, config json.RawMessage) (Provider, error) {
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown payment provider '%s'", name)
+	}
+	if len(config) == 0 {
+		config = json.RawMessage("{}")
+	}
+	return factory(config)
+}
+
+// Providers returns the sorted names of the registered providers.
+func Providers() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
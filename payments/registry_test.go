@@ -0,0 +1,54 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testProvider struct {
+	Greeting string `json:"greeting"`
+}
+
+func (p *testProvider) Name() string { return "registry-test" }
+func (p *testProvider) NewCharger(ctx context.Context, r *http.Request) (Charger, error) {
+	return nil, nil
+}
+func (p *testProvider) NewRefunder(ctx context.Context, r *http.Request) (Refunder, error) {
+	return nil, nil
+}
+func (p *testProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (Preauthorizer, error) {
+	return nil, nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("registry-test", func(config json.RawMessage) (Provider, error) {
+		p := &testProvider{}
+		if err := json.Unmarshal(config, p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	})
+	assert.Contains(t, Providers(), "registry-test")
+
+	p, err := NewProvider("registry-test", json.RawMessage(`{"greeting": "hello"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", p.(*testProvider).Greeting)
+
+	p, err = NewProvider("registry-test", nil)
+	require.NoError(t, err)
+	assert.Empty(t, p.(*testProvider).Greeting)
+
+	_, err = NewProvider("registry-test", json.RawMessage(`[]`))
+	assert.Error(t, err)
+	_, err = NewProvider("unknown", nil)
+	assert.Error(t, err)
+
+	assert.Panics(t, func() {
+		Register("registry-test", func(config json.RawMessage) (Provider, error) { return nil, nil })
+	})
+}
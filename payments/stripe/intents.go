@@ -0,0 +1,151 @@
+package stripe
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultAPIURL is the Stripe API. PaymentIntents are called directly, since
+// the vendored stripe-go predates them.
+const defaultAPIURL = "https://api.stripe.com/v1"
+
+// Statuses of PaymentIntents.
+const (
+	intentRequiresConfirmation = "requires_confirmation"
+	intentRequiresAction       = "requires_action"
+	intentSucceeded            = "succeeded"
+)
+
+type paymentIntent struct {
+	ID           string `json:"id"`
+	Amount       uint64 `json:"amount"`
+	Currency     string `json:"currency"`
+	Status       string `json:"status"`
+	ClientSecret string `json:"client_secret"`
+	LatestCharge string `json:"latest_charge"`
+	Charges      struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	} `json:"charges"`
+}
+
+// chargeID is the charge of a PaymentIntent that succeeded, which refunds
+// use like the charges of tokens. Refunds can't use the ID of the intent.
+func (pi *paymentIntent) chargeID() (string, error) {
+	if pi.LatestCharge != "" {
+		return pi.LatestCharge, nil
+	}
+	if len(pi.Charges.Data) > 0 {
+		return pi.Charges.Data[0].ID, nil
+	}
+	return "", fmt.Errorf("The payment intent %s has no charge", pi.ID)
+}
+
+type apiError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// intentsClient calls the PaymentIntents API of Stripe.
+type intentsClient struct {
+	secretKey string
+	apiURL    string
+	client    *http.Client
+}
+
+func newIntentsClient(secretKey, apiURL string) *intentsClient {
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+	return &intentsClient{
+		secretKey: secretKey,
+		apiURL:    strings.TrimSuffix(apiURL, "/"),
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (c *intentsClient) create(amount uint64, currency, description string) (*paymentIntent, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatUint(amount, 10))
+	form.Set("currency", strings.ToLower(currency))
+	form.Set("payment_method_types[]", "card")
+	if description != "" {
+		form.Set("description", description)
+	}
+	return c.do(http.MethodPost, "/payment_intents", form)
+}
+
+func (c *intentsClient) get(id string) (*paymentIntent, error) {
+	return c.do(http.MethodGet, "/payment_intents/"+url.PathEscape(id), nil)
+}
+
+func (c *intentsClient) confirm(id string) (*paymentIntent, error) {
+	return c.do(http.MethodPost, "/payment_intents/"+url.PathEscape(id)+"/confirm", url.Values{})
+}
+
+// finalize checks that a PaymentIntent the customer confirmed pays the
+// amount, confirms it if the client didn't, and returns its charge.
+func (c *intentsClient) finalize(id string, amount uint64, currency string) (string, error) {
+	intent, err := c.get(id)
+	if err != nil {
+		return "", err
+	}
+	if intent.Amount != amount || !strings.EqualFold(intent.Currency, currency) {
+		return "", fmt.Errorf("The amount of the payment intent doesn't match the amount for the order: %d %s", intent.Amount, intent.Currency)
+	}
+
+	if intent.Status == intentRequiresConfirmation {
+		if intent, err = c.confirm(id); err != nil {
+			return "", err
+		}
+	}
+	switch intent.Status {
+	case intentSucceeded:
+		return intent.chargeID()
+	case intentRequiresAction:
+		return "", errors.New("The payment requires the customer to authenticate with their bank")
+	default:
+		return "", fmt.Errorf("The payment intent can't be completed in status %s", intent.Status)
+	}
+}
+
+func (c *intentsClient) do(method, path string, form url.Values) (*paymentIntent, error) {
+	req, err := http.NewRequest(method, c.apiURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.secretKey, "")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	rsp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error calling Stripe")
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode >= http.StatusBadRequest {
+		apiErr := &apiError{}
+		if err := json.NewDecoder(rsp.Body).Decode(apiErr); err != nil || apiErr.Error.Message == "" {
+			return nil, fmt.Errorf("Stripe responded with status %d", rsp.StatusCode)
+		}
+		return nil, errors.New(apiErr.Error.Message)
+	}
+	intent := &paymentIntent{}
+	if err := json.NewDecoder(rsp.Body).Decode(intent); err != nil {
+		return nil, errors.Wrap(err, "Error reading Stripe response")
+	}
+	return intent, nil
+}
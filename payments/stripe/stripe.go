@@ -6,6 +6,7 @@ import (
 
 	"encoding/json"
 
+	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/payments"
 	"github.com/pkg/errors"
 	stripe "github.com/stripe/stripe-go"
@@ -13,16 +14,31 @@ import (
 )
 
 type stripePaymentProvider struct {
-	client *client.API
+	client  *client.API
+	intents *intentsClient
 }
 
 type stripeBodyParams struct {
-	StripeToken string `json:"stripe_token"`
+	StripeToken     string `json:"stripe_token"`
+	PaymentIntentID string `json:"stripe_payment_intent_id"`
 }
 
 // Config contains the Stripe-specific configuration for payment providers.
 type Config struct {
 	SecretKey string `mapstructure:"secret_key" json:"secret_key"`
+	// APIURL replaces the URL of the Stripe API for PaymentIntents, like
+	// with a stand-in for tests.
+	APIURL string `mapstructure:"api_url" json:"api_url"`
+}
+
+func init() {
+	payments.Register(payments.StripeProvider, func(raw json.RawMessage) (payments.Provider, error) {
+		config := Config{}
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return nil, errors.Wrap(err, "Error parsing Stripe configuration")
+		}
+		return NewPaymentProvider(config)
+	})
 }
 
 // NewPaymentProvider creates a new Stripe payment provider using the provided configuration.
@@ -32,7 +48,8 @@ func NewPaymentProvider(config Config) (payments.Provider, error) {
 	}
 
 	s := stripePaymentProvider{
-		client: &client.API{},
+		client:  &client.API{},
+		intents: newIntentsClient(config.SecretKey, config.APIURL),
 	}
 	s.client.Init(config.SecretKey, nil)
 	return &s, nil
@@ -43,28 +60,53 @@ func (s *stripePaymentProvider) Name() string {
 }
 
 func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request) (payments.Charger, error) {
-	var bp stripeBodyParams
-	bod, err := r.GetBody()
+	bp, err := readBodyParams(r)
 	if err != nil {
 		return nil, err
 	}
-	err = json.NewDecoder(bod).Decode(&bp)
-	if err != nil {
-		return nil, err
+	if bp.PaymentIntentID != "" {
+		return func(amount uint64, currency string) (string, error) {
+			return s.intents.finalize(bp.PaymentIntentID, amount, currency)
+		}, nil
 	}
 	if bp.StripeToken == "" {
-		return nil, errors.New("Stripe requires a stripe_token for creating a payment")
+		return nil, errors.New("Stripe requires a stripe_token or stripe_payment_intent_id for creating a payment")
 	}
 
 	return func(amount uint64, currency string) (string, error) {
-		return s.charge(bp.StripeToken, amount, currency)
+		return s.charge("", bp.StripeToken, "", amount, currency)
 	}, nil
 }
 
-func (s *stripePaymentProvider) charge(token string, amount uint64, currency string) (string, error) {
+// PreauthorizedPaymentID returns the PaymentIntent a request pays with.
+func (s *stripePaymentProvider) PreauthorizedPaymentID(r *http.Request) (string, error) {
+	bp, err := readBodyParams(r)
+	if err != nil {
+		return "", err
+	}
+	return bp.PaymentIntentID, nil
+}
+
+func readBodyParams(r *http.Request) (*stripeBodyParams, error) {
+	bod, err := r.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	bp := &stripeBodyParams{}
+	if err := json.NewDecoder(bod).Decode(bp); err != nil {
+		return nil, err
+	}
+	return bp, nil
+}
+
+// charge charges a token, or a source of a customer. Charges with the same
+// idempotency key are only made once.
+func (s *stripePaymentProvider) charge(customerID, source, idempotencyKey string, amount uint64, currency string) (string, error) {
 	ch, err := s.client.Charges.New(&stripe.ChargeParams{
+		Params:   stripe.Params{IdempotencyKey: idempotencyKey},
 		Amount:   amount,
-		Source:   &stripe.SourceParams{Token: token},
+		Customer: customerID,
+		Source:   &stripe.SourceParams{Token: source},
 		Currency: stripe.Currency(currency),
 	})
 
@@ -75,6 +117,59 @@ func (s *stripePaymentProvider) charge(token string, amount uint64, currency str
 	return ch.ID, nil
 }
 
+// SaveMethod adds the card of the stripe_token in the request to a Stripe
+// customer, which is created if needed.
+func (s *stripePaymentProvider) SaveMethod(ctx context.Context, r *http.Request, customerID, email string) (*payments.SavedMethod, error) {
+	bp, err := readBodyParams(r)
+	if err != nil {
+		return nil, err
+	}
+	if bp.StripeToken == "" {
+		return nil, errors.New("Stripe requires a stripe_token for saving a payment method")
+	}
+
+	if customerID == "" {
+		customer, err := s.client.Customers.New(&stripe.CustomerParams{Email: email})
+		if err != nil {
+			return nil, errors.Wrap(err, "Error creating Stripe customer")
+		}
+		customerID = customer.ID
+	}
+	source, err := s.client.Sources.New(&stripe.CustomerSourceParams{
+		Customer: customerID,
+		Source:   &stripe.SourceParams{Token: bp.StripeToken},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error adding card to Stripe customer")
+	}
+
+	saved := &payments.SavedMethod{
+		CustomerID: customerID,
+		MethodID:   source.ID,
+	}
+	if card := source.Card; card != nil {
+		saved.Brand = string(card.Brand)
+		saved.Last4 = card.LastFour
+		saved.ExpMonth = uint(card.Month)
+		saved.ExpYear = uint(card.Year)
+	}
+	return saved, nil
+}
+
+func (s *stripePaymentProvider) RemoveMethod(ctx context.Context, customerID, methodID string) error {
+	_, err := s.client.Sources.Del(methodID, &stripe.CustomerSourceParams{Customer: customerID})
+	return err
+}
+
+// NewSavedMethodCharger charges a saved source of a customer, with the
+// idempotency key of the context if it has one.
+func (s *stripePaymentProvider) NewSavedMethodCharger(ctx context.Context, customerID, methodID string) (payments.Charger, error) {
+	idempotencyKey := gcontext.GetIdempotencyKey(ctx)
+	return func(amount uint64, currency string) (string, error) {
+		return s.charge(customerID, methodID, idempotencyKey, amount, currency)
+	}, nil
+}
+
 func (s *stripePaymentProvider) NewRefunder(ctx context.Context, r *http.Request) (payments.Refunder, error) {
 	return s.refund, nil
 }
@@ -91,6 +186,15 @@ func (s *stripePaymentProvider) refund(transactionID string, amount uint64, curr
 	return ref.ID, err
 }
 
+// NewPreauthorizer creates PaymentIntents, which the customer confirms with
+// Stripe.js, authenticating with 3-D Secure if the card requires it. The
+// payment is then created with the stripe_payment_intent_id.
 func (s *stripePaymentProvider) NewPreauthorizer(ctx context.Context, r *http.Request) (payments.Preauthorizer, error) {
-	return nil, errors.New("Stripe does not require preauthorization")
+	return func(amount uint64, currency string, description string) (*payments.PreauthorizationResult, error) {
+		intent, err := s.intents.create(amount, currency, description)
+		if err != nil {
+			return nil, err
+		}
+		return &payments.PreauthorizationResult{ID: intent.ID, ClientSecret: intent.ClientSecret}, nil
+	}, nil
 }